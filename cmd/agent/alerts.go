@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"isp-agent/pkg/alert"
+	"isp-agent/pkg/config"
+	"isp-agent/pkg/license"
+	"isp-agent/pkg/nginx"
+	"isp-agent/pkg/telemetry"
+)
+
+// newAlertEngine builds the local alert rules and their actions
+func newAlertEngine(cfg config.AlertingConfig, logger *slog.Logger, saasURL, agentID string) (*alert.Engine, error) {
+	actions := make(map[string]alert.Action, len(cfg.Actions))
+	for name, ac := range cfg.Actions {
+		action, err := newAlertAction(ac, saasURL, agentID)
+		if err != nil {
+			return nil, fmt.Errorf("action %s: %w", name, err)
+		}
+		actions[name] = action
+	}
+
+	var rules []alert.Rule
+	for _, rc := range cfg.Rules {
+		rule, err := newAlertRule(rc)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range rule.Actions {
+			if _, ok := actions[name]; !ok {
+				return nil, fmt.Errorf("rule %s: unknown action %s", rule.Name, name)
+			}
+		}
+		rules = append(rules, rule)
+	}
+
+	engine := alert.NewEngine(rules, actions)
+	engine.Hostname, _ = os.Hostname()
+	engine.Logger = logger
+	return engine, nil
+}
+
+func newAlertRule(rc config.AlertRuleConfig) (alert.Rule, error) {
+	rule := alert.Rule{Name: rc.Name, Severity: rc.Severity, Summary: rc.Summary, Actions: rc.Actions}
+	if rule.Severity == "" {
+		rule.Severity = "warning"
+	}
+
+	var err error
+	if rule.Condition, err = alert.ParseCondition(rc.Expr); err != nil {
+		return rule, fmt.Errorf("rule %s: %w", rc.Name, err)
+	}
+	if rc.Resolve != "" {
+		resolve, err := alert.ParseCondition(rc.Resolve)
+		if err != nil {
+			return rule, fmt.Errorf("rule %s: %w", rc.Name, err)
+		}
+		rule.Resolve = &resolve
+	}
+	if rule.For, err = parseOptionalDuration(rc.For); err != nil {
+		return rule, fmt.Errorf("rule %s: invalid for: %w", rc.Name, err)
+	}
+	if rule.ResolveFor, err = parseOptionalDuration(rc.ResolveFor); err != nil {
+		return rule, fmt.Errorf("rule %s: invalid resolve_for: %w", rc.Name, err)
+	}
+	return rule, rule.Validate()
+}
+
+func parseOptionalDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func newAlertAction(ac config.AlertActionConfig, saasURL, agentID string) (alert.Action, error) {
+	switch ac.Type {
+	case "webhook":
+		if ac.URL == "" {
+			return nil, fmt.Errorf("webhook needs a url")
+		}
+		return alert.NewWebhook(ac.URL, ac.Headers), nil
+	case "email-file":
+		if ac.Dir == "" || len(ac.To) == 0 {
+			return nil, fmt.Errorf("email-file needs a dir and recipients")
+		}
+		from := ac.From
+		if from == "" {
+			from = "isp-agent@localhost"
+		}
+		return &alert.EmailFile{Dir: ac.Dir, From: from, To: ac.To}, nil
+	case "syslog":
+		return &alert.Syslog{Network: ac.Network, Address: ac.Address, Tag: ac.Tag}, nil
+	case "exec":
+		if len(ac.Command) == 0 {
+			return nil, fmt.Errorf("exec needs a command")
+		}
+		return &alert.Exec{Command: ac.Command, Timeout: time.Duration(ac.TimeoutSeconds) * time.Second}, nil
+	case "saas":
+		return alert.Func(func(ctx context.Context, n alert.Notification) error {
+			return reportAlert(saasURL, agentID, n)
+		}), nil
+	}
+	return nil, fmt.Errorf("unknown action type %q", ac.Type)
+}
+
+// reportAlert sends a notification to the SaaS as an alert event
+func reportAlert(saasURL, agentID string, n alert.Notification) error {
+	return telemetry.SendAlert(saasURL, telemetry.AlertEvent{
+		AgentID:   agentID,
+		Hostname:  n.Hostname,
+		Rule:      n.Rule,
+		State:     n.State,
+		Severity:  n.Severity,
+		Summary:   n.Summary,
+		Condition: n.Condition,
+		Value:     n.Value,
+		Since:     n.Since,
+		At:        n.At,
+	})
+}
+
+// alertMetrics returns the values alert rules can refer to. Metrics that
+// cannot be measured are left out, so their rules keep their state.
+// statuses holds the cache statuses logged since the previous evaluation.
+func alertMetrics(cfg *config.Config, data *telemetry.TelemetryData, statuses nginx.CacheStatusCounters, health *nginx.HealthMonitor, info *license.LicenseInfo, ledger *telemetry.Ledger) map[string]float64 {
+	metrics := make(map[string]float64)
+
+	if data != nil {
+		metrics["cpu_usage"] = data.CPUUsage
+		metrics["memory_usage"] = data.MemoryUsage
+	}
+	// An idle cache has no meaningful hit ratio
+	if statuses.Cacheable().Requests > 0 {
+		metrics["hit_ratio"] = statuses.RequestHitRatio()
+	}
+	if percent, err := nginx.DiskUsedPercent(cfg.Nginx.CachePath); err == nil {
+		metrics["cache_disk_percent"] = percent
+	}
+	if report := health.Last(); report != nil && report.State != nginx.HealthUnknown {
+		metrics["nginx_up"] = 1
+		if report.State == nginx.HealthUnhealthy {
+			metrics["nginx_up"] = 0
+		}
+	}
+	if info != nil {
+		if expiry, err := time.Parse(time.RFC3339, info.ExpiresAt); err == nil {
+			metrics["license_days_left"] = time.Until(expiry).Hours() / 24
+		}
+	}
+	if ledger != nil {
+		metrics["spool_depth"] = float64(len(ledger.Unsent()))
+	}
+	return metrics
+}
+
+// runAlerts evaluates the alert rules every interval until ctx is cancelled
+func runAlerts(ctx context.Context, engine *alert.Engine, interval time.Duration, metrics func() map[string]float64) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			engine.Evaluate(ctx, now, metrics())
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"isp-agent/pkg/config"
+	"isp-agent/pkg/features"
+	"isp-agent/pkg/nginx"
+	"isp-agent/pkg/telemetry"
+)
+
+// analyticsKeyPath holds the key for hashed client labels, so labels stay stable across restarts
+const analyticsKeyPath = "/var/lib/isp-agent/analytics.key"
+
+// subscriberAnalytics aggregates traffic per subnet while the subscriber_analytics module is licensed
+type subscriberAnalytics struct {
+	stats     *nginx.SubnetStats
+	anonymize string
+	enabled   atomic.Bool
+}
+
+func newSubscriberAnalytics(cfg config.AnalyticsConfig) (*subscriberAnalytics, error) {
+	var groups []nginx.SubnetGroup
+	for _, g := range cfg.Subnets {
+		group, err := nginx.ParseSubnetGroup(g.Name, g.CIDRs)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+
+	var anonymize nginx.Anonymizer
+	switch cfg.Anonymize {
+	case "", "truncate":
+		anonymize = nginx.TruncateAddr(cfg.TruncateIPv4Bits, cfg.TruncateIPv6Bits)
+	case "hash":
+		key, err := analyticsKey()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load analytics key: %w", err)
+		}
+		anonymize = nginx.HashAddr(key)
+	case "none":
+		anonymize = nginx.PlainAddr
+	default:
+		return nil, fmt.Errorf("unknown anonymization %q", cfg.Anonymize)
+	}
+
+	a := &subscriberAnalytics{
+		stats:     nginx.NewSubnetStats(groups, cfg.TopClients, anonymize),
+		anonymize: cfg.Anonymize,
+	}
+	if a.anonymize == "" {
+		a.anonymize = "truncate"
+	}
+	return a, nil
+}
+
+// Observe ignores records while the module is not licensed
+func (a *subscriberAnalytics) Observe(r *nginx.Record) {
+	if a.enabled.Load() {
+		a.stats.Observe(r)
+	}
+}
+
+func (a *subscriberAnalytics) feature() features.Feature {
+	return features.Feature{
+		Name:   "subscriber-analytics",
+		Module: features.ModuleSubscriberAnalytics,
+		Run: func(ctx context.Context) {
+			a.enabled.Store(true)
+			<-ctx.Done()
+			a.enabled.Store(false)
+			a.stats.Flush()
+		},
+	}
+}
+
+func (a *subscriberAnalytics) collect(data *telemetry.TelemetryData) {
+	if !a.enabled.Load() {
+		return
+	}
+	groups, top := a.stats.Flush()
+	if len(groups) == 0 {
+		return
+	}
+
+	report := &telemetry.SubscriberReport{
+		Groups:        trafficStats(groups),
+		Anonymization: a.anonymize,
+	}
+	for _, c := range top {
+		report.TopClients = append(report.TopClients, telemetry.ClientStats{
+			Client:       c.Client,
+			TrafficStats: trafficStat(c.TrafficCounters),
+		})
+	}
+	data.Subscribers = report
+}
+
+func analyticsKey() ([]byte, error) {
+	key, err := os.ReadFile(analyticsKeyPath)
+	if err == nil {
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	os.MkdirAll(filepath.Dir(analyticsKeyPath), 0700)
+	if err := os.WriteFile(analyticsKeyPath, key, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
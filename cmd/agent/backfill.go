@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"isp-agent/pkg/config"
+	"isp-agent/pkg/history"
+	"isp-agent/pkg/telemetry"
+)
+
+const (
+	// ledgerPath numbers telemetry reports and lists the undelivered ones
+	ledgerPath = "/var/lib/isp-agent/telemetry-ledger.json"
+	// spoolDir keeps undelivered reports when there is no local history to rebuild them from
+	spoolDir = "/var/lib/isp-agent/spool"
+)
+
+// newReporter sends telemetry every interval and, when backfill is enabled,
+// uploads the intervals the SaaS missed once it is reachable again
+func newReporter(cfg *config.Config, logger *slog.Logger, saasURL string, ispID int, agentID string, store *history.Store, collect func() (*telemetry.TelemetryData, error)) *telemetry.Reporter {
+	reporter := &telemetry.Reporter{
+		SaaSURL:  saasURL,
+		ISPID:    ispID,
+		AgentID:  agentID,
+		Interval: 5 * time.Minute,
+		Collect:  collect,
+		Logger:   logger,
+	}
+	if !cfg.Backfill.Enabled {
+		return reporter
+	}
+
+	spool := ""
+	if store == nil {
+		spool = spoolDir
+	}
+	ledger, err := telemetry.OpenLedger(ledgerPath, spool)
+	if err != nil {
+		logger.Warn("telemetry backfill disabled", "error", err)
+		return reporter
+	}
+	reporter.Ledger = ledger
+
+	var load func(telemetry.Interval) (*telemetry.TelemetryData, error)
+	if store != nil {
+		load = historyInterval(store)
+	}
+	backfill := telemetry.NewBackfiller(saasURL, agentID, ledger, load)
+	backfill.BatchSize = cfg.Backfill.BatchSize
+	backfill.Pause = time.Duration(cfg.Backfill.PauseSeconds) * time.Second
+	backfill.MaxAge = time.Duration(cfg.Backfill.MaxAgeHours) * time.Hour
+	backfill.Logger = logger
+	reporter.Backfill = backfill
+	return reporter
+}
+
+// historyInterval rebuilds a report by merging the minute samples it covered
+func historyInterval(store *history.Store) func(telemetry.Interval) (*telemetry.TelemetryData, error) {
+	return func(iv telemetry.Interval) (*telemetry.TelemetryData, error) {
+		samples, err := store.Query(iv.From, iv.To, history.Minute)
+		if err != nil || len(samples) == 0 {
+			return nil, err
+		}
+		return telemetry.Merge(samples), nil
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"log/slog"
+
+	"isp-agent/pkg/command"
+	"isp-agent/pkg/configsync"
+	"isp-agent/pkg/features"
+	"isp-agent/pkg/license"
+	"isp-agent/pkg/nginx"
+	"isp-agent/pkg/updater"
+)
+
+// registerCommandHandlers declares the commands the SaaS may send to this agent
+func registerCommandHandlers(d *command.Dispatcher, saasURL string, supervisor *license.Supervisor, registry *features.Registry, syncer *configsync.Syncer, publicKey ed25519.PublicKey) {
+	d.Handle("nginx.test", func(ctx context.Context, cmd *command.Command, logf command.Logf) (interface{}, error) {
+		if err := nginx.TestConfig(); err != nil {
+			return nil, err
+		}
+		logf("nginx configuration test passed")
+		return nil, nil
+	})
+
+	d.Handle("nginx.reload", func(ctx context.Context, cmd *command.Command, logf command.Logf) (interface{}, error) {
+		if err := nginx.TestConfig(); err != nil {
+			return nil, fmt.Errorf("config test failed, not reloading: %w", err)
+		}
+		logf("nginx configuration test passed, reloading")
+		return nil, nginx.ReloadNginx()
+	})
+
+	d.Handle("update.check", func(ctx context.Context, cmd *command.Command, logf command.Logf) (interface{}, error) {
+		version, needsUpdate, err := updater.CheckForUpdates(saasURL)
+		if err != nil {
+			return nil, err
+		}
+		output := map[string]interface{}{
+			"current_version": VERSION,
+			"latest_version":  version.Version,
+			"update_needed":   needsUpdate,
+		}
+		if needsUpdate && cmd.Args["install"] == "true" {
+			logf("installing version %s", version.Version)
+			if err := updater.DownloadAndInstall(slog.Default(), version, publicKey); err != nil {
+				return output, err
+			}
+			output["installed"] = true
+		}
+		return output, nil
+	})
+
+	d.Handle("config.refresh", func(ctx context.Context, cmd *command.Command, logf command.Logf) (interface{}, error) {
+		logf("revalidating license and refreshing licensed features")
+		supervisor.Refresh()
+		return nil, nil
+	})
+
+	d.Handle("config.sync", func(ctx context.Context, cmd *command.Command, logf command.Logf) (interface{}, error) {
+		if !registry.Licensed("nginx-config") {
+			return nil, fmt.Errorf("%w: nginx-config", features.ErrNotLicensed)
+		}
+		report, err := syncer.Sync(ctx)
+		if report != nil && report.Drift {
+			logf("local edits detected: %d lines differ from the last applied config", len(report.DriftDiff))
+		}
+		return report, err
+	})
+
+	d.Handle("feature", func(ctx context.Context, cmd *command.Command, logf command.Logf) (interface{}, error) {
+		return registry.Execute(ctx, cmd.Args["feature"], cmd.Args["command"], cmd.Args)
+	})
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"isp-agent/pkg/nginx"
+	"isp-agent/pkg/telemetry"
+)
+
+// discoveryInterval is how often nginx -T is read again to pick up config changes
+const discoveryInterval = 10 * time.Minute
+
+// nginxTopology holds the nginx instances found with nginx -T. It labels
+// records with their server block and cache zone, and reports traffic and
+// disk use per zone and per server block.
+type nginxTopology struct {
+	logger *slog.Logger
+
+	mu         sync.RWMutex
+	instances  []*nginx.Instance
+	discovered time.Time
+
+	servers *nginx.GroupStats
+	zones   *nginx.GroupStats
+}
+
+func newNginxTopology(logger *slog.Logger) *nginxTopology {
+	t := &nginxTopology{
+		logger:  logger,
+		servers: nginx.NewGroupStats(func(r *nginx.Record) string { return r.Server }),
+		zones:   nginx.NewGroupStats(func(r *nginx.Record) string { return r.CacheZone }),
+	}
+	t.refresh()
+	return t
+}
+
+// refresh reads the nginx config again once discoveryInterval has passed
+func (t *nginxTopology) refresh() {
+	t.mu.RLock()
+	due := time.Since(t.discovered) >= discoveryInterval
+	t.mu.RUnlock()
+	if !due {
+		return
+	}
+
+	instances, err := nginx.DiscoverInstances()
+	t.mu.Lock()
+	t.discovered = time.Now()
+	if err == nil {
+		t.instances = instances
+	}
+	t.mu.Unlock()
+
+	if err != nil {
+		t.logger.Warn("nginx config discovery failed", "error", err)
+		return
+	}
+	for _, inst := range instances {
+		t.logger.Debug("nginx instance discovered", "pid", inst.PID, "config", inst.ConfigFile, "zones", len(inst.Zones), "servers", len(inst.Servers))
+	}
+}
+
+// server returns the block handling host, preferring a name match in any instance
+func (t *nginxTopology) server(host string) *nginx.ServerBlock {
+	for _, inst := range t.instances {
+		for _, s := range inst.Servers {
+			if host != "" && s.Matches(host) {
+				return s
+			}
+		}
+	}
+	if len(t.instances) > 0 {
+		return t.instances[0].ServerFor(host)
+	}
+	return nil
+}
+
+// enrich labels a record with the server block and cache zone that handled it
+func (t *nginxTopology) enrich(r *nginx.Record) {
+	t.mu.RLock()
+	s := t.server(r.Host)
+	t.mu.RUnlock()
+
+	if s == nil {
+		return
+	}
+	r.Server = s.Label
+	r.CacheZone = s.CacheZoneFor(r.URI)
+}
+
+// logFiles returns the access log files of every discovered server block
+func (t *nginxTopology) logFiles() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var files []string
+	for _, inst := range t.instances {
+		files = append(files, inst.LogFiles()...)
+	}
+	return files
+}
+
+// observers returns the aggregates to add to the log pipeline
+func (t *nginxTopology) observers() []nginx.Observer {
+	return []nginx.Observer{t.servers, t.zones}
+}
+
+// sources returns the logs and cache directories for the cache status
+// snapshot. With discovered zones no directories are returned, since collect
+// measures each zone.
+func (t *nginxTopology) sources(accessLog string, extraLogs []string) ([]string, []string) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var logs []string
+	var zones int
+	for _, inst := range t.instances {
+		logs = append(logs, inst.LogFiles()...)
+		zones += len(inst.Zones)
+	}
+	// CollectCacheStats reads a log listed twice only once
+	if len(logs) == 0 {
+		logs = nginx.DefaultLogs(accessLog, extraLogs)
+	} else {
+		logs = append(append(logs, accessLog), extraLogs...)
+	}
+	if zones == 0 {
+		return logs, nginx.DefaultCacheDirs
+	}
+	return logs, nil
+}
+
+// collect adds the instances, zones and server blocks to data, and sums
+// the zones' disk use into CacheSizeUsed
+func (t *nginxTopology) collect(data *telemetry.TelemetryData) {
+	t.refresh()
+
+	t.mu.RLock()
+	instances := t.instances
+	t.mu.RUnlock()
+
+	zoneTraffic := t.zones.Flush()
+	data.Servers = trafficStats(t.servers.Flush())
+	if len(instances) == 0 {
+		return
+	}
+
+	sizes := make(map[string]int64)
+	var paths []string
+	for _, inst := range instances {
+		data.Instances = append(data.Instances, telemetry.NginxInstance{
+			PID:        inst.PID,
+			ConfigFile: inst.ConfigFile,
+			Zones:      len(inst.Zones),
+			Servers:    len(inst.Servers),
+		})
+		for _, z := range inst.Zones {
+			path := filepath.Clean(z.Path)
+			size, ok := sizes[path]
+			if !ok {
+				size = nginx.DirSize(path)
+				sizes[path] = size
+				paths = append(paths, path)
+			}
+			zone := telemetry.ZoneStats{
+				Instance:      inst.PID,
+				Name:          z.Name,
+				Path:          z.Path,
+				KeysZoneBytes: z.KeysZoneBytes,
+				MaxSizeBytes:  z.MaxSizeBytes,
+				Inactive:      z.Inactive,
+				SizeBytes:     size,
+				Traffic:       trafficStat(zoneTraffic[z.Name]),
+			}
+			if z.MaxSizeBytes > 0 {
+				zone.UsedRatio = float64(size) / float64(z.MaxSizeBytes)
+			}
+			data.Zones = append(data.Zones, zone)
+		}
+	}
+
+	// Zones nested in another zone's directory are already part of its size
+	if len(paths) > 0 {
+		var total int64
+		for _, dir := range nginx.OutermostDirs(paths) {
+			total += sizes[dir]
+		}
+		data.CacheSizeUsed = int(total / (1024 * 1024))
+	}
+}
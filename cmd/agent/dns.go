@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"isp-agent/pkg/cdn"
+	"isp-agent/pkg/config"
+	"isp-agent/pkg/dns"
+	"isp-agent/pkg/telemetry"
+)
+
+// newDNSServer builds the responder for the enabled CDN profiles
+func newDNSServer(cfg *config.Config, profiles []cdn.Profile) (*dns.Server, error) {
+	ipv4, err := parseIPs(cfg.DNS.CacheIPv4, false)
+	if err != nil {
+		return nil, err
+	}
+	ipv6, err := parseIPs(cfg.DNS.CacheIPv6, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(ipv4) == 0 && len(ipv6) == 0 {
+		return nil, fmt.Errorf("dns.cache_ipv4 or dns.cache_ipv6 must be set")
+	}
+
+	// An empty list would make the responder an open resolver
+	if len(cfg.DNS.AllowedSubnets) == 0 {
+		return nil, fmt.Errorf("dns.allowed_subnets must list the subscriber networks")
+	}
+	var allowed []*net.IPNet
+	for _, cidr := range cfg.DNS.AllowedSubnets {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dns.allowed_subnets entry %q", cidr)
+		}
+		allowed = append(allowed, network)
+	}
+
+	server := dns.NewServer(cfg.DNS.Listen, ipv4, ipv6, cfg.DNS.Upstreams, cdn.NewMatcher(profiles))
+	server.Allowed = allowed
+	if cfg.DNS.TTLSeconds > 0 {
+		server.TTL = uint32(cfg.DNS.TTLSeconds)
+	}
+	if cfg.DNS.Workers > 0 {
+		server.Workers = cfg.DNS.Workers
+	}
+	return server, nil
+}
+
+func parseIPs(values []string, v6 bool) ([]net.IP, error) {
+	var ips []net.IP
+	for _, v := range values {
+		ip := net.ParseIP(v)
+		if ip == nil || (ip.To4() != nil) == v6 {
+			return nil, fmt.Errorf("invalid cache address %q", v)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+func dnsStats(server *dns.Server) *telemetry.DNSStats {
+	m := server.Metrics()
+	return &telemetry.DNSStats{
+		Queries:         m.Queries,
+		Steered:         m.Steered,
+		Forwarded:       m.Forwarded,
+		CacheHits:       m.CacheHits,
+		UpstreamErrors:  m.UpstreamErrors,
+		Refused:         m.Refused,
+		Dropped:         m.Dropped,
+		ByType:          m.ByType,
+		ByProfile:       m.ByProfile,
+		AvgLatencyMs:    m.AvgLatencyMs,
+		SteeringEnabled: m.SteeringEnabled,
+	}
+}
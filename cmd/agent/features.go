@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"isp-agent/pkg/cdn"
+	"isp-agent/pkg/config"
+	"isp-agent/pkg/configsync"
+	"isp-agent/pkg/features"
+	"isp-agent/pkg/nginx"
+	"isp-agent/pkg/telemetry"
+)
+
+// registerFeatures declares every license-gated capability of the agent
+func registerFeatures(reg *features.Registry, cfg *config.Config, logger *slog.Logger, saasURL string, ispID func() int, latest func() *telemetry.TelemetryData, syncer *configsync.Syncer) {
+	reg.Register(features.Feature{
+		Name:   "top-domains",
+		Module: features.ModuleTopDomains,
+		Run: func(ctx context.Context) {
+			ticker := time.NewTicker(cfg.Features.TopDomainsInterval())
+			defer ticker.Stop()
+
+			for {
+				reportTopDomains(logger, saasURL, accessLogPath(cfg), cfg.Features.TopDomainsLimit, ispID())
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		},
+	})
+
+	reg.Register(features.Feature{
+		Name:   "cache-purge",
+		Module: features.ModuleCachePurge,
+		Commands: map[string]features.CommandFunc{
+			"purge-key": func(ctx context.Context, args map[string]string) (interface{}, error) {
+				if args["key"] == "" {
+					return nil, fmt.Errorf("missing key")
+				}
+				removed, err := nginx.PurgeKey(cfg.Nginx.CachePath, cfg.Nginx.CacheLevels, args["key"])
+				return map[string]interface{}{"removed": removed}, err
+			},
+			"purge-match": func(ctx context.Context, args map[string]string) (interface{}, error) {
+				pattern := args["contains"]
+				if pattern == "" {
+					return nil, fmt.Errorf("missing contains")
+				}
+				removed, err := nginx.PurgeMatching(cfg.Nginx.CachePath, func(key string) bool {
+					return strings.Contains(key, pattern)
+				})
+				return map[string]interface{}{"removed": removed}, err
+			},
+		},
+	})
+
+	reg.Register(features.Feature{
+		Name:   "prefetch",
+		Module: features.ModulePrefetch,
+		Commands: map[string]features.CommandFunc{
+			"prefetch": func(ctx context.Context, args map[string]string) (interface{}, error) {
+				var results []*nginx.PrefetchResult
+				for _, u := range strings.Split(args["urls"], ",") {
+					u = strings.TrimSpace(u)
+					if u == "" {
+						continue
+					}
+					if ctx.Err() != nil {
+						return results, ctx.Err()
+					}
+					result, err := nginx.Prefetch(cfg.Nginx.ListenAddr, u)
+					if err != nil {
+						return results, err
+					}
+					results = append(results, result)
+				}
+				return results, nil
+			},
+		},
+	})
+
+	reg.Register(features.Feature{
+		Name:   "prometheus-exporter",
+		Module: features.ModulePrometheus,
+		Run: func(ctx context.Context) {
+			if err := telemetry.ServeMetrics(ctx, cfg.Features.PrometheusListen, latest); err != nil {
+				logger.Error("prometheus exporter stopped", "error", err)
+			}
+		},
+	})
+
+	var syncLoop func(ctx context.Context)
+	if cfg.ConfigSync.Enabled {
+		syncLoop = func(ctx context.Context) {
+			syncer.Run(ctx, cfg.ConfigSync.Interval(), func(report *configsync.Report, err error) {
+				logSyncReport(logger, report, err)
+			})
+		}
+	}
+
+	reg.Register(features.Feature{
+		Name:   "nginx-config",
+		Module: features.ModuleNginxConfig,
+		Run:    syncLoop,
+		Commands: map[string]features.CommandFunc{
+			"sync": func(ctx context.Context, args map[string]string) (interface{}, error) {
+				return syncer.Sync(ctx)
+			},
+			"render": func(ctx context.Context, args map[string]string) (interface{}, error) {
+				model, err := nginxModel(cfg)
+				if err != nil {
+					return nil, err
+				}
+				rendered, err := nginx.Render(model)
+				return string(rendered), err
+			},
+			"apply": func(ctx context.Context, args map[string]string) (interface{}, error) {
+				model, err := nginxModel(cfg)
+				if err != nil {
+					return nil, err
+				}
+				changed, err := syncer.Generator.Apply(model)
+				return map[string]interface{}{"changed": changed}, err
+			},
+			"rollback": func(ctx context.Context, args map[string]string) (interface{}, error) {
+				return nil, syncer.Generator.Rollback()
+			},
+			"test": func(ctx context.Context, args map[string]string) (interface{}, error) {
+				return nil, nginx.TestConfig()
+			},
+			"reload": func(ctx context.Context, args map[string]string) (interface{}, error) {
+				if err := nginx.TestConfig(); err != nil {
+					return nil, fmt.Errorf("config test failed, not reloading: %w", err)
+				}
+				return nil, nginx.ReloadNginx()
+			},
+		},
+	})
+}
+
+// nginxModel builds the managed nginx config from the agent config
+func nginxModel(cfg *config.Config) (*nginx.ConfigModel, error) {
+	profiles, err := cdn.Enabled(cfg.CDNProfiles)
+	if err != nil {
+		return nil, err
+	}
+
+	model := nginx.DefaultModel()
+	model.Profiles = cdn.ServerProfiles(profiles)
+	model.Cache.Path = cfg.Nginx.CachePath
+	model.Cache.Levels = cfg.Nginx.CacheLevels
+	model.AccessLog = cfg.Nginx.AccessLog
+	if cfg.Nginx.Syslog.Enabled && cfg.Nginx.Syslog.ConfigureNginx {
+		model.AccessLog = nginx.SyslogAccessLog(cfg.Nginx.Syslog.Server(), "isp_cache")
+	}
+	if len(cfg.Nginx.Resolvers) > 0 {
+		model.Resolvers = cfg.Nginx.Resolvers
+	}
+	model.StatusPath = cfg.Nginx.StatusPath
+	model.VTS = cfg.Nginx.VTS
+	if err := model.SizeCacheFromDisk(cfg.Nginx.CacheDiskPercent); err != nil {
+		return nil, fmt.Errorf("failed to size cache: %w", err)
+	}
+	return model, nil
+}
+
+// logSyncReport logs the outcome of a desired-state config sync
+func logSyncReport(logger *slog.Logger, report *configsync.Report, err error) {
+	if report != nil {
+		if report.Drift {
+			logger.Warn("nginx config was edited locally, reverting to desired state", "lines_differ", len(report.DriftDiff))
+		}
+		if report.Status != configsync.StatusUnchanged {
+			logger.Info("nginx config sync", "version", report.Version, "status", report.Status, "sync_error", report.Error)
+		}
+	}
+	if err != nil {
+		logger.Error("nginx config sync failed", "error", err)
+	}
+}
+
+func nginxGenerator(cfg *config.Config) *nginx.Generator {
+	g := nginx.NewGenerator()
+	g.AvailableDir = cfg.Nginx.SitesAvailable
+	g.EnabledDir = cfg.Nginx.SitesEnabled
+	return g
+}
+
+// reportTopDomains sends the most requested cached domains to the SaaS
+func reportTopDomains(logger *slog.Logger, saasURL, logPath string, limit, ispID int) {
+	domains, err := nginx.GetTopDomains(logPath, limit)
+	if err != nil {
+		logger.Warn("failed to collect top domains", "error", err)
+		return
+	}
+
+	for domain, hits := range domains {
+		site := telemetry.SiteData{ISPID: ispID, Domain: domain, Hits: hits}
+		if err := telemetry.SendCachedSite(saasURL, site); err != nil {
+			logger.Warn("failed to report domain", "domain", domain, "error", err)
+		}
+	}
+}
+
+// accessLogPath returns the configured access log, falling back to nginx's default
+func accessLogPath(cfg *config.Config) string {
+	if _, err := os.Stat(cfg.Nginx.AccessLog); err == nil {
+		return cfg.Nginx.AccessLog
+	}
+	return "/var/log/nginx/access.log"
+}
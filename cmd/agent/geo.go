@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/netip"
+	"sort"
+	"strconv"
+	"sync"
+
+	"isp-agent/pkg/config"
+	"isp-agent/pkg/geoip"
+	"isp-agent/pkg/nginx"
+	"isp-agent/pkg/telemetry"
+)
+
+// originASNLimit is how many origin networks are reported, by miss bytes
+const originASNLimit = 50
+
+// geoEnrichment labels records from local MMDB files and aggregates by region and origin ASN
+type geoEnrichment struct {
+	db      *geoip.DB
+	regions *nginx.GroupStats
+	origins *nginx.GroupStats
+
+	mu   sync.Mutex
+	orgs map[uint64]string
+}
+
+// newGeoEnrichment returns nil when no database is configured
+func newGeoEnrichment(cfg config.GeoIPConfig) (*geoEnrichment, error) {
+	if cfg.CityDB == "" && cfg.ASNDB == "" {
+		return nil, nil
+	}
+	db, err := geoip.OpenDB(cfg.CityDB, cfg.ASNDB)
+	if err != nil {
+		return nil, err
+	}
+	return &geoEnrichment{
+		db:      db,
+		regions: nginx.NewGroupStats(func(r *nginx.Record) string { return r.ClientRegion }),
+		origins: nginx.NewGroupStats(func(r *nginx.Record) string {
+			if r.OriginASN == 0 {
+				return ""
+			}
+			return strconv.FormatUint(r.OriginASN, 10)
+		}),
+		orgs: make(map[uint64]string),
+	}, nil
+}
+
+// enrich sets the client region and, when the origin was contacted, its ASN
+func (g *geoEnrichment) enrich(r *nginx.Record) {
+	if g.db.HasRegions() {
+		if addr, err := netip.ParseAddr(r.RemoteAddr); err == nil {
+			r.ClientRegion = g.db.Region(addr)
+		}
+	}
+	if g.db.HasASN() {
+		if addr, ok := r.UpstreamIP(); ok {
+			if asn, ok := g.db.ASN(addr); ok {
+				r.OriginASN, r.OriginOrg = asn.Number, asn.Organization
+				g.mu.Lock()
+				g.orgs[asn.Number] = asn.Organization
+				g.mu.Unlock()
+			}
+		}
+	}
+}
+
+func (g *geoEnrichment) Observe(r *nginx.Record) {
+	g.regions.Observe(r)
+	g.origins.Observe(r)
+}
+
+func (g *geoEnrichment) collect(data *telemetry.TelemetryData) {
+	regions := g.regions.Flush()
+	origins := g.origins.Flush()
+	if len(regions) == 0 && len(origins) == 0 {
+		return
+	}
+
+	report := &telemetry.GeoReport{ClientRegions: trafficStats(regions)}
+	g.mu.Lock()
+	for key, c := range origins {
+		asn, _ := strconv.ParseUint(key, 10, 64)
+		report.OriginASNs = append(report.OriginASNs, telemetry.OriginASNStats{
+			ASN:          asn,
+			Organization: g.orgs[asn],
+			Requests:     c.Requests,
+			Bytes:        c.Bytes,
+			MissBytes:    c.Bytes - c.HitBytes,
+		})
+	}
+	g.mu.Unlock()
+
+	sort.Slice(report.OriginASNs, func(i, j int) bool {
+		a, b := report.OriginASNs[i], report.OriginASNs[j]
+		if a.MissBytes != b.MissBytes {
+			return a.MissBytes > b.MissBytes
+		}
+		return a.ASN < b.ASN
+	})
+	if len(report.OriginASNs) > originASNLimit {
+		report.OriginASNs = report.OriginASNs[:originASNLimit]
+	}
+	data.Geo = report
+}
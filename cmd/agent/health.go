@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"isp-agent/pkg/config"
+	"isp-agent/pkg/dns"
+	"isp-agent/pkg/nginx"
+	"isp-agent/pkg/telemetry"
+)
+
+// newHealthMonitor probes the cache on its listen address
+func newHealthMonitor(cfg *config.Config, logger *slog.Logger, saasURL string) *nginx.HealthMonitor {
+	monitor := nginx.NewHealthMonitor(fmt.Sprintf("http://%s", cfg.Nginx.ListenAddr))
+	monitor.Logger = logger
+	monitor.ProbePath = cfg.Health.ProbePath
+	monitor.FailThreshold = cfg.Health.FailThreshold
+	monitor.RestartCommand = cfg.Health.RestartCommand
+	if cfg.Health.IntervalSeconds > 0 {
+		monitor.Interval = time.Duration(cfg.Health.IntervalSeconds) * time.Second
+	}
+	if cfg.Health.SlowMs > 0 {
+		monitor.SlowThreshold = time.Duration(cfg.Health.SlowMs) * time.Millisecond
+	}
+
+	monitor.OnRestart = func(err error) {
+		level, message := "warning", "nginx restarted after repeated health check failures"
+		if err != nil {
+			level, message = "error", fmt.Sprintf("nginx restart failed: %v", err)
+		}
+		if err := telemetry.SendSystemLog(saasURL, level, "health", message, nil); err != nil {
+			logger.Warn("failed to report nginx restart", "error", err)
+		}
+	}
+	return monitor
+}
+
+// reportHealthTransition logs a state change, reports it to the SaaS and
+// stops DNS steering while the cache cannot serve subscribers
+func reportHealthTransition(logger *slog.Logger, saasURL string, dnsServer *dns.Server, prev, next *nginx.HealthReport) {
+	var failed []string
+	for _, c := range next.Checks {
+		if !c.OK && !c.Skipped {
+			failed = append(failed, fmt.Sprintf("%s: %s", c.Name, c.Detail))
+		}
+	}
+	message := fmt.Sprintf("nginx health changed from %s to %s", prev.State, next.State)
+	if len(failed) > 0 {
+		message += " (" + strings.Join(failed, "; ") + ")"
+	}
+	logLevel := slog.LevelInfo
+	if next.State != nginx.HealthHealthy {
+		logLevel = slog.LevelWarn
+	}
+	logger.Log(context.Background(), logLevel, "nginx health changed", "from", prev.State, "to", next.State, "failed_checks", strings.Join(failed, "; "))
+
+	if dnsServer != nil {
+		steer := next.State != nginx.HealthUnhealthy
+		if steer != dnsServer.Steering() {
+			dnsServer.SetSteering(steer)
+			if steer {
+				logger.Info("cache healthy again, DNS steering resumed")
+			} else {
+				logger.Warn("cache unhealthy, DNS steering stopped")
+			}
+		}
+	}
+
+	// The first report after startup is only interesting when something is wrong
+	if prev.State == nginx.HealthUnknown && next.State == nginx.HealthHealthy {
+		return
+	}
+	level := "info"
+	switch next.State {
+	case nginx.HealthDegraded:
+		level = "warning"
+	case nginx.HealthUnhealthy:
+		level = "error"
+	}
+	metadata := map[string]interface{}{
+		"from_state": prev.State,
+		"to_state":   next.State,
+		"master_pid": next.MasterPID,
+		"workers":    next.Workers,
+		"checks":     next.Checks,
+	}
+	if err := telemetry.SendSystemLog(saasURL, level, "health", message, metadata); err != nil {
+		logger.Warn("failed to report health change", "error", err)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"isp-agent/pkg/config"
+	"isp-agent/pkg/history"
+	"isp-agent/pkg/telemetry"
+)
+
+// sampleInterval is the resolution of the local history
+const sampleInterval = time.Minute
+
+// maxPendingSamples bounds the samples held for the next telemetry report
+const maxPendingSamples = 60
+
+// sampler collects one telemetry sample per minute, keeps it in the local
+// history and hands the samples since the last report to the telemetry loop
+type sampler struct {
+	collect func() (*telemetry.TelemetryData, error)
+	store   *history.Store
+	logger  *slog.Logger
+
+	mu      sync.Mutex
+	last    time.Time
+	latest  *telemetry.TelemetryData
+	pending []*telemetry.TelemetryData
+}
+
+func openHistory(cfg config.HistoryConfig) (*history.Store, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	return history.Open(cfg.Dir, history.Retention{
+		Minute:   time.Duration(cfg.MinuteRetentionDays) * 24 * time.Hour,
+		Hour:     time.Duration(cfg.HourlyRetentionDays) * 24 * time.Hour,
+		MaxBytes: int64(cfg.MaxDiskMB) << 20,
+	})
+}
+
+func newSampler(logger *slog.Logger, store *history.Store, collect func() (*telemetry.TelemetryData, error)) *sampler {
+	return &sampler{collect: collect, store: store, logger: logger, last: time.Now()}
+}
+
+// Run takes a sample every minute until ctx is cancelled
+func (s *sampler) Run(ctx context.Context) {
+	ticker := time.NewTicker(sampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.take(); err != nil {
+				s.logger.Warn("telemetry sample failed", "error", err)
+			}
+		}
+	}
+}
+
+// take collects and stores one sample
+func (s *sampler) take() (*telemetry.TelemetryData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := s.collect()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	data.Timestamp = now
+	data.IntervalSeconds = int(now.Sub(s.last).Round(time.Second).Seconds())
+	s.last = now
+
+	if s.store != nil {
+		if err := s.store.Append(data); err != nil {
+			s.logger.Error("failed to write telemetry history", "error", err)
+		}
+	}
+	s.latest = data
+	s.pending = append(s.pending, data)
+	if len(s.pending) > maxPendingSamples {
+		s.pending = s.pending[len(s.pending)-maxPendingSamples:]
+	}
+	return data, nil
+}
+
+// Latest returns the most recent sample, or nil before the first one
+func (s *sampler) Latest() *telemetry.TelemetryData {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.latest
+}
+
+// report merges the samples taken since the previous report, sampling now if there are none
+func (s *sampler) report() (*telemetry.TelemetryData, error) {
+	s.mu.Lock()
+	samples := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+
+	if len(samples) == 0 {
+		if _, err := s.take(); err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		samples = s.pending
+		s.pending = nil
+		s.mu.Unlock()
+	}
+	return telemetry.Merge(samples), nil
+}
+
+// printHistory prints hourly totals of a running agent's history
+func printHistory(addr string, since time.Duration) error {
+	to := time.Now().UTC()
+	from := to.Add(-since)
+	var samples []*telemetry.TelemetryData
+	url := fmt.Sprintf("http://%s/history?from=%s&to=%s&resolution=hour", addr, from.Format(time.RFC3339), to.Format(time.RFC3339))
+	if err := getJSON(url, &samples); err != nil {
+		return err
+	}
+	if len(samples) == 0 {
+		fmt.Println("No history recorded for this period")
+		return nil
+	}
+
+	fmt.Printf("%-17s %10s %10s %9s %12s %6s %6s\n", "Hour (UTC)", "Requests", "Hits", "Hit ratio", "Bytes", "CPU %", "Mem %")
+	for _, s := range samples {
+		total := historyTotals(s)
+		hour := s.Timestamp.Add(-time.Nanosecond).Truncate(time.Hour)
+		fmt.Printf("%-17s %10d %10d %8.1f%% %12d %6.1f %6.1f\n", hour.Format("2006-01-02 15:04"), total.Requests, total.Hits, total.HitRatio*100, total.Bytes, s.CPUUsage, s.MemoryUsage)
+
+		names := make([]string, 0, len(s.Profiles))
+		for name := range s.Profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			p := s.Profiles[name]
+			fmt.Printf("  %-15s %10d %10d %8.1f%% %12d\n", name, p.Requests, p.Hits, p.HitRatio*100, p.Bytes)
+		}
+	}
+	return nil
+}
+
+// historyTotals counts all traffic of a sample, including requests that
+// matched no CDN profile
+func historyTotals(s *telemetry.TelemetryData) telemetry.TrafficStats {
+	total := telemetry.TrafficStats{Requests: s.TotalRequests, Hits: s.CacheHits, Misses: s.CacheMisses}
+	if total.Requests > 0 {
+		total.HitRatio = float64(total.Hits) / float64(total.Requests)
+	}
+	cs := s.CacheStatus
+	if cs == nil {
+		return total
+	}
+	total.Hits = cs.Hit.Requests + cs.Stale.Requests + cs.Updating.Requests + cs.Revalidated.Requests
+	total.HitBytes = cs.Hit.Bytes + cs.Stale.Bytes + cs.Updating.Bytes + cs.Revalidated.Bytes
+	total.Misses = cs.Miss.Requests + cs.Expired.Requests + cs.Bypass.Requests
+	total.Bytes = total.HitBytes + cs.Miss.Bytes + cs.Bypass.Bytes + cs.Expired.Bytes + cs.Uncached.Bytes
+	total.HitRatio = cs.RequestHitRatio
+	return total
+}
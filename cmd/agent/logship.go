@@ -0,0 +1,31 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"isp-agent/pkg/config"
+	"isp-agent/pkg/logging"
+	"isp-agent/pkg/logship"
+)
+
+// newLogShipper tails the nginx error logs; with agent_logs, it also returns
+// a logger whose warnings and errors are shipped
+func newLogShipper(cfg config.LogShipConfig, logger *slog.Logger, saasURL, agentID string) (*logship.Shipper, *slog.Logger) {
+	shipper := logship.NewShipper(saasURL, cfg.ErrorLogs)
+	shipper.AgentID = agentID
+	shipper.Logger = logging.Component(logger, "logship")
+	if cfg.MinNginxLevel != "" {
+		shipper.MinNginxLevel = cfg.MinNginxLevel
+	}
+	if cfg.FlushSeconds > 0 {
+		shipper.FlushInterval = time.Duration(cfg.FlushSeconds) * time.Second
+	}
+	shipper.MaxPerPattern = cfg.MaxPerPattern
+	shipper.RequestDetails = cfg.RequestDetails
+
+	if cfg.AgentLogs {
+		logger = slog.New(shipper.Handler(logger.Handler()))
+	}
+	return shipper, logger
+}
@@ -1,16 +1,28 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"isp-agent/pkg/alert"
+	"isp-agent/pkg/cdn"
+	"isp-agent/pkg/command"
+	"isp-agent/pkg/config"
+	"isp-agent/pkg/configsync"
+	"isp-agent/pkg/dns"
+	"isp-agent/pkg/features"
 	"isp-agent/pkg/hwid"
 	"isp-agent/pkg/license"
+	"isp-agent/pkg/logging"
+	"isp-agent/pkg/logship"
 	"isp-agent/pkg/nginx"
 	"isp-agent/pkg/telemetry"
 	"isp-agent/pkg/updater"
@@ -22,9 +34,13 @@ const SAAS_URL = "http://64.23.151.140:8080"
 func main() {
 	// Command-line flags
 	installFlag := flag.Bool("install", false, "Run initial installation and registration")
-	hwidFlag := flag.Bool("hwid", false, "Generate and display hardware ID only")
+	hwidFlag := flag.Bool("hwid", false, "Display the hardware ID the agent registers with")
+	reenrollFlag := flag.Bool("reenroll-hwid", false, "Accept the current hardware components for the stored hardware ID after a planned hardware change")
 	versionFlag := flag.Bool("version", false, "Display version information")
 	checkUpdateFlag := flag.Bool("check-update", false, "Check for available updates")
+	statusFlag := flag.Bool("status", false, "Show status of the running agent")
+	historyFlag := flag.Duration("history", 0, "Show hourly history of the running agent for this period, e.g. 24h")
+	configPath := flag.String("config", config.DefaultPath, "Path to agent config file")
 	flag.Parse()
 
 	// Handle version flag
@@ -33,21 +49,63 @@ func main() {
 		os.Exit(0)
 	}
 
-	// Handle HWID flag
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fatal(slog.Default(), "failed to load config", "error", err)
+	}
+
+	// Handle HWID flag, printing the stored ID the agent registers with
 	if *hwidFlag {
-		id, err := hwid.Generate()
+		identity, err := hwid.Resolve(cfg.HWID.MaxDrift)
 		if err != nil {
-			log.Fatalf("Failed to generate hardware ID: %v", err)
+			fatal(slog.Default(), "failed to get hardware ID", "error", err)
+		}
+		fmt.Println(identity.HWID)
+		os.Exit(0)
+	}
+
+	// Handle re-enrollment, the only way the enrolled component snapshot changes
+	if *reenrollFlag {
+		id, err := hwid.Reenroll(cfg.HWID.MaxDrift)
+		if err != nil {
+			fatal(slog.Default(), "failed to re-enroll hardware components", "error", err)
+		}
+		fmt.Printf("Hardware components re-enrolled for %s\n", id)
+		os.Exit(0)
+	}
+
+	// Structured logger for the whole agent; secrets are redacted in every record
+	logger, err := logging.New(logging.Options{Level: cfg.Logging.Level, Format: cfg.Logging.Format, Identifier: "isp-agent"})
+	if err != nil {
+		fatal(slog.Default(), "invalid logging config", "error", err)
+	}
+	slog.SetDefault(logger)
+	saasURL := SAAS_URL
+	if cfg.SaaSURL != "" {
+		saasURL = cfg.SaaSURL
+	}
+
+	// Handle status flag
+	if *statusFlag {
+		if err := printStatus(cfg.StatusListen); err != nil {
+			fatal(logger, "status query failed", "error", err)
+		}
+		os.Exit(0)
+	}
+
+	// Handle history flag
+	if *historyFlag > 0 {
+		if err := printHistory(cfg.StatusListen, *historyFlag); err != nil {
+			fatal(logger, "history query failed", "error", err)
 		}
-		fmt.Println(id)
 		os.Exit(0)
 	}
 
 	// Handle check-update flag
 	if *checkUpdateFlag {
-		version, needsUpdate, err := updater.CheckForUpdates(SAAS_URL)
+		version, needsUpdate, err := updater.CheckForUpdates(saasURL)
 		if err != nil {
-			log.Fatalf("Update check failed: %v", err)
+			fatal(logger, "update check failed", "error", err)
 		}
 		
 		fmt.Printf("Current version: %s\n", VERSION)
@@ -66,29 +124,72 @@ func main() {
 	// Load license key from config
 	licenseKey, err := license.LoadConfig()
 	if err != nil {
-		log.Fatalf("Failed to load license config: %v. Run with -install flag first.", err)
+		fatal(logger, "failed to load license config, run with -install first", "error", err)
 	}
+	logging.AddSecret(licenseKey)
 
-	// Get hardware ID
-	hardwareID, err := hwid.GetOrCreate()
+	// Get hardware ID, tolerating a few changed hardware components
+	identity, err := hwid.Resolve(cfg.HWID.MaxDrift)
 	if err != nil {
-		log.Fatalf("Failed to get hardware ID: %v", err)
+		fatal(logger, "failed to get hardware ID", "error", err)
+	}
+	hardwareID := identity.HWID
+	if identity.Tampered {
+		logger.Error("stored identity rejected, generated new hardware ID", "component", "security", "reason", identity.TamperReason, "hwid", hardwareID)
+		metadata := map[string]interface{}{
+			"reason":        identity.TamperReason,
+			"previous_hwid": identity.PreviousHWID,
+			"new_hwid":      hardwareID,
+		}
+		if err := telemetry.SendSystemLog(saasURL, "critical", "security", "Identity file copied or modified, hardware ID regenerated", metadata); err != nil {
+			logger.Warn("failed to report identity security event", "error", err)
+		}
+	}
+	if identity.Regenerated && len(identity.Drifted) > 0 {
+		logger.Warn("hardware changed too much, generated new hardware ID", "changed", strings.Join(identity.Drifted, ", "))
+	} else if len(identity.Drifted) > 0 {
+		logger.Info("hardware components changed, hardware ID kept", "changed", strings.Join(identity.Drifted, ", "))
+	}
+
+	// The compiled-in vendor key verifies tokens unless the config names another
+	licenseOpts := license.Options{GracePeriod: cfg.License.GracePeriod(), HWIDDrift: identity.Drifted}
+	publicKey := license.VendorPublicKey
+	if cfg.License.PublicKey != "" {
+		publicKey = cfg.License.PublicKey
+	}
+	if publicKey != "" {
+		licenseOpts.PublicKey, err = license.ParsePublicKey(publicKey)
+		if err != nil {
+			fatal(logger, "invalid license public key", "error", err)
+		}
+	} else {
+		logger.Warn("no license public key built in or configured, offline validation, commands and updates are unavailable")
 	}
 
 	// Installation mode
 	if *installFlag {
 		fmt.Println("=== ISP Agent Installation ===")
 		fmt.Printf("Hardware ID: %s\n", hardwareID)
-		fmt.Printf("License Key: %s\n", licenseKey)
+		fmt.Printf("License Key: %s\n", logging.Redact(licenseKey))
 
-		// Validate license
-		licenseInfo, err := license.Validate(SAAS_URL, licenseKey, hardwareID)
+		// Validate license (installation always requires the SaaS)
+		licenseInfo, err := license.Validate(saasURL, licenseKey, hardwareID)
 		if err != nil {
-			log.Fatalf("License validation failed: %v", err)
+			fatal(logger, "license validation failed", "error", err)
 		}
+		logging.AddSecret(licenseInfo.Token)
 
 		if licenseInfo.Status != "active" {
-			log.Fatal("License is not active")
+			fatal(logger, "license is not active", "status", licenseInfo.Status)
+		}
+
+		if licenseInfo.Token != "" && licenseOpts.PublicKey != nil {
+			if _, err := license.VerifyToken(licenseInfo.Token, licenseOpts.PublicKey); err != nil {
+				fatal(logger, "license token rejected", "error", err)
+			}
+			if err := license.SaveToken(licenseInfo.Token); err != nil {
+				logger.Warn("failed to cache license token", "error", err)
+			}
 		}
 
 		fmt.Println("✓ License validated successfully")
@@ -100,53 +201,240 @@ func main() {
 	}
 
 	// Normal operation mode
-	log.Printf("ISP SaaS Agent v%s starting...", VERSION)
-	log.Printf("Hardware ID: %s", hardwareID)
-	log.Printf("License Key: %s", licenseKey)
+	var shipper *logship.Shipper
+	if cfg.LogShipping.Enabled {
+		shipper, logger = newLogShipper(cfg.LogShipping, logger, saasURL, hardwareID)
+		slog.SetDefault(logger)
+	}
+	logger.Info("ISP SaaS Agent starting", "version", VERSION, "hwid", hardwareID, "license_key", logging.Secret(licenseKey))
 
-	// Validate license at startup
-	licenseInfo, err := license.Validate(SAAS_URL, licenseKey, hardwareID)
+	// Validate license at startup, using the cached token if the SaaS is unreachable
+	licenseInfo, err := license.ValidateWithGrace(saasURL, licenseKey, hardwareID, licenseOpts)
 	if err != nil {
-		log.Fatalf("License validation failed: %v", err)
+		fatal(logger, "license validation failed", "error", err)
 	}
+	logging.AddSecret(licenseInfo.Token)
 
 	if licenseInfo.Status != "active" {
-		log.Fatal("License is not active")
+		fatal(logger, "license is not active", "status", licenseInfo.Status)
 	}
 
-	log.Printf("License validated successfully (ISP ID: %d)", licenseInfo.ISPID)
+	// Drift only needs to reach the SaaS once
+	if !licenseInfo.Offline && len(licenseOpts.HWIDDrift) > 0 {
+		if err := hwid.AcknowledgeDrift(); err != nil {
+			logger.Warn("failed to clear reported hardware drift", "error", err)
+		}
+		licenseOpts.HWIDDrift = nil
+	}
+
+	if licenseInfo.Offline {
+		remaining := license.GraceRemaining(licenseInfo, licenseOpts.GracePeriod)
+		logger.Warn("SaaS unreachable, running on cached license token", "grace_hours_left", int(remaining.Hours()))
+	} else {
+		logger.Info("license validated", "isp_id", licenseInfo.ISPID)
+	}
+
+	if days := license.DaysUntilExpiry(licenseInfo.ExpiresAt); days <= cfg.License.WarnDays {
+		logger.Warn("license expires soon", "days", days, "expires_at", licenseInfo.ExpiresAt)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Optional modules run only while the license is active
+	var stopOptional context.CancelFunc
+	startOptional := func() {
+		if stopOptional != nil {
+			return
+		}
+		var optCtx context.Context
+		optCtx, stopOptional = context.WithCancel(ctx)
+		startUpdater(optCtx, logging.Component(logger, "updater"), saasURL, licenseOpts.PublicKey)
+	}
+	stopOptionalModules := func() {
+		if stopOptional != nil {
+			stopOptional()
+			stopOptional = nil
+		}
+	}
+
+	// License-gated features, refreshed whenever the license changes
+	var latest latestTelemetry
+	registry := features.NewRegistry(ctx)
+
+	// Revalidate the license periodically and react to status changes
+	supervisor := license.NewSupervisor(saasURL, licenseKey, hardwareID, licenseOpts, licenseInfo)
+	supervisor.Interval = cfg.License.RevalidateInterval()
+	supervisor.Logger = logging.Component(logger, "license")
+	supervisor.OnChange = func(prev, next *license.LicenseInfo) {
+		logging.AddSecret(next.Token)
+		supervisor.Logger.Info("license status changed", "from", prev.Status, "to", next.Status)
+
+		if next.Status == license.StatusActive {
+			startOptional()
+		} else {
+			supervisor.Logger.Warn("optional modules stopped, only minimal telemetry is reported")
+			stopOptionalModules()
+		}
 
-	// Check for updates on startup
+		level := "info"
+		if next.Status != license.StatusActive {
+			level = "warning"
+		}
+		metadata := map[string]interface{}{
+			"isp_id":      next.ISPID,
+			"from_status": prev.Status,
+			"to_status":   next.Status,
+			"offline":     next.Offline,
+			"expires_at":  next.ExpiresAt,
+		}
+		message := fmt.Sprintf("License status changed from %s to %s", prev.Status, next.Status)
+		if err := telemetry.SendSystemLog(saasURL, level, "license", message, metadata); err != nil {
+			supervisor.Logger.Warn("failed to report license status change", "error", err)
+		}
+	}
+	credentials := command.Credentials{HWID: hardwareID, LicenseKey: licenseKey}
+	syncer := configsync.NewSyncer(saasURL, credentials.Headers, func() (*nginx.ConfigModel, error) { return nginxModel(cfg) }, nginxGenerator(cfg))
+	syncer.HealthURL = fmt.Sprintf("http://%s/health", cfg.Nginx.ListenAddr)
+	syncer.PublicKey = licenseOpts.PublicKey
+
+	registerFeatures(registry, cfg, logging.Component(logger, "features"), saasURL, func() int { return supervisor.Current().ISPID }, latest.Get, syncer)
+	analytics, err := newSubscriberAnalytics(cfg.Analytics)
+	if err != nil {
+		fatal(logger, "invalid analytics config", "error", err)
+	}
+	registry.Register(analytics.feature())
+	registry.Apply(licenseInfo.Modules, true)
+	licenseUpdates := supervisor.Subscribe()
 	go func() {
-		time.Sleep(30 * time.Second) // Wait 30s after startup
-		version, needsUpdate, err := updater.CheckForUpdates(SAAS_URL)
+		for info := range licenseUpdates {
+			registry.Apply(info.Modules, info.Status == license.StatusActive)
+		}
+	}()
+
+	startOptional()
+	go supervisor.Run(ctx)
+
+	// Ship nginx error logs and agent warnings to the SaaS
+	if shipper != nil {
+		shipper.ISPID = func() int { return supervisor.Current().ISPID }
+		go shipper.Run(ctx)
+	}
+
+	// Command channel from the SaaS
+	if cfg.Commands.Enabled {
+		dispatcher := command.NewDispatcher()
+		registerCommandHandlers(dispatcher, saasURL, supervisor, registry, syncer, licenseOpts.PublicKey)
+
+		commandClient := command.NewClient(saasURL, credentials, dispatcher, licenseOpts.PublicKey)
+		commandClient.UseWebSocket = cfg.Commands.WebSocket
+		commandClient.Logger = logging.Component(logger, "commands")
+		go commandClient.Run(ctx)
+	}
+
+	healthLogger := logging.Component(logger, "health")
+	health := newHealthMonitor(cfg, healthLogger, saasURL)
+
+	// Local telemetry history, also used for the status API
+	historyStore, err := openHistory(cfg.History)
+	if err != nil {
+		logger.Warn("telemetry history disabled", "error", err)
+	}
+
+	var alerts *alert.Engine
+	if cfg.Alerting.Enabled {
+		alerts, err = newAlertEngine(cfg.Alerting, logging.Component(logger, "alerts"), saasURL, hardwareID)
 		if err != nil {
-			log.Printf("Update check failed: %v", err)
-			return
+			logger.Warn("local alerting disabled", "error", err)
 		}
-		
-		if needsUpdate {
-			log.Printf("New version available: %s (current: %s)", version.Version, VERSION)
-			log.Printf("Update will be installed automatically")
-			
-			if err := updater.DownloadAndInstall(version); err != nil {
-				log.Printf("Auto-update failed: %v", err)
-			}
+	}
+
+	status := &statusServer{
+		hardwareID: hardwareID,
+		supervisor: supervisor,
+		registry:   registry,
+		telemetry:  &latest,
+		health:     health,
+		history:    historyStore,
+		alerts:     alerts,
+	}
+	if status.token, err = newStatusToken(); err != nil {
+		logger.Warn("feature commands on the status API disabled", "error", err)
+	}
+	go func() {
+		if err := status.Serve(ctx, cfg.StatusListen); err != nil {
+			logger.Error("status API stopped", "error", err)
 		}
 	}()
 
-	// Start auto-update checker (every 24 hours)
-	go updater.StartUpdateLoop(SAAS_URL, 24*time.Hour)
+	// CDN profiles label log records and select per-service logs
+	profiles, err := cdn.Enabled(cfg.CDNProfiles)
+	if err != nil {
+		logger.Warn("invalid CDN profiles", "error", err)
+	}
 
-	// Start telemetry loop in background
-	collectStats := func() (*telemetry.TelemetryData, error) {
-		// Try cache.log first, fallback to access.log
-		logPath := "/var/log/nginx/cache.log"
-		if _, err := os.Stat(logPath); os.IsNotExist(err) {
-			logPath = "/var/log/nginx/access.log"
+	// Optional DNS responder steering CDN hostnames to the cache
+	var dnsServer *dns.Server
+	if cfg.DNS.Enabled {
+		dnsServer, err = newDNSServer(cfg, profiles)
+		if err != nil {
+			logger.Warn("DNS responder disabled", "error", err)
+		} else {
+			dnsServer.Logger = logging.Component(logger, "dns")
+			dnsServer.OnListening = func() {
+				dnsServer.Logger.Info("DNS responder listening", "listen", cfg.DNS.Listen)
+			}
+			go func() {
+				if err := dnsServer.ListenAndServe(ctx); err != nil {
+					dnsServer.Logger.Error("DNS responder stopped", "error", err)
+				}
+			}()
 		}
-		
-		cacheStats, err := nginx.GetCacheStats(logPath)
+	}
+
+	// Nginx health, which also decides whether DNS steers to the cache
+	health.OnTransition = func(prev, next *nginx.HealthReport) {
+		reportHealthTransition(healthLogger, saasURL, dnsServer, prev, next)
+	}
+	go health.Run(ctx)
+
+	logDir := "/var/log/nginx"
+	records := newLogPipeline(logging.Component(logger, "pipeline"), []string{accessLogPath(cfg)}, profiles, analytics)
+	records.useJSONFields(cfg.Nginx.JSONLog, cfg.Nginx.AccessLog)
+
+	// Cache zones and server blocks of every nginx instance, from nginx -T
+	var topology *nginxTopology
+	if cfg.Nginx.Discover {
+		topology = newNginxTopology(logging.Component(logger, "nginx"))
+		records.pipeline.AddEnricher(topology.enrich)
+		for _, o := range topology.observers() {
+			records.pipeline.AddObserver(o)
+		}
+		records.follow(topology.logFiles())
+	}
+	nginxStatus := newNginxStatusSource(cfg, logging.Component(logger, "nginx"))
+	geo, err := newGeoEnrichment(cfg.GeoIP)
+	if err != nil {
+		logger.Warn("GeoIP enrichment disabled", "error", err)
+	} else if geo != nil {
+		records.pipeline.AddEnricher(geo.enrich)
+		records.pipeline.AddObserver(geo)
+		logger.Info("GeoIP enrichment enabled", "city_db", cfg.GeoIP.CityDB, "asn_db", cfg.GeoIP.ASNDB)
+	}
+	if cfg.Nginx.Syslog.Enabled {
+		records.listenSyslog(ctx, cfg.Nginx.Syslog)
+	}
+
+	// One sample per minute goes to the history; reports merge the samples since the last one
+	sampleStats := func() (*telemetry.TelemetryData, error) {
+		// Try the configured cache log first, fallback to access.log
+		logs := nginx.DefaultLogs(accessLogPath(cfg), cdn.LancacheLogs(logDir, profiles))
+		cacheDirs := nginx.DefaultCacheDirs
+		if topology != nil {
+			logs, cacheDirs = topology.sources(accessLogPath(cfg), cdn.LancacheLogs(logDir, profiles))
+			records.follow(topology.logFiles())
+		}
+		cacheStats, err := records.cacheStats(logs, cacheDirs)
 		if err != nil {
 			return nil, err
 		}
@@ -156,8 +444,8 @@ func main() {
 			return nil, err
 		}
 
-		return &telemetry.TelemetryData{
-			ISPID:          licenseInfo.ISPID,
+		data := &telemetry.TelemetryData{
+			ISPID:          supervisor.Current().ISPID,
 			CacheHits:      cacheStats.Hits,
 			CacheMisses:    cacheStats.Misses,
 			BandwidthSaved: cacheStats.BytesServed / (1024 * 1024), // Convert to MB
@@ -165,19 +453,102 @@ func main() {
 			CacheSizeUsed:  int(cacheStats.CacheSizeUsed / (1024 * 1024)), // Convert to MB
 			CPUUsage:       systemStats.CPUUsage,
 			MemoryUsage:    systemStats.MemoryUsage,
-		}, nil
+		}
+		data.CacheStatus = cacheStatusStats(&cacheStats.Statuses)
+		records.collect(data)
+		if topology != nil {
+			topology.collect(data)
+		}
+		nginxStatus.collect(data)
+		analytics.collect(data)
+		if geo != nil {
+			geo.collect(data)
+		}
+		if report := health.Last(); report != nil {
+			data.NginxHealth = string(report.State)
+		}
+		if dnsServer != nil {
+			data.DNS = dnsStats(dnsServer)
+		}
+		if shipper != nil {
+			data.Errors = shipper.Rates()
+		}
+		return data, nil
 	}
+	telemetryLogger := logging.Component(logger, "telemetry")
+	samples := newSampler(telemetryLogger, historyStore, sampleStats)
+	go samples.Run(ctx)
 
-	go telemetry.StartTelemetryLoop(SAAS_URL, licenseInfo.ISPID, 5*time.Minute, collectStats)
+	// Start telemetry loop in background
+	collectStats := func() (*telemetry.TelemetryData, error) {
+		data, err := samples.report()
+		if err != nil {
+			return nil, err
+		}
+		latest.Set(data)
+		// Without an active license only the core counters are reported
+		if !supervisor.Active() {
+			return data.Minimal(), nil
+		}
+		return data, nil
+	}
+
+	reporter := newReporter(cfg, telemetryLogger, saasURL, licenseInfo.ISPID, hardwareID, historyStore, collectStats)
+	go reporter.Run(ctx)
+
+	// Local alert rules, evaluated even while the SaaS is unreachable
+	if alerts != nil {
+		// hit_ratio covers the requests logged since the previous evaluation
+		statuses := &nginx.StatusCounter{}
+		records.pipeline.AddObserver(statuses)
+		metrics := func() map[string]float64 {
+			return alertMetrics(cfg, samples.Latest(), statuses.Flush(), health, supervisor.Current(), reporter.Ledger)
+		}
+		go runAlerts(ctx, alerts, cfg.Alerting.Interval(), metrics)
+	}
 
 	// Handle graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
-	log.Println("Agent running. Press Ctrl+C to stop.")
+	logger.Info("agent running")
 	<-sigChan
 
-	log.Println("Shutting down gracefully...")
+	logger.Info("shutting down")
+	cancel()
 	time.Sleep(2 * time.Second)
-	log.Println("Agent stopped")
+	logger.Info("agent stopped")
+}
+
+// startUpdater checks for updates shortly after startup and then every 24 hours
+func startUpdater(ctx context.Context, logger *slog.Logger, saasURL string, publicKey ed25519.PublicKey) {
+	go func() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(30 * time.Second): // Wait 30s after startup
+		}
+
+		version, needsUpdate, err := updater.CheckForUpdates(saasURL)
+		if err != nil {
+			logger.Warn("update check failed", "error", err)
+			return
+		}
+
+		if needsUpdate {
+			logger.Info("new version available, installing automatically", "version", version.Version, "current", VERSION)
+
+			if err := updater.DownloadAndInstall(logger, version, publicKey); err != nil {
+				logger.Error("auto-update failed", "error", err)
+			}
+		}
+	}()
+
+	go updater.StartUpdateLoop(ctx, logger, saasURL, 24*time.Hour, publicKey)
+}
+
+// fatal logs the error and exits; only main ends the process
+func fatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
 }
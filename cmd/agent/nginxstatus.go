@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"isp-agent/pkg/config"
+	"isp-agent/pkg/nginx"
+	"isp-agent/pkg/telemetry"
+)
+
+// nginxStatusSource scrapes nginx's status endpoints for telemetry
+type nginxStatusSource struct {
+	collector *nginx.StatusCollector
+	logger    *slog.Logger
+	lastErr   string
+}
+
+func newNginxStatusSource(cfg *config.Config, logger *slog.Logger) *nginxStatusSource {
+	collector := nginx.NewStatusCollector(fmt.Sprintf("http://%s", cfg.Nginx.ListenAddr))
+	collector.StubPath = cfg.Nginx.StatusPath
+	if cfg.Nginx.VTS {
+		collector.VTSPath = "/vts-status/format/json"
+	}
+	collector.PlusPath = cfg.Nginx.PlusAPI
+	return &nginxStatusSource{collector: collector, logger: logger}
+}
+
+// collect adds nginx status to data, logging scrape errors only when they change
+func (s *nginxStatusSource) collect(data *telemetry.TelemetryData) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	snap, err := s.collector.Collect(ctx)
+	if err != nil {
+		if err.Error() != s.lastErr {
+			s.logger.Warn("nginx status unavailable", "error", err)
+			s.lastErr = err.Error()
+		}
+		return
+	}
+	s.lastErr = ""
+
+	status := &telemetry.NginxStatus{
+		Source:            snap.Source,
+		ActiveConnections: snap.Connections.Active,
+		Reading:           snap.Connections.Reading,
+		Writing:           snap.Connections.Writing,
+		Waiting:           snap.Connections.Waiting,
+		Accepted:          snap.Connections.Accepted,
+		Handled:           snap.Connections.Handled,
+		Requests:          snap.Connections.Requests,
+		RequestsPerSecond: snap.RequestsPerSecond,
+	}
+	for _, u := range snap.Upstreams {
+		status.Upstreams = append(status.Upstreams, telemetry.UpstreamStats(u))
+	}
+	for _, z := range snap.CacheZones {
+		status.CacheZones = append(status.CacheZones, telemetry.CacheZoneStats(z))
+	}
+	data.Nginx = status
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+
+	"isp-agent/pkg/cdn"
+	"isp-agent/pkg/config"
+	"isp-agent/pkg/nginx"
+	"isp-agent/pkg/telemetry"
+)
+
+// logPipeline turns new access log lines into per-interval aggregates
+type logPipeline struct {
+	pipeline  *nginx.Pipeline
+	parse     nginx.LineParser
+	tailers   []*nginx.Tailer
+	logger    *slog.Logger
+	profiles  *nginx.GroupStats
+	latency   *nginx.LatencyStats
+	breakdown *nginx.BreakdownStats
+
+	// syslog is set when access logs arrive over syslog; statuses then
+	// replaces the log file window for the cache status snapshot
+	syslog   *nginx.SyslogReceiver
+	statuses *nginx.StatusWindow
+}
+
+// latencyHosts is how many of the busiest hosts get their own latency percentiles
+const latencyHosts = 20
+
+func newLogPipeline(logger *slog.Logger, logPaths []string, profiles []cdn.Profile, observers ...nginx.Observer) *logPipeline {
+	p := &logPipeline{pipeline: nginx.NewPipeline(), parse: nginx.ParseAny, logger: logger}
+
+	matcher := cdn.NewMatcher(profiles)
+	p.pipeline.AddEnricher(func(r *nginx.Record) {
+		r.Profile = matcher.Match(r.Host)
+	})
+
+	p.profiles = nginx.NewGroupStats(func(r *nginx.Record) string { return r.Profile })
+	p.pipeline.AddObserver(p.profiles)
+
+	// Hosts beyond the limit are pooled so a crawl of many hosts cannot grow memory
+	p.latency = nginx.NewLatencyStats(1000)
+	p.pipeline.AddObserver(p.latency)
+
+	p.breakdown = nginx.NewBreakdownStats()
+	p.pipeline.AddObserver(p.breakdown)
+
+	for _, o := range observers {
+		p.pipeline.AddObserver(o)
+	}
+
+	p.follow(logPaths)
+	return p
+}
+
+// useJSONFields parses JSON access logs with the configured mapping, on top
+// of the one detected from the nginx log_format when enabled
+func (p *logPipeline) useJSONFields(cfg config.JSONLogConfig, accessLog string) {
+	fields := make(nginx.JSONFields)
+	if cfg.Detect {
+		detected, format, err := detectJSONFields(accessLog)
+		if err != nil {
+			p.logger.Debug("JSON log format not detected", "error", err)
+		} else if detected != nil {
+			p.logger.Info("parsing JSON access log", "log_format", format, "fields", len(detected))
+			fields = detected
+		}
+	}
+	for field, key := range cfg.Fields {
+		fields[field] = key
+	}
+	if len(fields) == 0 {
+		return
+	}
+	p.parse = fields.Parse
+	p.pipeline.SetParser(p.parse)
+}
+
+// detectJSONFields reads the JSON log_format of accessLog from nginx -T
+func detectJSONFields(accessLog string) (nginx.JSONFields, string, error) {
+	dump, err := nginx.EffectiveConfig()
+	if err != nil {
+		return nil, "", err
+	}
+	directives, err := nginx.ParseDump(dump)
+	if err != nil {
+		return nil, "", err
+	}
+	fields, format, _ := nginx.DetectJSONFields(directives, accessLog)
+	return fields, format, nil
+}
+
+// listenSyslog receives access log lines over syslog until ctx is cancelled
+func (p *logPipeline) listenSyslog(ctx context.Context, cfg config.AccessSyslogConfig) {
+	p.statuses = nginx.NewStatusWindow(0)
+	p.pipeline.AddObserver(p.statuses)
+
+	p.syslog = nginx.NewSyslogReceiver(p.pipeline, cfg.QueueSize)
+	p.syslog.UDP = cfg.Listen
+	p.syslog.Socket = cfg.Socket
+	p.syslog.SocketGroup = cfg.SocketGroup
+	go func() {
+		if err := p.syslog.Run(ctx); err != nil {
+			p.logger.Error("access log syslog receiver stopped", "error", err)
+		}
+	}()
+	p.logger.Info("receiving access logs over syslog", "listen", cfg.Listen, "socket", cfg.Socket)
+}
+
+// cacheStats returns the cache status snapshot, from the syslog window when
+// access logs arrive over syslog and from the log files otherwise
+func (p *logPipeline) cacheStats(logs, cacheDirs []string) (*nginx.CacheStats, error) {
+	stats, err := nginx.CollectCacheStats(p.parse, logs, cacheDirs)
+	if err != nil {
+		return nil, err
+	}
+	if p.statuses != nil {
+		stats.SetStatuses(p.statuses.Counters())
+	}
+	return stats, nil
+}
+
+// follow starts tailing logs that are not tailed yet, at their current end
+func (p *logPipeline) follow(paths []string) {
+	for _, path := range paths {
+		tailed := false
+		for _, t := range p.tailers {
+			if t.Path == path {
+				tailed = true
+				break
+			}
+		}
+		if !tailed {
+			p.tailers = append(p.tailers, nginx.NewTailer(path))
+		}
+	}
+}
+
+// collect reads everything logged since the last call and adds the aggregates to data
+func (p *logPipeline) collect(data *telemetry.TelemetryData) {
+	for _, t := range p.tailers {
+		if err := p.pipeline.Consume(t); err != nil && !os.IsNotExist(err) {
+			p.logger.Warn("failed to read access log", "path", t.Path, "error", err)
+		}
+	}
+
+	data.Profiles = trafficStats(p.profiles.Flush())
+	data.ProfileLibrary = cdn.LibraryVersion
+	data.Latency = latencyReport(p.latency.Flush())
+	data.Breakdown = responseBreakdown(p.breakdown.Flush())
+	if p.syslog != nil {
+		stats := telemetry.SyslogStats(p.syslog.Stats())
+		data.Syslog = &stats
+	}
+}
+
+func responseBreakdown(b *nginx.Breakdown) *telemetry.ResponseBreakdown {
+	if len(b.StatusClass) == 0 {
+		return nil
+	}
+	convert := func(m map[string]nginx.RequestBytes) map[string]telemetry.RequestBytes {
+		out := make(map[string]telemetry.RequestBytes, len(m))
+		for k, v := range m {
+			out[k] = telemetry.RequestBytes(v)
+		}
+		return out
+	}
+	return &telemetry.ResponseBreakdown{
+		StatusClass: convert(b.StatusClass),
+		StatusCode:  convert(b.StatusCode),
+		Method:      convert(b.Method),
+		ContentType: convert(b.ContentType),
+	}
+}
+
+func latencyReport(byStatus, byHost map[string]*nginx.LatencySketches) *telemetry.LatencyReport {
+	if len(byStatus) == 0 {
+		return nil
+	}
+	report := &telemetry.LatencyReport{
+		ByCacheStatus: make(map[string]telemetry.LatencyGroup, len(byStatus)),
+		ByHost:        make(map[string]telemetry.LatencyGroup),
+	}
+	for status, sketches := range byStatus {
+		report.ByCacheStatus[status] = latencyGroup(sketches)
+	}
+	for _, host := range nginx.TopByCount(byHost, latencyHosts) {
+		report.ByHost[host] = latencyGroup(byHost[host])
+	}
+	return report
+}
+
+func latencyGroup(s *nginx.LatencySketches) telemetry.LatencyGroup {
+	group := telemetry.LatencyGroup{
+		Response:       telemetry.LatencyPercentiles(s.Response.Summary()),
+		ResponseSketch: s.Response,
+	}
+	if s.OriginTTFB.Count() > 0 {
+		ttfb := telemetry.LatencyPercentiles(s.OriginTTFB.Summary())
+		group.OriginTTFB = &ttfb
+		group.OriginTTFBSketch = s.OriginTTFB
+	}
+	return group
+}
+
+func trafficStats(groups map[string]nginx.TrafficCounters) map[string]telemetry.TrafficStats {
+	if len(groups) == 0 {
+		return nil
+	}
+	out := make(map[string]telemetry.TrafficStats, len(groups))
+	for name, c := range groups {
+		out[name] = trafficStat(c)
+	}
+	return out
+}
+
+func trafficStat(c nginx.TrafficCounters) telemetry.TrafficStats {
+	return telemetry.TrafficStats{
+		Requests: c.Requests,
+		Hits:     c.Hits,
+		Misses:   c.Misses,
+		Bytes:    c.Bytes,
+		HitBytes: c.HitBytes,
+		HitRatio: c.HitRatio(),
+	}
+}
+
+func cacheStatusStats(c *nginx.CacheStatusCounters) *telemetry.CacheStatusStats {
+	return &telemetry.CacheStatusStats{
+		Hit:             telemetry.RequestBytes(c.Hit),
+		Miss:            telemetry.RequestBytes(c.Miss),
+		Bypass:          telemetry.RequestBytes(c.Bypass),
+		Expired:         telemetry.RequestBytes(c.Expired),
+		Stale:           telemetry.RequestBytes(c.Stale),
+		Updating:        telemetry.RequestBytes(c.Updating),
+		Revalidated:     telemetry.RequestBytes(c.Revalidated),
+		Uncached:        telemetry.RequestBytes(c.Uncached),
+		RequestHitRatio: c.RequestHitRatio(),
+		ByteHitRatio:    c.ByteHitRatio(),
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"isp-agent/pkg/alert"
+	"isp-agent/pkg/features"
+	"isp-agent/pkg/history"
+	"isp-agent/pkg/license"
+	"isp-agent/pkg/nginx"
+	"isp-agent/pkg/telemetry"
+)
+
+// statusTokenPath holds the bearer token for feature commands, readable by root only
+const statusTokenPath = "/var/lib/isp-agent/status.token"
+
+// statusReport is served by the local status API
+type statusReport struct {
+	Version    string                   `json:"version"`
+	HardwareID string                   `json:"hardware_id"`
+	License    licenseStatus            `json:"license"`
+	Features   []features.Status        `json:"features"`
+	Telemetry  *telemetry.TelemetryData `json:"telemetry,omitempty"`
+	Health     *nginx.HealthReport      `json:"health,omitempty"`
+	Alerts     []alert.Status           `json:"alerts,omitempty"`
+}
+
+type licenseStatus struct {
+	Status    string   `json:"status"`
+	ISPID     int      `json:"isp_id"`
+	ExpiresAt string   `json:"expires_at"`
+	Modules   []string `json:"modules"`
+	Offline   bool     `json:"offline"`
+}
+
+// latestTelemetry holds the most recently collected telemetry
+type latestTelemetry struct {
+	mu   sync.Mutex
+	data *telemetry.TelemetryData
+}
+
+func (l *latestTelemetry) Set(data *telemetry.TelemetryData) {
+	l.mu.Lock()
+	l.data = data
+	l.mu.Unlock()
+}
+
+func (l *latestTelemetry) Get() *telemetry.TelemetryData {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.data
+}
+
+// statusServer exposes agent state and feature commands on a local address
+type statusServer struct {
+	hardwareID string
+	supervisor *license.Supervisor
+	registry   *features.Registry
+	telemetry  *latestTelemetry
+	health     *nginx.HealthMonitor
+	history    *history.Store
+	alerts     *alert.Engine
+	// token authorizes feature commands; empty disables them
+	token string
+}
+
+func (s *statusServer) report() statusReport {
+	info := s.supervisor.Current()
+	report := statusReport{
+		Version:    VERSION,
+		HardwareID: s.hardwareID,
+		License: licenseStatus{
+			Status:    info.Status,
+			ISPID:     info.ISPID,
+			ExpiresAt: info.ExpiresAt,
+			Modules:   info.Modules,
+			Offline:   info.Offline,
+		},
+		Features:  s.registry.Status(),
+		Telemetry: s.telemetry.Get(),
+		Health:    s.health.Last(),
+	}
+	if s.alerts != nil {
+		report.Alerts = s.alerts.Status()
+	}
+	return report
+}
+
+// Serve runs the status API until ctx is cancelled
+func (s *statusServer) Serve(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.report())
+	})
+	// GET /history?from=<RFC3339>&to=<RFC3339>&resolution=minute|hour, the last 24 hours by default
+	mux.HandleFunc("/history", func(w http.ResponseWriter, r *http.Request) {
+		if s.history == nil {
+			http.Error(w, "history is disabled", http.StatusNotFound)
+			return
+		}
+		from, to, res, err := s.historyRange(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		samples, err := s.history.Query(from, to, res)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if samples == nil {
+			samples = []*telemetry.TelemetryData{}
+		}
+		writeJSON(w, http.StatusOK, samples)
+	})
+	// POST /features/<name>/<command> with a JSON object of string arguments
+	// Requires "Authorization: Bearer <token>" with the token from statusTokenPath
+	mux.HandleFunc("/features/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !s.authorized(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/features/"), "/")
+		if len(parts) != 2 {
+			http.Error(w, "expected /features/<name>/<command>", http.StatusNotFound)
+			return
+		}
+
+		args := map[string]string{}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+				http.Error(w, "invalid arguments: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		result, err := s.registry.Execute(r.Context(), parts[0], parts[1], args)
+		switch {
+		case errors.Is(err, features.ErrNotLicensed):
+			writeJSON(w, http.StatusForbidden, map[string]interface{}{"success": false, "error": err.Error()})
+		case errors.Is(err, features.ErrUnknownFeature), errors.Is(err, features.ErrUnknownCommand):
+			writeJSON(w, http.StatusNotFound, map[string]interface{}{"success": false, "error": err.Error()})
+		case err != nil:
+			writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"success": false, "error": err.Error(), "data": result})
+		default:
+			writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "data": result})
+		}
+	})
+
+	server := &http.Server{Addr: addr, Handler: loopbackOnly(mux), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func (s *statusServer) authorized(r *http.Request) bool {
+	if s.token == "" {
+		return false
+	}
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(given), []byte(s.token)) == 1
+}
+
+// loopbackOnly rejects requests whose Host is not a loopback name, so
+// requests relayed by the cache's proxy_pass http://$host never get through
+func loopbackOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if ip := net.ParseIP(host); !strings.EqualFold(host, "localhost") && (ip == nil || !ip.IsLoopback()) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// newStatusToken writes a fresh bearer token for feature commands, replacing any earlier one
+func newStatusToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(raw)
+
+	os.MkdirAll(filepath.Dir(statusTokenPath), 0700)
+	tmp := statusTokenPath + ".tmp"
+	os.Remove(tmp)
+	if err := os.WriteFile(tmp, []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, statusTokenPath); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return token, nil
+}
+
+func (s *statusServer) historyRange(r *http.Request) (from, to time.Time, res history.Resolution, err error) {
+	q := r.URL.Query()
+	to = time.Now().UTC()
+	if v := q.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, res, fmt.Errorf("invalid to: %w", err)
+		}
+	}
+	from = to.Add(-24 * time.Hour)
+	if v := q.Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, res, fmt.Errorf("invalid from: %w", err)
+		}
+	}
+
+	switch v := history.Resolution(q.Get("resolution")); v {
+	case "":
+		res = s.history.ResolutionFor(from)
+	case history.Minute, history.Hour:
+		res = v
+	default:
+		return from, to, res, fmt.Errorf("unknown resolution %q", v)
+	}
+	return from, to, res, nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// getJSON queries the status API of a running agent
+func getJSON(url string, v interface{}) error {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return fmt.Errorf("agent not reachable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("agent returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+	return nil
+}
+
+// printStatus queries a running agent's status API
+func printStatus(addr string) error {
+	var report statusReport
+	if err := getJSON(fmt.Sprintf("http://%s/status", addr), &report); err != nil {
+		return err
+	}
+
+	fmt.Printf("ISP SaaS Agent v%s\n", report.Version)
+	fmt.Printf("Hardware ID: %s\n", report.HardwareID)
+	fmt.Printf("License:     %s (ISP ID %d, expires %s", report.License.Status, report.License.ISPID, report.License.ExpiresAt)
+	if report.License.Offline {
+		fmt.Print(", offline")
+	}
+	fmt.Println(")")
+
+	if h := report.Health; h != nil {
+		fmt.Printf("Nginx:       %s (master %d, %d workers)\n", h.State, h.MasterPID, h.Workers)
+		for _, c := range h.Checks {
+			if !c.OK && !c.Skipped {
+				fmt.Printf("  %-12s %s\n", c.Name, c.Detail)
+			}
+		}
+	}
+
+	for _, a := range report.Alerts {
+		if a.State == alert.StateFiring {
+			fmt.Printf("Alert:       %s firing since %s (%s)\n", a.Rule, a.Since.Local().Format(time.RFC3339), a.Condition)
+		}
+	}
+
+	fmt.Println("\nFeatures:")
+	for _, f := range report.Features {
+		state := "not licensed"
+		if f.Licensed && f.Active {
+			state = "active"
+		} else if f.Licensed {
+			state = "licensed, inactive"
+		}
+		fmt.Fprintf(os.Stdout, "  %-22s %-22s (module %s)\n", f.Name, state, f.Module)
+	}
+
+	return nil
+}
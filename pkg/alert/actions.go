@@ -0,0 +1,184 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Action delivers notifications somewhere
+type Action interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// Webhook posts the notification as JSON
+type Webhook struct {
+	URL     string
+	Headers map[string]string
+	client  *http.Client
+}
+
+func NewWebhook(url string, headers map[string]string) *Webhook {
+	return &Webhook{URL: url, Headers: headers, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (w *Webhook) Notify(ctx context.Context, n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// EmailFile writes each notification as an RFC 5322 message into Dir, for
+// a local MTA or a mail pickup job to deliver
+type EmailFile struct {
+	Dir  string
+	From string
+	To   []string
+}
+
+func (e *EmailFile) Notify(ctx context.Context, n Notification) error {
+	if err := os.MkdirAll(e.Dir, 0755); err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", e.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(e.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject(n))
+	fmt.Fprintf(&b, "Date: %s\r\n", n.At.Format(time.RFC1123Z))
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&b, "Rule:      %s\r\nState:     %s\r\nSeverity:  %s\r\nCondition: %s\r\nValue:     %g\r\nSince:     %s\r\n",
+		n.Rule, n.State, n.Severity, n.Condition, n.Value, n.Since.Format(time.RFC3339))
+	if n.Summary != "" {
+		fmt.Fprintf(&b, "\r\n%s\r\n", n.Summary)
+	}
+
+	name := fmt.Sprintf("%d-%s-%s.eml", n.At.UnixNano(), sanitize(n.Rule), n.State)
+	tmp := filepath.Join(e.Dir, "."+name)
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	// Pickup jobs only see complete files
+	return os.Rename(tmp, filepath.Join(e.Dir, name))
+}
+
+// Syslog sends notifications to the local syslog daemon, or to Address when set
+type Syslog struct {
+	Network string
+	Address string
+	Tag     string
+}
+
+func (s *Syslog) Notify(ctx context.Context, n Notification) error {
+	priority := syslog.LOG_WARNING
+	switch {
+	case n.State == StateResolved:
+		priority = syslog.LOG_NOTICE
+	case n.Severity == "critical":
+		priority = syslog.LOG_CRIT
+	}
+	w, err := syslog.Dial(s.Network, s.Address, priority|syslog.LOG_DAEMON, s.Tag)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	msg := fmt.Sprintf("%s (%s, value %g)", subject(n), n.Condition, n.Value)
+	switch {
+	case n.State == StateResolved:
+		return w.Notice(msg)
+	case n.Severity == "critical":
+		return w.Crit(msg)
+	}
+	return w.Warning(msg)
+}
+
+// Exec runs a command with the notification as JSON on stdin and in ALERT_* variables
+type Exec struct {
+	Command []string
+	Timeout time.Duration
+}
+
+func (e *Exec) Notify(ctx context.Context, n Notification) error {
+	if len(e.Command) == 0 {
+		return fmt.Errorf("no command configured")
+	}
+	timeout := e.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, e.Command[0], e.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(),
+		"ALERT_RULE="+n.Rule,
+		"ALERT_STATE="+n.State,
+		"ALERT_SEVERITY="+n.Severity,
+		"ALERT_CONDITION="+n.Condition,
+		fmt.Sprintf("ALERT_VALUE=%g", n.Value),
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w: %s", e.Command[0], err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// Func adapts a function, e.g. the SaaS event reporter, to an Action
+type Func func(ctx context.Context, n Notification) error
+
+func (f Func) Notify(ctx context.Context, n Notification) error {
+	return f(ctx, n)
+}
+
+func subject(n Notification) string {
+	prefix := "[FIRING]"
+	if n.State == StateResolved {
+		prefix = "[RESOLVED]"
+	}
+	s := fmt.Sprintf("%s %s", prefix, n.Rule)
+	if n.Hostname != "" {
+		s += " on " + n.Hostname
+	}
+	return s
+}
+
+func sanitize(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -0,0 +1,228 @@
+package alert
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Alert states
+const (
+	StateInactive = "inactive"
+	StatePending  = "pending"
+	StateFiring   = "firing"
+	StateResolved = "resolved"
+)
+
+// Notification is sent to actions when a rule fires or resolves
+type Notification struct {
+	Rule      string    `json:"rule"`
+	State     string    `json:"state"`
+	Severity  string    `json:"severity"`
+	Summary   string    `json:"summary"`
+	Condition string    `json:"condition"`
+	Value     float64   `json:"value"`
+	Since     time.Time `json:"since"`
+	At        time.Time `json:"at"`
+	Hostname  string    `json:"hostname,omitempty"`
+}
+
+// Status describes one rule for the status API
+type Status struct {
+	Rule      string    `json:"rule"`
+	State     string    `json:"state"`
+	Severity  string    `json:"severity"`
+	Condition string    `json:"condition"`
+	Value     *float64  `json:"value,omitempty"`
+	Since     time.Time `json:"since,omitempty"`
+}
+
+// ruleState tracks one rule between evaluations
+type ruleState struct {
+	state string
+	// since is when the condition started holding
+	since time.Time
+	// resolving is when the resolve condition started holding while firing
+	resolving time.Time
+	value     *float64
+	// samples holds the raw values a delta is taken over
+	samples []sample
+}
+
+type sample struct {
+	at    time.Time
+	value float64
+}
+
+// delta returns the change of the metric over the condition's window, or
+// since the previous evaluation. It is false until enough samples exist.
+func (st *ruleState) delta(c Condition, now time.Time, raw float64) (float64, bool) {
+	st.samples = append(st.samples, sample{now, raw})
+	cutoff := now.Add(-c.Window)
+	// Keep the newest sample at or before the start of the window
+	for len(st.samples) > 2 && !st.samples[1].at.After(cutoff) {
+		st.samples = st.samples[1:]
+	}
+	first := st.samples[0]
+	if len(st.samples) < 2 || first.at.After(cutoff) {
+		return 0, false
+	}
+	return raw - first.value, true
+}
+
+// transition is a notification waiting to be sent once the lock is released
+type transition struct {
+	rule Rule
+	note Notification
+}
+
+// Engine evaluates rules against metric snapshots
+type Engine struct {
+	Rules    []Rule
+	Actions  map[string]Action
+	Hostname string
+	Logger   *slog.Logger
+
+	mu     sync.Mutex
+	states map[string]*ruleState
+}
+
+func NewEngine(rules []Rule, actions map[string]Action) *Engine {
+	return &Engine{
+		Rules:   rules,
+		Actions: actions,
+		Logger:  slog.Default(),
+		states:  make(map[string]*ruleState),
+	}
+}
+
+// Evaluate updates every rule with the metrics at now and notifies actions of
+// transitions. Rules whose metric is missing keep their state.
+func (e *Engine) Evaluate(ctx context.Context, now time.Time, metrics map[string]float64) {
+	var notes []transition
+
+	e.mu.Lock()
+	for _, rule := range e.Rules {
+		st := e.states[rule.Name]
+		if st == nil {
+			st = &ruleState{state: StateInactive}
+			e.states[rule.Name] = st
+		}
+
+		raw, ok := metrics[rule.Condition.Metric]
+		if !ok {
+			continue
+		}
+		value := raw
+		if rule.Condition.Delta {
+			if value, ok = st.delta(rule.Condition, now, raw); !ok {
+				continue
+			}
+		}
+		st.value = &value
+
+		if note, changed := e.step(&rule, st, now, value); changed {
+			notes = append(notes, transition{rule, note})
+		}
+	}
+	e.mu.Unlock()
+
+	for _, n := range notes {
+		e.notify(ctx, n.rule, n.note)
+	}
+}
+
+// step advances the state machine of one rule
+func (e *Engine) step(rule *Rule, st *ruleState, now time.Time, value float64) (Notification, bool) {
+	note := Notification{
+		Rule:      rule.Name,
+		Severity:  rule.Severity,
+		Summary:   rule.Summary,
+		Condition: rule.Condition.String(),
+		Value:     value,
+		At:        now,
+		Hostname:  e.Hostname,
+	}
+
+	switch st.state {
+	case StateInactive, StatePending:
+		if !rule.Condition.Holds(value) {
+			st.state = StateInactive
+			return note, false
+		}
+		if st.state == StateInactive {
+			st.state = StatePending
+			st.since = now
+		}
+		if now.Sub(st.since) >= rule.For {
+			st.state = StateFiring
+			st.resolving = time.Time{}
+			note.State = StateFiring
+			note.Since = st.since
+			return note, true
+		}
+
+	case StateFiring:
+		if !rule.resolved(value) {
+			st.resolving = time.Time{}
+			return note, false
+		}
+		if st.resolving.IsZero() {
+			st.resolving = now
+		}
+		if now.Sub(st.resolving) >= rule.ResolveFor {
+			note.State = StateResolved
+			note.Since = st.since
+			st.state = StateInactive
+			st.since = time.Time{}
+			return note, true
+		}
+	}
+	return note, false
+}
+
+func (e *Engine) notify(ctx context.Context, rule Rule, note Notification) {
+	level := slog.LevelWarn
+	if note.State == StateResolved {
+		level = slog.LevelInfo
+	}
+	e.Logger.Log(ctx, level, "alert "+note.State, "rule", note.Rule, "condition", note.Condition, "value", note.Value)
+
+	names := rule.Actions
+	if len(names) == 0 {
+		for name := range e.Actions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	for _, name := range names {
+		action, ok := e.Actions[name]
+		if !ok {
+			e.Logger.Warn("alert action not configured", "rule", rule.Name, "action", name)
+			continue
+		}
+		if err := action.Notify(ctx, note); err != nil {
+			e.Logger.Warn("alert action failed", "rule", rule.Name, "action", name, "error", err)
+		}
+	}
+}
+
+// Status returns every rule's state, in rule order
+func (e *Engine) Status() []Status {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	out := make([]Status, 0, len(e.Rules))
+	for _, rule := range e.Rules {
+		s := Status{Rule: rule.Name, State: StateInactive, Severity: rule.Severity, Condition: rule.Condition.String()}
+		if st := e.states[rule.Name]; st != nil {
+			s.State = st.state
+			s.Value = st.value
+			s.Since = st.since
+		}
+		out = append(out, s)
+	}
+	return out
+}
@@ -0,0 +1,135 @@
+// Package alert evaluates local alert rules over agent metrics and sends
+// firing and resolved notifications, independently of the SaaS.
+package alert
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Condition compares a metric, or its change over Window, with a threshold:
+// "hit_ratio < 0.2", "delta(spool_depth, 30m) > 0". A delta without a window
+// is the change since the previous evaluation.
+type Condition struct {
+	Metric    string
+	Delta     bool
+	Window    time.Duration
+	Op        string
+	Threshold float64
+}
+
+var operators = []string{"<=", ">=", "==", "!=", "<", ">"}
+
+// ParseCondition parses "<metric> <op> <number>" with an optional
+// delta(<metric>[, <window>]) around the metric
+func ParseCondition(expr string) (Condition, error) {
+	expr = strings.TrimSpace(expr)
+	for _, op := range operators {
+		i := strings.Index(expr, op)
+		if i < 0 {
+			continue
+		}
+		c := Condition{Op: op, Metric: strings.TrimSpace(expr[:i])}
+		threshold, err := strconv.ParseFloat(strings.TrimSpace(expr[i+len(op):]), 64)
+		if err != nil {
+			return Condition{}, fmt.Errorf("invalid threshold in %q", expr)
+		}
+		c.Threshold = threshold
+
+		if strings.HasPrefix(c.Metric, "delta(") && strings.HasSuffix(c.Metric, ")") {
+			c.Delta = true
+			c.Metric = strings.TrimSpace(c.Metric[len("delta(") : len(c.Metric)-1])
+			if metric, window, ok := strings.Cut(c.Metric, ","); ok {
+				c.Metric = strings.TrimSpace(metric)
+				if c.Window, err = time.ParseDuration(strings.TrimSpace(window)); err != nil || c.Window <= 0 {
+					return Condition{}, fmt.Errorf("invalid delta window in %q", expr)
+				}
+			}
+		}
+		if c.Metric == "" || strings.ContainsAny(c.Metric, " ()") {
+			return Condition{}, fmt.Errorf("invalid metric in %q", expr)
+		}
+		return c, nil
+	}
+	return Condition{}, fmt.Errorf("no comparison operator in %q", expr)
+}
+
+func (c Condition) String() string {
+	metric := c.Metric
+	if c.Delta && c.Window > 0 {
+		metric = fmt.Sprintf("delta(%s, %s)", metric, shortDuration(c.Window))
+	} else if c.Delta {
+		metric = "delta(" + metric + ")"
+	}
+	return fmt.Sprintf("%s %s %g", metric, c.Op, c.Threshold)
+}
+
+// shortDuration formats 30m as "30m" rather than "30m0s"
+func shortDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
+
+// Holds compares value with the threshold
+func (c Condition) Holds(value float64) bool {
+	switch c.Op {
+	case "<":
+		return value < c.Threshold
+	case "<=":
+		return value <= c.Threshold
+	case ">":
+		return value > c.Threshold
+	case ">=":
+		return value >= c.Threshold
+	case "==":
+		return value == c.Threshold
+	case "!=":
+		return value != c.Threshold
+	}
+	return false
+}
+
+// Rule fires once Condition has held for For and resolves once Resolve has
+// held for ResolveFor. A Resolve condition with a different threshold gives
+// hysteresis; without one, the rule resolves as soon as Condition stops holding.
+type Rule struct {
+	Name       string
+	Severity   string
+	Summary    string
+	Condition  Condition
+	For        time.Duration
+	Resolve    *Condition
+	ResolveFor time.Duration
+	// Actions names the actions to notify; empty means all
+	Actions []string
+}
+
+// Validate checks that Resolve measures the same value as Condition
+func (r *Rule) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("alert rule without a name")
+	}
+	if r.Resolve == nil {
+		return nil
+	}
+	if r.Resolve.Metric != r.Condition.Metric || r.Resolve.Delta != r.Condition.Delta || r.Resolve.Window != r.Condition.Window {
+		return fmt.Errorf("rule %s: resolve must use %s", r.Name, r.Condition.String())
+	}
+	return nil
+}
+
+// resolved reports whether a firing rule may resolve at value
+func (r *Rule) resolved(value float64) bool {
+	if r.Resolve != nil {
+		return r.Resolve.Holds(value)
+	}
+	return !r.Condition.Holds(value)
+}
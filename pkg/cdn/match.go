@@ -0,0 +1,55 @@
+package cdn
+
+import "strings"
+
+// Matcher maps request hosts to profile names
+type Matcher struct {
+	exact    map[string]string
+	suffixes []suffixRule
+}
+
+type suffixRule struct {
+	suffix  string
+	profile string
+}
+
+// NewMatcher indexes the hostnames of the given profiles.
+// "*.example.com" matches subdomains, ".example.com" also matches example.com.
+func NewMatcher(profiles []Profile) *Matcher {
+	m := &Matcher{exact: make(map[string]string)}
+	for _, p := range profiles {
+		for _, h := range p.Hostnames {
+			h = strings.ToLower(h)
+			switch {
+			case strings.HasPrefix(h, "*."):
+				m.suffixes = append(m.suffixes, suffixRule{suffix: h[1:], profile: p.Name})
+			case strings.HasPrefix(h, "."):
+				m.exact[h[1:]] = p.Name
+				m.suffixes = append(m.suffixes, suffixRule{suffix: h, profile: p.Name})
+			default:
+				m.exact[h] = p.Name
+			}
+		}
+	}
+	return m
+}
+
+// Match returns the profile serving host, or "" if none does
+func (m *Matcher) Match(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if i := strings.LastIndexByte(host, ':'); i >= 0 && !strings.Contains(host[i:], "]") {
+		host = host[:i]
+	}
+	if p, ok := m.exact[host]; ok {
+		return p
+	}
+
+	// Longest suffix wins so specific wildcards beat broad ones
+	best, bestLen := "", 0
+	for _, rule := range m.suffixes {
+		if strings.HasSuffix(host, rule.suffix) && len(rule.suffix) > bestLen {
+			best, bestLen = rule.profile, len(rule.suffix)
+		}
+	}
+	return best
+}
@@ -0,0 +1,283 @@
+package cdn
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"isp-agent/pkg/nginx"
+)
+
+// LibraryVersion changes whenever a built-in profile changes
+const LibraryVersion = "2026.10.1"
+
+// Cache key strategies
+const (
+	// KeyURI keys on host, path and query string
+	KeyURI = "uri"
+	// KeyPath ignores the query string, for CDNs that add per-user tokens
+	KeyPath = "path"
+	// KeyShared keys on the profile name and path so every mirror hostname shares one copy
+	KeyShared = "shared"
+)
+
+// Range handling modes
+const (
+	// RangeSlice fetches fixed-size slices and caches each one
+	RangeSlice = "slice"
+	// RangeFull fetches whole objects and serves ranges from the cache
+	RangeFull = "full"
+)
+
+// Profile describes how to cache one content delivery network
+type Profile struct {
+	Name        string
+	Description string
+	Hostnames   []string
+
+	KeyStrategy   string
+	RangeHandling string
+	SliceSize     string
+	Validity      string
+	ReadTimeout   string
+
+	// IgnoreOriginHeaders caches content the origin marks as uncacheable
+	IgnoreOriginHeaders bool
+	// ShortLived matches mutable files such as repository indexes
+	ShortLived    string
+	ShortValidity string
+
+	// LancacheLog is the per-service log name used by lancache setups
+	LancacheLog string
+	Quirks      []string
+}
+
+var library = []Profile{
+	{
+		Name:        "steam",
+		Description: "Valve Steam depots",
+		Hostnames: []string{
+			"steamcontent.com", "*.steamcontent.com", "client-download.steampowered.com",
+			"cdn.steampowered.com", "cdn.steamstatic.com", "*.cs.steampowered.com",
+		},
+		KeyStrategy:         KeyShared,
+		RangeHandling:       RangeSlice,
+		SliceSize:           "8m",
+		Validity:            "365d",
+		ReadTimeout:         "600s",
+		IgnoreOriginHeaders: true,
+		LancacheLog:         "lancache-steam",
+		Quirks: []string{
+			"Depot chunks are content-addressed and immutable, so all CDN hostnames share one key space",
+			"Clients must use HTTP content servers; HTTPS downloads bypass the cache",
+		},
+	},
+	{
+		Name:          "epic",
+		Description:   "Epic Games Store",
+		Hostnames:     []string{"download.epicgames.com", "download2.epicgames.com", "download3.epicgames.com", "download4.epicgames.com", "fastly-download.epicgames.com", "epicgames-download1.akamaized.net"},
+		KeyStrategy:   KeyShared,
+		RangeHandling: RangeSlice,
+		SliceSize:     "8m",
+		Validity:      "365d",
+		ReadTimeout:   "600s",
+		LancacheLog:   "lancache-epic",
+		Quirks:        []string{"Chunk URLs are immutable; manifests are fetched over HTTPS and not cached"},
+	},
+	{
+		Name:          "blizzard",
+		Description:   "Blizzard Battle.net",
+		Hostnames:     []string{"dist.blizzard.com", "cdn.blizzard.com", "level3.blizzard.com", "us.cdn.blizzard.com", "eu.cdn.blizzard.com", "blzddist1-a.akamaihd.net", "blizzard.vo.llnwd.net"},
+		KeyStrategy:   KeyShared,
+		RangeHandling: RangeSlice,
+		SliceSize:     "8m",
+		Validity:      "365d",
+		ReadTimeout:   "600s",
+		LancacheLog:   "lancache-blizzard",
+		Quirks:        []string{"The Battle.net agent issues many small range requests into large archive files"},
+	},
+	{
+		Name:          "riot",
+		Description:   "Riot Games (League of Legends, Valorant)",
+		Hostnames:     []string{"l3cdn.riotgames.com", "worldwide.l3cdn.riotgames.com", "riotgamespatcher-a.akamaihd.net", "lol.dyn.riotcdn.net", "*.dyn.riotcdn.net"},
+		KeyStrategy:   KeyShared,
+		RangeHandling: RangeSlice,
+		SliceSize:     "8m",
+		Validity:      "365d",
+		ReadTimeout:   "600s",
+		LancacheLog:   "lancache-riot",
+	},
+	{
+		Name:          "origin",
+		Description:   "EA app / Origin",
+		Hostnames:     []string{"origin-a.akamaihd.net", "lvlt.cdn.ea.com", "download.dm.origin.com"},
+		KeyStrategy:   KeyPath,
+		RangeHandling: RangeSlice,
+		SliceSize:     "8m",
+		Validity:      "365d",
+		ReadTimeout:   "600s",
+		LancacheLog:   "lancache-origin",
+		Quirks:        []string{"Download URLs carry per-user auth tokens in the query string, which must not be part of the key"},
+	},
+	{
+		Name:          "windows-update",
+		Description:   "Windows Update and Delivery Optimization",
+		Hostnames:     []string{"*.windowsupdate.com", "*.update.microsoft.com", "*.delivery.mp.microsoft.com", "dl.delivery.mp.microsoft.com"},
+		KeyStrategy:   KeyPath,
+		RangeHandling: RangeSlice,
+		SliceSize:     "1m",
+		Validity:      "30d",
+		ReadTimeout:   "300s",
+		Quirks: []string{
+			"Clients request small ranges of large .cab/.esd files, so small slices avoid fetching whole files",
+			"Delivery Optimization peer traffic is not HTTP and cannot be cached",
+		},
+	},
+	{
+		Name:          "apple",
+		Description:   "Apple software and app updates",
+		Hostnames:     []string{"appldnld.apple.com", "updates-http.cdn-apple.com", "swcdn.apple.com", "iosapps.itunes.apple.com", "osxapps.itunes.apple.com"},
+		KeyStrategy:   KeyPath,
+		RangeHandling: RangeSlice,
+		SliceSize:     "8m",
+		Validity:      "30d",
+		ReadTimeout:   "600s",
+		Quirks:        []string{"Only the plain HTTP update endpoints are cacheable; the App Store API is HTTPS"},
+	},
+	{
+		Name:          "linux-mirrors",
+		Description:   "Ubuntu and Debian package mirrors",
+		Hostnames:     []string{"archive.ubuntu.com", "*.archive.ubuntu.com", "security.ubuntu.com", "deb.debian.org", "security.debian.org", "ftp.debian.org", "*.ftp.debian.org"},
+		KeyStrategy:   KeyURI,
+		RangeHandling: RangeFull,
+		Validity:      "30d",
+		ReadTimeout:   "300s",
+		ShortLived:    `/(InRelease|Release(\.gpg)?|Packages(\.(gz|xz|bz2))?|Sources(\.(gz|xz))?|Translation-[^/]+|Contents-[^/]+)$`,
+		ShortValidity: "5m",
+		Quirks:        []string{"Repository indexes change in place and must expire quickly or apt reports hash sum mismatches; .deb files never change"},
+	},
+	{
+		Name:          "playstation",
+		Description:   "Sony PlayStation Network downloads",
+		Hostnames:     []string{"gs2.ww.prod.dl.playstation.net", "*.gs2.ww.prod.dl.playstation.net", "gst.prod.dl.playstation.net", "gs2-ww-prod.psn.akadns.net", "uef.np.dl.playstation.net", "pls.patch.station.sony.com"},
+		KeyStrategy:   KeyPath,
+		RangeHandling: RangeSlice,
+		SliceSize:     "8m",
+		Validity:      "365d",
+		ReadTimeout:   "600s",
+		Quirks:        []string{"Consoles download with parallel range requests and tokenized query strings"},
+	},
+	{
+		Name:          "xbox",
+		Description:   "Microsoft Xbox Live content",
+		Hostnames:     []string{"assets1.xboxlive.com", "assets2.xboxlive.com", "dlassets.xboxlive.com", "dlassets2.xboxlive.com", "xvcf1.xboxlive.com", "xvcf2.xboxlive.com", "d1.xboxlive.com"},
+		KeyStrategy:   KeyPath,
+		RangeHandling: RangeSlice,
+		SliceSize:     "8m",
+		Validity:      "365d",
+		ReadTimeout:   "600s",
+		Quirks:        []string{"Package files are served with short-lived query tokens"},
+	},
+}
+
+// Library returns every built-in profile
+func Library() []Profile {
+	out := make([]Profile, len(library))
+	copy(out, library)
+	return out
+}
+
+// Get returns the built-in profile with the given name
+func Get(name string) (Profile, bool) {
+	for _, p := range library {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Profile{}, false
+}
+
+// Enabled resolves profile names from the config, failing on unknown names
+func Enabled(names []string) ([]Profile, error) {
+	var profiles []Profile
+	var unknown []string
+	for _, name := range names {
+		p, ok := Get(name)
+		if !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+		profiles = append(profiles, p)
+	}
+	if len(unknown) > 0 {
+		return profiles, fmt.Errorf("unknown CDN profiles: %s", strings.Join(unknown, ", "))
+	}
+	return profiles, nil
+}
+
+// Names lists the built-in profile names
+func Names() []string {
+	names := make([]string, 0, len(library))
+	for _, p := range library {
+		names = append(names, p.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CacheKey returns the nginx proxy_cache_key for the profile's strategy
+func (p Profile) CacheKey() string {
+	var key string
+	switch p.KeyStrategy {
+	case KeyPath:
+		key = "$host$uri"
+	case KeyShared:
+		key = p.Name + "$uri"
+	default:
+		key = "$host$uri$is_args$args"
+	}
+	if p.RangeHandling == RangeSlice {
+		key += "$slice_range"
+	}
+	return key
+}
+
+// ServerProfile converts the profile into an nginx server block
+func (p Profile) ServerProfile() nginx.ServerProfile {
+	sp := nginx.ServerProfile{
+		Name:                p.Name,
+		Hostnames:           p.Hostnames,
+		CacheKey:            p.CacheKey(),
+		Validity:            p.Validity,
+		ReadTimeout:         p.ReadTimeout,
+		UseStale:            "error timeout updating",
+		IgnoreOriginHeaders: p.IgnoreOriginHeaders,
+		ShortLived:          p.ShortLived,
+		ShortValidity:       p.ShortValidity,
+	}
+	if p.RangeHandling == RangeSlice {
+		sp.SliceSize = p.SliceSize
+		sp.RangeHeader = "$slice_range"
+	}
+	return sp
+}
+
+// ServerProfiles converts a list of profiles into nginx server blocks
+func ServerProfiles(profiles []Profile) []nginx.ServerProfile {
+	out := make([]nginx.ServerProfile, 0, len(profiles))
+	for _, p := range profiles {
+		out = append(out, p.ServerProfile())
+	}
+	return out
+}
+
+// LancacheLogs returns the lancache per-service log paths for the profiles
+func LancacheLogs(dir string, profiles []Profile) []string {
+	var logs []string
+	for _, p := range profiles {
+		if p.LancacheLog != "" {
+			logs = append(logs, fmt.Sprintf("%s/%s.log", dir, p.LancacheLog))
+		}
+	}
+	return logs
+}
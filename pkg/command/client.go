@@ -0,0 +1,207 @@
+package command
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client keeps the command channel to the SaaS open, preferring WebSocket
+// and falling back to HTTP long-poll when upgrades fail. Only commands
+// signed with PublicKey's private half and addressed to this agent are run.
+type Client struct {
+	BaseURL     string
+	Credentials Credentials
+	Dispatcher  *Dispatcher
+	PublicKey   ed25519.PublicKey
+	// TLSConfig overrides the system roots, mainly for tests
+	TLSConfig *tls.Config
+
+	UseWebSocket bool
+	// WebSocketRetry is how long to stay on long-poll before retrying WebSocket
+	WebSocketRetry time.Duration
+	MaxBackoff     time.Duration
+
+	Logger *slog.Logger
+
+	mu      sync.Mutex
+	current Transport
+	outbox  []Message
+}
+
+// maxOutbox bounds results kept while the SaaS is unreachable
+const maxOutbox = 100
+
+func NewClient(baseURL string, creds Credentials, dispatcher *Dispatcher, publicKey ed25519.PublicKey) *Client {
+	return &Client{
+		BaseURL:        baseURL,
+		Credentials:    creds,
+		Dispatcher:     dispatcher,
+		PublicKey:      publicKey,
+		UseWebSocket:   true,
+		WebSocketRetry: 10 * time.Minute,
+		MaxBackoff:     5 * time.Minute,
+		Logger:         slog.Default(),
+	}
+}
+
+// Run serves commands until ctx is cancelled. It refuses to start without a
+// public key or over plain HTTP.
+func (c *Client) Run(ctx context.Context) {
+	if len(c.PublicKey) != ed25519.PublicKeySize {
+		c.Logger.Error("command channel disabled", "error", ErrNoPublicKey)
+		return
+	}
+	if !strings.HasPrefix(c.BaseURL, "https://") {
+		c.Logger.Error("command channel disabled", "error", ErrInsecure)
+		return
+	}
+
+	backoff := time.Second
+	var pollUntil time.Time
+
+	for ctx.Err() == nil {
+		var transport Transport
+		name := "longpoll"
+
+		if c.UseWebSocket && time.Now().After(pollUntil) {
+			ws, err := DialWebSocket(ctx, c.BaseURL, c.Credentials, c.TLSConfig)
+			if err == nil {
+				transport, name = ws, "websocket"
+			} else {
+				c.reportError(err)
+				pollUntil = time.Now().Add(c.WebSocketRetry)
+			}
+		}
+		if transport == nil {
+			transport = NewLongPoll(c.BaseURL, c.Credentials, c.TLSConfig)
+		}
+
+		c.Logger.Info("command channel connected", "transport", name)
+		received := c.serve(ctx, transport)
+		transport.Close()
+
+		if received {
+			backoff = time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > c.MaxBackoff {
+			backoff = c.MaxBackoff
+		}
+	}
+}
+
+// serve reads commands until the transport fails and reports whether any receive succeeded
+func (c *Client) serve(ctx context.Context, transport Transport) bool {
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if ws, ok := transport.(*WebSocket); ok {
+		go keepAlive(connCtx, ws)
+	}
+
+	c.mu.Lock()
+	c.current = transport
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.current = nil
+		c.mu.Unlock()
+	}()
+	c.flush(ctx, transport)
+
+	received := false
+	for {
+		commands, err := transport.Receive(connCtx)
+		if err != nil {
+			if ctx.Err() == nil {
+				c.reportError(err)
+			}
+			return received
+		}
+		received = true
+
+		for _, signed := range commands {
+			cmd, err := signed.Verify(c.PublicKey, c.Credentials.HWID)
+			if err != nil {
+				c.Logger.Warn("rejected command", "id", signed.commandID(), "error", err)
+				c.send(Message{Type: "ack", Ack: &Ack{CommandID: signed.commandID(), Status: AckRejected, Error: err.Error()}})
+				continue
+			}
+			// Commands outlive the connection so a reconnect does not abort them
+			go c.Dispatcher.Dispatch(ctx, cmd, c.send)
+		}
+	}
+}
+
+// send delivers a message on the current connection; undelivered results are kept for the next one
+func (c *Client) send(msg Message) {
+	c.mu.Lock()
+	transport := c.current
+	c.mu.Unlock()
+
+	if transport != nil {
+		err := transport.Send(context.Background(), msg)
+		if err == nil {
+			return
+		}
+		c.reportError(err)
+	}
+	if msg.Type == "result" {
+		c.queue(msg)
+	}
+}
+
+func keepAlive(ctx context.Context, ws *WebSocket) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if ws.Ping() != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *Client) queue(msg Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.outbox = append(c.outbox, msg)
+	if len(c.outbox) > maxOutbox {
+		c.outbox = c.outbox[len(c.outbox)-maxOutbox:]
+	}
+}
+
+// flush resends results that could not be delivered earlier
+func (c *Client) flush(ctx context.Context, transport Transport) {
+	c.mu.Lock()
+	pending := c.outbox
+	c.outbox = nil
+	c.mu.Unlock()
+
+	for i, msg := range pending {
+		if err := transport.Send(ctx, msg); err != nil {
+			c.mu.Lock()
+			c.outbox = append(pending[i:], c.outbox...)
+			c.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (c *Client) reportError(err error) {
+	c.Logger.Warn("command channel error", "error", err)
+}
@@ -0,0 +1,406 @@
+package command
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testHWID = "hwid-test"
+
+// stubSaaS is the server side of the command channel. It hands out the
+// queued commands once, over WebSocket or long-poll, and collects every
+// message the agent sends back.
+type stubSaaS struct {
+	websocket bool
+
+	mu       sync.Mutex
+	pending  []SignedCommand
+	messages []Message
+	received chan Message
+}
+
+func newStubSaaS(websocket bool, commands ...SignedCommand) *stubSaaS {
+	return &stubSaaS{websocket: websocket, pending: commands, received: make(chan Message, 64)}
+}
+
+func (s *stubSaaS) take() []SignedCommand {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	commands := s.pending
+	s.pending = nil
+	return commands
+}
+
+func (s *stubSaaS) record(msg Message) {
+	s.mu.Lock()
+	s.messages = append(s.messages, msg)
+	s.mu.Unlock()
+	s.received <- msg
+}
+
+func (s *stubSaaS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Agent-HWID") != testHWID || r.Header.Get("X-Agent-Signature") == "" {
+		http.Error(w, "unauthenticated", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/api/agents/commands/ws":
+		if !s.websocket {
+			http.Error(w, "websocket disabled", http.StatusBadRequest)
+			return
+		}
+		s.serveWebSocket(w, r)
+	case "/api/agents/commands/poll":
+		commands := s.take()
+		if len(commands) == 0 {
+			time.Sleep(50 * time.Millisecond)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "commands": commands})
+	case "/api/agents/commands/messages":
+		var msg Message
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.record(msg)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *stubSaaS) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	sum := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + websocketGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	rw.Flush()
+
+	for _, cmd := range s.take() {
+		data, _ := json.Marshal(cmd)
+		writeServerFrame(rw.Writer, opText, data)
+	}
+	rw.Flush()
+
+	for {
+		opcode, payload, err := readClientFrame(rw.Reader)
+		if err != nil {
+			return
+		}
+		switch opcode {
+		case opText:
+			var msg Message
+			if json.Unmarshal(payload, &msg) == nil {
+				s.record(msg)
+			}
+		case opClose:
+			return
+		}
+	}
+}
+
+// writeServerFrame writes an unmasked frame, as servers do
+func writeServerFrame(w *bufio.Writer, opcode byte, payload []byte) {
+	w.WriteByte(0x80 | opcode)
+	if len(payload) < 126 {
+		w.WriteByte(byte(len(payload)))
+	} else {
+		w.WriteByte(126)
+		binary.Write(w, binary.BigEndian, uint16(len(payload)))
+	}
+	w.Write(payload)
+}
+
+// readClientFrame reads one masked frame sent by the agent
+func readClientFrame(r *bufio.Reader) (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	if header[1]&0x80 == 0 {
+		return 0, nil, errors.New("client frame not masked")
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext uint16
+		binary.Read(r, binary.BigEndian, &ext)
+		length = uint64(ext)
+	case 127:
+		binary.Read(r, binary.BigEndian, &length)
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(r, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return header[0] & 0x0F, payload, nil
+}
+
+// sign stamps cmd as issued now unless the test set issued_at itself
+func sign(t *testing.T, key ed25519.PrivateKey, cmd Command) SignedCommand {
+	t.Helper()
+	if cmd.IssuedAt.IsZero() {
+		cmd.IssuedAt = time.Now().UTC()
+	}
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return SignedCommand{Command: string(data), Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, data))}
+}
+
+// startClient runs a client against server until the test ends
+func startClient(t *testing.T, server *httptest.Server, publicKey ed25519.PublicKey) {
+	t.Helper()
+
+	dispatcher := NewDispatcher()
+	dispatcher.Handle("echo", func(ctx context.Context, cmd *Command, logf Logf) (interface{}, error) {
+		logf("echoing %s", cmd.Args["text"])
+		return cmd.Args["text"], nil
+	})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	client := NewClient(server.URL, Credentials{HWID: testHWID, LicenseKey: "key"}, dispatcher, publicKey)
+	client.TLSConfig = &tls.Config{RootCAs: roots}
+	client.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		client.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// await collects messages until want results arrived
+func await(t *testing.T, stub *stubSaaS, want int) map[string][]Message {
+	t.Helper()
+
+	byCommand := make(map[string][]Message)
+	results := 0
+	timeout := time.After(10 * time.Second)
+	for results < want {
+		select {
+		case msg := <-stub.received:
+			var id string
+			switch msg.Type {
+			case "ack":
+				id = msg.Ack.CommandID
+				if msg.Ack.Status == AckRejected {
+					results++
+				}
+			case "log":
+				id = msg.Log.CommandID
+			case "result":
+				id = msg.Result.CommandID
+				results++
+			}
+			byCommand[id] = append(byCommand[id], msg)
+		case <-timeout:
+			t.Fatalf("timed out with %d of %d results: %+v", results, want, byCommand)
+		}
+	}
+	return byCommand
+}
+
+func TestClient(t *testing.T) {
+	publicKey, privateKey, _ := ed25519.GenerateKey(nil)
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+
+	tests := []struct {
+		name      string
+		websocket bool
+	}{
+		{"websocket", true},
+		{"long-poll fallback", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newStubSaaS(tt.websocket,
+				sign(t, privateKey, Command{ID: "ok", Agent: testHWID, Type: "echo", Args: map[string]string{"text": "hi"}}),
+				sign(t, otherKey, Command{ID: "forged", Agent: testHWID, Type: "echo"}),
+				sign(t, privateKey, Command{ID: "elsewhere", Agent: "other-hwid", Type: "echo"}),
+				sign(t, privateKey, Command{ID: "stale", Agent: testHWID, Type: "echo", IssuedAt: time.Now().Add(-time.Hour)}),
+				sign(t, privateKey, Command{ID: "expired", Agent: testHWID, Type: "echo", Deadline: time.Now().Add(-time.Second)}),
+			)
+			server := httptest.NewTLSServer(stub)
+			defer server.Close()
+
+			// The client always tries WebSocket first; the stub rejects the
+			// upgrade to force the long-poll fallback
+			startClient(t, server, publicKey)
+			messages := await(t, stub, 5)
+
+			ok := messages["ok"]
+			if len(ok) != 3 {
+				t.Fatalf("ok: got %d messages, want ack, log and result: %+v", len(ok), ok)
+			}
+			if ok[0].Type != "ack" || ok[0].Ack.Status != AckAccepted {
+				t.Errorf("ok: first message %+v, want accepted ack", ok[0])
+			}
+			if ok[1].Type != "log" || ok[1].Log.Line != "echoing hi" {
+				t.Errorf("ok: second message %+v, want log line", ok[1])
+			}
+			if r := ok[2].Result; ok[2].Type != "result" || r.Status != StatusSucceeded || r.Output != "hi" {
+				t.Errorf("ok: last message %+v, want succeeded result", ok[2])
+			}
+
+			for id, reason := range map[string]error{"forged": ErrBadSignature, "elsewhere": ErrWrongAgent, "stale": ErrStale, "expired": ErrExpired} {
+				got := messages[id]
+				if len(got) != 1 || got[0].Type != "ack" || got[0].Ack.Status != AckRejected || got[0].Ack.Error != reason.Error() {
+					t.Errorf("%s: got %+v, want a single rejected ack (%v)", id, got, reason)
+				}
+			}
+		})
+	}
+}
+
+func TestClientRefusesPlainHTTP(t *testing.T) {
+	publicKey, privateKey, _ := ed25519.GenerateKey(nil)
+
+	stub := newStubSaaS(true, sign(t, privateKey, Command{ID: "ok", Agent: testHWID, Type: "echo"}))
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	client := NewClient(server.URL, Credentials{HWID: testHWID}, NewDispatcher(), publicKey)
+	client.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	done := make(chan struct{})
+	go func() {
+		client.Run(context.Background())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client kept running against a plain HTTP URL")
+	}
+	if len(stub.take()) != 1 {
+		t.Error("client fetched commands over plain HTTP")
+	}
+
+	if _, err := DialWebSocket(context.Background(), server.URL, Credentials{}, nil); !errors.Is(err, ErrInsecure) {
+		t.Errorf("DialWebSocket over http: got %v, want ErrInsecure", err)
+	}
+}
+
+func TestDispatchDuplicateAndPanic(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	d := NewDispatcher()
+	d.Handle("block", func(ctx context.Context, cmd *Command, logf Logf) (interface{}, error) {
+		close(started)
+		<-release
+		return nil, nil
+	})
+	d.Handle("panic", func(ctx context.Context, cmd *Command, logf Logf) (interface{}, error) {
+		panic("boom")
+	})
+
+	var mu sync.Mutex
+	var sent []Message
+	send := func(msg Message) {
+		mu.Lock()
+		sent = append(sent, msg)
+		mu.Unlock()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		d.Dispatch(context.Background(), &Command{ID: "a", Type: "block", IdempotencyKey: "k"}, send)
+		close(done)
+	}()
+	<-started
+	d.Dispatch(context.Background(), &Command{ID: "b", Type: "block", IdempotencyKey: "k"}, send)
+	close(release)
+	<-done
+
+	d.Dispatch(context.Background(), &Command{ID: "c", Type: "panic"}, send)
+
+	tests := []struct {
+		id, typ, status string
+	}{
+		{"a", "ack", AckAccepted},
+		{"b", "ack", AckDuplicate},
+		{"a", "result", StatusSucceeded},
+		{"c", "ack", AckAccepted},
+		{"c", "result", StatusFailed},
+	}
+	if len(sent) != len(tests) {
+		t.Fatalf("got %d messages, want %d: %+v", len(sent), len(tests), sent)
+	}
+	for i, tt := range tests {
+		msg := sent[i]
+		var id, status string
+		switch msg.Type {
+		case "ack":
+			id, status = msg.Ack.CommandID, msg.Ack.Status
+		case "result":
+			id, status = msg.Result.CommandID, msg.Result.Status
+		}
+		if msg.Type != tt.typ || id != tt.id || status != tt.status {
+			t.Errorf("message %d: got %s %s %s, want %s %s %s", i, msg.Type, id, status, tt.typ, tt.id, tt.status)
+		}
+	}
+	if got := sent[4].Result.Error; got != "handler panicked: boom" {
+		t.Errorf("panic result error = %q", got)
+	}
+}
+
+func TestVerifyRequiresIssuedAt(t *testing.T) {
+	publicKey, privateKey, _ := ed25519.GenerateKey(nil)
+
+	data := []byte(`{"id":"undated","agent":"` + testHWID + `","type":"echo"}`)
+	undated := SignedCommand{Command: string(data), Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, data))}
+	if _, err := undated.Verify(publicKey, testHWID); !errors.Is(err, ErrUndated) {
+		t.Errorf("undated command: got %v, want ErrUndated", err)
+	}
+
+	future := sign(t, privateKey, Command{ID: "future", Agent: testHWID, Type: "echo", IssuedAt: time.Now().Add(time.Hour)})
+	if _, err := future.Verify(publicKey, testHWID); !errors.Is(err, ErrStale) {
+		t.Errorf("command issued in the future: got %v, want ErrStale", err)
+	}
+
+	fresh := sign(t, privateKey, Command{ID: "fresh", Agent: testHWID, Type: "echo", Deadline: time.Now().Add(time.Minute)})
+	if _, err := fresh.Verify(publicKey, testHWID); err != nil {
+		t.Errorf("fresh command: %v", err)
+	}
+}
@@ -0,0 +1,230 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Command is an instruction sent by the SaaS to this agent
+type Command struct {
+	ID string `json:"id"`
+	// Agent is the hardware ID of the agent the command is meant for
+	Agent          string            `json:"agent"`
+	Type           string            `json:"type"`
+	Args           map[string]string `json:"args,omitempty"`
+	IssuedAt       time.Time         `json:"issued_at"`
+	Deadline       time.Time         `json:"deadline,omitempty"`
+	IdempotencyKey string            `json:"idempotency_key,omitempty"`
+}
+
+// Result statuses
+const (
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+	StatusExpired   = "expired"
+	StatusRejected  = "rejected"
+)
+
+// Result is reported back once a command finished
+type Result struct {
+	CommandID      string      `json:"command_id"`
+	IdempotencyKey string      `json:"idempotency_key,omitempty"`
+	Status         string      `json:"status"`
+	Output         interface{} `json:"output,omitempty"`
+	Error          string      `json:"error,omitempty"`
+	StartedAt      time.Time   `json:"started_at"`
+	FinishedAt     time.Time   `json:"finished_at"`
+	// Duplicate is set when the result was replayed for a repeated idempotency key
+	Duplicate bool `json:"duplicate,omitempty"`
+}
+
+// Ack statuses
+const (
+	AckAccepted  = "accepted"
+	AckDuplicate = "duplicate"
+	AckRejected  = "rejected"
+)
+
+// Ack confirms that a command arrived, before it runs. Commands that are
+// not run, such as duplicates or ones failing verification, are acked
+// with the reason.
+type Ack struct {
+	CommandID string `json:"command_id"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+}
+
+// LogLine is streamed while a command runs
+type LogLine struct {
+	CommandID string    `json:"command_id"`
+	Time      time.Time `json:"time"`
+	Line      string    `json:"line"`
+}
+
+// Message is the envelope sent from the agent to the SaaS
+type Message struct {
+	Type   string   `json:"type"` // "ack", "result" or "log"
+	Ack    *Ack     `json:"ack,omitempty"`
+	Result *Result  `json:"result,omitempty"`
+	Log    *LogLine `json:"log,omitempty"`
+}
+
+// Logf streams a log line for the running command
+type Logf func(format string, args ...interface{})
+
+// Handler executes one command type
+type Handler func(ctx context.Context, cmd *Command, logf Logf) (interface{}, error)
+
+var ErrUnknownType = errors.New("unknown command type")
+
+// Dispatcher runs commands through registered handlers, at most once per idempotency key
+type Dispatcher struct {
+	mu       sync.Mutex
+	handlers map[string]Handler
+	seen     map[string]*Result
+	order    []string
+	inFlight map[string]bool
+
+	// MaxRemembered bounds how many idempotency keys are kept
+	MaxRemembered int
+}
+
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{
+		handlers:      make(map[string]Handler),
+		seen:          make(map[string]*Result),
+		inFlight:      make(map[string]bool),
+		MaxRemembered: 1000,
+	}
+}
+
+// Handle registers the handler for a command type
+func (d *Dispatcher) Handle(commandType string, h Handler) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.handlers[commandType] = h
+}
+
+// Types lists the registered command types
+func (d *Dispatcher) Types() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	types := make([]string, 0, len(d.handlers))
+	for t := range d.handlers {
+		types = append(types, t)
+	}
+	return types
+}
+
+// Dispatch acks cmd, runs it and sends its logs and result through send.
+// A command whose idempotency key is already running is acked as a
+// duplicate and not run again.
+func (d *Dispatcher) Dispatch(ctx context.Context, cmd *Command, send func(Message)) {
+	key := cmd.IdempotencyKey
+	if key == "" {
+		key = cmd.ID
+	}
+
+	d.mu.Lock()
+	if prev, ok := d.seen[key]; ok {
+		d.mu.Unlock()
+		replay := *prev
+		replay.CommandID = cmd.ID
+		replay.Duplicate = true
+		send(Message{Type: "result", Result: &replay})
+		return
+	}
+	if d.inFlight[key] {
+		d.mu.Unlock()
+		send(Message{Type: "ack", Ack: &Ack{
+			CommandID: cmd.ID,
+			Status:    AckDuplicate,
+			Error:     fmt.Sprintf("command with idempotency key %q is already running", key),
+		}})
+		return
+	}
+	d.inFlight[key] = true
+	handler := d.handlers[cmd.Type]
+	d.mu.Unlock()
+
+	send(Message{Type: "ack", Ack: &Ack{CommandID: cmd.ID, Status: AckAccepted}})
+
+	result := d.run(ctx, cmd, handler, send)
+	result.IdempotencyKey = cmd.IdempotencyKey
+
+	d.mu.Lock()
+	delete(d.inFlight, key)
+	d.remember(key, result)
+	d.mu.Unlock()
+
+	send(Message{Type: "result", Result: result})
+}
+
+func (d *Dispatcher) run(ctx context.Context, cmd *Command, handler Handler, send func(Message)) *Result {
+	result := &Result{CommandID: cmd.ID, StartedAt: time.Now().UTC()}
+	defer func() { result.FinishedAt = time.Now().UTC() }()
+
+	if handler == nil {
+		result.Status = StatusRejected
+		result.Error = fmt.Sprintf("%v: %s", ErrUnknownType, cmd.Type)
+		return result
+	}
+
+	if !cmd.Deadline.IsZero() {
+		if time.Now().After(cmd.Deadline) {
+			result.Status = StatusExpired
+			result.Error = "deadline passed before execution"
+			return result
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, cmd.Deadline)
+		defer cancel()
+	}
+
+	logf := func(format string, args ...interface{}) {
+		send(Message{Type: "log", Log: &LogLine{
+			CommandID: cmd.ID,
+			Time:      time.Now().UTC(),
+			Line:      fmt.Sprintf(format, args...),
+		}})
+	}
+
+	output, err := call(ctx, handler, cmd, logf)
+	result.Output = output
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded):
+		result.Status = StatusExpired
+		result.Error = "deadline exceeded"
+	case err != nil:
+		result.Status = StatusFailed
+		result.Error = err.Error()
+	default:
+		result.Status = StatusSucceeded
+	}
+	return result
+}
+
+// call runs handler, turning a panic into an error so one broken handler
+// cannot take the agent down
+func call(ctx context.Context, handler Handler, cmd *Command, logf Logf) (output interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			output, err = nil, fmt.Errorf("handler panicked: %v", r)
+		}
+	}()
+	return handler(ctx, cmd, logf)
+}
+
+// remember stores a finished result, evicting the oldest keys; d.mu must be held
+func (d *Dispatcher) remember(key string, result *Result) {
+	d.seen[key] = result
+	d.order = append(d.order, key)
+	for len(d.order) > d.MaxRemembered {
+		delete(d.seen, d.order[0])
+		d.order = d.order[1:]
+	}
+}
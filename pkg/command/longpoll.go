@@ -0,0 +1,109 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// LongPoll receives commands by holding a GET open until the SaaS has work.
+// Like the WebSocket it only talks to an https BaseURL.
+type LongPoll struct {
+	BaseURL     string
+	Credentials Credentials
+	Wait        time.Duration
+	client      *http.Client
+}
+
+// NewLongPoll creates the fallback transport; tlsConfig may be nil to use
+// the system roots
+func NewLongPoll(baseURL string, creds Credentials, tlsConfig *tls.Config) *LongPoll {
+	wait := 30 * time.Second
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &LongPoll{
+		BaseURL:     baseURL,
+		Credentials: creds,
+		Wait:        wait,
+		client:      &http.Client{Timeout: wait + 15*time.Second, Transport: transport},
+	}
+}
+
+type pollResponse struct {
+	Success  bool            `json:"success"`
+	Commands []SignedCommand `json:"commands"`
+	Error    string          `json:"error"`
+}
+
+func (p *LongPoll) Receive(ctx context.Context) ([]SignedCommand, error) {
+	if !strings.HasPrefix(p.BaseURL, "https://") {
+		return nil, ErrInsecure
+	}
+	url := fmt.Sprintf("%s/api/agents/commands/poll?wait=%d", p.BaseURL, int(p.Wait.Seconds()))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	p.Credentials.apply(req)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("poll failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("poll returned %s", resp.Status)
+	}
+
+	var result pollResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to parse commands: %w", err)
+	}
+	if !result.Success && result.Error != "" {
+		return nil, fmt.Errorf("poll error: %s", result.Error)
+	}
+	return result.Commands, nil
+}
+
+func (p *LongPoll) Send(ctx context.Context, msg Message) error {
+	if !strings.HasPrefix(p.BaseURL, "https://") {
+		return ErrInsecure
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/api/agents/commands/messages", p.BaseURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	p.Credentials.apply(req)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send %s: %w", msg.Type, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("sending %s returned %s", msg.Type, resp.Status)
+	}
+	return nil
+}
+
+func (p *LongPoll) Close() error {
+	p.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,77 @@
+package command
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrNoPublicKey  = errors.New("no public key to verify commands with")
+	ErrBadSignature = errors.New("command signature does not verify")
+	ErrWrongAgent   = errors.New("command is addressed to another agent")
+	ErrUndated      = errors.New("command carries no issued_at")
+	ErrStale        = errors.New("command was issued too long ago or in the future")
+	ErrExpired      = errors.New("command deadline has passed")
+)
+
+const (
+	// MaxCommandAge bounds how long after issued_at a command is accepted, so
+	// a captured command cannot be replayed once the dispatcher forgot its ID
+	MaxCommandAge = 10 * time.Minute
+	// maxClockSkew tolerates an issued_at slightly ahead of the local clock
+	maxClockSkew = 2 * time.Minute
+)
+
+// SignedCommand is a command as delivered by the SaaS: the command JSON and
+// the base64 Ed25519 signature of exactly those bytes, made with the license
+// signing key. Commands are only decoded from the signed bytes, so nothing
+// outside the signature can change what runs.
+type SignedCommand struct {
+	Command   string `json:"command"`
+	Signature string `json:"signature"`
+}
+
+// Verify checks the signature, that the command targets hwid and that it
+// is recent and not past its deadline
+func (s SignedCommand) Verify(publicKey ed25519.PublicKey, hwid string) (*Command, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, ErrNoPublicKey
+	}
+	signature, err := base64.StdEncoding.DecodeString(s.Signature)
+	if err != nil || !ed25519.Verify(publicKey, []byte(s.Command), signature) {
+		return nil, ErrBadSignature
+	}
+
+	var cmd Command
+	if err := json.Unmarshal([]byte(s.Command), &cmd); err != nil {
+		return nil, fmt.Errorf("failed to parse command: %w", err)
+	}
+	if cmd.Agent != hwid {
+		return nil, ErrWrongAgent
+	}
+
+	now := time.Now()
+	switch {
+	case cmd.IssuedAt.IsZero():
+		return nil, ErrUndated
+	case now.Sub(cmd.IssuedAt) > MaxCommandAge, cmd.IssuedAt.Sub(now) > maxClockSkew:
+		return nil, ErrStale
+	case !cmd.Deadline.IsZero() && now.After(cmd.Deadline):
+		return nil, ErrExpired
+	}
+	return &cmd, nil
+}
+
+// commandID extracts the ID from an unverified command so a rejection can
+// be reported against it
+func (s SignedCommand) commandID() string {
+	var cmd struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal([]byte(s.Command), &cmd)
+	return cmd.ID
+}
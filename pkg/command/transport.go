@@ -0,0 +1,51 @@
+package command
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ErrInsecure is returned for a SaaS URL that is not https; commands are
+// never received over plain HTTP
+var ErrInsecure = errors.New("command channel requires an https SaaS URL")
+
+// Transport carries commands from the SaaS and messages back to it
+type Transport interface {
+	// Receive blocks until commands arrive, the connection fails or ctx is done
+	Receive(ctx context.Context) ([]SignedCommand, error)
+	Send(ctx context.Context, msg Message) error
+	Close() error
+}
+
+// Credentials authenticate the agent on the command channel
+type Credentials struct {
+	HWID       string
+	LicenseKey string
+}
+
+// Headers returns the agent identity headers.
+// The signature is an HMAC-SHA256 of "<hwid>\n<unix timestamp>" keyed with the license key.
+func (c Credentials) Headers() http.Header {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+
+	mac := hmac.New(sha256.New, []byte(c.LicenseKey))
+	mac.Write([]byte(c.HWID + "\n" + ts))
+
+	h := http.Header{}
+	h.Set("X-Agent-HWID", c.HWID)
+	h.Set("X-Agent-Timestamp", ts)
+	h.Set("X-Agent-Signature", hex.EncodeToString(mac.Sum(nil)))
+	return h
+}
+
+func (c Credentials) apply(req *http.Request) {
+	for k, v := range c.Headers() {
+		req.Header[k] = v
+	}
+}
@@ -0,0 +1,424 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+const DefaultPath = "/etc/isp-agent/config.json"
+
+type Config struct {
+	SaaSURL      string          `json:"saas_url"`
+	StatusListen string          `json:"status_listen"`
+	License      LicenseConfig   `json:"license"`
+	HWID         HWIDConfig      `json:"hwid"`
+	Nginx        NginxConfig     `json:"nginx"`
+	Features     FeaturesConfig  `json:"features"`
+	Commands     CommandsConfig  `json:"commands"`
+	ConfigSync   SyncConfig      `json:"config_sync"`
+	DNS          DNSConfig       `json:"dns"`
+	Health       HealthConfig    `json:"health"`
+	Analytics    AnalyticsConfig `json:"analytics"`
+	GeoIP        GeoIPConfig     `json:"geoip"`
+	History      HistoryConfig   `json:"history"`
+	Backfill     BackfillConfig  `json:"backfill"`
+	Logging      LoggingConfig   `json:"logging"`
+	LogShipping  LogShipConfig   `json:"log_shipping"`
+	Alerting     AlertingConfig  `json:"alerting"`
+	// CDNProfiles names the built-in CDN profiles to cache
+	CDNProfiles []string `json:"cdn_profiles"`
+}
+
+type LicenseConfig struct {
+	// PublicKey overrides the built-in base64 Ed25519 key that verifies license tokens
+	PublicKey         string `json:"public_key"`
+	GracePeriodHours  int    `json:"grace_period_hours"`
+	WarnDays          int    `json:"warn_days"`
+	RevalidateMinutes int    `json:"revalidate_minutes"`
+}
+
+type HWIDConfig struct {
+	// MaxDrift is how many hardware components may change before a new HWID is generated
+	MaxDrift int `json:"max_drift"`
+}
+
+type NginxConfig struct {
+	// ListenAddr is where the cache accepts subscriber traffic
+	ListenAddr  string `json:"listen_addr"`
+	CachePath   string `json:"cache_path"`
+	CacheLevels string `json:"cache_levels"`
+	AccessLog   string `json:"access_log"`
+
+	// Managed config generation
+	Resolvers        []string `json:"resolvers"`
+	CacheDiskPercent int      `json:"cache_disk_percent"`
+	SitesAvailable   string   `json:"sites_available"`
+	SitesEnabled     string   `json:"sites_enabled"`
+
+	// StatusPath is the localhost-only stub_status location; empty disables it
+	StatusPath string `json:"status_path"`
+	// VTS enables the nginx-module-vts status location (the module must be installed)
+	VTS bool `json:"vts"`
+	// PlusAPI is the nginx Plus API location, e.g. "/api", when running nginx Plus
+	PlusAPI string `json:"plus_api"`
+	// Syslog receives access logs over syslog instead of from AccessLog
+	Syslog AccessSyslogConfig `json:"syslog"`
+	// Discover reads cache zones and server blocks of every nginx instance with nginx -T
+	Discover bool `json:"discover"`
+	// JSONLog maps the keys of JSON access logs (log_format escape=json)
+	JSONLog JSONLogConfig `json:"json_log"`
+}
+
+// JSONLogConfig maps record fields to JSON keys, e.g. {"cache_status": "cache"}
+type JSONLogConfig struct {
+	Fields map[string]string `json:"fields"`
+	// Detect derives the mapping from the access log's log_format in nginx -T;
+	// Fields still take precedence
+	Detect bool `json:"detect"`
+}
+
+// AccessSyslogConfig runs a syslog receiver for access_log syslog:server=...
+type AccessSyslogConfig struct {
+	Enabled bool `json:"enabled"`
+	// Listen is a UDP host:port and Socket a unix datagram socket; either may be empty
+	Listen string `json:"listen"`
+	Socket string `json:"socket"`
+	// SocketGroup is the nginx worker group allowed to write to Socket;
+	// empty tries "nginx", then "www-data"
+	SocketGroup string `json:"socket_group"`
+	// QueueSize bounds the lines waiting for the parser; more are dropped
+	QueueSize int `json:"queue_size"`
+	// ConfigureNginx points the generated access_log at the receiver
+	ConfigureNginx bool `json:"configure_nginx"`
+}
+
+// Server returns the access_log syslog server for the receiver, preferring the socket
+func (c AccessSyslogConfig) Server() string {
+	if c.Socket != "" {
+		return "unix:" + c.Socket
+	}
+	return c.Listen
+}
+
+type FeaturesConfig struct {
+	TopDomainsLimit           int    `json:"top_domains_limit"`
+	TopDomainsIntervalMinutes int    `json:"top_domains_interval_minutes"`
+	PrometheusListen          string `json:"prometheus_listen"`
+}
+
+type CommandsConfig struct {
+	Enabled bool `json:"enabled"`
+	// WebSocket is tried first; long-poll is used when it is disabled or fails
+	WebSocket bool `json:"websocket"`
+}
+
+// SyncConfig controls pulling the desired nginx config from the SaaS
+type SyncConfig struct {
+	Enabled         bool `json:"enabled"`
+	IntervalMinutes int  `json:"interval_minutes"`
+}
+
+// DNSConfig controls the built-in responder that steers CDN names to the cache
+type DNSConfig struct {
+	Enabled bool   `json:"enabled"`
+	Listen  string `json:"listen"`
+	// CacheIPv4 and CacheIPv6 are returned for CDN hostnames; an empty family gets no records
+	CacheIPv4 []string `json:"cache_ipv4"`
+	CacheIPv6 []string `json:"cache_ipv6"`
+	// Upstreams resolve everything that is not steered, as host:port
+	Upstreams  []string `json:"upstreams"`
+	TTLSeconds int      `json:"ttl_seconds"`
+	// AllowedSubnets are the client networks answered, as CIDRs; others are ignored
+	AllowedSubnets []string `json:"allowed_subnets"`
+	// Workers bounds concurrently answered UDP queries
+	Workers int `json:"workers"`
+}
+
+// HealthConfig controls the nginx health monitor
+type HealthConfig struct {
+	IntervalSeconds int `json:"interval_seconds"`
+	// SlowMs marks the cache degraded when /health takes longer
+	SlowMs int `json:"slow_ms"`
+	// ProbePath is a cacheable test object that must come back as a HIT
+	ProbePath     string `json:"probe_path"`
+	FailThreshold int    `json:"fail_threshold"`
+	// RestartCommand runs once after FailThreshold failed checks, e.g. ["systemctl", "restart", "nginx"]
+	RestartCommand []string `json:"restart_command"`
+}
+
+// AnalyticsConfig controls per-subnet subscriber analytics
+type AnalyticsConfig struct {
+	// Subnets groups client ranges, e.g. {"name": "pop-north", "cidrs": ["100.64.0.0/16"]}
+	Subnets []SubnetGroup `json:"subnets"`
+	// TopClients reports the N busiest clients per interval; 0 disables it
+	TopClients int `json:"top_clients"`
+	// Anonymize is how clients are labelled: "truncate" (default), "hash" or "none"
+	Anonymize        string `json:"anonymize"`
+	TruncateIPv4Bits int    `json:"truncate_ipv4_bits"`
+	TruncateIPv6Bits int    `json:"truncate_ipv6_bits"`
+}
+
+type SubnetGroup struct {
+	Name  string   `json:"name"`
+	CIDRs []string `json:"cidrs"`
+}
+
+// GeoIPConfig points at local MaxMind-format databases; lookups never use the network
+type GeoIPConfig struct {
+	// CityDB is a GeoIP2/GeoLite2 City or Country database, used for client regions
+	CityDB string `json:"city_db"`
+	// ASNDB is a GeoLite2 ASN database, used for origin networks
+	ASNDB string `json:"asn_db"`
+}
+
+// HistoryConfig controls the local telemetry history
+type HistoryConfig struct {
+	Enabled bool   `json:"enabled"`
+	Dir     string `json:"dir"`
+	// MinuteRetentionDays keeps one sample per minute; older data survives as hourly rollups
+	MinuteRetentionDays int `json:"minute_retention_days"`
+	HourlyRetentionDays int `json:"hourly_retention_days"`
+	// MaxDiskMB caps the history directory; 0 means no limit
+	MaxDiskMB int `json:"max_disk_mb"`
+}
+
+// BackfillConfig controls uploading intervals the SaaS missed during an outage
+type BackfillConfig struct {
+	Enabled bool `json:"enabled"`
+	// BatchSize reports are uploaded per request, PauseSeconds apart
+	BatchSize    int `json:"batch_size"`
+	PauseSeconds int `json:"pause_seconds"`
+	// MaxAgeHours skips older intervals; minute history only covers history.minute_retention_days
+	MaxAgeHours int `json:"max_age_hours"`
+}
+
+// LoggingConfig controls the agent's own log output
+type LoggingConfig struct {
+	// Level is "debug", "info", "warn" or "error"
+	Level string `json:"level"`
+	// Format is "text", "json" or "journald"; empty uses journald fields when running under systemd
+	Format string `json:"format"`
+}
+
+// LogShipConfig controls sending nginx error logs and agent warnings to the SaaS
+type LogShipConfig struct {
+	Enabled   bool     `json:"enabled"`
+	ErrorLogs []string `json:"error_logs"`
+	// MinNginxLevel is the least severe nginx level shipped: "error", "warn", "notice", ...
+	MinNginxLevel string `json:"min_nginx_level"`
+	// AgentLogs ships the agent's own warnings and errors
+	AgentLogs    bool `json:"agent_logs"`
+	FlushSeconds int  `json:"flush_seconds"`
+	// MaxPerPattern limits distinct messages per pattern and flush; repeats are counted
+	MaxPerPattern int `json:"max_per_pattern"`
+	// RequestDetails ships the request path, Host and upstream of nginx errors
+	RequestDetails bool `json:"request_details"`
+}
+
+// AlertingConfig controls local alert rules, evaluated every IntervalSeconds
+type AlertingConfig struct {
+	Enabled         bool                         `json:"enabled"`
+	IntervalSeconds int                          `json:"interval_seconds"`
+	Rules           []AlertRuleConfig            `json:"rules"`
+	Actions         map[string]AlertActionConfig `json:"actions"`
+}
+
+// AlertRuleConfig fires when Expr has held for For ("15m") and resolves once
+// Resolve, or else the negation of Expr, has held for ResolveFor
+type AlertRuleConfig struct {
+	Name string `json:"name"`
+	// Expr is "<metric> <op> <number>", e.g. "hit_ratio < 0.2" or "delta(spool_depth, 30m) > 0"
+	Expr       string `json:"expr"`
+	For        string `json:"for"`
+	Resolve    string `json:"resolve"`
+	ResolveFor string `json:"resolve_for"`
+	Severity   string `json:"severity"`
+	Summary    string `json:"summary"`
+	// Actions names entries of AlertingConfig.Actions; empty notifies all
+	Actions []string `json:"actions"`
+}
+
+// AlertActionConfig is one notification target
+type AlertActionConfig struct {
+	// Type is "webhook", "email-file", "syslog", "exec" or "saas"
+	Type    string            `json:"type"`
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Dir receives one .eml file per notification for a local MTA to pick up
+	Dir  string   `json:"dir,omitempty"`
+	From string   `json:"from,omitempty"`
+	To   []string `json:"to,omitempty"`
+	// Network and Address select a remote syslog; empty uses the local daemon
+	Network        string   `json:"network,omitempty"`
+	Address        string   `json:"address,omitempty"`
+	Tag            string   `json:"tag,omitempty"`
+	Command        []string `json:"command,omitempty"`
+	TimeoutSeconds int      `json:"timeout_seconds,omitempty"`
+}
+
+// Default returns the configuration used when no config file exists
+func Default() *Config {
+	return &Config{
+		StatusListen: "127.0.0.1:8099",
+		CDNProfiles:  []string{"steam", "epic", "blizzard"},
+		HWID:         HWIDConfig{MaxDrift: 2},
+		Nginx: NginxConfig{
+			ListenAddr:  "127.0.0.1:80",
+			CachePath:   "/var/cache/nginx/isp-cache",
+			CacheLevels: "1:2",
+			AccessLog:   "/var/log/nginx/cache.log",
+
+			Resolvers:        []string{"8.8.8.8", "8.8.4.4", "1.1.1.1"},
+			CacheDiskPercent: 80,
+			SitesAvailable:   "/etc/nginx/sites-available",
+			SitesEnabled:     "/etc/nginx/sites-enabled",
+
+			StatusPath: "/nginx-status",
+			Syslog: AccessSyslogConfig{
+				Listen:    "127.0.0.1:5514",
+				QueueSize: 10000,
+			},
+			Discover: true,
+			JSONLog:  JSONLogConfig{Detect: true},
+		},
+		Features: FeaturesConfig{
+			TopDomainsLimit:           20,
+			TopDomainsIntervalMinutes: 15,
+			PrometheusListen:          "127.0.0.1:9145",
+		},
+		Commands: CommandsConfig{
+			Enabled:   false,
+			WebSocket: true,
+		},
+		ConfigSync: SyncConfig{
+			Enabled:         false,
+			IntervalMinutes: 10,
+		},
+		DNS: DNSConfig{
+			Listen:     ":53",
+			Upstreams:  []string{"8.8.8.8:53", "1.1.1.1:53"},
+			TTLSeconds: 60,
+			AllowedSubnets: []string{
+				"127.0.0.0/8", "::1/128",
+				"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7",
+			},
+			Workers: 64,
+		},
+		Health: HealthConfig{
+			IntervalSeconds: 15,
+			SlowMs:          1000,
+			ProbePath:       "/cache-probe",
+			FailThreshold:   3,
+		},
+		Analytics: AnalyticsConfig{
+			Anonymize:        "truncate",
+			TruncateIPv4Bits: 24,
+			TruncateIPv6Bits: 48,
+		},
+		History: HistoryConfig{
+			Enabled:             true,
+			Dir:                 "/var/lib/isp-agent/history",
+			MinuteRetentionDays: 7,
+			HourlyRetentionDays: 365,
+			MaxDiskMB:           512,
+		},
+		Backfill: BackfillConfig{
+			Enabled:      true,
+			BatchSize:    12,
+			PauseSeconds: 10,
+			MaxAgeHours:  168,
+		},
+		Logging: LoggingConfig{
+			Level: "info",
+		},
+		LogShipping: LogShipConfig{
+			Enabled:       true,
+			ErrorLogs:     []string{"/var/log/nginx/cache-error.log", "/var/log/nginx/error.log"},
+			MinNginxLevel: "warn",
+			AgentLogs:     true,
+			FlushSeconds:  30,
+			MaxPerPattern: 20,
+		},
+		Alerting: AlertingConfig{
+			Enabled:         true,
+			IntervalSeconds: 60,
+			Rules: []AlertRuleConfig{
+				{Name: "low_hit_ratio", Expr: "hit_ratio < 0.2", For: "15m", Resolve: "hit_ratio > 0.25", ResolveFor: "5m", Severity: "warning", Summary: "Cache hit ratio below 20%"},
+				{Name: "cache_disk_full", Expr: "cache_disk_percent > 95", For: "5m", Resolve: "cache_disk_percent < 90", Severity: "critical", Summary: "Cache disk above 95%"},
+				{Name: "nginx_down", Expr: "nginx_up == 0", For: "1m", Severity: "critical", Summary: "Nginx is not serving"},
+				{Name: "license_expiring", Expr: "license_days_left < 7", Resolve: "license_days_left >= 8", Severity: "warning", Summary: "License expires in less than 7 days"},
+				{Name: "spool_growing", Expr: "delta(spool_depth, 30m) > 0", Resolve: "delta(spool_depth, 30m) <= 0", Severity: "warning", Summary: "Unsent telemetry keeps growing"},
+			},
+			Actions: map[string]AlertActionConfig{
+				"saas":   {Type: "saas"},
+				"syslog": {Type: "syslog", Tag: "isp-agent"},
+			},
+		},
+		License: LicenseConfig{
+			GracePeriodHours:  72,
+			WarnDays:          14,
+			RevalidateMinutes: 5,
+		},
+	}
+}
+
+// Load reads the agent config, falling back to defaults for missing values
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+// GracePeriod returns how long the agent may run without reaching the SaaS, 72 hours when unset
+func (c LicenseConfig) GracePeriod() time.Duration {
+	if c.GracePeriodHours <= 0 {
+		return 72 * time.Hour
+	}
+	return time.Duration(c.GracePeriodHours) * time.Hour
+}
+
+// Interval returns how often alert rules are evaluated, once a minute when unset
+func (c AlertingConfig) Interval() time.Duration {
+	if c.IntervalSeconds <= 0 {
+		return time.Minute
+	}
+	return time.Duration(c.IntervalSeconds) * time.Second
+}
+
+// TopDomainsInterval returns how often top domains are reported, every 15 minutes when unset
+func (c FeaturesConfig) TopDomainsInterval() time.Duration {
+	if c.TopDomainsIntervalMinutes <= 0 {
+		return 15 * time.Minute
+	}
+	return time.Duration(c.TopDomainsIntervalMinutes) * time.Minute
+}
+
+// Interval returns how often the desired config is pulled, every 10 minutes when unset
+func (c SyncConfig) Interval() time.Duration {
+	if c.IntervalMinutes <= 0 {
+		return 10 * time.Minute
+	}
+	return time.Duration(c.IntervalMinutes) * time.Minute
+}
+
+// RevalidateInterval returns how often the license is checked with the SaaS, every 5 minutes when unset
+func (c LicenseConfig) RevalidateInterval() time.Duration {
+	if c.RevalidateMinutes <= 0 {
+		return 5 * time.Minute
+	}
+	return time.Duration(c.RevalidateMinutes) * time.Minute
+}
@@ -0,0 +1,421 @@
+package configsync
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"isp-agent/pkg/cdn"
+	"isp-agent/pkg/nginx"
+)
+
+var (
+	// ErrInsecure is returned for a SaaS URL that is not https; the desired
+	// config is never fetched over plain HTTP
+	ErrInsecure     = errors.New("config sync requires an https SaaS URL")
+	ErrNoPublicKey  = errors.New("no public key to verify the desired config with")
+	ErrBadSignature = errors.New("desired config signature does not verify")
+)
+
+// DesiredConfig is the centrally managed cache configuration served by the SaaS
+type DesiredConfig struct {
+	Version       int64                 `json:"version"`
+	Profiles      []Profile             `json:"profiles"`
+	CacheValidity []nginx.CacheValidity `json:"cache_validity"`
+	BypassRules   []string              `json:"bypass_rules"`
+	BlockedHosts  []string              `json:"blocked_hosts"`
+}
+
+// Profile overrides or adds a CDN server block
+type Profile struct {
+	Name      string   `json:"name"`
+	Hostnames []string `json:"hostnames"`
+	Validity  string   `json:"validity"`
+	SliceSize string   `json:"slice_size"`
+	CacheKey  string   `json:"cache_key"`
+}
+
+// Sync outcomes reported to the SaaS
+const (
+	StatusApplied    = "applied"
+	StatusUnchanged  = "unchanged"
+	StatusFailed     = "failed"
+	StatusRolledBack = "rolled_back"
+)
+
+// Report describes one sync run
+type Report struct {
+	Version    int64     `json:"version"`
+	Status     string    `json:"status"`
+	Drift      bool      `json:"drift"`
+	DriftDiff  []string  `json:"drift_diff,omitempty"`
+	Diff       []string  `json:"diff,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	AppliedAt  time.Time `json:"applied_at,omitempty"`
+	ReportedAt time.Time `json:"reported_at"`
+}
+
+// state remembers what the agent last wrote, to tell local edits apart
+type state struct {
+	Version int64  `json:"version"`
+	SHA256  string `json:"sha256"`
+	Content string `json:"content"`
+}
+
+// Syncer pulls the desired config, renders it and applies it guarded by
+// nginx -t and a health probe
+type Syncer struct {
+	SaaSURL   string
+	Headers   func() http.Header
+	BaseModel func() (*nginx.ConfigModel, error)
+	Generator *nginx.Generator
+	HealthURL string
+	StatePath string
+	// PublicKey verifies the desired config; it is the license signing key
+	PublicKey ed25519.PublicKey
+
+	client *http.Client
+}
+
+func NewSyncer(saasURL string, headers func() http.Header, baseModel func() (*nginx.ConfigModel, error), generator *nginx.Generator) *Syncer {
+	return &Syncer{
+		SaaSURL:   saasURL,
+		Headers:   headers,
+		BaseModel: baseModel,
+		Generator: generator,
+		HealthURL: "http://127.0.0.1/health",
+		StatePath: "/var/lib/isp-agent/nginx-config.json",
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Run syncs on the interval until ctx is cancelled
+func (s *Syncer) Run(ctx context.Context, interval time.Duration, onReport func(*Report, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		report, err := s.Sync(ctx)
+		if onReport != nil {
+			onReport(report, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sync performs one fetch, drift check, apply and report cycle
+func (s *Syncer) Sync(ctx context.Context) (*Report, error) {
+	desired, err := s.fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := s.reconcile(desired)
+	report.ReportedAt = time.Now().UTC()
+
+	if err := s.report(ctx, report); err != nil {
+		return report, fmt.Errorf("failed to report sync result: %w", err)
+	}
+	return report, nil
+}
+
+func (s *Syncer) reconcile(desired *DesiredConfig) *Report {
+	report := &Report{Version: desired.Version}
+	fail := func(status string, err error) *Report {
+		report.Status = status
+		report.Error = err.Error()
+		return report
+	}
+
+	onDisk, _ := os.ReadFile(s.Generator.Path())
+	last := s.loadState()
+
+	// The file differs from what the agent wrote: someone edited it locally
+	if last.SHA256 != "" && len(onDisk) > 0 && hash(onDisk) != last.SHA256 {
+		report.Drift = true
+		report.DriftDiff = lineDiff(last.Content, string(onDisk))
+	}
+
+	// Nothing from a config that fails validation is applied, not even the
+	// fields that are valid on their own
+	if err := desired.Validate(); err != nil {
+		return fail(StatusFailed, fmt.Errorf("invalid desired config: %w", err))
+	}
+
+	model, err := s.BaseModel()
+	if err != nil {
+		return fail(StatusFailed, err)
+	}
+	desired.applyTo(model)
+
+	rendered, err := nginx.Render(model)
+	if err != nil {
+		return fail(StatusFailed, err)
+	}
+	if bytes.Equal(rendered, onDisk) {
+		report.Status = StatusUnchanged
+		s.saveState(desired.Version, rendered)
+		return report
+	}
+	report.Diff = lineDiff(string(onDisk), string(rendered))
+
+	if _, err := s.Generator.Install(rendered); err != nil {
+		return fail(StatusFailed, err)
+	}
+
+	if err := s.probe(); err != nil {
+		if rbErr := s.Generator.Rollback(); rbErr != nil {
+			return fail(StatusFailed, fmt.Errorf("health probe failed: %v; rollback failed: %v", err, rbErr))
+		}
+		return fail(StatusRolledBack, fmt.Errorf("health probe failed: %w", err))
+	}
+
+	report.Status = StatusApplied
+	report.AppliedAt = time.Now().UTC()
+	s.saveState(desired.Version, rendered)
+	return report
+}
+
+// Validate checks every field against the grammar nginx.ConfigModel accepts
+// for it. The values end up inside nginx directives, so anything that could
+// close a directive or block is rejected rather than escaped.
+func (d *DesiredConfig) Validate() error {
+	for i, v := range d.CacheValidity {
+		if !nginx.ValidStatusCodes(v.Codes) {
+			return fmt.Errorf("cache_validity[%d]: invalid status codes %q", i, v.Codes)
+		}
+		if !nginx.ValidDuration(v.Duration) {
+			return fmt.Errorf("cache_validity[%d]: invalid duration %q", i, v.Duration)
+		}
+	}
+	for i, v := range d.BypassRules {
+		if !nginx.ValidVariable(v) {
+			return fmt.Errorf("bypass_rules[%d]: %q is not an nginx variable", i, v)
+		}
+	}
+	for i, h := range d.BlockedHosts {
+		if !nginx.ValidHostname(h) {
+			return fmt.Errorf("blocked_hosts[%d]: invalid hostname %q", i, h)
+		}
+	}
+	for i, p := range d.Profiles {
+		if !nginx.ValidName(p.Name) {
+			return fmt.Errorf("profiles[%d]: invalid name %q", i, p.Name)
+		}
+		for j, h := range p.Hostnames {
+			if !nginx.ValidHostname(h) {
+				return fmt.Errorf("profiles[%d].hostnames[%d]: invalid hostname %q", i, j, h)
+			}
+		}
+		if p.Validity != "" && !nginx.ValidDuration(p.Validity) {
+			return fmt.Errorf("profiles[%d]: invalid validity %q", i, p.Validity)
+		}
+		if p.SliceSize != "" && !nginx.ValidSize(p.SliceSize) {
+			return fmt.Errorf("profiles[%d]: invalid slice_size %q", i, p.SliceSize)
+		}
+		if p.CacheKey != "" && !nginx.ValidCacheKey(p.CacheKey) {
+			return fmt.Errorf("profiles[%d]: invalid cache_key %q", i, p.CacheKey)
+		}
+	}
+	return nil
+}
+
+// applyTo overlays the desired settings on the locally derived model
+func (d *DesiredConfig) applyTo(m *nginx.ConfigModel) {
+	if len(d.CacheValidity) > 0 {
+		m.CacheValidity = d.CacheValidity
+	}
+	if d.BypassRules != nil {
+		m.Bypass = d.BypassRules
+	}
+	m.BlockedHosts = d.BlockedHosts
+
+	for _, p := range d.Profiles {
+		idx := -1
+		for i := range m.Profiles {
+			if m.Profiles[i].Name == p.Name {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			// Start from the built-in profile when the SaaS enables one by name
+			base, ok := cdn.Get(p.Name)
+			if !ok {
+				base = cdn.Profile{
+					Name:          p.Name,
+					KeyStrategy:   cdn.KeyURI,
+					RangeHandling: cdn.RangeSlice,
+					SliceSize:     "8m",
+					Validity:      "365d",
+					ReadTimeout:   "600s",
+				}
+			}
+			m.Profiles = append(m.Profiles, base.ServerProfile())
+			idx = len(m.Profiles) - 1
+		}
+
+		profile := &m.Profiles[idx]
+		if len(p.Hostnames) > 0 {
+			profile.Hostnames = p.Hostnames
+		}
+		if p.Validity != "" {
+			profile.Validity = p.Validity
+		}
+		if p.SliceSize != "" {
+			profile.SliceSize = p.SliceSize
+		}
+		if p.CacheKey != "" {
+			profile.CacheKey = p.CacheKey
+		}
+	}
+}
+
+// probe waits for the health location to answer after a reload
+func (s *Syncer) probe() error {
+	var lastErr error
+	for attempt := 0; attempt < 5; attempt++ {
+		time.Sleep(time.Duration(attempt+1) * time.Second)
+
+		resp, err := s.client.Get(s.HealthURL)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusOK && strings.TrimSpace(string(body)) == "OK" {
+			return nil
+		}
+		lastErr = fmt.Errorf("health returned %s", resp.Status)
+	}
+	return lastErr
+}
+
+// signedConfig is the desired config JSON and the base64 Ed25519 signature
+// of exactly those bytes. The config is only decoded from the signed bytes.
+type signedConfig struct {
+	Config    string `json:"config"`
+	Signature string `json:"signature"`
+}
+
+type desiredResponse struct {
+	Success bool         `json:"success"`
+	Data    signedConfig `json:"data"`
+	Error   string       `json:"error"`
+}
+
+// verify checks the signature and decodes the desired config it covers
+func (c signedConfig) verify(publicKey ed25519.PublicKey) (*DesiredConfig, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, ErrNoPublicKey
+	}
+	signature, err := base64.StdEncoding.DecodeString(c.Signature)
+	if err != nil || !ed25519.Verify(publicKey, []byte(c.Config), signature) {
+		return nil, ErrBadSignature
+	}
+
+	var desired DesiredConfig
+	if err := json.Unmarshal([]byte(c.Config), &desired); err != nil {
+		return nil, fmt.Errorf("failed to parse desired config: %w", err)
+	}
+	return &desired, nil
+}
+
+func (s *Syncer) fetch(ctx context.Context) (*DesiredConfig, error) {
+	if !strings.HasPrefix(s.SaaSURL, "https://") {
+		return nil, ErrInsecure
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.SaaSURL+"/api/agents/config", nil)
+	if err != nil {
+		return nil, err
+	}
+	s.addHeaders(req)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch desired config: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var result desiredResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to parse desired config: %w", err)
+	}
+	if !result.Success {
+		return nil, fmt.Errorf("desired config error: %s", result.Error)
+	}
+	return result.Data.verify(s.PublicKey)
+}
+
+func (s *Syncer) report(ctx context.Context, report *Report) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.SaaSURL+"/api/agents/config/status", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	s.addHeaders(req)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("server returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *Syncer) addHeaders(req *http.Request) {
+	if s.Headers == nil {
+		return
+	}
+	for k, v := range s.Headers() {
+		req.Header[k] = v
+	}
+}
+
+func (s *Syncer) loadState() state {
+	var st state
+	data, err := os.ReadFile(s.StatePath)
+	if err == nil {
+		json.Unmarshal(data, &st)
+	}
+	return st
+}
+
+func (s *Syncer) saveState(version int64, applied []byte) {
+	data, _ := json.Marshal(state{Version: version, SHA256: hash(applied), Content: string(applied)})
+	os.MkdirAll(filepath.Dir(s.StatePath), 0700)
+	os.WriteFile(s.StatePath, data, 0600)
+}
+
+func hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
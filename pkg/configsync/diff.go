@@ -0,0 +1,82 @@
+package configsync
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxDiffLines bounds the diff reported to the SaaS
+const maxDiffLines = 200
+
+// maxDiffCells bounds the LCS table; larger changes are only summarized
+const maxDiffCells = 1 << 20
+
+// lineDiff returns a unified-style listing of removed ("-") and added ("+") lines
+func lineDiff(before, after string) []string {
+	a := strings.Split(before, "\n")
+	b := strings.Split(after, "\n")
+
+	// Lines shared at both ends need no table
+	start := 0
+	for start < len(a) && start < len(b) && a[start] == b[start] {
+		start++
+	}
+	a, b = a[start:], b[start:]
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		a, b = a[:len(a)-1], b[:len(b)-1]
+	}
+	if len(a) == 0 && len(b) == 0 {
+		return nil
+	}
+	if (len(a)+1)*(len(b)+1) > maxDiffCells {
+		return []string{fmt.Sprintf("... %d lines from line %d replaced by %d lines, too large to diff", len(a), start+1, len(b))}
+	}
+
+	// Longest common subsequence table over the changed middle
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var diff []string
+	add := func(line string) bool {
+		if len(diff) == maxDiffLines {
+			diff = append(diff, "... diff truncated")
+			return false
+		}
+		diff = append(diff, line)
+		return true
+	}
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+			continue
+		case j < len(b) && (i == len(a) || lcs[i][j+1] >= lcs[i+1][j]):
+			if !add(fmt.Sprintf("+%d: %s", start+j+1, b[j])) {
+				return diff
+			}
+			j++
+		default:
+			if !add(fmt.Sprintf("-%d: %s", start+i+1, a[i])) {
+				return diff
+			}
+			i++
+		}
+	}
+	return diff
+}
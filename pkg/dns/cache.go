@@ -0,0 +1,137 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// negativeTTL is used for NXDOMAIN and answers without records
+const negativeTTL = 30 * time.Second
+
+// responseCache stores forwarded responses until their shortest TTL expires
+type responseCache struct {
+	mu         sync.Mutex
+	entries    map[string]*cacheEntry
+	maxEntries int
+	maxTTL     time.Duration
+}
+
+type cacheEntry struct {
+	msg []byte
+	// questionEnd is the offset just past the question section of msg
+	questionEnd int
+	ttlOffsets  []int
+	stored      time.Time
+	expires     time.Time
+}
+
+func newResponseCache(maxEntries int, maxTTL time.Duration) *responseCache {
+	return &responseCache{
+		entries:    make(map[string]*cacheEntry),
+		maxEntries: maxEntries,
+		maxTTL:     maxTTL,
+	}
+}
+
+func cacheKey(q *Question) string {
+	return fmt.Sprintf("%s/%d/%d", q.Name, q.Type, q.Class)
+}
+
+// get returns a cached response rewritten for the query with TTLs counted
+// down. The ID and question are copied from the query, so clients that
+// randomise the case of names (0x20) get their own spelling back.
+func (c *responseCache) get(q *Question, query []byte) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[cacheKey(q)]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	if now.After(entry.expires) {
+		delete(c.entries, cacheKey(q))
+		return nil
+	}
+	if entry.questionEnd != q.end {
+		return nil
+	}
+
+	msg := make([]byte, len(entry.msg))
+	copy(msg, entry.msg)
+	copy(msg[0:2], query[0:2])
+	copy(msg[headerLen:q.end], query[headerLen:q.end])
+
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	for _, off := range entry.ttlOffsets {
+		ttl := binary.BigEndian.Uint32(msg[off : off+4])
+		if ttl > elapsed {
+			ttl -= elapsed
+		} else {
+			ttl = 0
+		}
+		binary.BigEndian.PutUint32(msg[off:off+4], ttl)
+	}
+	return msg
+}
+
+// put stores a successful or negative upstream response
+func (c *responseCache) put(q *Question, msg []byte, info *responseInfo) {
+	if info.truncated || (info.rcode != RcodeSuccess && info.rcode != RcodeNXDomain) {
+		return
+	}
+
+	ttl := time.Duration(info.minTTL) * time.Second
+	if info.rcode == RcodeNXDomain || len(info.ttlOffsets) == 0 {
+		ttl = negativeTTL
+	}
+	if ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	questionEnd, err := skipName(msg, headerLen)
+	if err != nil || binary.BigEndian.Uint16(msg[4:6]) != 1 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= c.maxEntries {
+		c.evictExpired()
+		if len(c.entries) >= c.maxEntries {
+			return
+		}
+	}
+
+	stored := make([]byte, len(msg))
+	copy(stored, msg)
+	now := time.Now()
+	c.entries[cacheKey(q)] = &cacheEntry{
+		msg:         stored,
+		questionEnd: questionEnd + 4,
+		ttlOffsets:  info.ttlOffsets,
+		stored:      now,
+		expires:     now.Add(ttl),
+	}
+}
+
+// evictExpired drops stale entries; c.mu must be held
+func (c *responseCache) evictExpired() {
+	now := time.Now()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+}
+
+func (c *responseCache) size() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
@@ -0,0 +1,282 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+// Record types and classes used by the responder
+const (
+	TypeA    = 1
+	TypeAAAA = 28
+	ClassIN  = 1
+)
+
+// Response codes
+const (
+	RcodeSuccess  = 0
+	RcodeFormErr  = 1
+	RcodeServFail = 2
+	RcodeNXDomain = 3
+)
+
+const headerLen = 12
+
+// typeOPT is the EDNS pseudo-record
+const typeOPT = 41
+
+// minUDPSize is the largest message sent over UDP to clients without EDNS
+const minUDPSize = 512
+
+var errMalformed = errors.New("malformed DNS message")
+
+// Question is the first question of a query
+type Question struct {
+	Name  string // lower case, without trailing dot
+	Type  uint16
+	Class uint16
+	// end is the offset just past the question section
+	end int
+	// udpSize is the largest response the client accepts over UDP
+	udpSize int
+}
+
+// parseQuery validates a query and returns its first question
+func parseQuery(msg []byte) (*Question, error) {
+	if len(msg) < headerLen {
+		return nil, errMalformed
+	}
+	if msg[2]&0x80 != 0 { // QR set: this is a response
+		return nil, errMalformed
+	}
+	if binary.BigEndian.Uint16(msg[4:6]) == 0 {
+		return nil, errMalformed
+	}
+
+	name, off, err := readName(msg, headerLen)
+	if err != nil {
+		return nil, err
+	}
+	if off+4 > len(msg) {
+		return nil, errMalformed
+	}
+	return &Question{
+		Name:    strings.ToLower(name),
+		Type:    binary.BigEndian.Uint16(msg[off : off+2]),
+		Class:   binary.BigEndian.Uint16(msg[off+2 : off+4]),
+		end:     off + 4,
+		udpSize: ednsUDPSize(msg, off+4),
+	}, nil
+}
+
+// ednsUDPSize returns the payload size advertised in the query's OPT record,
+// or 512 when it has none
+func ednsUDPSize(msg []byte, off int) int {
+	rrCount := int(binary.BigEndian.Uint16(msg[6:8])) + int(binary.BigEndian.Uint16(msg[8:10])) + int(binary.BigEndian.Uint16(msg[10:12]))
+	for i := 0; i < rrCount; i++ {
+		var err error
+		if off, err = skipName(msg, off); err != nil || off+10 > len(msg) {
+			return minUDPSize
+		}
+		if binary.BigEndian.Uint16(msg[off:off+2]) == typeOPT {
+			return max(int(binary.BigEndian.Uint16(msg[off+2:off+4])), minUDPSize)
+		}
+		off += 10 + int(binary.BigEndian.Uint16(msg[off+8:off+10]))
+	}
+	return minUDPSize
+}
+
+// readName decodes a possibly compressed domain name starting at off
+// and returns it with the offset after the name in the original position
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for hops := 0; hops < 64; hops++ {
+		if off >= len(msg) {
+			return "", 0, errMalformed
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, "."), end, nil
+		case length&0xC0 == 0xC0:
+			if off+1 >= len(msg) {
+				return "", 0, errMalformed
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:off+2]) & 0x3FFF)
+		case length&0xC0 != 0:
+			return "", 0, errMalformed
+		default:
+			if off+1+length > len(msg) {
+				return "", 0, errMalformed
+			}
+			labels = append(labels, string(msg[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+	return "", 0, errMalformed
+}
+
+// skipName returns the offset after the name at off
+func skipName(msg []byte, off int) (int, error) {
+	for off < len(msg) {
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			return off + 1, nil
+		case length&0xC0 == 0xC0:
+			return off + 2, nil
+		default:
+			off += 1 + length
+		}
+	}
+	return 0, errMalformed
+}
+
+// answer builds an authoritative response with the given addresses.
+// An empty ips list produces NODATA so clients fall back to the other family.
+func answer(query []byte, q *Question, ips []net.IP, ttl uint32) []byte {
+	resp := make([]byte, 0, q.end+len(ips)*28)
+	resp = append(resp, query[:q.end]...)
+
+	flags := binary.BigEndian.Uint16(query[2:4])
+	flags = 0x8000 | 0x0400 | flags&0x0100 | 0x0080 // QR, AA, copy RD, RA
+	binary.BigEndian.PutUint16(resp[2:4], flags)
+	binary.BigEndian.PutUint16(resp[4:6], 1)
+	binary.BigEndian.PutUint16(resp[6:8], uint16(len(ips)))
+	binary.BigEndian.PutUint16(resp[8:10], 0)
+	binary.BigEndian.PutUint16(resp[10:12], 0)
+
+	for _, ip := range ips {
+		if q.Type == TypeA {
+			ip = ip.To4()
+		} else {
+			ip = ip.To16()
+		}
+		resp = append(resp, 0xC0, headerLen) // pointer to the question name
+		resp = binary.BigEndian.AppendUint16(resp, q.Type)
+		resp = binary.BigEndian.AppendUint16(resp, ClassIN)
+		resp = binary.BigEndian.AppendUint32(resp, ttl)
+		resp = binary.BigEndian.AppendUint16(resp, uint16(len(ip)))
+		resp = append(resp, ip...)
+	}
+	return resp
+}
+
+// errorResponse answers a query with only a response code, echoing the
+// question when it could be parsed so resolvers accept the reply
+func errorResponse(query []byte, q *Question, rcode int) []byte {
+	if len(query) < headerLen {
+		return nil
+	}
+	end := headerLen
+	if q != nil {
+		end = q.end
+	}
+	resp := make([]byte, end)
+	copy(resp, query[:end])
+	flags := binary.BigEndian.Uint16(query[2:4])
+	flags = 0x8000 | flags&0x0100 | 0x0080 | uint16(rcode&0x0F)
+	binary.BigEndian.PutUint16(resp[2:4], flags)
+	qd := uint16(0)
+	if q != nil {
+		qd = 1
+	}
+	binary.BigEndian.PutUint16(resp[4:6], qd)
+	for i := 6; i < headerLen; i++ {
+		resp[i] = 0
+	}
+	return resp
+}
+
+// truncate cuts a response longer than size down to its header and question
+// and sets TC, so the client retries over TCP
+func truncate(resp []byte, size int) []byte {
+	if len(resp) <= size {
+		return resp
+	}
+	qd := uint16(1)
+	end, err := skipName(resp, headerLen)
+	if err != nil || end+4 > len(resp) {
+		qd, end = 0, headerLen
+	} else {
+		end += 4
+	}
+	out := make([]byte, end)
+	copy(out, resp[:end])
+	out[2] |= 0x02
+	binary.BigEndian.PutUint16(out[4:6], qd)
+	for i := 6; i < headerLen; i++ {
+		out[i] = 0
+	}
+	return out
+}
+
+// responseInfo extracts what the cache needs from an upstream response
+type responseInfo struct {
+	rcode      int
+	truncated  bool
+	minTTL     uint32
+	ttlOffsets []int
+}
+
+// inspectResponse walks the resource records of a response
+func inspectResponse(msg []byte) (*responseInfo, error) {
+	if len(msg) < headerLen {
+		return nil, errMalformed
+	}
+	info := &responseInfo{
+		rcode:     int(msg[3] & 0x0F),
+		truncated: msg[2]&0x02 != 0,
+		minTTL:    ^uint32(0),
+	}
+
+	qd := int(binary.BigEndian.Uint16(msg[4:6]))
+	rrCount := int(binary.BigEndian.Uint16(msg[6:8])) + int(binary.BigEndian.Uint16(msg[8:10])) + int(binary.BigEndian.Uint16(msg[10:12]))
+
+	off := headerLen
+	var err error
+	for i := 0; i < qd; i++ {
+		if off, err = skipName(msg, off); err != nil {
+			return nil, err
+		}
+		off += 4
+	}
+
+	for i := 0; i < rrCount; i++ {
+		if off, err = skipName(msg, off); err != nil {
+			return nil, err
+		}
+		if off+10 > len(msg) {
+			return nil, errMalformed
+		}
+		rrType := binary.BigEndian.Uint16(msg[off : off+2])
+		ttl := binary.BigEndian.Uint32(msg[off+4 : off+8])
+		rdLen := int(binary.BigEndian.Uint16(msg[off+8 : off+10]))
+
+		// OPT pseudo-records reuse the TTL field for flags
+		if rrType != typeOPT {
+			info.ttlOffsets = append(info.ttlOffsets, off+4)
+			if ttl < info.minTTL {
+				info.minTTL = ttl
+			}
+		}
+		off += 10 + rdLen
+		if off > len(msg) {
+			return nil, errMalformed
+		}
+	}
+
+	if len(info.ttlOffsets) == 0 {
+		info.minTTL = 0
+	}
+	return info, nil
+}
@@ -0,0 +1,480 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Matcher decides whether a name is steered to the cache
+type Matcher interface {
+	Match(host string) string
+}
+
+// Server answers CDN hostnames with the cache address and forwards everything else
+type Server struct {
+	Listen    string
+	CacheIPv4 []net.IP
+	CacheIPv6 []net.IP
+	Upstreams []string
+	TTL       uint32
+	Matcher   Matcher
+	Logger    *slog.Logger
+	// Allowed lists the client networks served; nil serves everyone
+	Allowed []*net.IPNet
+	// Workers answer UDP queries; queries arriving while all are busy and the
+	// queue is full are dropped. MaxTCPConns limits open TCP connections.
+	Workers     int
+	MaxTCPConns int
+	// OnListening is called once both UDP and TCP are bound
+	OnListening func()
+
+	steering atomic.Bool
+	cache    *responseCache
+	metrics  metrics
+}
+
+// Metrics is a snapshot of the responder counters
+type Metrics struct {
+	Queries         int64            `json:"queries"`
+	Steered         int64            `json:"steered"`
+	Forwarded       int64            `json:"forwarded"`
+	CacheHits       int64            `json:"cache_hits"`
+	UpstreamErrors  int64            `json:"upstream_errors"`
+	Malformed       int64            `json:"malformed"`
+	Refused         int64            `json:"refused"`
+	Dropped         int64            `json:"dropped"`
+	ByType          map[string]int64 `json:"by_type"`
+	ByProfile       map[string]int64 `json:"by_profile"`
+	AvgLatencyMs    float64          `json:"avg_latency_ms"`
+	CachedResponses int              `json:"cached_responses"`
+	SteeringEnabled bool             `json:"steering_enabled"`
+}
+
+type metrics struct {
+	mu             sync.Mutex
+	queries        int64
+	steered        int64
+	forwarded      int64
+	cacheHits      int64
+	upstreamErrors int64
+	malformed      int64
+	refused        int64
+	dropped        int64
+	byType         map[string]int64
+	byProfile      map[string]int64
+	latency        time.Duration
+}
+
+func NewServer(listen string, cacheIPv4, cacheIPv6 []net.IP, upstreams []string, matcher Matcher) *Server {
+	s := &Server{
+		Listen:      listen,
+		CacheIPv4:   cacheIPv4,
+		CacheIPv6:   cacheIPv6,
+		Upstreams:   upstreams,
+		TTL:         60,
+		Matcher:     matcher,
+		Logger:      slog.Default(),
+		Workers:     64,
+		MaxTCPConns: 128,
+		cache:       newResponseCache(10000, time.Hour),
+	}
+	s.steering.Store(true)
+	return s
+}
+
+// SetSteering is the kill switch: when off, CDN names are forwarded like any other
+func (s *Server) SetSteering(enabled bool) {
+	s.steering.Store(enabled)
+}
+
+// Steering reports whether CDN names are currently answered with the cache address
+func (s *Server) Steering() bool {
+	return s.steering.Load()
+}
+
+// ListenAndServe serves UDP and TCP until ctx is cancelled. If either
+// fails, to bind or later, both listeners are closed.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	udp, err := net.ListenPacket("udp", s.Listen)
+	if err != nil {
+		return fmt.Errorf("DNS UDP listen failed: %w", err)
+	}
+	tcp, err := net.Listen("tcp", s.Listen)
+	if err != nil {
+		udp.Close()
+		return fmt.Errorf("DNS TCP listen failed: %w", err)
+	}
+	if s.OnListening != nil {
+		s.OnListening()
+	}
+
+	var once sync.Once
+	closeAll := func() {
+		once.Do(func() {
+			udp.Close()
+			tcp.Close()
+		})
+	}
+	stop := context.AfterFunc(ctx, closeAll)
+	defer stop()
+
+	errs := make(chan error, 2)
+	go func() { errs <- s.serveUDP(ctx, udp) }()
+	go func() { errs <- s.serveTCP(ctx, tcp) }()
+
+	err = <-errs
+	closeAll()
+	if other := <-errs; err == nil {
+		err = other
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+type udpQuery struct {
+	msg  []byte
+	addr net.Addr
+}
+
+func (s *Server) serveUDP(ctx context.Context, conn net.PacketConn) error {
+	workers := max(s.Workers, 1)
+	queries := make(chan udpQuery, workers)
+	defer close(queries)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for q := range queries {
+				if resp := s.handle(ctx, q.msg, false); resp != nil {
+					conn.WriteTo(resp, q.addr)
+				}
+			}
+		}()
+	}
+
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		// Queries from elsewhere are dropped silently, so the responder
+		// cannot be used for reflection
+		if !s.allowed(addr) {
+			s.metrics.count(func(m *metrics) { m.refused++ })
+			continue
+		}
+		query := make([]byte, n)
+		copy(query, buf[:n])
+
+		select {
+		case queries <- udpQuery{msg: query, addr: addr}:
+		default:
+			s.metrics.count(func(m *metrics) { m.dropped++ })
+		}
+	}
+}
+
+func (s *Server) serveTCP(ctx context.Context, ln net.Listener) error {
+	open := make(chan struct{}, max(s.MaxTCPConns, 1))
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if !s.allowed(conn.RemoteAddr()) {
+			s.metrics.count(func(m *metrics) { m.refused++ })
+			conn.Close()
+			continue
+		}
+		select {
+		case open <- struct{}{}:
+			go func() {
+				s.serveTCPConn(ctx, conn)
+				<-open
+			}()
+		default:
+			s.metrics.count(func(m *metrics) { m.dropped++ })
+			conn.Close()
+		}
+	}
+}
+
+// allowed reports whether the client at addr may query the responder
+func (s *Server) allowed(addr net.Addr) bool {
+	if s.Allowed == nil {
+		return true
+	}
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	}
+	for _, network := range s.Allowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveTCPConn handles length-prefixed queries until the client goes idle
+func (s *Server) serveTCPConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		query, err := readTCPMessage(conn)
+		if err != nil {
+			return
+		}
+		resp := s.handle(ctx, query, true)
+		if resp == nil {
+			return
+		}
+		if err := writeTCPMessage(conn, resp); err != nil {
+			return
+		}
+	}
+}
+
+// handle answers one query; over UDP, answers too large for the client are truncated
+func (s *Server) handle(ctx context.Context, query []byte, overTCP bool) []byte {
+	start := time.Now()
+	defer func() { s.metrics.observeLatency(time.Since(start)) }()
+
+	// Never answer responses, which could bounce between two servers forever
+	if len(query) < headerLen || query[2]&0x80 != 0 {
+		return nil
+	}
+	q, err := parseQuery(query)
+	if err != nil {
+		s.metrics.count(func(m *metrics) { m.malformed++ })
+		return errorResponse(query, nil, RcodeFormErr)
+	}
+	s.metrics.countQuery(q.Type)
+
+	resp := s.resolve(ctx, query, q, overTCP)
+	if !overTCP {
+		resp = truncate(resp, q.udpSize)
+	}
+	return resp
+}
+
+// resolve steers, serves from the cache or forwards a parsed query
+func (s *Server) resolve(ctx context.Context, query []byte, q *Question, overTCP bool) []byte {
+	if q.Class == ClassIN && (q.Type == TypeA || q.Type == TypeAAAA) && s.Steering() {
+		if profile := s.Matcher.Match(q.Name); profile != "" {
+			s.metrics.countSteered(profile)
+			ips := s.CacheIPv4
+			if q.Type == TypeAAAA {
+				ips = s.CacheIPv6
+			}
+			return answer(query, q, ips, s.TTL)
+		}
+	}
+
+	if cached := s.cache.get(q, query); cached != nil {
+		s.metrics.count(func(m *metrics) { m.cacheHits++ })
+		return cached
+	}
+
+	s.metrics.count(func(m *metrics) { m.forwarded++ })
+	resp, err := s.forward(ctx, query, overTCP)
+	if err != nil {
+		s.metrics.count(func(m *metrics) { m.upstreamErrors++ })
+		s.Logger.Debug("upstream resolution failed", "name", q.Name, "error", err)
+		return errorResponse(query, q, RcodeServFail)
+	}
+	if info, err := inspectResponse(resp); err == nil {
+		s.cache.put(q, resp, info)
+	}
+	return resp
+}
+
+// forward tries each upstream in order, retrying over TCP when the UDP answer is truncated
+func (s *Server) forward(ctx context.Context, query []byte, overTCP bool) ([]byte, error) {
+	var lastErr error = errors.New("no upstream resolvers configured")
+	for _, upstream := range s.Upstreams {
+		var resp []byte
+		var err error
+		if !overTCP {
+			resp, err = exchangeUDP(ctx, upstream, query)
+			if err == nil && len(resp) > 2 && resp[2]&0x02 != 0 {
+				resp, err = exchangeTCP(ctx, upstream, query)
+			}
+		} else {
+			resp, err = exchangeTCP(ctx, upstream, query)
+		}
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func exchangeUDP(ctx context.Context, upstream string, query []byte) ([]byte, error) {
+	dialer := net.Dialer{Timeout: 2 * time.Second}
+	conn, err := dialer.DialContext(ctx, "udp", upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Ignore stray datagrams that do not answer this query
+		if n >= headerLen && buf[0] == query[0] && buf[1] == query[1] {
+			return buf[:n], nil
+		}
+	}
+}
+
+func exchangeTCP(ctx context.Context, upstream string, query []byte) ([]byte, error) {
+	dialer := net.Dialer{Timeout: 3 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := writeTCPMessage(conn, query); err != nil {
+		return nil, err
+	}
+	return readTCPMessage(conn)
+}
+
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+// Metrics returns the counters since start
+func (s *Server) Metrics() Metrics {
+	s.metrics.mu.Lock()
+	defer s.metrics.mu.Unlock()
+
+	m := &s.metrics
+	snapshot := Metrics{
+		Queries:         m.queries,
+		Steered:         m.steered,
+		Forwarded:       m.forwarded,
+		CacheHits:       m.cacheHits,
+		UpstreamErrors:  m.upstreamErrors,
+		Malformed:       m.malformed,
+		Refused:         m.refused,
+		Dropped:         m.dropped,
+		ByType:          make(map[string]int64, len(m.byType)),
+		ByProfile:       make(map[string]int64, len(m.byProfile)),
+		CachedResponses: s.cache.size(),
+		SteeringEnabled: s.Steering(),
+	}
+	for k, v := range m.byType {
+		snapshot.ByType[k] = v
+	}
+	for k, v := range m.byProfile {
+		snapshot.ByProfile[k] = v
+	}
+	if total := m.queries + m.malformed; total > 0 {
+		snapshot.AvgLatencyMs = float64(m.latency.Microseconds()) / 1000 / float64(total)
+	}
+	return snapshot
+}
+
+func (m *metrics) count(fn func(m *metrics)) {
+	m.mu.Lock()
+	fn(m)
+	m.mu.Unlock()
+}
+
+func (m *metrics) countQuery(qtype uint16) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queries++
+	if m.byType == nil {
+		m.byType = make(map[string]int64)
+	}
+	m.byType[typeName(qtype)]++
+}
+
+func (m *metrics) countSteered(profile string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.steered++
+	if m.byProfile == nil {
+		m.byProfile = make(map[string]int64)
+	}
+	m.byProfile[profile]++
+}
+
+func (m *metrics) observeLatency(d time.Duration) {
+	m.mu.Lock()
+	m.latency += d
+	m.mu.Unlock()
+}
+
+func typeName(t uint16) string {
+	switch t {
+	case TypeA:
+		return "A"
+	case TypeAAAA:
+		return "AAAA"
+	case 5:
+		return "CNAME"
+	case 6:
+		return "SOA"
+	case 12:
+		return "PTR"
+	case 15:
+		return "MX"
+	case 16:
+		return "TXT"
+	case 33:
+		return "SRV"
+	case 65:
+		return "HTTPS"
+	default:
+		return fmt.Sprintf("TYPE%d", t)
+	}
+}
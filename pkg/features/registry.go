@@ -0,0 +1,197 @@
+package features
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// License modules that gate agent features
+const (
+	ModuleTopDomains          = "top_domains"
+	ModuleCachePurge          = "cache_purge"
+	ModulePrefetch            = "prefetch"
+	ModulePrometheus          = "prometheus"
+	ModuleNginxConfig         = "nginx_config"
+	ModuleSubscriberAnalytics = "subscriber_analytics"
+)
+
+var (
+	ErrUnknownFeature = errors.New("unknown feature")
+	ErrUnknownCommand = errors.New("unknown command")
+	ErrNotLicensed    = errors.New("feature not licensed")
+)
+
+// CommandFunc handles a command sent to a feature
+type CommandFunc func(ctx context.Context, args map[string]string) (interface{}, error)
+
+// Feature is an agent capability that requires a licensed module
+type Feature struct {
+	Name   string
+	Module string
+
+	// Run performs background work until ctx is cancelled (optional)
+	Run func(ctx context.Context)
+	// Commands are refused unless the feature is licensed
+	Commands map[string]CommandFunc
+}
+
+// Status describes a feature for the status API
+type Status struct {
+	Name     string   `json:"name"`
+	Module   string   `json:"module"`
+	Licensed bool     `json:"licensed"`
+	Active   bool     `json:"active"`
+	Commands []string `json:"commands,omitempty"`
+}
+
+type entry struct {
+	feature  Feature
+	licensed bool
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// Registry starts and stops features according to the licensed modules.
+// Run functions must not call back into the registry.
+type Registry struct {
+	ctx     context.Context
+	mu      sync.Mutex
+	entries map[string]*entry
+	order   []string
+}
+
+// NewRegistry creates a registry whose features stop when ctx is cancelled
+func NewRegistry(ctx context.Context) *Registry {
+	return &Registry{
+		ctx:     ctx,
+		entries: make(map[string]*entry),
+	}
+}
+
+// Register adds a feature; it stays stopped until Apply licenses it
+func (r *Registry) Register(f Feature) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.entries[f.Name]; !exists {
+		r.order = append(r.order, f.Name)
+	}
+	r.entries[f.Name] = &entry{feature: f}
+}
+
+// Apply starts newly licensed features and stops those no longer licensed.
+// When active is false every feature is stopped regardless of modules.
+func (r *Registry) Apply(modules []string, active bool) {
+	licensed := make(map[string]bool, len(modules))
+	for _, m := range modules {
+		licensed[m] = true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, name := range r.order {
+		e := r.entries[name]
+		e.licensed = active && licensed[e.feature.Module]
+
+		if e.licensed && e.cancel == nil && e.feature.Run != nil {
+			r.start(e)
+		} else if !e.licensed && e.cancel != nil {
+			stop(e)
+		}
+	}
+}
+
+func (r *Registry) start(e *entry) {
+	ctx, cancel := context.WithCancel(r.ctx)
+	e.cancel = cancel
+	e.done = make(chan struct{})
+
+	go func(run func(context.Context), done chan struct{}) {
+		defer close(done)
+		run(ctx)
+	}(e.feature.Run, e.done)
+}
+
+func stop(e *entry) {
+	e.cancel()
+	<-e.done
+	e.cancel = nil
+	e.done = nil
+}
+
+// running reports whether the feature's Run function has not returned yet
+func running(e *entry) bool {
+	if e.done == nil {
+		return false
+	}
+	select {
+	case <-e.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// Licensed reports whether the named feature is currently licensed
+func (r *Registry) Licensed(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.entries[name]
+	return ok && e.licensed
+}
+
+// Execute runs a feature command, refusing it when the feature is not licensed
+func (r *Registry) Execute(ctx context.Context, name, command string, args map[string]string) (interface{}, error) {
+	r.mu.Lock()
+	e, ok := r.entries[name]
+	var handler CommandFunc
+	licensed := false
+	if ok {
+		handler = e.feature.Commands[command]
+		licensed = e.licensed
+	}
+	r.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownFeature, name)
+	}
+	if !licensed {
+		return nil, fmt.Errorf("%w: %s requires module %q", ErrNotLicensed, name, e.feature.Module)
+	}
+	if handler == nil {
+		return nil, fmt.Errorf("%w: %s/%s", ErrUnknownCommand, name, command)
+	}
+
+	return handler(ctx, args)
+}
+
+// Status lists every registered feature in registration order
+func (r *Registry) Status() []Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	statuses := make([]Status, 0, len(r.order))
+	for _, name := range r.order {
+		e := r.entries[name]
+
+		commands := make([]string, 0, len(e.feature.Commands))
+		for c := range e.feature.Commands {
+			commands = append(commands, c)
+		}
+		sort.Strings(commands)
+
+		statuses = append(statuses, Status{
+			Name:     name,
+			Module:   e.feature.Module,
+			Licensed: e.licensed,
+			Active:   e.licensed && (e.feature.Run == nil || running(e)),
+			Commands: commands,
+		})
+	}
+	return statuses
+}
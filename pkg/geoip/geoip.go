@@ -0,0 +1,145 @@
+package geoip
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+)
+
+// ASN identifies the network an address belongs to
+type ASN struct {
+	Number       uint64 `json:"asn"`
+	Organization string `json:"organization,omitempty"`
+}
+
+func (a ASN) String() string {
+	return fmt.Sprintf("AS%d", a.Number)
+}
+
+// maxCached bounds the lookup cache; it is cleared when full
+const maxCached = 50000
+
+// DB answers region and ASN lookups from local MMDB files, never the network
+type DB struct {
+	city *Reader
+	asn  *Reader
+
+	mu      sync.Mutex
+	regions map[netip.Addr]string
+	asns    map[netip.Addr]ASN
+}
+
+// OpenDB loads a City/Country database and an ASN database; either path may be empty
+func OpenDB(cityPath, asnPath string) (*DB, error) {
+	db := &DB{
+		regions: make(map[netip.Addr]string),
+		asns:    make(map[netip.Addr]ASN),
+	}
+	var err error
+	if cityPath != "" {
+		if db.city, err = Open(cityPath); err != nil {
+			return nil, fmt.Errorf("failed to load %s: %w", cityPath, err)
+		}
+	}
+	if asnPath != "" {
+		if db.asn, err = Open(asnPath); err != nil {
+			return nil, fmt.Errorf("failed to load %s: %w", asnPath, err)
+		}
+	}
+	return db, nil
+}
+
+// HasRegions reports whether a City/Country database is loaded
+func (db *DB) HasRegions() bool {
+	return db.city != nil
+}
+
+// HasASN reports whether an ASN database is loaded
+func (db *DB) HasASN() bool {
+	return db.asn != nil
+}
+
+// Region returns "<country>-<subdivision>" (e.g. "US-CA"), the country code
+// alone when no subdivision is known, or "" when the address is not found
+func (db *DB) Region(addr netip.Addr) string {
+	if db.city == nil {
+		return ""
+	}
+	addr = addr.Unmap()
+
+	db.mu.Lock()
+	region, ok := db.regions[addr]
+	db.mu.Unlock()
+	if ok {
+		return region
+	}
+
+	if record, err := db.city.Lookup(addr); err == nil {
+		region = regionOf(record)
+	}
+
+	db.mu.Lock()
+	if len(db.regions) >= maxCached {
+		db.regions = make(map[netip.Addr]string)
+	}
+	db.regions[addr] = region
+	db.mu.Unlock()
+	return region
+}
+
+// ASN returns the autonomous system of addr; ok is false when it is not found
+func (db *DB) ASN(addr netip.Addr) (asn ASN, ok bool) {
+	if db.asn == nil {
+		return ASN{}, false
+	}
+	addr = addr.Unmap()
+
+	db.mu.Lock()
+	asn, cached := db.asns[addr]
+	db.mu.Unlock()
+	if !cached {
+		if record, err := db.asn.Lookup(addr); err == nil {
+			asn = asnOf(record)
+		}
+
+		db.mu.Lock()
+		if len(db.asns) >= maxCached {
+			db.asns = make(map[netip.Addr]ASN)
+		}
+		db.asns[addr] = asn
+		db.mu.Unlock()
+	}
+	return asn, asn.Number != 0
+}
+
+// regionOf reads a GeoIP2/GeoLite2 City or Country record
+func regionOf(record interface{}) string {
+	m, _ := record.(map[string]interface{})
+	country := isoCode(m["country"])
+	if country == "" {
+		country = isoCode(m["registered_country"])
+	}
+	if country == "" {
+		return ""
+	}
+	if subdivisions, ok := m["subdivisions"].([]interface{}); ok && len(subdivisions) > 0 {
+		if sub := isoCode(subdivisions[0]); sub != "" {
+			return country + "-" + sub
+		}
+	}
+	return country
+}
+
+func isoCode(v interface{}) string {
+	m, _ := v.(map[string]interface{})
+	code, _ := m["iso_code"].(string)
+	return code
+}
+
+// asnOf reads a GeoLite2 ASN record
+func asnOf(record interface{}) ASN {
+	m, _ := record.(map[string]interface{})
+	asn := ASN{Number: asUint(m["autonomous_system_number"])}
+	asn.Organization, _ = m["autonomous_system_organization"].(string)
+	return asn
+}
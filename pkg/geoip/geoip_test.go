@@ -0,0 +1,77 @@
+package geoip
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestRegion(t *testing.T) {
+	db, err := OpenDB("testdata/city-test.mmdb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"1.2.3.4", "US-CA"},
+		{"::ffff:1.2.3.4", "US-CA"},
+		{"5.6.7.8", "FR"},
+		{"2001:db8::1", "DE"},
+		{"9.9.9.9", ""},
+		{"2001:db9::1", ""},
+	}
+	for _, tt := range tests {
+		// Twice, the second answer comes from the cache
+		for i := 0; i < 2; i++ {
+			if got := db.Region(netip.MustParseAddr(tt.addr)); got != tt.want {
+				t.Errorf("Region(%s) = %q, want %q", tt.addr, got, tt.want)
+			}
+		}
+	}
+	if _, ok := db.ASN(netip.MustParseAddr("1.2.3.4")); ok {
+		t.Error("ASN found without an ASN database")
+	}
+}
+
+func TestASN(t *testing.T) {
+	db, err := OpenDB("", "testdata/asn-test.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		addr string
+		want ASN
+		ok   bool
+	}{
+		{"1.2.3.4", ASN{Number: 64500, Organization: "Example Net"}, true},
+		{"8.8.8.8", ASN{Number: 15169, Organization: "Google LLC"}, true},
+		{"9.9.9.9", ASN{}, false},
+		{"2001:db8::1", ASN{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := db.ASN(netip.MustParseAddr(tt.addr))
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("ASN(%s) = %+v, %v, want %+v, %v", tt.addr, got, ok, tt.want, tt.ok)
+		}
+	}
+	if db.Region(netip.MustParseAddr("1.2.3.4")) != "" {
+		t.Error("region found without a city database")
+	}
+}
+
+func TestOpenDBErrors(t *testing.T) {
+	tests := []struct {
+		city, asn string
+	}{
+		{"testdata/missing.mmdb", ""},
+		{"", "testdata/generate.go"},
+	}
+	for _, tt := range tests {
+		if _, err := OpenDB(tt.city, tt.asn); err == nil {
+			t.Errorf("OpenDB(%q, %q) succeeded", tt.city, tt.asn)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/netip"
+	"os"
+)
+
+// metadataMarker precedes the metadata map at the end of every MMDB file
+var metadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+var ErrInvalidDatabase = errors.New("invalid MaxMind database")
+
+// Metadata describes an MMDB file
+type Metadata struct {
+	DatabaseType string
+	IPVersion    int
+	NodeCount    int
+	RecordSize   int
+	BuildEpoch   uint64
+}
+
+// Reader looks up addresses in a MaxMind DB file held in memory.
+// See https://maxmind.github.io/MaxMind-DB/ for the format.
+type Reader struct {
+	Metadata Metadata
+
+	buf       []byte
+	data      []byte
+	nodeBytes int
+	ipv4Start int
+}
+
+// Open reads an MMDB file into memory
+func Open(path string) (*Reader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return FromBytes(buf)
+}
+
+// FromBytes parses an MMDB file already in memory
+func FromBytes(buf []byte) (*Reader, error) {
+	// The marker is within the last 128 KiB
+	searchFrom := len(buf) - 128*1024
+	if searchFrom < 0 {
+		searchFrom = 0
+	}
+	idx := bytes.LastIndex(buf[searchFrom:], metadataMarker)
+	if idx < 0 {
+		return nil, fmt.Errorf("%w: metadata not found", ErrInvalidDatabase)
+	}
+	metaStart := searchFrom + idx + len(metadataMarker)
+
+	d := decoder{buf: buf[metaStart:]}
+	raw, _, err := d.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidDatabase, err)
+	}
+	meta, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: metadata is not a map", ErrInvalidDatabase)
+	}
+
+	r := &Reader{buf: buf}
+	r.Metadata.DatabaseType, _ = meta["database_type"].(string)
+	r.Metadata.IPVersion = int(asUint(meta["ip_version"]))
+	r.Metadata.NodeCount = int(asUint(meta["node_count"]))
+	r.Metadata.RecordSize = int(asUint(meta["record_size"]))
+	r.Metadata.BuildEpoch = asUint(meta["build_epoch"])
+
+	switch r.Metadata.RecordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("%w: unsupported record size %d", ErrInvalidDatabase, r.Metadata.RecordSize)
+	}
+	r.nodeBytes = r.Metadata.RecordSize / 4
+	treeSize := r.Metadata.NodeCount * r.nodeBytes
+	// The search tree is followed by 16 zero bytes, then the data section
+	if treeSize+16 > searchFrom+idx {
+		return nil, fmt.Errorf("%w: search tree exceeds file", ErrInvalidDatabase)
+	}
+	r.data = buf[treeSize+16 : searchFrom+idx]
+
+	// IPv4 addresses live under ::/96 in IPv6 databases
+	if r.Metadata.IPVersion == 6 {
+		node := 0
+		for i := 0; i < 96 && node < r.Metadata.NodeCount; i++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+// Lookup returns the data record for addr, or nil when the address is not in the database
+func (r *Reader) Lookup(addr netip.Addr) (interface{}, error) {
+	addr = addr.Unmap()
+	var ip []byte
+	node := 0
+	if addr.Is4() {
+		a := addr.As4()
+		ip = a[:]
+		node = r.ipv4Start
+	} else {
+		if r.Metadata.IPVersion == 4 {
+			return nil, nil
+		}
+		a := addr.As16()
+		ip = a[:]
+	}
+
+	nodeCount := r.Metadata.NodeCount
+	for i := 0; i < len(ip)*8 && node < nodeCount; i++ {
+		bit := int(ip[i/8]>>(7-uint(i%8))) & 1
+		node = r.record(node, bit)
+	}
+
+	switch {
+	case node == nodeCount:
+		return nil, nil
+	case node < nodeCount:
+		return nil, fmt.Errorf("%w: search tree too deep", ErrInvalidDatabase)
+	}
+
+	offset := node - nodeCount - 16
+	if offset < 0 || offset >= len(r.data) {
+		return nil, fmt.Errorf("%w: data pointer out of range", ErrInvalidDatabase)
+	}
+	d := decoder{buf: r.data}
+	value, _, err := d.decode(offset)
+	return value, err
+}
+
+// record reads the left (0) or right (1) record of a search tree node
+func (r *Reader) record(node, bit int) int {
+	b := r.buf[node*r.nodeBytes : (node+1)*r.nodeBytes]
+	switch r.Metadata.RecordSize {
+	case 24:
+		b = b[bit*3:]
+		return int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+	case 28:
+		if bit == 0 {
+			return int(b[3]&0xF0)<<20 | int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+		}
+		return int(b[3]&0x0F)<<24 | int(b[4])<<16 | int(b[5])<<8 | int(b[6])
+	default:
+		return int(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// decoder reads the MMDB data section format
+type decoder struct {
+	buf []byte
+}
+
+// Data section field types
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// decode returns the value at offset and the offset after it
+func (d *decoder) decode(offset int) (interface{}, int, error) {
+	return d.decodeDepth(offset, 0)
+}
+
+func (d *decoder) decodeDepth(offset, depth int) (interface{}, int, error) {
+	if depth > 32 {
+		return nil, 0, errors.New("data nested too deeply")
+	}
+	if offset >= len(d.buf) {
+		return nil, 0, errors.New("unexpected end of data")
+	}
+
+	ctrl := d.buf[offset]
+	offset++
+	typ := int(ctrl >> 5)
+	if typ == typeExtended {
+		if offset >= len(d.buf) {
+			return nil, 0, errors.New("unexpected end of data")
+		}
+		typ = 7 + int(d.buf[offset])
+		offset++
+	}
+
+	if typ == typePointer {
+		target, next, err := d.pointer(ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		// Decoding continues after the pointer, not after the value it points at
+		value, _, err := d.decodeDepth(target, depth+1)
+		return value, next, err
+	}
+
+	size, offset, err := d.size(ctrl, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	// Every map entry or array element takes at least one byte, so a larger
+	// count can only come from a damaged file; don't allocate for it
+	if (typ == typeMap || typ == typeArray) && size > len(d.buf)-offset {
+		return nil, 0, errors.New("container size exceeds data section")
+	}
+
+	switch typ {
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for i := 0; i < size; i++ {
+			var key, value interface{}
+			if key, offset, err = d.decodeDepth(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			if value, offset, err = d.decodeDepth(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			m[k] = value
+		}
+		return m, offset, nil
+	case typeArray:
+		a := make([]interface{}, 0, size)
+		for i := 0; i < size; i++ {
+			var value interface{}
+			if value, offset, err = d.decodeDepth(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+		}
+		return a, offset, nil
+	case typeBool:
+		return size != 0, offset, nil
+	}
+
+	if offset+size > len(d.buf) {
+		return nil, 0, errors.New("value exceeds data section")
+	}
+	raw := d.buf[offset : offset+size]
+	next := offset + size
+
+	switch typ {
+	case typeString:
+		return string(raw), next, nil
+	case typeBytes:
+		return append([]byte(nil), raw...), next, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errors.New("invalid double size")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(raw)), next, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errors.New("invalid float size")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(raw))), next, nil
+	case typeUint16, typeUint32, typeUint64:
+		if size > 8 {
+			return nil, 0, errors.New("invalid integer size")
+		}
+		var v uint64
+		for _, b := range raw {
+			v = v<<8 | uint64(b)
+		}
+		return v, next, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, errors.New("invalid integer size")
+		}
+		var v uint32
+		for _, b := range raw {
+			v = v<<8 | uint32(b)
+		}
+		// Shorter encodings are zero-extended, so only a full 4 bytes can be negative
+		return int64(int32(v)), next, nil
+	case typeUint128:
+		return new(big.Int).SetBytes(raw), next, nil
+	case typeContainer, typeEndMarker:
+		return nil, next, nil
+	default:
+		return nil, 0, fmt.Errorf("unknown data type %d", typ)
+	}
+}
+
+// size decodes the payload size in the low 5 bits of the control byte
+func (d *decoder) size(ctrl byte, offset int) (int, int, error) {
+	size := int(ctrl & 0x1F)
+	if size < 29 {
+		return size, offset, nil
+	}
+	n := size - 28
+	if offset+n > len(d.buf) {
+		return 0, 0, errors.New("unexpected end of data")
+	}
+	var v int
+	for _, b := range d.buf[offset : offset+n] {
+		v = v<<8 | int(b)
+	}
+	switch size {
+	case 29:
+		return 29 + v, offset + n, nil
+	case 30:
+		return 285 + v, offset + n, nil
+	default:
+		return 65821 + v, offset + n, nil
+	}
+}
+
+// pointer decodes a pointer to another offset in the data section
+func (d *decoder) pointer(ctrl byte, offset int) (int, int, error) {
+	n := int((ctrl>>3)&0x3) + 1
+	if offset+n > len(d.buf) {
+		return 0, 0, errors.New("unexpected end of data")
+	}
+	b := d.buf[offset : offset+n]
+	vvv := int(ctrl & 0x7)
+
+	var target int
+	switch n {
+	case 1:
+		target = vvv<<8 | int(b[0])
+	case 2:
+		target = (vvv<<16 | int(b[0])<<8 | int(b[1])) + 2048
+	case 3:
+		target = (vvv<<24 | int(b[0])<<16 | int(b[1])<<8 | int(b[2])) + 526336
+	default:
+		target = int(binary.BigEndian.Uint32(b))
+	}
+	return target, offset + n, nil
+}
+
+func asUint(v interface{}) uint64 {
+	switch n := v.(type) {
+	case uint64:
+		return n
+	case int64:
+		if n > 0 {
+			return uint64(n)
+		}
+	}
+	return 0
+}
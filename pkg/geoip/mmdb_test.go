@@ -0,0 +1,118 @@
+package geoip
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"testing"
+)
+
+//go:generate go run testdata/generate.go
+
+func readTestDB(t *testing.T, name string) []byte {
+	t.Helper()
+	buf, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestMetadata(t *testing.T) {
+	tests := []struct {
+		file string
+		want Metadata
+	}{
+		{"city-test.mmdb", Metadata{DatabaseType: "GeoIP2-City", IPVersion: 6, RecordSize: 24, BuildEpoch: 1700000000}},
+		{"asn-test.mmdb", Metadata{DatabaseType: "GeoLite2-ASN", IPVersion: 4, RecordSize: 28, BuildEpoch: 1700000000}},
+	}
+	for _, tt := range tests {
+		r, err := Open("testdata/" + tt.file)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.file, err)
+		}
+		got := r.Metadata
+		if got.NodeCount == 0 {
+			t.Errorf("%s: node count is 0", tt.file)
+		}
+		got.NodeCount = 0
+		if got != tt.want {
+			t.Errorf("%s: metadata %+v, want %+v", tt.file, got, tt.want)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	city, err := Open("testdata/city-test.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	asn, err := Open("testdata/asn-test.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		db    *Reader
+		addr  string
+		found bool
+	}{
+		{"ipv4 in ipv6 tree", city, "1.2.3.4", true},
+		{"ipv4 mapped", city, "::ffff:1.2.3.200", true},
+		{"ipv4 short prefix", city, "5.6.255.1", true},
+		{"ipv6", city, "2001:db8:1::1", true},
+		{"ipv4 missing", city, "9.9.9.9", false},
+		{"ipv6 missing", city, "2001:db9::1", false},
+		{"ipv4 tree", asn, "8.8.8.8", true},
+		{"ipv4 tree missing", asn, "1.2.4.1", false},
+		{"ipv6 in ipv4 tree", asn, "2001:db8::1", false},
+	}
+	for _, tt := range tests {
+		record, err := tt.db.Lookup(netip.MustParseAddr(tt.addr))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if found := record != nil; found != tt.found {
+			t.Errorf("%s: found %v, want %v (record %v)", tt.name, found, tt.found, record)
+		}
+	}
+}
+
+func TestCorruptDatabase(t *testing.T) {
+	buf := readTestDB(t, "city-test.mmdb")
+	r, err := FromBytes(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	treeSize := r.Metadata.NodeCount * r.nodeBytes
+
+	tests := []struct {
+		name string
+		buf  []byte
+	}{
+		{"empty", nil},
+		{"not a database", []byte("hello world")},
+		{"truncated metadata", buf[:len(buf)-8]},
+		{"truncated tree", buf[treeSize/2:]},
+	}
+	for _, tt := range tests {
+		if _, err := FromBytes(tt.buf); !errors.Is(err, ErrInvalidDatabase) {
+			t.Errorf("%s: got %v, want ErrInvalidDatabase", tt.name, err)
+		}
+	}
+
+	// A damaged data section is only noticed on lookup
+	damaged := append([]byte(nil), buf...)
+	for i := range r.data {
+		damaged[treeSize+16+i] = 0xFF
+	}
+	r, err = FromBytes(damaged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record, err := r.Lookup(netip.MustParseAddr("1.2.3.4")); err == nil {
+		t.Errorf("damaged data section: got record %v, want an error", record)
+	}
+}
@@ -0,0 +1,230 @@
+//go:build ignore
+
+// generate writes the small MMDB files the geoip tests read. Run it with
+// go generate from pkg/geoip.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"net/netip"
+	"os"
+	"sort"
+)
+
+func main() {
+	// City: IPv6 tree with 24 bit records, IPv4 under ::/96
+	city := newWriter(6, 24, "GeoIP2-City")
+	de := city.add(map[string]interface{}{"iso_code": "DE"})
+	city.insert("1.2.3.0/24", city.add(map[string]interface{}{
+		"country":      map[string]interface{}{"iso_code": "US"},
+		"subdivisions": []interface{}{map[string]interface{}{"iso_code": "CA"}},
+	}))
+	city.insert("5.6.0.0/16", city.add(map[string]interface{}{
+		"registered_country": map[string]interface{}{"iso_code": "FR"},
+	}))
+	// The country is a pointer to a record shared with other entries
+	city.insert("2001:db8::/32", city.add(map[string]interface{}{
+		"country":      pointer(de),
+		"subdivisions": []interface{}{},
+	}))
+	city.write("testdata/city-test.mmdb")
+
+	// ASN: IPv4 only tree with 28 bit records
+	asn := newWriter(4, 28, "GeoLite2-ASN")
+	asn.insert("1.2.3.0/24", asn.add(map[string]interface{}{
+		"autonomous_system_number":       uint32(64500),
+		"autonomous_system_organization": "Example Net",
+	}))
+	asn.insert("8.8.8.0/24", asn.add(map[string]interface{}{
+		"autonomous_system_number":       uint32(15169),
+		"autonomous_system_organization": "Google LLC",
+	}))
+	asn.write("testdata/asn-test.mmdb")
+}
+
+type pointer int
+
+type node struct {
+	child [2]*node
+	leaf  [2]int
+}
+
+func newNode() *node {
+	return &node{leaf: [2]int{-1, -1}}
+}
+
+type writer struct {
+	ipVersion  int
+	recordSize int
+	dbType     string
+	root       *node
+	data       bytes.Buffer
+}
+
+func newWriter(ipVersion, recordSize int, dbType string) *writer {
+	return &writer{ipVersion: ipVersion, recordSize: recordSize, dbType: dbType, root: newNode()}
+}
+
+// add encodes a data record and returns its offset in the data section
+func (w *writer) add(v interface{}) int {
+	offset := w.data.Len()
+	encode(&w.data, v)
+	return offset
+}
+
+func (w *writer) insert(cidr string, offset int) {
+	prefix := netip.MustParsePrefix(cidr)
+	var bits []byte
+	length := prefix.Bits()
+	switch {
+	case w.ipVersion == 6 && prefix.Addr().Is4():
+		// IPv4 networks live under ::/96, not under ::ffff:0:0/96
+		a := prefix.Addr().As4()
+		bits = append(make([]byte, 12), a[:]...)
+		length += 96
+	case w.ipVersion == 6:
+		a := prefix.Addr().As16()
+		bits = a[:]
+	default:
+		a := prefix.Addr().As4()
+		bits = a[:]
+	}
+
+	bit := func(i int) int { return int(bits[i/8]>>(7-uint(i%8))) & 1 }
+	n := w.root
+	for i := 0; i < length-1; i++ {
+		b := bit(i)
+		if n.child[b] == nil {
+			n.child[b] = newNode()
+		}
+		n = n.child[b]
+	}
+	n.leaf[bit(length-1)] = offset
+}
+
+func (w *writer) write(path string) {
+	// Number the nodes breadth first, the root is node 0
+	var nodes []*node
+	index := make(map[*node]int)
+	queue := []*node{w.root}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		index[n] = len(nodes)
+		nodes = append(nodes, n)
+		for _, c := range n.child {
+			if c != nil {
+				queue = append(queue, c)
+			}
+		}
+	}
+	count := len(nodes)
+
+	var out bytes.Buffer
+	for _, n := range nodes {
+		var records [2]int
+		for b := range records {
+			switch {
+			case n.child[b] != nil:
+				records[b] = index[n.child[b]]
+			case n.leaf[b] >= 0:
+				records[b] = count + 16 + n.leaf[b]
+			default:
+				records[b] = count
+			}
+		}
+		left, right := records[0], records[1]
+		switch w.recordSize {
+		case 24:
+			out.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left), byte(right >> 16), byte(right >> 8), byte(right)})
+		case 28:
+			out.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left), byte(left>>20)&0xF0 | byte(right>>24)&0x0F, byte(right >> 16), byte(right >> 8), byte(right)})
+		}
+	}
+	out.Write(make([]byte, 16))
+	out.Write(w.data.Bytes())
+
+	out.WriteString("\xAB\xCD\xEFMaxMind.com")
+	encode(&out, map[string]interface{}{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(1700000000),
+		"database_type":               w.dbType,
+		"description":                 map[string]interface{}{"en": "isp-agent test database"},
+		"ip_version":                  uint16(w.ipVersion),
+		"languages":                   []interface{}{"en"},
+		"node_count":                  uint32(count),
+		"record_size":                 uint16(w.recordSize),
+	})
+
+	if err := os.WriteFile(path, out.Bytes(), 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// encode writes v in the MMDB data section format
+func encode(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case pointer:
+		// Only the 11 bit form is needed for these small files
+		buf.Write([]byte{1<<5 | byte(v>>8)&0x7, byte(v)})
+	case string:
+		control(buf, 2, len(v))
+		buf.WriteString(v)
+	case uint16:
+		writeUint(buf, 5, uint64(v))
+	case uint32:
+		writeUint(buf, 6, uint64(v))
+	case uint64:
+		writeUint(buf, 9, v)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		control(buf, 7, len(v))
+		for _, k := range keys {
+			encode(buf, k)
+			encode(buf, v[k])
+		}
+	case []interface{}:
+		control(buf, 11, len(v))
+		for _, item := range v {
+			encode(buf, item)
+		}
+	default:
+		log.Fatalf("cannot encode %T", v)
+	}
+}
+
+func writeUint(buf *bytes.Buffer, typ int, v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	raw := bytes.TrimLeft(b[:], "\x00")
+	control(buf, typ, len(raw))
+	buf.Write(raw)
+}
+
+// control writes the type and size header
+func control(buf *bytes.Buffer, typ, size int) {
+	var ext []byte
+	switch {
+	case size < 29:
+	case size < 285:
+		ext = []byte{byte(size - 29)}
+		size = 29
+	default:
+		ext = []byte{byte((size - 285) >> 8), byte(size - 285)}
+		size = 30
+	}
+	if typ <= 7 {
+		buf.WriteByte(byte(typ<<5 | size))
+	} else {
+		buf.WriteByte(byte(size))
+		buf.WriteByte(byte(typ - 7))
+	}
+	buf.Write(ext)
+}
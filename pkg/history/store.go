@@ -0,0 +1,454 @@
+// Package history keeps telemetry samples on local disk: one sample per
+// minute for recent data and hourly rollups for the long term.
+package history
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"isp-agent/pkg/telemetry"
+)
+
+// Resolution selects which tier a query reads
+type Resolution string
+
+const (
+	Minute Resolution = "minute"
+	Hour   Resolution = "hour"
+)
+
+// Retention limits how much history is kept on disk
+type Retention struct {
+	Minute time.Duration
+	Hour   time.Duration
+	// MaxBytes caps the store size; the oldest minute files go first, then hourly ones. 0 disables it.
+	MaxBytes int64
+}
+
+// DefaultRetention keeps 7 days of minute samples and a year of hourly rollups
+var DefaultRetention = Retention{
+	Minute:   7 * 24 * time.Hour,
+	Hour:     365 * 24 * time.Hour,
+	MaxBytes: 512 << 20,
+}
+
+const (
+	minuteDir = "minute"
+	hourDir   = "hour"
+	// maxLine bounds one encoded sample; larger lines are skipped when reading
+	maxLine = 16 << 20
+)
+
+// Store appends samples to daily minute files and monthly hourly files.
+// Minute files of past days are gzipped. Timestamps are bucketed in UTC.
+type Store struct {
+	dir       string
+	retention Retention
+
+	mu sync.Mutex
+	// pending holds the minute samples of the hour not yet rolled up
+	pending []*telemetry.TelemetryData
+	// lastDay is the day of the latest sample, to compress and prune once per day
+	lastDay string
+}
+
+// Open creates the store directories and reloads the samples of an unfinished hour
+func Open(dir string, retention Retention) (*Store, error) {
+	for _, sub := range []string{minuteDir, hourDir} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create history directory: %w", err)
+		}
+	}
+	s := &Store{dir: dir, retention: retention}
+
+	// Minute samples newer than the last rollup still need to be rolled up
+	now := time.Now().UTC()
+	lastRollup := time.Time{}
+	hours, err := s.read(Hour, now.Add(-62*24*time.Hour), now.Add(time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	if len(hours) > 0 {
+		lastRollup = hours[len(hours)-1].Timestamp
+	}
+	from := now.Add(-24 * time.Hour)
+	if lastRollup.After(from) {
+		from = lastRollup
+	}
+	s.pending, err = s.read(Minute, from, now.Add(time.Minute))
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Prune(now); err != nil {
+		return nil, err
+	}
+	s.lastDay = dayOf(now)
+	return s, nil
+}
+
+// Dir returns the directory the store writes to
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// Append stores one minute sample, rolling up finished hours and pruning once a day.
+// Samples must arrive in timestamp order.
+func (s *Store) Append(data *telemetry.TelemetryData) error {
+	if data.Timestamp.IsZero() {
+		return fmt.Errorf("sample has no timestamp")
+	}
+	t := data.Timestamp.UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.rollup(t); err != nil {
+		return err
+	}
+	if err := appendLine(s.minutePath(t), data); err != nil {
+		return err
+	}
+	s.pending = append(s.pending, data)
+
+	if day := dayOf(t); day != s.lastDay {
+		s.lastDay = day
+		if err := s.Prune(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollup writes one hourly sample for every finished hour in pending
+func (s *Store) rollup(now time.Time) error {
+	current := hourOf(now)
+	for len(s.pending) > 0 {
+		hour := hourOf(s.pending[0].Timestamp)
+		if !hour.Before(current) {
+			break
+		}
+		n := 0
+		for n < len(s.pending) && hourOf(s.pending[n].Timestamp).Equal(hour) {
+			n++
+		}
+		if err := appendLine(s.hourPath(hour), hourly(hour, s.pending[:n])); err != nil {
+			return err
+		}
+		s.pending = s.pending[n:]
+	}
+	return nil
+}
+
+// hourOf returns the hour a sample belongs to; a sample stamped exactly on the
+// hour closes the previous one
+func hourOf(t time.Time) time.Time {
+	return t.UTC().Add(-time.Nanosecond).Truncate(time.Hour)
+}
+
+func hourly(hour time.Time, samples []*telemetry.TelemetryData) *telemetry.TelemetryData {
+	merged := telemetry.Merge(samples)
+	merged.Timestamp = hour.Add(time.Hour)
+	return merged
+}
+
+// Query returns the samples with timestamps in (from, to], oldest first.
+// Hourly queries include the unfinished current hour. Files are read
+// without holding the lock, so a slow query does not hold up Append.
+func (s *Store) Query(from, to time.Time, res Resolution) ([]*telemetry.TelemetryData, error) {
+	var pending []*telemetry.TelemetryData
+	if res == Hour {
+		s.mu.Lock()
+		pending = append(pending, s.pending...)
+		s.mu.Unlock()
+	}
+
+	samples, err := s.read(res, from, to)
+	if err != nil || len(pending) == 0 {
+		return samples, err
+	}
+
+	hour := hourOf(pending[0].Timestamp)
+	// The hour may have been rolled up since pending was copied
+	for _, sample := range samples {
+		if sample.Timestamp.Equal(hour.Add(time.Hour)) {
+			return samples, nil
+		}
+	}
+	partial := hourly(hour, pending)
+	partial.Timestamp = pending[len(pending)-1].Timestamp
+	if partial.Timestamp.After(from) && !partial.Timestamp.After(to) {
+		samples = append(samples, partial)
+	}
+	return samples, nil
+}
+
+// ResolutionFor picks minute samples while they are still retained, hourly rollups otherwise
+func (s *Store) ResolutionFor(from time.Time) Resolution {
+	if time.Since(from) <= s.retention.Minute {
+		return Minute
+	}
+	return Hour
+}
+
+// read scans the files of one tier that may hold samples in (from, to]
+func (s *Store) read(res Resolution, from, to time.Time) ([]*telemetry.TelemetryData, error) {
+	files, err := s.files(res)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []*telemetry.TelemetryData
+	for _, f := range files {
+		if !f.end.After(from) || f.start.After(to) {
+			continue
+		}
+		samples, err := readFile(f.path)
+		if err != nil {
+			return nil, err
+		}
+		if samples == nil && !f.compressed {
+			// Compressed since the directory was listed
+			if samples, err = readFile(f.path + ".gz"); err != nil {
+				return nil, err
+			}
+		}
+		for _, sample := range samples {
+			if sample.Timestamp.After(from) && !sample.Timestamp.After(to) {
+				out = append(out, sample)
+			}
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Timestamp.Before(out[j].Timestamp) })
+	return out, nil
+}
+
+// Prune compresses minute files of past days and enforces the retention limits
+func (s *Store) Prune(now time.Time) error {
+	minutes, err := s.files(Minute)
+	if err != nil {
+		return err
+	}
+	hours, err := s.files(Hour)
+	if err != nil {
+		return err
+	}
+
+	today := dayOf(now)
+	for i, f := range minutes {
+		if !f.compressed && f.name != today {
+			if err := compress(f.path); err != nil {
+				return err
+			}
+			minutes[i].path += ".gz"
+			minutes[i].compressed = true
+		}
+	}
+
+	minutes, err = expire(minutes, now.Add(-s.retention.Minute))
+	if err != nil {
+		return err
+	}
+	hours, err = expire(hours, now.Add(-s.retention.Hour))
+	if err != nil {
+		return err
+	}
+
+	if s.retention.MaxBytes <= 0 {
+		return nil
+	}
+	var total int64
+	var sizes []int64
+	all := append(minutes, hours...)
+	for _, f := range all {
+		info, err := os.Stat(f.path)
+		if err != nil {
+			sizes = append(sizes, 0)
+			continue
+		}
+		sizes = append(sizes, info.Size())
+		total += info.Size()
+	}
+	// The file being written to is never removed
+	for i, f := range all {
+		if total <= s.retention.MaxBytes {
+			break
+		}
+		if !f.end.Before(now) {
+			continue
+		}
+		if err := os.Remove(f.path); err != nil {
+			return err
+		}
+		total -= sizes[i]
+	}
+	return nil
+}
+
+// expire removes files that end before cutoff and returns the rest
+func expire(files []file, cutoff time.Time) ([]file, error) {
+	var keep []file
+	for _, f := range files {
+		if f.end.Before(cutoff) {
+			if err := os.Remove(f.path); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		keep = append(keep, f)
+	}
+	return keep, nil
+}
+
+// file is one history file and the time range its samples can cover
+type file struct {
+	path       string
+	name       string
+	start, end time.Time
+	compressed bool
+}
+
+// files lists one tier oldest first
+func (s *Store) files(res Resolution) ([]file, error) {
+	layout, span := "2006-01-02", func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }
+	if res == Hour {
+		layout, span = "2006-01", func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }
+	}
+
+	dir := filepath.Join(s.dir, string(res))
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var out []file
+	for _, e := range entries {
+		name := e.Name()
+		compressed := strings.HasSuffix(name, ".jsonl.gz")
+		base := strings.TrimSuffix(strings.TrimSuffix(name, ".gz"), ".jsonl")
+		if base == name {
+			continue
+		}
+		start, err := time.Parse(layout, base)
+		if err != nil {
+			continue
+		}
+		// Samples are stamped with the end of their interval, so a file can hold the next period's first instant
+		out = append(out, file{
+			path:       filepath.Join(dir, name),
+			name:       base,
+			start:      start,
+			end:        span(start).Add(time.Hour),
+			compressed: compressed,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].start.Before(out[j].start) })
+	return out, nil
+}
+
+func (s *Store) minutePath(t time.Time) string {
+	return filepath.Join(s.dir, minuteDir, dayOf(t)+".jsonl")
+}
+
+func (s *Store) hourPath(hour time.Time) string {
+	return filepath.Join(s.dir, hourDir, hour.UTC().Format("2006-01")+".jsonl")
+}
+
+func dayOf(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+func appendLine(path string, data *telemetry.TelemetryData) error {
+	line, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to encode sample: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readFile decodes a (possibly gzipped) file, skipping lines cut short by a crash
+func readFile(path string) ([]*telemetry.TelemetryData, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		// Compressed or pruned meanwhile
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	var out []*telemetry.TelemetryData
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLine)
+	for scanner.Scan() {
+		var sample telemetry.TelemetryData
+		if err := json.Unmarshal(scanner.Bytes(), &sample); err != nil {
+			continue
+		}
+		out = append(out, &sample)
+	}
+	if err := scanner.Err(); err != nil && err != io.ErrUnexpectedEOF {
+		return out, fmt.Errorf("%s: %w", path, err)
+	}
+	return out, nil
+}
+
+// compress replaces path with path.gz
+func compress(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := path + ".gz.tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
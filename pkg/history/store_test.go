@@ -0,0 +1,226 @@
+package history
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"isp-agent/pkg/telemetry"
+)
+
+var longRetention = Retention{Minute: 10 * 365 * 24 * time.Hour, Hour: 10 * 365 * 24 * time.Hour}
+
+func sample(t time.Time, requests int64) *telemetry.TelemetryData {
+	return &telemetry.TelemetryData{
+		Timestamp:       t,
+		IntervalSeconds: 60,
+		Profiles:        map[string]telemetry.TrafficStats{"steam": {Requests: requests}},
+	}
+}
+
+func openStore(t *testing.T, retention Retention) *Store {
+	t.Helper()
+	s, err := Open(t.TempDir(), retention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func appendAll(t *testing.T, s *Store, samples ...*telemetry.TelemetryData) {
+	t.Helper()
+	for _, d := range samples {
+		if err := s.Append(d); err != nil {
+			t.Fatalf("Append(%s): %v", d.Timestamp, err)
+		}
+	}
+}
+
+func requests(samples []*telemetry.TelemetryData) []int64 {
+	var out []int64
+	for _, d := range samples {
+		out = append(out, d.Profiles["steam"].Requests)
+	}
+	return out
+}
+
+func equal(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestAppendAndQuery(t *testing.T) {
+	s := openStore(t, longRetention)
+	base := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	appendAll(t, s,
+		sample(base.Add(1*time.Minute), 1),
+		sample(base.Add(2*time.Minute), 2),
+		sample(base.Add(3*time.Minute), 3),
+	)
+
+	if err := s.Append(&telemetry.TelemetryData{}); err == nil {
+		t.Error("Append accepted a sample without timestamp")
+	}
+
+	tests := []struct {
+		name     string
+		from, to time.Time
+		want     []int64
+	}{
+		{"all", base, base.Add(time.Hour), []int64{1, 2, 3}},
+		{"from is exclusive", base.Add(time.Minute), base.Add(time.Hour), []int64{2, 3}},
+		{"to is inclusive", base, base.Add(2 * time.Minute), []int64{1, 2}},
+		{"empty range", base.Add(time.Hour), base.Add(2 * time.Hour), nil},
+	}
+	for _, tt := range tests {
+		got, err := s.Query(tt.from, tt.to, Minute)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !equal(requests(got), tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, requests(got), tt.want)
+		}
+	}
+}
+
+func TestHourlyRollup(t *testing.T) {
+	s := openStore(t, longRetention)
+	hour := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	appendAll(t, s,
+		sample(hour.Add(10*time.Minute), 1),
+		sample(hour.Add(20*time.Minute), 2),
+		// Stamped on the hour, so it still belongs to the first one
+		sample(hour.Add(60*time.Minute), 4),
+		sample(hour.Add(70*time.Minute), 8),
+	)
+
+	if !exists(filepath.Join(s.Dir(), hourDir, "2024-03.jsonl")) {
+		t.Fatal("no hourly file written")
+	}
+
+	got, err := s.Query(hour, hour.Add(3*time.Hour), Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{7, 8}; !equal(requests(got), want) {
+		t.Fatalf("hourly requests %v, want %v", requests(got), want)
+	}
+	if !got[0].Timestamp.Equal(hour.Add(time.Hour)) {
+		t.Errorf("rollup stamped %s, want the end of the hour", got[0].Timestamp)
+	}
+	if got[0].IntervalSeconds != 180 {
+		t.Errorf("rollup covers %ds, want 180", got[0].IntervalSeconds)
+	}
+	// The unfinished hour is merged on the fly and stamped with its latest sample
+	if !got[1].Timestamp.Equal(hour.Add(70 * time.Minute)) {
+		t.Errorf("partial hour stamped %s", got[1].Timestamp)
+	}
+}
+
+func TestReopenKeepsUnfinishedHour(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, longRetention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	hour := hourOf(now)
+	appendAll(t, s, sample(hour.Add(-30*time.Minute), 1), sample(hour.Add(now.Sub(hour)/2), 2), sample(now, 3))
+
+	s, err = Open(dir, longRetention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Query(hour.Add(-2*time.Hour), now.Add(time.Hour), Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{1, 5}; !equal(requests(got), want) {
+		t.Errorf("after reopen: hourly requests %v, want %v", requests(got), want)
+	}
+}
+
+func TestDailyRotation(t *testing.T) {
+	s := openStore(t, longRetention)
+	day := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+	appendAll(t, s,
+		sample(day.Add(-time.Minute), 1),
+		sample(day.Add(time.Minute), 2),
+	)
+
+	minutes := filepath.Join(s.Dir(), minuteDir)
+	tests := []struct {
+		file string
+		want bool
+	}{
+		{"2024-03-09.jsonl", false},
+		{"2024-03-09.jsonl.gz", true},
+		{"2024-03-10.jsonl", true},
+	}
+	for _, tt := range tests {
+		if got := exists(filepath.Join(minutes, tt.file)); got != tt.want {
+			t.Errorf("%s exists = %v, want %v", tt.file, got, tt.want)
+		}
+	}
+
+	got, err := s.Query(day.Add(-time.Hour), day.Add(time.Hour), Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{1, 2}; !equal(requests(got), want) {
+		t.Errorf("across compressed day: got %v, want %v", requests(got), want)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	day := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+
+	t.Run("age", func(t *testing.T) {
+		s := openStore(t, Retention{Minute: 2 * 24 * time.Hour, Hour: 10 * 24 * time.Hour})
+		appendAll(t, s,
+			sample(day.Add(-5*24*time.Hour+time.Hour), 1),
+			sample(day.Add(-24*time.Hour+time.Hour), 2),
+			sample(day.Add(time.Hour), 3),
+		)
+		got, err := s.Query(day.Add(-6*24*time.Hour), day.Add(24*time.Hour), Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []int64{2, 3}; !equal(requests(got), want) {
+			t.Errorf("minute samples %v, want %v", requests(got), want)
+		}
+		if hours, _ := s.Query(day.Add(-6*24*time.Hour), day, Hour); len(hours) == 0 {
+			t.Error("hourly rollups expired with the minute samples")
+		}
+	})
+
+	t.Run("size", func(t *testing.T) {
+		s := openStore(t, Retention{Minute: longRetention.Minute, Hour: longRetention.Hour, MaxBytes: 1})
+		appendAll(t, s,
+			sample(day.Add(-2*24*time.Hour), 1),
+			sample(day.Add(-24*time.Hour), 2),
+			sample(day.Add(2*time.Hour), 3),
+		)
+		got, err := s.Query(day.Add(-3*24*time.Hour), day.Add(24*time.Hour), Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Everything but the file being written to goes
+		if want := []int64{3}; !equal(requests(got), want) {
+			t.Errorf("minute samples %v, want %v", requests(got), want)
+		}
+	})
+}
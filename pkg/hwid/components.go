@@ -0,0 +1,194 @@
+package hwid
+
+import (
+    "bufio"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+)
+
+// Component is one hardware fact contributing to the fingerprint
+type Component struct {
+    Name   string
+    Weight int
+    Value  string
+}
+
+// Component names, also reported to the SaaS when they drift
+const (
+    ComponentMachineID = "machine_id"
+    ComponentMACs      = "nic_macs"
+    ComponentDMI       = "dmi_uuid"
+    ComponentDisk      = "root_disk_serial"
+    ComponentCPU       = "cpu_model"
+)
+
+// CollectComponents reads every fingerprint component from sysfs and procfs.
+// Components that cannot be read have an empty value.
+func CollectComponents() []Component {
+    return []Component{
+        {Name: ComponentMachineID, Weight: 3, Value: machineID()},
+        {Name: ComponentMACs, Weight: 2, Value: strings.Join(physicalMACs(), ",")},
+        {Name: ComponentDMI, Weight: 3, Value: dmiUUID()},
+        {Name: ComponentDisk, Weight: 2, Value: rootDiskSerial()},
+        {Name: ComponentCPU, Weight: 1, Value: cpuModel()},
+    }
+}
+
+func machineID() string {
+    for _, path := range []string{"/etc/machine-id", "/var/lib/dbus/machine-id"} {
+        if id, err := readFile(path); err == nil && id != "" {
+            return id
+        }
+    }
+    return ""
+}
+
+// physicalMACs returns the sorted permanent MACs of NICs backed by a device
+func physicalMACs() []string {
+    entries, err := os.ReadDir("/sys/class/net")
+    if err != nil {
+        return nil
+    }
+    
+    var macs []string
+    for _, entry := range entries {
+        iface := entry.Name()
+        base := filepath.Join("/sys/class/net", iface)
+        
+        // Virtual interfaces (bridges, bonds, veth, tun) have no device link
+        if _, err := os.Stat(filepath.Join(base, "device")); err != nil {
+            continue
+        }
+        
+        mac := permanentMAC(iface, base)
+        if mac == "" || mac == "00:00:00:00:00:00" {
+            continue
+        }
+        macs = append(macs, mac)
+    }
+    
+    sort.Strings(macs)
+    return macs
+}
+
+// permanentMAC returns the burned-in MAC, looking through bonding which rewrites addresses
+func permanentMAC(iface, base string) string {
+    if master, err := os.Readlink(filepath.Join(base, "master")); err == nil {
+        if mac := bondingPermanentMAC(filepath.Base(master), iface); mac != "" {
+            return mac
+        }
+    }
+    mac, _ := readFile(filepath.Join(base, "address"))
+    return strings.ToLower(mac)
+}
+
+func bondingPermanentMAC(bond, iface string) string {
+    file, err := os.Open(filepath.Join("/proc/net/bonding", bond))
+    if err != nil {
+        return ""
+    }
+    defer file.Close()
+    
+    current := ""
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        line := scanner.Text()
+        if strings.HasPrefix(line, "Slave Interface:") {
+            current = strings.TrimSpace(strings.TrimPrefix(line, "Slave Interface:"))
+        } else if current == iface && strings.HasPrefix(line, "Permanent HW addr:") {
+            return strings.ToLower(strings.TrimSpace(strings.TrimPrefix(line, "Permanent HW addr:")))
+        }
+    }
+    return ""
+}
+
+func dmiUUID() string {
+    for _, name := range []string{"product_uuid", "board_serial", "product_serial"} {
+        value, err := readFile(filepath.Join("/sys/class/dmi/id", name))
+        if err == nil && value != "" && !isPlaceholder(value) {
+            return strings.ToLower(value)
+        }
+    }
+    return ""
+}
+
+// isPlaceholder detects vendor filler values found in cheap DMI tables
+func isPlaceholder(value string) bool {
+    v := strings.ToLower(value)
+    switch v {
+    case "none", "default string", "to be filled by o.e.m.", "not specified", "0", "03000200-0400-0500-0006-000700080009":
+        return true
+    }
+    return strings.Trim(v, "0-") == "" || strings.Trim(v, "f-") == ""
+}
+
+// rootDiskSerial returns the serial of the block device holding "/"
+func rootDiskSerial() string {
+    dev := rootBlockDevice()
+    if dev == "" {
+        return ""
+    }
+    
+    base := filepath.Join("/sys/class/block", dev)
+    // Partitions inherit the serial of their parent disk
+    if _, err := os.Stat(filepath.Join(base, "partition")); err == nil {
+        if target, err := filepath.EvalSymlinks(base); err == nil {
+            dev = filepath.Base(filepath.Dir(target))
+            base = filepath.Join("/sys/class/block", dev)
+        }
+    }
+    
+    for _, name := range []string{"device/serial", "serial", "device/wwid", "wwid"} {
+        if value, err := readFile(filepath.Join(base, name)); err == nil && value != "" {
+            return value
+        }
+    }
+    return ""
+}
+
+// rootBlockDevice finds the kernel name of the device mounted at "/"
+func rootBlockDevice() string {
+    file, err := os.Open("/proc/self/mountinfo")
+    if err != nil {
+        return ""
+    }
+    defer file.Close()
+    
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        fields := strings.Fields(scanner.Text())
+        if len(fields) < 5 || fields[4] != "/" {
+            continue
+        }
+        // fields[2] is major:minor of the mounted device
+        target, err := filepath.EvalSymlinks(filepath.Join("/sys/dev/block", fields[2]))
+        if err != nil {
+            return ""
+        }
+        return filepath.Base(target)
+    }
+    return ""
+}
+
+func cpuModel() string {
+    file, err := os.Open("/proc/cpuinfo")
+    if err != nil {
+        return ""
+    }
+    defer file.Close()
+    
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        key, value, ok := strings.Cut(scanner.Text(), ":")
+        if !ok {
+            continue
+        }
+        key = strings.TrimSpace(key)
+        if key == "model name" || key == "Model" || key == "cpu model" {
+            return strings.Join(strings.Fields(value), " ")
+        }
+    }
+    return ""
+}
@@ -1,37 +1,130 @@
 package hwid
 
 import (
+    "crypto/hmac"
     "crypto/md5"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
     "fmt"
+    "net"
     "os"
-    "os/exec"
+    "path/filepath"
+    "sort"
     "strings"
+    "time"
 )
 
+var (
+    legacyPath   = "/etc/isp-agent/hwid"
+    identityPath = "/etc/isp-agent/identity.json"
+    // The identity key lives outside /etc/isp-agent so copying that directory does not copy it
+    keyPath = "/var/lib/isp-agent/identity.key"
+    
+    // collectComponents is replaced in tests
+    collectComponents = CollectComponents
+)
+
+var (
+    ErrTampered     = errors.New("identity file not created on this machine")
+    ErrTooMuchDrift = errors.New("too many hardware components changed to keep the hardware ID")
+)
+
+// DefaultMaxDrift is how many components may change before the ID is regenerated
+const DefaultMaxDrift = 2
+
+// Identity is the stored hardware ID with the component snapshot taken at
+// enrollment. Drift is always measured against that snapshot; only an
+// explicit Reenroll replaces it.
+type Identity struct {
+    HWID       string            `json:"hw_id"`
+    Components map[string]string `json:"components"`
+    CreatedAt  time.Time         `json:"created_at"`
+    
+    // Drifted lists components that changed and have not been reported yet
+    Drifted []string `json:"drifted,omitempty"`
+    // Reported lists changed components the SaaS already knows about
+    Reported []string `json:"reported,omitempty"`
+    
+    // HMAC authenticates the fields above with a machine-local key
+    HMAC string `json:"hmac,omitempty"`
+}
+
+// Result describes how the hardware ID was resolved on this boot
+type Result struct {
+    HWID        string
+    Drifted     []string
+    Regenerated bool
+    
+    // Tampered is set when the stored identity failed verification,
+    // e.g. because /etc/isp-agent was copied from another server
+    Tampered     bool
+    TamperReason string
+    PreviousHWID string
+}
+
 // Generate creates a unique hardware ID for this server
 func Generate() (string, error) {
-    // Get machine-id (Linux)
-    machineID, err := readFile("/etc/machine-id")
-    if err != nil {
-        machineID, err = readFile("/var/lib/dbus/machine-id")
-        if err != nil {
-            // Fallback to hostname
-            machineID, _ = os.Hostname()
+    fingerprint := Fingerprint(collectComponents())
+    if len(fingerprint) == 0 {
+        return "", fmt.Errorf("no hardware components readable")
+    }
+    return idFromFingerprint(fingerprint), nil
+}
+
+// Fingerprint hashes each readable component value
+func Fingerprint(components []Component) map[string]string {
+    fingerprint := make(map[string]string, len(components))
+    for _, c := range components {
+        if c.Value == "" {
+            continue
         }
+        sum := sha256.Sum256([]byte(c.Name + "=" + c.Value))
+        fingerprint[c.Name] = hex.EncodeToString(sum[:])
+    }
+    return fingerprint
+}
+
+func idFromFingerprint(fingerprint map[string]string) string {
+    names := make([]string, 0, len(fingerprint))
+    for name := range fingerprint {
+        names = append(names, name)
     }
+    sort.Strings(names)
     
-    // Get primary network interface MAC
-    mac, err := getMACAddress()
-    if err != nil {
-        mac = "unknown"
+    h := sha256.New()
+    for _, name := range names {
+        fmt.Fprintf(h, "%s=%s\n", name, fingerprint[name])
     }
+    return fmt.Sprintf("ISP-%X", h.Sum(nil)[:16])
+}
+
+// Compare returns the components of stored that changed or disappeared in current,
+// and whether the snapshot still matches: at most maxDrift components changed
+// and the unchanged components carry at least half of the total weight.
+func Compare(stored, current map[string]string, components []Component, maxDrift int) ([]string, bool) {
+    var drifted []string
+    total, kept := 0, 0
     
-    // Combine and hash
-    combined := fmt.Sprintf("%s-%s", machineID, mac)
-    hash := md5.Sum([]byte(combined))
-    hwid := fmt.Sprintf("ISP-%X", hash)
+    for _, c := range components {
+        old, ok := stored[c.Name]
+        if !ok {
+            continue // Not part of the snapshot, nothing to compare
+        }
+        total += c.Weight
+        if current[c.Name] == old {
+            kept += c.Weight
+        } else {
+            drifted = append(drifted, c.Name)
+        }
+    }
     
-    return hwid, nil
+    if total == 0 {
+        return drifted, false
+    }
+    return drifted, len(drifted) <= maxDrift && kept*2 >= total
 }
 
 func readFile(path string) (string, error) {
@@ -42,57 +135,314 @@ func readFile(path string) (string, error) {
     return strings.TrimSpace(string(data)), nil
 }
 
-func getMACAddress() (string, error) {
-    // Try to get MAC from ip command
-    cmd := exec.Command("sh", "-c", "ip link show | grep 'link/ether' | head -1 | awk '{print $2}'")
-    output, err := cmd.Output()
-    if err != nil {
-        return "", err
+// Load retrieves the HWID stored by older agents in plaintext
+func Load() (string, error) {
+    return readFile(legacyPath)
+}
+
+// legacyMatches reports whether id is what older agents generated on this
+// machine: the MD5 of the machine-id (or hostname) and the MAC of the first
+// interface "ip link" listed, "unknown" or all zeroes when there was none
+func legacyMatches(id string) bool {
+    host := machineID()
+    if host == "" {
+        host, _ = os.Hostname()
     }
     
-    mac := strings.TrimSpace(string(output))
-    if mac == "" {
-        return "00:00:00:00:00:00", nil
+    macs := []string{"unknown", "00:00:00:00:00:00"}
+    if ifaces, err := net.Interfaces(); err == nil {
+        for _, iface := range ifaces {
+            if len(iface.HardwareAddr) > 0 {
+                macs = append(macs, iface.HardwareAddr.String())
+            }
+        }
+    }
+    for _, mac := range macs {
+        if strings.EqualFold(legacyID(host, mac), id) {
+            return true
+        }
+    }
+    return false
+}
+
+func legacyID(machineID, mac string) string {
+    return fmt.Sprintf("ISP-%X", md5.Sum([]byte(machineID+"-"+mac)))
+}
+
+// localKey derives the HMAC key from the machine-id and a secret kept outside /etc/isp-agent
+func localKey(create bool) ([]byte, error) {
+    secret, err := os.ReadFile(keyPath)
+    if os.IsNotExist(err) && create {
+        secret = make([]byte, 32)
+        if _, err := rand.Read(secret); err != nil {
+            return nil, err
+        }
+        os.MkdirAll(filepath.Dir(keyPath), 0700)
+        if err := os.WriteFile(keyPath, secret, 0600); err != nil {
+            return nil, err
+        }
+    } else if err != nil {
+        return nil, err
     }
     
-    return mac, nil
+    h := sha256.New()
+    h.Write(secret)
+    h.Write([]byte(machineID()))
+    return h.Sum(nil), nil
 }
 
-// Save stores the HWID to a local file
-func Save(hwid string) error {
-    return os.WriteFile("/etc/isp-agent/hwid", []byte(hwid), 0644)
+// sign computes the identity HMAC over every field except the HMAC itself
+func (i *Identity) sign(key []byte) string {
+    unsigned := *i
+    unsigned.HMAC = ""
+    data, _ := json.Marshal(unsigned)
+    
+    mac := hmac.New(sha256.New, key)
+    mac.Write(data)
+    return hex.EncodeToString(mac.Sum(nil))
 }
 
-// Load retrieves the stored HWID
-func Load() (string, error) {
-    data, err := os.ReadFile("/etc/isp-agent/hwid")
+// verify checks the identity HMAC against this machine's key
+func (i *Identity) verify() error {
+    // Deleting the field must not bypass the check
+    if i.HMAC == "" {
+        return fmt.Errorf("%w: HMAC missing", ErrTampered)
+    }
+    key, err := localKey(false)
+    if os.IsNotExist(err) {
+        return fmt.Errorf("%w: identity key missing", ErrTampered)
+    }
     if err != nil {
-        return "", err
+        return err
     }
-    return strings.TrimSpace(string(data)), nil
+    expected, err := hex.DecodeString(i.sign(key))
+    if err != nil {
+        return err
+    }
+    actual, err := hex.DecodeString(i.HMAC)
+    if err != nil || !hmac.Equal(expected, actual) {
+        return fmt.Errorf("%w: HMAC mismatch", ErrTampered)
+    }
+    return nil
 }
 
-// GetOrCreate gets existing HWID or creates new one
-func GetOrCreate() (string, error) {
-    // Try to load existing
-    hwid, err := Load()
-    if err == nil && hwid != "" {
-        return hwid, nil
+// LoadIdentity reads the stored identity with its component snapshot
+func LoadIdentity() (*Identity, error) {
+    data, err := os.ReadFile(identityPath)
+    if err != nil {
+        return nil, err
+    }
+    var identity Identity
+    if err := json.Unmarshal(data, &identity); err != nil {
+        return nil, fmt.Errorf("corrupt identity file: %w", err)
+    }
+    return &identity, nil
+}
+
+// SaveIdentity signs the identity with the machine-local key and stores it
+func SaveIdentity(identity *Identity) error {
+    key, err := localKey(true)
+    if err != nil {
+        return fmt.Errorf("failed to load identity key: %w", err)
+    }
+    identity.HMAC = identity.sign(key)
+    
+    os.MkdirAll(filepath.Dir(identityPath), 0755)
+    
+    data, err := json.MarshalIndent(identity, "", "  ")
+    if err != nil {
+        return err
+    }
+    tmp := identityPath + ".tmp"
+    if err := os.WriteFile(tmp, data, 0600); err != nil {
+        return err
+    }
+    return os.Rename(tmp, identityPath)
+}
+
+// Resolve matches the current hardware against the stored snapshot.
+// The stored ID is kept while at most maxDrift components changed;
+// otherwise a new ID is generated.
+func Resolve(maxDrift int) (*Result, error) {
+    components := collectComponents()
+    current := Fingerprint(components)
+    if len(current) == 0 {
+        return nil, fmt.Errorf("no hardware components readable")
     }
     
-    // Generate new
-    hwid, err = Generate()
+    identity, err := LoadIdentity()
+    if os.IsNotExist(err) {
+        // Adopt an ID written by older agents so existing licenses keep working,
+        // unless this machine already had a signed identity or the ID was
+        // generated on another machine
+        _, keyErr := os.Stat(keyPath)
+        if legacy, err := Load(); err == nil && legacy != "" && os.IsNotExist(keyErr) {
+            if !legacyMatches(legacy) {
+                result, createErr := create(current)
+                if result != nil {
+                    result.Tampered = true
+                    result.TamperReason = fmt.Sprintf("%v: legacy hardware ID does not match this machine", ErrTampered)
+                    result.PreviousHWID = legacy
+                }
+                return result, createErr
+            }
+            identity = &Identity{HWID: legacy, Components: current, CreatedAt: time.Now().UTC()}
+            if err := SaveIdentity(identity); err != nil {
+                return &Result{HWID: legacy}, err
+            }
+            // The plaintext copy could otherwise be used to clone this identity
+            os.Remove(legacyPath)
+            return &Result{HWID: legacy}, nil
+        }
+        return create(current)
+    }
     if err != nil {
-        return "", err
+        result, createErr := create(current)
+        if result != nil {
+            result.Tampered = true
+            result.TamperReason = err.Error()
+        }
+        return result, createErr
+    }
+    
+    // An identity without a valid HMAC, including one whose HMAC was removed, is tampered
+    if err := identity.verify(); err != nil {
+        if !errors.Is(err, ErrTampered) {
+            return nil, err
+        }
+        result, createErr := create(current)
+        if result != nil {
+            result.Tampered = true
+            result.TamperReason = err.Error()
+            result.PreviousHWID = identity.HWID
+        }
+        return result, createErr
     }
     
-    // Create directory if needed
-    os.MkdirAll("/etc/isp-agent", 0755)
+    drifted, ok := Compare(identity.Components, current, components, maxDrift)
+    if !ok {
+        result, err := create(current)
+        if result != nil {
+            result.Drifted = drifted
+        }
+        return result, err
+    }
+    
+    // The enrolled snapshot stays as it is, so components cannot be swapped
+    // one per boot until none of the original hardware is left. Only drift
+    // that was not reported yet is passed on.
+    pending := keepDrifted(mergeDrift(identity.Drifted, drifted), drifted, identity.Reported)
+    reported := keepDrifted(identity.Reported, drifted, nil)
+    if !sameNames(pending, identity.Drifted) || !sameNames(reported, identity.Reported) {
+        identity.Drifted, identity.Reported = pending, reported
+        if err := SaveIdentity(identity); err != nil {
+            return &Result{HWID: identity.HWID, Drifted: identity.Drifted}, err
+        }
+    }
     
-    // Save for future use
-    if err := Save(hwid); err != nil {
-        return hwid, err // Return HWID even if save fails
+    return &Result{HWID: identity.HWID, Drifted: identity.Drifted}, nil
+}
+
+// Reenroll replaces the enrolled snapshot with the current hardware while
+// keeping the hardware ID. It refuses when the hardware changed beyond what
+// Resolve tolerates, since that ID would be regenerated anyway.
+func Reenroll(maxDrift int) (string, error) {
+    components := collectComponents()
+    current := Fingerprint(components)
+    if len(current) == 0 {
+        return "", fmt.Errorf("no hardware components readable")
     }
     
-    return hwid, nil
+    identity, err := LoadIdentity()
+    if err != nil {
+        return "", err
+    }
+    if err := identity.verify(); err != nil {
+        return "", err
+    }
+    if drifted, ok := Compare(identity.Components, current, components, maxDrift); !ok {
+        return "", fmt.Errorf("%w: %s", ErrTooMuchDrift, strings.Join(drifted, ", "))
+    }
+    
+    identity.Components = current
+    identity.Drifted = nil
+    identity.Reported = nil
+    return identity.HWID, SaveIdentity(identity)
+}
+
+func create(fingerprint map[string]string) (*Result, error) {
+    identity := &Identity{
+        HWID:       idFromFingerprint(fingerprint),
+        Components: fingerprint,
+        CreatedAt:  time.Now().UTC(),
+    }
+    // Return HWID even if save fails
+    return &Result{HWID: identity.HWID, Regenerated: true}, SaveIdentity(identity)
+}
+
+func mergeDrift(pending, drifted []string) []string {
+    seen := make(map[string]bool)
+    var merged []string
+    for _, name := range append(pending, drifted...) {
+        if !seen[name] {
+            seen[name] = true
+            merged = append(merged, name)
+        }
+    }
+    return merged
+}
+
+// keepDrifted returns the names in names that are still drifted and not in skip
+func keepDrifted(names, drifted, skip []string) []string {
+    var kept []string
+    for _, name := range names {
+        if contains(drifted, name) && !contains(skip, name) {
+            kept = append(kept, name)
+        }
+    }
+    return kept
+}
+
+func contains(names []string, name string) bool {
+    for _, n := range names {
+        if n == name {
+            return true
+        }
+    }
+    return false
+}
+
+func sameNames(a, b []string) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for i := range a {
+        if a[i] != b[i] {
+            return false
+        }
+    }
+    return true
+}
+
+// AcknowledgeDrift marks pending drift as reported once the SaaS has it
+func AcknowledgeDrift() error {
+    identity, err := LoadIdentity()
+    if err != nil {
+        return err
+    }
+    if len(identity.Drifted) == 0 {
+        return nil
+    }
+    identity.Reported = mergeDrift(identity.Reported, identity.Drifted)
+    identity.Drifted = nil
+    return SaveIdentity(identity)
+}
+
+// GetOrCreate gets existing HWID or creates new one
+func GetOrCreate() (string, error) {
+    result, err := Resolve(DefaultMaxDrift)
+    if result == nil {
+        return "", err
+    }
+    return result.HWID, err
 }
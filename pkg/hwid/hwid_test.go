@@ -0,0 +1,286 @@
+package hwid
+
+import (
+    "encoding/json"
+    "errors"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+// testMachine points the identity files at a temporary directory and
+// returns a hardware stub whose component values the test can change
+func testMachine(t *testing.T) map[string]string {
+    t.Helper()
+    dir := t.TempDir()
+    paths := []*string{&legacyPath, &identityPath, &keyPath}
+    saved := []string{legacyPath, identityPath, keyPath}
+    savedCollect := collectComponents
+    t.Cleanup(func() {
+        for i, p := range paths {
+            *p = saved[i]
+        }
+        collectComponents = savedCollect
+    })
+    legacyPath = filepath.Join(dir, "etc", "hwid")
+    identityPath = filepath.Join(dir, "etc", "identity.json")
+    keyPath = filepath.Join(dir, "lib", "identity.key")
+
+    values := map[string]string{
+        ComponentMachineID: "0123456789abcdef",
+        ComponentMACs:      "52:54:00:12:34:56",
+        ComponentDMI:       "4c4c4544-0042-3510-8052-b4c04f333232",
+        ComponentDisk:      "S3Z8NB0K123456",
+        ComponentCPU:       "Intel(R) Xeon(R) E-2236 CPU @ 3.40GHz",
+    }
+    collectComponents = func() []Component {
+        return []Component{
+            {Name: ComponentMachineID, Weight: 3, Value: values[ComponentMachineID]},
+            {Name: ComponentMACs, Weight: 2, Value: values[ComponentMACs]},
+            {Name: ComponentDMI, Weight: 3, Value: values[ComponentDMI]},
+            {Name: ComponentDisk, Weight: 2, Value: values[ComponentDisk]},
+            {Name: ComponentCPU, Weight: 1, Value: values[ComponentCPU]},
+        }
+    }
+    return values
+}
+
+func resolve(t *testing.T) *Result {
+    t.Helper()
+    result, err := Resolve(DefaultMaxDrift)
+    if err != nil {
+        t.Fatalf("Resolve: %v", err)
+    }
+    return result
+}
+
+// editIdentity rewrites the stored identity file without re-signing it
+func editIdentity(t *testing.T, edit func(map[string]interface{})) {
+    t.Helper()
+    data, err := os.ReadFile(identityPath)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var raw map[string]interface{}
+    if err := json.Unmarshal(data, &raw); err != nil {
+        t.Fatal(err)
+    }
+    edit(raw)
+    if data, err = json.Marshal(raw); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.WriteFile(identityPath, data, 0600); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestResolveSignsAndKeepsIdentity(t *testing.T) {
+    testMachine(t)
+
+    first := resolve(t)
+    if !first.Regenerated || first.Tampered {
+        t.Fatalf("first boot: got %+v, want a newly generated ID", first)
+    }
+    identity, err := LoadIdentity()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if identity.HMAC == "" {
+        t.Fatal("stored identity carries no HMAC")
+    }
+    if info, err := os.Stat(identityPath); err != nil || info.Mode().Perm() != 0600 {
+        t.Errorf("identity file mode: %v, %v; want 0600", info.Mode().Perm(), err)
+    }
+
+    second := resolve(t)
+    if second.HWID != first.HWID || second.Regenerated || second.Tampered {
+        t.Errorf("second boot: got %+v, want %s kept", second, first.HWID)
+    }
+}
+
+func TestResolveRejectsTamperedIdentity(t *testing.T) {
+    tests := []struct {
+        name   string
+        tamper func(t *testing.T)
+    }{
+        {"edited hwid", func(t *testing.T) {
+            editIdentity(t, func(raw map[string]interface{}) { raw["hw_id"] = "ISP-COPIED" })
+        }},
+        {"removed hmac", func(t *testing.T) {
+            editIdentity(t, func(raw map[string]interface{}) { delete(raw, "hmac") })
+        }},
+        {"edited components", func(t *testing.T) {
+            editIdentity(t, func(raw map[string]interface{}) { raw["components"] = map[string]string{ComponentCPU: "x"} })
+        }},
+        {"copied without key", func(t *testing.T) {
+            // /etc/isp-agent copied to a machine that never had the key
+            if err := os.Remove(keyPath); err != nil {
+                t.Fatal(err)
+            }
+        }},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            testMachine(t)
+            original := resolve(t)
+
+            tt.tamper(t)
+            stored, err := LoadIdentity()
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            result := resolve(t)
+            if !result.Tampered || !result.Regenerated {
+                t.Fatalf("got %+v, want a tampered identity replaced by a new one", result)
+            }
+            if result.PreviousHWID != stored.HWID {
+                t.Errorf("previous hwid %q, want %q", result.PreviousHWID, stored.HWID)
+            }
+            // Same hardware, so the regenerated ID matches the original one
+            if result.HWID != original.HWID {
+                t.Errorf("regenerated %s, want %s from the same hardware", result.HWID, original.HWID)
+            }
+            if after := resolve(t); after.Tampered || after.HWID != result.HWID {
+                t.Errorf("after regeneration: got %+v, want %s kept", after, result.HWID)
+            }
+        })
+    }
+}
+
+func TestCompareThreshold(t *testing.T) {
+    components := []Component{
+        {Name: ComponentMachineID, Weight: 3},
+        {Name: ComponentMACs, Weight: 2},
+        {Name: ComponentDMI, Weight: 3},
+        {Name: ComponentDisk, Weight: 2},
+        {Name: ComponentCPU, Weight: 1},
+    }
+    stored := map[string]string{
+        ComponentMachineID: "m", ComponentMACs: "n", ComponentDMI: "d", ComponentDisk: "s", ComponentCPU: "c",
+    }
+    changed := func(names ...string) map[string]string {
+        current := make(map[string]string, len(stored))
+        for k, v := range stored {
+            current[k] = v
+        }
+        for _, name := range names {
+            current[name] = "new"
+        }
+        return current
+    }
+
+    tests := []struct {
+        name    string
+        current map[string]string
+        drifted int
+        ok      bool
+    }{
+        {"unchanged", changed(), 0, true},
+        {"one light component", changed(ComponentCPU), 1, true},
+        {"two components", changed(ComponentMACs, ComponentDisk), 2, true},
+        {"three components", changed(ComponentMACs, ComponentDisk, ComponentCPU), 3, false},
+        // Within the count but less than half the weight is left
+        {"two heavy components", changed(ComponentMachineID, ComponentDMI), 2, false},
+    }
+    for _, tt := range tests {
+        drifted, ok := Compare(stored, tt.current, components, DefaultMaxDrift)
+        if len(drifted) != tt.drifted || ok != tt.ok {
+            t.Errorf("%s: got %v, %v; want %d drifted, %v", tt.name, drifted, ok, tt.drifted, tt.ok)
+        }
+    }
+}
+
+func TestResolveMeasuresDriftFromEnrollment(t *testing.T) {
+    values := testMachine(t)
+    enrolled := resolve(t).HWID
+
+    values[ComponentCPU] = "AMD EPYC 7302P"
+    result := resolve(t)
+    if result.HWID != enrolled || len(result.Drifted) != 1 {
+        t.Fatalf("one component changed: got %+v, want %s with cpu drift", result, enrolled)
+    }
+    if err := AcknowledgeDrift(); err != nil {
+        t.Fatal(err)
+    }
+    if result := resolve(t); len(result.Drifted) != 0 {
+        t.Errorf("reported drift came back as pending: %v", result.Drifted)
+    }
+
+    values[ComponentDisk] = "WD-WX12A3456789"
+    if result := resolve(t); result.HWID != enrolled {
+        t.Fatalf("two components changed: got %s, want %s kept", result.HWID, enrolled)
+    }
+
+    // A third part swapped on a later boot counts against the enrolled
+    // snapshot, not against the previous boot
+    values[ComponentMACs] = "52:54:00:ab:cd:ef"
+    result = resolve(t)
+    if result.HWID == enrolled || !result.Regenerated {
+        t.Errorf("three components changed since enrollment: got %+v, want a new ID", result)
+    }
+}
+
+func TestReenroll(t *testing.T) {
+    values := testMachine(t)
+    enrolled := resolve(t).HWID
+
+    values[ComponentCPU] = "AMD EPYC 7302P"
+    values[ComponentDisk] = "WD-WX12A3456789"
+    id, err := Reenroll(DefaultMaxDrift)
+    if err != nil || id != enrolled {
+        t.Fatalf("Reenroll: %s, %v; want %s", id, err, enrolled)
+    }
+
+    // Two more changes are tolerated again after re-enrollment
+    values[ComponentMACs] = "52:54:00:ab:cd:ef"
+    values[ComponentMachineID] = "fedcba9876543210"
+    if result := resolve(t); result.HWID != enrolled || len(result.Drifted) != 2 {
+        t.Errorf("after re-enrollment: got %+v, want %s with two drifted", result, enrolled)
+    }
+
+    values[ComponentDMI] = "00000000-1111-2222-3333-444444444444"
+    if _, err := Reenroll(DefaultMaxDrift); !errors.Is(err, ErrTooMuchDrift) {
+        t.Errorf("Reenroll beyond the threshold: got %v, want ErrTooMuchDrift", err)
+    }
+}
+
+func TestResolveLegacyID(t *testing.T) {
+    t.Run("generated here", func(t *testing.T) {
+        testMachine(t)
+        host := machineID()
+        if host == "" {
+            host, _ = os.Hostname()
+        }
+        legacy := legacyID(host, "unknown")
+        os.MkdirAll(filepath.Dir(legacyPath), 0755)
+        if err := os.WriteFile(legacyPath, []byte(legacy+"\n"), 0644); err != nil {
+            t.Fatal(err)
+        }
+
+        result := resolve(t)
+        if result.HWID != legacy || result.Tampered {
+            t.Fatalf("got %+v, want legacy %s adopted", result, legacy)
+        }
+        if _, err := os.Stat(legacyPath); !os.IsNotExist(err) {
+            t.Error("legacy file kept after adoption")
+        }
+        if identity, err := LoadIdentity(); err != nil || identity.verify() != nil {
+            t.Errorf("adopted identity not signed: %v", err)
+        }
+    })
+
+    t.Run("copied from another machine", func(t *testing.T) {
+        testMachine(t)
+        legacy := legacyID("another-machine-id", "52:54:00:99:88:77")
+        os.MkdirAll(filepath.Dir(legacyPath), 0755)
+        if err := os.WriteFile(legacyPath, []byte(legacy), 0644); err != nil {
+            t.Fatal(err)
+        }
+
+        result := resolve(t)
+        if result.HWID == legacy || !result.Tampered || result.PreviousHWID != legacy {
+            t.Errorf("got %+v, want the copied legacy ID rejected", result)
+        }
+    })
+}
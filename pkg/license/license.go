@@ -2,7 +2,9 @@ package license
 
 import (
     "bytes"
+    "crypto/ed25519"
     "encoding/json"
+    "errors"
     "fmt"
     "net/http"
     "os"
@@ -15,11 +17,52 @@ type LicenseInfo struct {
     ExpiresAt  string   `json:"expires_at"`
     Modules    []string `json:"modules"`
     Status     string   `json:"status"`
+    Token      string   `json:"token,omitempty"`
+
+    // Offline is set when the info came from the cached token
+    Offline  bool      `json:"-"`
+    IssuedAt time.Time `json:"-"`
+}
+
+// Options controls offline validation with cached license tokens
+type Options struct {
+    PublicKey   ed25519.PublicKey
+    GracePeriod time.Duration
+    // HWIDDrift is reported to the SaaS with each online validation
+    HWIDDrift []string
+}
+
+var (
+    ErrUnreachable  = errors.New("SaaS unreachable")
+    ErrGraceExpired = errors.New("offline grace period expired")
+    ErrRejected     = errors.New("license rejected")
+    // ErrRevoked is an explicit revocation by the SaaS, the only failure that revokes a running agent
+    ErrRevoked = errors.New("license revoked")
+)
+
+// RejectedError is an explicit refusal by the SaaS. Status is the license
+// status it sent, if any; the error matches ErrRejected.
+type RejectedError struct {
+    Status string
+    Reason string
+}
+
+func (e *RejectedError) Error() string {
+    if e.Status == "" {
+        return fmt.Sprintf("%v: %s", ErrRejected, e.Reason)
+    }
+    return fmt.Sprintf("%v (%s): %s", ErrRejected, e.Status, e.Reason)
+}
+
+func (e *RejectedError) Unwrap() error {
+    return ErrRejected
 }
 
 type ValidateRequest struct {
     LicenseKey string `json:"license_key"`
     HWID       string `json:"hw_id"`
+    // HWIDDrift names hardware components that changed since the HWID was created
+    HWIDDrift []string `json:"hw_id_drift,omitempty"`
 }
 
 type ValidateResponse struct {
@@ -30,33 +73,132 @@ type ValidateResponse struct {
 
 // Validate checks license with SaaS platform
 func Validate(saasURL, licenseKey, hwid string) (*LicenseInfo, error) {
+    return validate(saasURL, ValidateRequest{LicenseKey: licenseKey, HWID: hwid})
+}
+
+func validate(saasURL string, reqData ValidateRequest) (*LicenseInfo, error) {
     url := fmt.Sprintf("%s/api/licenses/validate", saasURL)
     
-    reqData := ValidateRequest{
-        LicenseKey: licenseKey,
-        HWID:       hwid,
-    }
-    
     jsonData, _ := json.Marshal(reqData)
     
     resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
     if err != nil {
-        return nil, fmt.Errorf("failed to connect to SaaS: %w", err)
+        return nil, fmt.Errorf("%w: %w", ErrUnreachable, err)
     }
     defer resp.Body.Close()
     
+    if resp.StatusCode >= 500 {
+        return nil, fmt.Errorf("%w: server returned %s", ErrUnreachable, resp.Status)
+    }
+    
     var result ValidateResponse
     if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
         return nil, fmt.Errorf("failed to parse response: %w", err)
     }
     
     if !result.Success {
-        return nil, fmt.Errorf("license validation failed: %s", result.Error)
+        if result.Data.Status == StatusRevoked {
+            return nil, fmt.Errorf("%w: %s", ErrRevoked, result.Error)
+        }
+        return nil, &RejectedError{Status: result.Data.Status, Reason: result.Error}
     }
     
     return &result.Data, nil
 }
 
+// ValidateWithGrace validates online and falls back to the cached token for
+// less than the grace period after the last successful validation. Outages
+// and refreshed tokens that fail to verify fall back; explicit answers from
+// the SaaS, rejections and revocations, are returned as they are.
+func ValidateWithGrace(saasURL, licenseKey, hwid string, opts Options) (*LicenseInfo, error) {
+    info, err := validate(saasURL, ValidateRequest{LicenseKey: licenseKey, HWID: hwid, HWIDDrift: opts.HWIDDrift})
+    if err == nil {
+        if info.Token == "" || opts.PublicKey == nil {
+            return info, nil
+        }
+        claims, tokenErr := checkToken(info.Token, licenseKey, hwid, opts.PublicKey)
+        if tokenErr == nil {
+            info.IssuedAt = time.Unix(claims.IssuedAt, 0)
+            if err := SaveToken(info.Token); err != nil {
+                return info, fmt.Errorf("license valid but token not cached: %w", err)
+            }
+            return info, nil
+        }
+        err = fmt.Errorf("refreshed token: %w", tokenErr)
+    }
+    
+    if errors.Is(err, ErrRevoked) || errors.Is(err, ErrRejected) || opts.PublicKey == nil {
+        return nil, err
+    }
+    
+    return validateOffline(licenseKey, hwid, opts, err)
+}
+
+// validateOffline verifies the cached token without contacting the SaaS
+func validateOffline(licenseKey, hwid string, opts Options, cause error) (*LicenseInfo, error) {
+    token, err := LoadToken()
+    if err != nil {
+        return nil, fmt.Errorf("%w (no cached license token)", cause)
+    }
+    
+    claims, err := checkToken(token, licenseKey, hwid, opts.PublicKey)
+    if err != nil {
+        return nil, err
+    }
+    
+    issuedAt := time.Unix(claims.IssuedAt, 0)
+    if time.Since(issuedAt) > opts.GracePeriod {
+        return nil, fmt.Errorf("%w: last validated %s", ErrGraceExpired, issuedAt.Format(time.RFC3339))
+    }
+    
+    info := claims.Info()
+    info.Token = token
+    info.Offline = true
+    info.IssuedAt = issuedAt
+    if IsExpired(info.ExpiresAt) {
+        info.Status = "expired"
+    }
+    
+    return info, nil
+}
+
+// checkToken verifies a token and that it is bound to this key and machine
+func checkToken(token, licenseKey, hwid string, publicKey ed25519.PublicKey) (*TokenClaims, error) {
+    claims, err := VerifyToken(token, publicKey)
+    if err != nil {
+        return nil, err
+    }
+    if claims.LicenseKey != licenseKey {
+        return nil, fmt.Errorf("%w: issued for a different license key", ErrInvalidToken)
+    }
+    if claims.HWID != hwid {
+        return nil, fmt.Errorf("%w: bound to a different hardware ID", ErrInvalidToken)
+    }
+    return claims, nil
+}
+
+// GraceRemaining returns how much offline grace is left for an offline license
+func GraceRemaining(info *LicenseInfo, gracePeriod time.Duration) time.Duration {
+    remaining := gracePeriod - time.Since(info.IssuedAt)
+    if remaining < 0 {
+        return 0
+    }
+    return remaining
+}
+
+// DaysUntilExpiry returns whole days until expiry, negative once expired
+func DaysUntilExpiry(expiresAt string) int {
+    expiry, err := time.Parse(time.RFC3339, expiresAt)
+    if err != nil {
+        return -1
+    }
+    remaining := time.Until(expiry)
+    if remaining < 0 {
+        return -1 - int(-remaining/(24*time.Hour))
+    }
+    return int(remaining / (24 * time.Hour))
+}
+
 // IsExpired checks if license is expired
 func IsExpired(expiresAt string) bool {
     expiry, err := time.Parse(time.RFC3339, expiresAt)
@@ -0,0 +1,187 @@
+package license
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log/slog"
+    "sync"
+    "time"
+)
+
+// License statuses reported by the SaaS or derived locally
+const (
+    StatusActive    = "active"
+    StatusSuspended = "suspended"
+    StatusExpired   = "expired"
+    StatusRevoked   = "revoked"
+)
+
+// Supervisor periodically revalidates the license and publishes changes
+type Supervisor struct {
+    SaaSURL    string
+    LicenseKey string
+    HWID       string
+    Options    Options
+
+    Interval   time.Duration
+    MinBackoff time.Duration
+    MaxBackoff time.Duration
+
+    // OnChange is called from the supervisor goroutine when the status changes
+    OnChange func(prev, next *LicenseInfo)
+    Logger   *slog.Logger
+
+    // failingSince is when revalidation started failing; only Run touches it
+    failingSince time.Time
+
+    mu      sync.RWMutex
+    current *LicenseInfo
+    subs    []chan *LicenseInfo
+    refresh chan struct{}
+}
+
+// NewSupervisor creates a supervisor seeded with the startup validation result
+func NewSupervisor(saasURL, licenseKey, hwid string, opts Options, initial *LicenseInfo) *Supervisor {
+    return &Supervisor{
+        SaaSURL:    saasURL,
+        LicenseKey: licenseKey,
+        HWID:       hwid,
+        Options:    opts,
+        Interval:   5 * time.Minute,
+        MinBackoff: 30 * time.Second,
+        MaxBackoff: 30 * time.Minute,
+        Logger:     slog.Default(),
+        current:    initial,
+        refresh:    make(chan struct{}, 1),
+    }
+}
+
+// Refresh asks the supervisor to revalidate now instead of waiting for the interval
+func (s *Supervisor) Refresh() {
+    select {
+    case s.refresh <- struct{}{}:
+    default:
+    }
+}
+
+// Current returns the most recent license info
+func (s *Supervisor) Current() *LicenseInfo {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    return s.current
+}
+
+// Active reports whether the current license allows full operation
+func (s *Supervisor) Active() bool {
+    info := s.Current()
+    return info != nil && info.Status == StatusActive
+}
+
+// Subscribe returns a channel that receives every new license info.
+// Slow subscribers only see the latest value.
+func (s *Supervisor) Subscribe() <-chan *LicenseInfo {
+    ch := make(chan *LicenseInfo, 1)
+    s.mu.Lock()
+    s.subs = append(s.subs, ch)
+    s.mu.Unlock()
+    return ch
+}
+
+// Run revalidates on the interval, backing off while validation fails
+func (s *Supervisor) Run(ctx context.Context) {
+    wait := s.Interval
+    backoff := s.MinBackoff
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-time.After(wait):
+        case <-s.refresh:
+        }
+
+        info, err := s.revalidate()
+        if err != nil {
+            s.Logger.Warn("license revalidation failed", "error", err, "retry_in", backoff)
+            wait = backoff
+            backoff *= 2
+            if backoff > s.MaxBackoff {
+                backoff = s.MaxBackoff
+            }
+        } else {
+            wait = s.Interval
+            backoff = s.MinBackoff
+        }
+
+        if info != nil {
+            s.publish(info)
+        }
+    }
+}
+
+// revalidate returns the new license info, or nil if the status is unknown
+func (s *Supervisor) revalidate() (*LicenseInfo, error) {
+    info, err := ValidateWithGrace(s.SaaSURL, s.LicenseKey, s.HWID, s.Options)
+    if err == nil {
+        s.failingSince = time.Time{}
+        if IsExpired(info.ExpiresAt) {
+            info.Status = StatusExpired
+        }
+        return info, nil
+    }
+
+    prev := s.Current()
+    if prev == nil {
+        return nil, err
+    }
+    if s.failingSince.IsZero() {
+        s.failingSince = time.Now()
+    }
+
+    // Explicit answers from the SaaS take effect at once. Any other failure
+    // may be transient, so the last status is kept until the grace period
+    // runs out.
+    next := *prev
+    var rejected *RejectedError
+    switch {
+    case errors.Is(err, ErrRevoked):
+        next.Status = StatusRevoked
+    case errors.As(err, &rejected):
+        next.Status = StatusSuspended
+        if rejected.Status == StatusExpired || rejected.Status == StatusRevoked {
+            next.Status = rejected.Status
+        }
+    case errors.Is(err, ErrGraceExpired):
+        next.Status = StatusExpired
+    case IsExpired(prev.ExpiresAt):
+        next.Status = StatusExpired
+    case time.Since(s.failingSince) > s.Options.GracePeriod:
+        next.Status = StatusExpired
+        err = fmt.Errorf("%w: failing since %s: %w", ErrGraceExpired, s.failingSince.Format(time.RFC3339), err)
+    default:
+        return nil, err
+    }
+    return &next, err
+}
+
+// publish stores the new info, notifies subscribers and reports transitions
+func (s *Supervisor) publish(info *LicenseInfo) {
+    s.mu.Lock()
+    prev := s.current
+    s.current = info
+    subs := s.subs
+    s.mu.Unlock()
+
+    for _, ch := range subs {
+        select {
+        case <-ch:
+        default:
+        }
+        ch <- info
+    }
+
+    if s.OnChange != nil && (prev == nil || prev.Status != info.Status) {
+        s.OnChange(prev, info)
+    }
+}
@@ -0,0 +1,125 @@
+package license
+
+import (
+    "crypto/ed25519"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "strings"
+    "time"
+)
+
+const TokenPath = "/etc/isp-agent/license.token"
+
+var (
+    ErrInvalidToken = errors.New("invalid license token")
+    ErrNoPublicKey  = errors.New("no license public key configured")
+)
+
+// VendorPublicKey is the base64 Ed25519 key the SaaS signs license tokens,
+// commands and updates with. Release builds compile it in with
+// -ldflags "-X isp-agent/pkg/license.VendorPublicKey=<key>"; license.public_key
+// in the config overrides it.
+var VendorPublicKey string
+
+// TokenClaims is the payload of a signed license token issued by the SaaS
+type TokenClaims struct {
+    LicenseKey string   `json:"license_key"`
+    ISPID      int      `json:"isp_id"`
+    HWID       string   `json:"hw_id"`
+    Modules    []string `json:"modules"`
+    Status     string   `json:"status"`
+    IssuedAt   int64    `json:"iat"`
+    ExpiresAt  int64    `json:"exp"`
+}
+
+type tokenHeader struct {
+    Alg string `json:"alg"`
+    Typ string `json:"typ"`
+}
+
+// ParsePublicKey decodes a base64 Ed25519 public key
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+    if s == "" {
+        return nil, ErrNoPublicKey
+    }
+    raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+    if err != nil {
+        return nil, fmt.Errorf("failed to decode public key: %w", err)
+    }
+    if len(raw) != ed25519.PublicKeySize {
+        return nil, fmt.Errorf("public key must be %d bytes, got %d", ed25519.PublicKeySize, len(raw))
+    }
+    return ed25519.PublicKey(raw), nil
+}
+
+// VerifyToken checks the EdDSA signature of a compact JWS token and returns its claims
+func VerifyToken(token string, publicKey ed25519.PublicKey) (*TokenClaims, error) {
+    if len(publicKey) != ed25519.PublicKeySize {
+        return nil, ErrNoPublicKey
+    }
+
+    parts := strings.Split(strings.TrimSpace(token), ".")
+    if len(parts) != 3 {
+        return nil, fmt.Errorf("%w: malformed", ErrInvalidToken)
+    }
+
+    headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+    if err != nil {
+        return nil, fmt.Errorf("%w: bad header encoding", ErrInvalidToken)
+    }
+    var header tokenHeader
+    if err := json.Unmarshal(headerJSON, &header); err != nil {
+        return nil, fmt.Errorf("%w: bad header", ErrInvalidToken)
+    }
+    if header.Alg != "EdDSA" {
+        return nil, fmt.Errorf("%w: unsupported alg %q", ErrInvalidToken, header.Alg)
+    }
+
+    signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+    if err != nil {
+        return nil, fmt.Errorf("%w: bad signature encoding", ErrInvalidToken)
+    }
+    if !ed25519.Verify(publicKey, []byte(parts[0]+"."+parts[1]), signature) {
+        return nil, fmt.Errorf("%w: signature mismatch", ErrInvalidToken)
+    }
+
+    payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+    if err != nil {
+        return nil, fmt.Errorf("%w: bad payload encoding", ErrInvalidToken)
+    }
+    var claims TokenClaims
+    if err := json.Unmarshal(payload, &claims); err != nil {
+        return nil, fmt.Errorf("%w: bad payload", ErrInvalidToken)
+    }
+
+    return &claims, nil
+}
+
+// Info converts token claims to the LicenseInfo returned by the SaaS
+func (c *TokenClaims) Info() *LicenseInfo {
+    return &LicenseInfo{
+        LicenseKey: c.LicenseKey,
+        ISPID:      c.ISPID,
+        ExpiresAt:  time.Unix(c.ExpiresAt, 0).UTC().Format(time.RFC3339),
+        Modules:    c.Modules,
+        Status:     c.Status,
+    }
+}
+
+// SaveToken caches the signed license token on disk
+func SaveToken(token string) error {
+    os.MkdirAll("/etc/isp-agent", 0755)
+    return os.WriteFile(TokenPath, []byte(token), 0600)
+}
+
+// LoadToken reads the cached license token
+func LoadToken() (string, error) {
+    data, err := os.ReadFile(TokenPath)
+    if err != nil {
+        return "", err
+    }
+    return strings.TrimSpace(string(data)), nil
+}
@@ -0,0 +1,161 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// journalSocket is where journald accepts native protocol datagrams
+const journalSocket = "/run/systemd/journal/socket"
+
+// UnderJournald reports whether stderr is connected to the journal, as
+// systemd signals with JOURNAL_STREAM, and the native socket exists
+func UnderJournald() bool {
+	if os.Getenv("JOURNAL_STREAM") == "" {
+		return false
+	}
+	_, err := os.Stat(journalSocket)
+	return err == nil
+}
+
+// JournalHandler sends records to journald with every attribute as its own
+// field, e.g. component="dns" becomes COMPONENT=dns
+type JournalHandler struct {
+	identifier string
+	level      slog.Leveler
+	conn       *net.UnixConn
+	mu         *sync.Mutex
+
+	// prefix is the field name prefix from WithGroup, fields are preformatted WithAttrs
+	prefix string
+	fields []byte
+}
+
+func NewJournalHandler(identifier string, level slog.Leveler) (*JournalHandler, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to journald: %w", err)
+	}
+	if identifier == "" {
+		identifier = "isp-agent"
+	}
+	return &JournalHandler{identifier: identifier, level: level, conn: conn, mu: &sync.Mutex{}}, nil
+}
+
+func (h *JournalHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *JournalHandler) Handle(_ context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	writeField(&buf, "MESSAGE", r.Message)
+	writeField(&buf, "PRIORITY", priority(r.Level))
+	writeField(&buf, "SYSLOG_IDENTIFIER", h.identifier)
+	buf.Write(h.fields)
+	r.Attrs(func(a slog.Attr) bool {
+		appendAttr(&buf, h.prefix, a)
+		return true
+	})
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, err := h.conn.Write(buf.Bytes()); err != nil {
+		// Entries too large for a datagram still reach the journal through stderr
+		fmt.Fprintf(os.Stderr, "%s %s\n", r.Level, r.Message)
+		return err
+	}
+	return nil
+}
+
+func (h *JournalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var buf bytes.Buffer
+	buf.Write(h.fields)
+	for _, a := range attrs {
+		appendAttr(&buf, h.prefix, a)
+	}
+	clone := *h
+	clone.fields = buf.Bytes()
+	return &clone
+}
+
+func (h *JournalHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	clone := *h
+	clone.prefix = h.prefix + name + "_"
+	return &clone
+}
+
+// priority maps slog levels to syslog priorities
+func priority(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return "3"
+	case level >= slog.LevelWarn:
+		return "4"
+	case level >= slog.LevelInfo:
+		return "6"
+	}
+	return "7"
+}
+
+func appendAttr(buf *bytes.Buffer, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Key == "" && a.Value.Kind() != slog.KindGroup {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		p := prefix
+		if a.Key != "" {
+			p += a.Key + "_"
+		}
+		for _, g := range a.Value.Group() {
+			appendAttr(buf, p, g)
+		}
+		return
+	}
+	writeField(buf, fieldName(prefix+a.Key), a.Value.String())
+}
+
+// fieldName converts a key to a journal field name: upper case letters,
+// digits and underscores, not starting with an underscore or digit
+func fieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return unicode.ToUpper(r)
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+	name = strings.TrimLeft(name, "_0123456789")
+	if name == "" {
+		return "FIELD"
+	}
+	return name
+}
+
+// writeField uses the binary form for values containing newlines
+func writeField(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
@@ -0,0 +1,79 @@
+// Package logging builds the agent's structured logger: text, JSON or
+// journald-native output, with secrets redacted from every record.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Options selects the log level and output format
+type Options struct {
+	// Level is "debug", "info", "warn" or "error"
+	Level string
+	// Format is "text", "json", "journald" or "" to use journald when running under systemd
+	Format string
+	// Identifier is the SYSLOG_IDENTIFIER of journald entries
+	Identifier string
+}
+
+// New returns a logger writing to stderr, or to the journal when selected
+func New(opts Options) (*slog.Logger, error) {
+	return newLogger(opts, os.Stderr)
+}
+
+func newLogger(opts Options, w io.Writer) (*slog.Logger, error) {
+	level, err := ParseLevel(opts.Level)
+	if err != nil {
+		return nil, err
+	}
+	handlerOpts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch opts.Format {
+	case "":
+		if UnderJournald() {
+			if jh, err := NewJournalHandler(opts.Identifier, level); err == nil {
+				handler = jh
+			}
+		}
+		if handler == nil {
+			handler = slog.NewTextHandler(w, handlerOpts)
+		}
+	case "text":
+		handler = slog.NewTextHandler(w, handlerOpts)
+	case "json":
+		handler = slog.NewJSONHandler(w, handlerOpts)
+	case "journald":
+		handler, err = NewJournalHandler(opts.Identifier, level)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown log format %q", opts.Format)
+	}
+	return slog.New(&redactHandler{inner: handler}), nil
+}
+
+// ParseLevel accepts "debug", "info" (or empty), "warn" and "error"
+func ParseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+// Component returns a logger that tags every record with the component name
+func Component(l *slog.Logger, name string) *slog.Logger {
+	return l.With("component", name)
+}
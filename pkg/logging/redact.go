@@ -0,0 +1,136 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// Secret is a value that is always logged redacted
+type Secret string
+
+func (s Secret) LogValue() slog.Value {
+	return slog.StringValue(Redact(string(s)))
+}
+
+func (s Secret) String() string {
+	return Redact(string(s))
+}
+
+// Redact keeps the last four characters of long values, enough to tell keys apart
+func Redact(s string) string {
+	if len(s) <= 8 {
+		return "****"
+	}
+	return "****" + s[len(s)-4:]
+}
+
+// minSecretLen avoids masking short, common strings
+const minSecretLen = 6
+
+var secrets struct {
+	sync.RWMutex
+	values []string
+}
+
+// AddSecret registers a value that must never appear in logs; it is
+// replaced wherever it shows up in messages or attribute values
+func AddSecret(value string) {
+	if len(value) < minSecretLen {
+		return
+	}
+	secrets.Lock()
+	defer secrets.Unlock()
+	for _, v := range secrets.values {
+		if v == value {
+			return
+		}
+	}
+	secrets.values = append(secrets.values, value)
+}
+
+// Scrub replaces registered secrets in s
+func Scrub(s string) string {
+	secrets.RLock()
+	defer secrets.RUnlock()
+	for _, v := range secrets.values {
+		if strings.Contains(s, v) {
+			s = strings.ReplaceAll(s, v, Redact(v))
+		}
+	}
+	return s
+}
+
+// sensitiveKeys are attribute names whose values are never logged
+var sensitiveKeys = []string{"license_key", "licensekey", "token", "password", "secret", "authorization", "api_key", "apikey"}
+
+func sensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, k := range sensitiveKeys {
+		if strings.Contains(key, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactHandler scrubs secrets from messages and attributes before passing records on
+type redactHandler struct {
+	inner slog.Handler
+}
+
+func (h *redactHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h *redactHandler) Handle(ctx context.Context, r slog.Record) error {
+	out := slog.NewRecord(r.Time, r.Level, Scrub(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(RedactAttr(a))
+		return true
+	})
+	return h.inner.Handle(ctx, out)
+}
+
+func (h *redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = RedactAttr(a)
+	}
+	return &redactHandler{inner: h.inner.WithAttrs(redacted)}
+}
+
+func (h *redactHandler) WithGroup(name string) slog.Handler {
+	return &redactHandler{inner: h.inner.WithGroup(name)}
+}
+
+// RedactAttr masks sensitive keys and registered secrets in an attribute
+func RedactAttr(a slog.Attr) slog.Attr {
+	a.Value = a.Value.Resolve()
+	if sensitive(a.Key) && a.Value.Kind() != slog.KindGroup {
+		// Secret values arrive already redacted
+		if v := a.Value.String(); !strings.HasPrefix(v, "****") {
+			return slog.String(a.Key, Redact(v))
+		}
+		return a
+	}
+
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, Scrub(a.Value.String()))
+	case slog.KindGroup:
+		group := a.Value.Group()
+		redacted := make([]any, len(group))
+		for i, g := range group {
+			redacted[i] = RedactAttr(g)
+		}
+		return slog.Group(a.Key, redacted...)
+	case slog.KindAny:
+		// Errors often wrap URLs or request bodies
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, Scrub(err.Error()))
+		}
+	}
+	return a
+}
@@ -0,0 +1,90 @@
+package logship
+
+import (
+	"context"
+	"log/slog"
+
+	"isp-agent/pkg/logging"
+)
+
+// component is the logger component of the shipper itself; its records are
+// never shipped, so a failing SaaS cannot feed the queue
+const component = "logship"
+
+// Handler passes every record to next and ships warnings and errors
+func (s *Shipper) Handler(next slog.Handler) slog.Handler {
+	return &handler{next: next, shipper: s}
+}
+
+type handler struct {
+	next    slog.Handler
+	shipper *Shipper
+	attrs   []slog.Attr
+	group   string
+}
+
+func (h *handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= slog.LevelWarn || h.next.Enabled(ctx, level)
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	var err error
+	if h.next.Enabled(ctx, r.Level) {
+		err = h.next.Handle(ctx, r)
+	}
+	if r.Level < slog.LevelWarn {
+		return err
+	}
+
+	comp := ""
+	metadata := make(map[string]string)
+	add := func(a slog.Attr) {
+		a = logging.RedactAttr(a)
+		if a.Key == "component" {
+			comp = a.Value.String()
+			return
+		}
+		metadata[a.Key] = a.Value.String()
+	}
+	for _, a := range h.attrs {
+		add(a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		add(h.grouped(a))
+		return true
+	})
+	if comp == component {
+		return err
+	}
+
+	h.shipper.AddAgent(comp, r.Level, logging.Scrub(r.Message), r.Time, metadata)
+	return err
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *h
+	clone.next = h.next.WithAttrs(attrs)
+	clone.attrs = append([]slog.Attr(nil), h.attrs...)
+	for _, a := range attrs {
+		clone.attrs = append(clone.attrs, h.grouped(a))
+	}
+	return &clone
+}
+
+// grouped prefixes the key with the open groups, e.g. "request.host"
+func (h *handler) grouped(a slog.Attr) slog.Attr {
+	if h.group != "" {
+		a.Key = h.group + "." + a.Key
+	}
+	return a
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	clone := *h
+	clone.next = h.next.WithGroup(name)
+	if clone.group != "" {
+		name = clone.group + "." + name
+	}
+	clone.group = name
+	return &clone
+}
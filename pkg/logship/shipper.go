@@ -0,0 +1,279 @@
+// Package logship sends nginx error log lines and the agent's own warnings
+// to the SaaS in deduplicated, rate-limited batches, and counts them per
+// pattern for error-rate metrics.
+package logship
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"isp-agent/pkg/nginx"
+	"isp-agent/pkg/telemetry"
+)
+
+// maxPending bounds entries kept while the SaaS is unreachable
+const maxPending = 1000
+
+// Shipper tails nginx error logs and collects agent log records
+type Shipper struct {
+	SaaSURL  string
+	AgentID  string
+	ISPID    func() int
+	Hostname string
+
+	// MinNginxLevel is the least severe nginx level shipped, e.g. "warn"
+	MinNginxLevel string
+	FlushInterval time.Duration
+	// MaxPerPattern limits distinct messages per pattern and flush; the rest are only counted
+	MaxPerPattern int
+	// RequestDetails ships the request path, Host and upstream URL of nginx
+	// errors. They show what subscribers download, so only the method is
+	// shipped by default.
+	RequestDetails bool
+	Logger         *slog.Logger
+
+	tailers []*nginx.Tailer
+
+	mu         sync.Mutex
+	window     map[string]*telemetry.LogEntry
+	order      []string
+	perPattern map[string]int
+	suppressed map[string]int
+	pending    []telemetry.LogEntry
+	dropped    int
+
+	patterns map[string]int64
+	levels   map[string]int64
+}
+
+func NewShipper(saasURL string, errorLogs []string) *Shipper {
+	hostname, _ := os.Hostname()
+	s := &Shipper{
+		SaaSURL:       saasURL,
+		Hostname:      hostname,
+		MinNginxLevel: "warn",
+		FlushInterval: 30 * time.Second,
+		MaxPerPattern: 20,
+		Logger:        slog.Default(),
+		patterns:      make(map[string]int64),
+		levels:        make(map[string]int64),
+	}
+	for _, path := range errorLogs {
+		s.tailers = append(s.tailers, nginx.NewTailer(path))
+	}
+	s.reset()
+	return s
+}
+
+func (s *Shipper) reset() {
+	s.window = make(map[string]*telemetry.LogEntry)
+	s.order = nil
+	s.perPattern = make(map[string]int)
+	s.suppressed = make(map[string]int)
+}
+
+// Run reads the error logs and sends a batch every FlushInterval until ctx is cancelled
+func (s *Shipper) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.readErrorLogs()
+			s.flush()
+			return
+		case <-ticker.C:
+			s.readErrorLogs()
+			s.flush()
+		}
+	}
+}
+
+func (s *Shipper) readErrorLogs() {
+	minRank := nginx.ErrorLevelRank(s.MinNginxLevel)
+	for _, t := range s.tailers {
+		err := t.ReadNew(func(line string) {
+			e, ok := nginx.ParseErrorLine(line)
+			if !ok || nginx.ErrorLevelRank(e.Level) > minRank {
+				return
+			}
+			s.AddNginx(t.Path, e)
+		})
+		if err != nil && !os.IsNotExist(err) {
+			s.Logger.Warn("failed to read nginx error log", "path", t.Path, "error", err)
+		}
+	}
+}
+
+// AddNginx records one nginx error log entry
+func (s *Shipper) AddNginx(path string, e *nginx.ErrorEntry) {
+	details := map[string]string{"server": e.Server, "request": requestMethod(e.Request)}
+	if s.RequestDetails {
+		details["host"] = e.Host
+		details["upstream"] = e.Upstream
+		details["request"] = stripQuery(e.Request)
+	}
+	metadata := map[string]string{"file": path}
+	for k, v := range details {
+		if v != "" {
+			metadata[k] = v
+		}
+	}
+	// Client addresses are subscriber data and are never shipped
+	s.add("nginx", nginxLevel(e.Level), nginx.ErrorPattern(e.Message), e.Message, nginx.NormalizeMessage(e.Message), e.Time, metadata)
+}
+
+// AddAgent records one of the agent's own log records
+func (s *Shipper) AddAgent(component string, level slog.Level, message string, t time.Time, metadata map[string]string) {
+	pattern := "agent"
+	if component != "" {
+		pattern += "/" + component
+	}
+	s.add("agent", agentLevel(level), pattern, message, message, t, metadata)
+}
+
+func (s *Shipper) add(source, level, pattern, message, normalized string, t time.Time, metadata map[string]string) {
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.patterns[pattern]++
+	s.levels[level]++
+
+	key := source + "|" + level + "|" + pattern + "|" + normalized
+	if entry, ok := s.window[key]; ok {
+		entry.Count++
+		entry.LastSeen = t
+		return
+	}
+	limitKey := source + "/" + pattern
+	if s.MaxPerPattern > 0 && s.perPattern[limitKey] >= s.MaxPerPattern {
+		s.suppressed[limitKey]++
+		return
+	}
+	s.perPattern[limitKey]++
+	s.window[key] = &telemetry.LogEntry{
+		Source:    source,
+		Level:     level,
+		Pattern:   pattern,
+		Message:   message,
+		Count:     1,
+		FirstSeen: t,
+		LastSeen:  t,
+		Metadata:  metadata,
+	}
+	s.order = append(s.order, key)
+}
+
+// flush sends the window plus anything left from failed sends
+func (s *Shipper) flush() {
+	s.mu.Lock()
+	entries := s.pending
+	for _, key := range s.order {
+		entries = append(entries, *s.window[key])
+	}
+	suppressed := s.suppressed
+	dropped := s.dropped
+	s.pending = nil
+	s.dropped = 0
+	s.reset()
+	s.mu.Unlock()
+
+	if len(entries) == 0 && len(suppressed) == 0 {
+		return
+	}
+	if dropped > 0 {
+		suppressed["agent/logship-dropped"] += dropped
+	}
+
+	batch := telemetry.LogBatch{
+		AgentID:    s.AgentID,
+		Hostname:   s.Hostname,
+		Entries:    entries,
+		Suppressed: suppressed,
+	}
+	if s.ISPID != nil {
+		batch.ISPID = s.ISPID()
+	}
+	if len(batch.Suppressed) == 0 {
+		batch.Suppressed = nil
+	}
+	if err := telemetry.SendLogBatch(s.SaaSURL, batch); err != nil {
+		s.Logger.Debug("log batch not sent", "entries", len(entries), "error", err)
+		s.requeue(entries)
+	}
+}
+
+// requeue keeps unsent entries for the next flush, dropping the oldest beyond maxPending
+func (s *Shipper) requeue(entries []telemetry.LogEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pending = append(entries, s.pending...)
+	if over := len(s.pending) - maxPending; over > 0 {
+		s.pending = s.pending[over:]
+		s.dropped += over
+	}
+}
+
+// Rates returns the lines counted per pattern and level since the previous call
+func (s *Shipper) Rates() *telemetry.ErrorLogStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.patterns) == 0 {
+		return nil
+	}
+	stats := &telemetry.ErrorLogStats{Patterns: s.patterns, Levels: s.levels}
+	s.patterns = make(map[string]int64)
+	s.levels = make(map[string]int64)
+	return stats
+}
+
+// nginxLevel maps nginx severities to the SaaS log levels
+func nginxLevel(level string) string {
+	switch level {
+	case "emerg", "alert", "crit":
+		return "critical"
+	case "error":
+		return "error"
+	case "warn":
+		return "warning"
+	}
+	return "info"
+}
+
+func agentLevel(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return "error"
+	case level >= slog.LevelWarn:
+		return "warning"
+	}
+	return "info"
+}
+
+// requestMethod keeps only the method of a request line, e.g. "GET /a HTTP/1.1" -> "GET"
+func requestMethod(request string) string {
+	method, _, _ := strings.Cut(request, " ")
+	return method
+}
+
+func stripQuery(request string) string {
+	if i := strings.IndexByte(request, '?'); i >= 0 {
+		// Keep the protocol after the path, e.g. "GET /a?b HTTP/1.1" -> "GET /a HTTP/1.1"
+		if sp := strings.IndexByte(request[i:], ' '); sp >= 0 {
+			return request[:i] + request[i+sp:]
+		}
+		return request[:i]
+	}
+	return request
+}
@@ -0,0 +1,101 @@
+package nginx
+
+import (
+    "strconv"
+    "sync"
+)
+
+// RequestBytes counts requests and body bytes for one bucket
+type RequestBytes struct {
+    Requests int64 `json:"requests"`
+    Bytes    int64 `json:"bytes"`
+}
+
+// Breakdown splits traffic by response status, method and content type
+type Breakdown struct {
+    StatusClass map[string]RequestBytes `json:"status_class"`
+    StatusCode  map[string]RequestBytes `json:"status_code"`
+    Method      map[string]RequestBytes `json:"method"`
+    ContentType map[string]RequestBytes `json:"content_type"`
+}
+
+func newBreakdown() *Breakdown {
+    return &Breakdown{
+        StatusClass: make(map[string]RequestBytes),
+        StatusCode:  make(map[string]RequestBytes),
+        Method:      make(map[string]RequestBytes),
+        ContentType: make(map[string]RequestBytes),
+    }
+}
+
+// Log lines are client controlled, so methods and content types are bounded
+var knownMethods = map[string]bool{
+    "GET": true, "HEAD": true, "POST": true, "PUT": true, "DELETE": true,
+    "OPTIONS": true, "PATCH": true, "CONNECT": true, "TRACE": true,
+}
+
+const (
+    otherBucket     = "other"
+    maxContentTypes = 50
+)
+
+// BreakdownStats aggregates a Breakdown per interval
+type BreakdownStats struct {
+    mu      sync.Mutex
+    current *Breakdown
+}
+
+func NewBreakdownStats() *BreakdownStats {
+    return &BreakdownStats{current: newBreakdown()}
+}
+
+func (s *BreakdownStats) Observe(r *Record) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    b := s.current
+    addRequest(b.StatusClass, statusClass(r.Status), r.BodyBytes)
+    if r.Status >= 100 && r.Status <= 599 {
+        addRequest(b.StatusCode, strconv.Itoa(r.Status), r.BodyBytes)
+    }
+
+    method := r.Method
+    if !knownMethods[method] {
+        method = otherBucket
+    }
+    addRequest(b.Method, method, r.BodyBytes)
+
+    contentType := r.ContentType
+    if contentType == "" {
+        contentType = "unknown"
+    }
+    if _, ok := b.ContentType[contentType]; !ok && len(b.ContentType) >= maxContentTypes {
+        contentType = otherBucket
+    }
+    addRequest(b.ContentType, contentType, r.BodyBytes)
+}
+
+// Flush returns the breakdown since the last flush and resets it
+func (s *BreakdownStats) Flush() *Breakdown {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    b := s.current
+    s.current = newBreakdown()
+    return b
+}
+
+func addRequest(m map[string]RequestBytes, key string, bytes int64) {
+    c := m[key]
+    c.Requests++
+    c.Bytes += bytes
+    m[key] = c
+}
+
+// statusClass maps 204 to "2xx"; codes outside 100-599 are "other"
+func statusClass(status int) string {
+    if status < 100 || status > 599 {
+        return otherBucket
+    }
+    return strconv.Itoa(status/100) + "xx"
+}
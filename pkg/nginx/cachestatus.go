@@ -0,0 +1,204 @@
+package nginx
+
+import (
+    "sync"
+)
+
+// CacheStatusCounters keeps one counter per $upstream_cache_status value.
+//
+// Served from cache: HIT, STALE (origin failed or is being refreshed),
+// UPDATING (stale while another request refreshes it) and REVALIDATED (the
+// origin answered 304 to a conditional request, so the stored body was sent).
+// Not served from cache: MISS, EXPIRED (stale entry fetched again) and
+// BYPASS (proxy_cache_bypass matched). Uncached ("-") responses never went
+// through proxy_cache, e.g. /health or blocked hosts.
+type CacheStatusCounters struct {
+    Hit         RequestBytes `json:"hit"`
+    Miss        RequestBytes `json:"miss"`
+    Bypass      RequestBytes `json:"bypass"`
+    Expired     RequestBytes `json:"expired"`
+    Stale       RequestBytes `json:"stale"`
+    Updating    RequestBytes `json:"updating"`
+    Revalidated RequestBytes `json:"revalidated"`
+    Uncached    RequestBytes `json:"uncached"`
+}
+
+// Add counts one response with the given cache status
+func (c *CacheStatusCounters) Add(status string, bytes int64) {
+    var bucket *RequestBytes
+    switch status {
+    case "HIT":
+        bucket = &c.Hit
+    case "MISS":
+        bucket = &c.Miss
+    case "BYPASS":
+        bucket = &c.Bypass
+    case "EXPIRED":
+        bucket = &c.Expired
+    case "STALE":
+        bucket = &c.Stale
+    case "UPDATING":
+        bucket = &c.Updating
+    case "REVALIDATED":
+        bucket = &c.Revalidated
+    default:
+        bucket = &c.Uncached
+    }
+    bucket.Requests++
+    bucket.Bytes += bytes
+}
+
+// Merge adds o's counters
+func (c *CacheStatusCounters) Merge(o CacheStatusCounters) {
+    for _, pair := range [][2]*RequestBytes{
+        {&c.Hit, &o.Hit}, {&c.Miss, &o.Miss}, {&c.Bypass, &o.Bypass},
+        {&c.Expired, &o.Expired}, {&c.Stale, &o.Stale}, {&c.Updating, &o.Updating},
+        {&c.Revalidated, &o.Revalidated}, {&c.Uncached, &o.Uncached},
+    } {
+        pair[0].Requests += pair[1].Requests
+        pair[0].Bytes += pair[1].Bytes
+    }
+}
+
+// Served is everything sent from the cache store
+func (c *CacheStatusCounters) Served() RequestBytes {
+    return sumRequestBytes(c.Hit, c.Stale, c.Updating, c.Revalidated)
+}
+
+// Fetched is everything the origin had to send in full
+func (c *CacheStatusCounters) Fetched() RequestBytes {
+    return sumRequestBytes(c.Miss, c.Expired, c.Bypass)
+}
+
+// Cacheable is every response that went through proxy_cache
+func (c *CacheStatusCounters) Cacheable() RequestBytes {
+    return sumRequestBytes(c.Served(), c.Fetched())
+}
+
+// RequestHitRatio is Served / Cacheable by request count
+func (c *CacheStatusCounters) RequestHitRatio() float64 {
+    return ratio(c.Served().Requests, c.Cacheable().Requests)
+}
+
+// ByteHitRatio is Served / Cacheable by body bytes, the share of bandwidth
+// the origin did not have to deliver
+func (c *CacheStatusCounters) ByteHitRatio() float64 {
+    return ratio(c.Served().Bytes, c.Cacheable().Bytes)
+}
+
+func sumRequestBytes(buckets ...RequestBytes) RequestBytes {
+    var sum RequestBytes
+    for _, b := range buckets {
+        sum.Requests += b.Requests
+        sum.Bytes += b.Bytes
+    }
+    return sum
+}
+
+func ratio(part, total int64) float64 {
+    if total == 0 {
+        return 0
+    }
+    return float64(part) / float64(total)
+}
+
+// StatusWindow keeps the cache status of the last records it observed, the
+// window GetCacheStats reads from a log file, for logs that never reach a file
+type StatusWindow struct {
+    mu      sync.Mutex
+    entries []statusEntry
+    next    int
+    full    bool
+}
+
+type statusEntry struct {
+    status string
+    bytes  int64
+}
+
+func NewStatusWindow(size int) *StatusWindow {
+    if size <= 0 {
+        size = statsWindow
+    }
+    return &StatusWindow{entries: make([]statusEntry, size)}
+}
+
+func (w *StatusWindow) Observe(r *Record) {
+    if r.CacheStatus == "" {
+        return
+    }
+    
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    
+    w.entries[w.next] = statusEntry{internStatus(r.CacheStatus), r.BodyBytes}
+    w.next++
+    if w.next == len(w.entries) {
+        w.next = 0
+        w.full = true
+    }
+}
+
+// Counters counts the statuses currently in the window
+func (w *StatusWindow) Counters() CacheStatusCounters {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    
+    n := w.next
+    if w.full {
+        n = len(w.entries)
+    }
+    var c CacheStatusCounters
+    for _, e := range w.entries[:n] {
+        c.Add(e.status, e.bytes)
+    }
+    return c
+}
+
+// StatusCounter counts cache statuses between calls to Flush, for ratios over
+// a time interval rather than over the last records
+type StatusCounter struct {
+    mu       sync.Mutex
+    counters CacheStatusCounters
+}
+
+func (c *StatusCounter) Observe(r *Record) {
+    if r.CacheStatus == "" {
+        return
+    }
+    
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.counters.Add(r.CacheStatus, r.BodyBytes)
+}
+
+// Flush returns the statuses counted since the previous call
+func (c *StatusCounter) Flush() CacheStatusCounters {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    
+    counters := c.counters
+    c.counters = CacheStatusCounters{}
+    return counters
+}
+
+// internStatus returns a constant for status so the window does not keep log lines alive
+func internStatus(status string) string {
+    switch status {
+    case "HIT":
+        return "HIT"
+    case "MISS":
+        return "MISS"
+    case "BYPASS":
+        return "BYPASS"
+    case "EXPIRED":
+        return "EXPIRED"
+    case "STALE":
+        return "STALE"
+    case "UPDATING":
+        return "UPDATING"
+    case "REVALIDATED":
+        return "REVALIDATED"
+    }
+    return "-"
+}
@@ -0,0 +1,542 @@
+package nginx
+
+import (
+    "bytes"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sync"
+    "syscall"
+    "text/template"
+)
+
+// ConfigModel is the typed description of the managed cache configuration
+type ConfigModel struct {
+    Listen     string
+    Resolvers  []string
+    Cache      CacheZone
+    LogFormats []LogFormat
+    AccessLog  string
+    LogFormat  string
+    ErrorLog   string
+    RateLimit  RateLimit
+    Profiles   []ServerProfile
+    
+    // CacheValidity sets proxy_cache_valid for the default server
+    CacheValidity []CacheValidity
+    // Bypass lists nginx variables that skip the cache when non-empty
+    Bypass []string
+    // BlockedHosts are answered with 403 instead of being proxied
+    BlockedHosts []string
+    
+    // StatusPath serves stub_status to localhost; empty disables it
+    StatusPath string
+    // VTS enables the nginx-module-vts JSON status on /vts-status
+    VTS bool
+}
+
+type CacheValidity struct {
+    Codes    string
+    Duration string
+}
+
+// CacheZone maps to a proxy_cache_path directive
+type CacheZone struct {
+    Path       string
+    Zone       string
+    Levels     string
+    KeysZoneMB int
+    MaxSize    string
+    Inactive   string
+}
+
+type LogFormat struct {
+    Name   string
+    Format string
+}
+
+type RateLimit struct {
+    ZoneSize string
+    Rate     string
+    Burst    int
+}
+
+// ServerProfile renders a server block for one CDN
+type ServerProfile struct {
+    Name        string
+    Hostnames   []string
+    CacheKey    string
+    SliceSize   string
+    Validity    string
+    ReadTimeout string
+    UseStale    string
+    
+    // RangeHeader is sent upstream as Range ("$slice_range", "$http_range" or empty)
+    RangeHeader string
+    // IgnoreOriginHeaders caches regardless of origin Cache-Control/Expires
+    IgnoreOriginHeaders bool
+    // ShortLived is a URI regex for mutable files (indexes, manifests) cached for ShortValidity
+    ShortLived    string
+    ShortValidity string
+}
+
+// CacheLogFormat is the access log format the agent parses
+const CacheLogFormat = `'$remote_addr - $remote_user [$time_local] '
+                     '"$request" $status $body_bytes_sent '
+                     '"$http_referer" "$http_user_agent" '
+                     'cache=$upstream_cache_status rt=$request_time '
+                     'uct=$upstream_connect_time uht=$upstream_header_time host=$host '
+                     'ct="$sent_http_content_type" upa=$upstream_addr'`
+
+// DefaultModel returns the base configuration previously shipped in configs/isp-cache.conf.
+// CDN server blocks are added from the profile library.
+func DefaultModel() *ConfigModel {
+    return &ConfigModel{
+        Listen:    "80",
+        Resolvers: []string{"8.8.8.8", "8.8.4.4", "1.1.1.1"},
+        Cache: CacheZone{
+            Path:       "/var/cache/nginx/isp-cache",
+            Zone:       "isp_cache",
+            Levels:     "1:2",
+            KeysZoneMB: 500,
+            MaxSize:    "50g",
+            Inactive:   "30d",
+        },
+        LogFormats: []LogFormat{{Name: "cache_log", Format: CacheLogFormat}},
+        AccessLog:  "/var/log/nginx/cache.log",
+        LogFormat:  "cache_log",
+        ErrorLog:   "/var/log/nginx/cache-error.log",
+        RateLimit:  RateLimit{ZoneSize: "10m", Rate: "100r/s", Burst: 200},
+        CacheValidity: []CacheValidity{
+            {Codes: "200 206", Duration: "30d"},
+            {Codes: "301 302", Duration: "1h"},
+            {Codes: "404", Duration: "1m"},
+            {Codes: "any", Duration: "1m"},
+        },
+        Bypass:     []string{"$http_authorization"},
+        StatusPath: "/nginx-status",
+    }
+}
+
+// SizeCacheFromDisk sets MaxSize to a percentage of the filesystem holding the cache
+func (m *ConfigModel) SizeCacheFromDisk(percent int) error {
+    total, err := diskSize(m.Cache.Path)
+    if err != nil {
+        return err
+    }
+    gb := total * uint64(percent) / 100 / (1 << 30)
+    if gb < 1 {
+        return fmt.Errorf("filesystem for %s too small for a cache", m.Cache.Path)
+    }
+    m.Cache.MaxSize = fmt.Sprintf("%dg", gb)
+    return nil
+}
+
+// diskSize returns the size of the filesystem containing path, or its nearest existing parent
+func diskSize(path string) (uint64, error) {
+    for {
+        var fs syscall.Statfs_t
+        err := syscall.Statfs(path, &fs)
+        if err == nil {
+            return fs.Blocks * uint64(fs.Bsize), nil
+        }
+        parent := filepath.Dir(path)
+        if parent == path {
+            return 0, err
+        }
+        path = parent
+    }
+}
+
+// DiskUsedPercent returns how full the filesystem containing path is
+func DiskUsedPercent(path string) (float64, error) {
+    var fs syscall.Statfs_t
+    if err := syscall.Statfs(path, &fs); err != nil {
+        return 0, err
+    }
+    if fs.Blocks == 0 {
+        return 0, nil
+    }
+    // Bavail excludes root-reserved blocks, which nginx cannot use either
+    used := fs.Blocks - fs.Bfree
+    return float64(used) / float64(used+fs.Bavail) * 100, nil
+}
+
+var configTemplate = template.Must(template.New("isp-cache").Funcs(template.FuncMap{
+    "join": func(items []string) string {
+        var b bytes.Buffer
+        for i, item := range items {
+            if i > 0 {
+                b.WriteString(" ")
+            }
+            b.WriteString(item)
+        }
+        return b.String()
+    },
+}).Parse(`# ISP SaaS Platform - Nginx Caching Proxy Configuration
+# Generated by isp-agent - local edits will be overwritten
+{{range .LogFormats}}
+log_format {{.Name}} {{.Format}};
+{{end}}
+proxy_cache_path {{.Cache.Path}}
+    levels={{.Cache.Levels}}
+    keys_zone={{.Cache.Zone}}:{{.Cache.KeysZoneMB}}m
+    max_size={{.Cache.MaxSize}}
+    inactive={{.Cache.Inactive}}
+    use_temp_path=off;
+
+limit_req_zone $binary_remote_addr zone=cache_limit:{{.RateLimit.ZoneSize}} rate={{.RateLimit.Rate}};
+{{- if .VTS}}
+vhost_traffic_status_zone;
+{{- end}}
+{{if .BlockedHosts}}
+map $host $isp_blocked_host {
+    hostnames;
+    default 0;
+{{- range .BlockedHosts}}
+    {{.}} 1;
+{{- end}}
+}
+{{end}}
+server {
+    listen {{.Listen}} default_server;
+    server_name _;
+
+    resolver {{join .Resolvers}} valid=300s ipv6=off;
+    resolver_timeout 30s;
+
+    access_log {{.AccessLog}} {{.LogFormat}};
+    error_log {{.ErrorLog}};
+
+    limit_req zone=cache_limit burst={{.RateLimit.Burst}} nodelay;
+{{if .BlockedHosts}}
+    if ($isp_blocked_host) {
+        return 403;
+    }
+{{end}}
+    location / {
+        proxy_cache {{.Cache.Zone}};
+{{range .CacheValidity}}
+        proxy_cache_valid {{.Codes}} {{.Duration}};
+{{- end}}
+
+        proxy_cache_use_stale error timeout http_500 http_502 http_503 http_504;
+        proxy_cache_background_update on;
+        proxy_cache_lock on;
+        proxy_cache_lock_timeout 5s;
+
+        proxy_cache_revalidate on;
+        slice 1m;
+        proxy_cache_key "$scheme$request_method$host$uri$is_args$args$slice_range";
+        proxy_set_header Range $slice_range;
+
+        proxy_pass http://$host$request_uri;
+        proxy_http_version 1.1;
+
+        proxy_set_header Host $host;
+        proxy_set_header X-Real-IP $remote_addr;
+        proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
+        proxy_set_header Connection "";
+
+        add_header X-Cache-Status $upstream_cache_status always;
+        add_header X-Served-By "ISP-Cache" always;
+
+        proxy_connect_timeout 60s;
+        proxy_send_timeout 300s;
+        proxy_read_timeout 300s;
+
+        proxy_buffers 32 4m;
+        proxy_buffer_size 1m;
+        proxy_busy_buffers_size 8m;
+        proxy_max_temp_file_size 8192m;
+
+{{- if .Bypass}}
+
+        proxy_cache_bypass {{join .Bypass}};
+        proxy_no_cache {{join .Bypass}};
+{{- end}}
+    }
+
+    location /health {
+        access_log off;
+        return 200 "OK\n";
+        add_header Content-Type text/plain;
+    }
+
+    location /cache-status {
+        allow 127.0.0.1;
+        allow ::1;
+        deny all;
+
+        default_type text/plain;
+        return 200 "Cache Active\n";
+    }
+{{- if .StatusPath}}
+
+    location = {{.StatusPath}} {
+        stub_status;
+        allow 127.0.0.1;
+        allow ::1;
+        deny all;
+        access_log off;
+    }
+{{- end}}
+{{- if .VTS}}
+
+    location /vts-status {
+        vhost_traffic_status_display;
+        vhost_traffic_status_display_format json;
+        allow 127.0.0.1;
+        allow ::1;
+        deny all;
+        access_log off;
+    }
+{{- end}}
+
+    # Test object for the agent health monitor, expected as a HIT on repeat
+    location = /cache-probe {
+        access_log off;
+
+        proxy_cache {{.Cache.Zone}};
+        proxy_cache_key "isp-agent-cache-probe";
+        proxy_cache_valid 200 10m;
+        proxy_pass http://$server_addr:$server_port/cache-probe-origin;
+
+        add_header X-Cache-Status $upstream_cache_status always;
+    }
+
+    location = /cache-probe-origin {
+        access_log off;
+        default_type text/plain;
+        return 200 "isp-agent cache probe\n";
+    }
+}
+{{range .Profiles}}
+# {{.Name}}
+server {
+    listen {{$.Listen}};
+    server_name {{join .Hostnames}};
+
+    resolver {{join $.Resolvers}} valid=300s ipv6=off;
+    access_log {{$.AccessLog}} {{$.LogFormat}};
+
+    location / {
+        proxy_cache {{$.Cache.Zone}};
+        proxy_cache_key "{{.CacheKey}}";
+        proxy_cache_valid 200 206 {{.Validity}};
+        proxy_cache_valid any 1m;
+
+        proxy_cache_use_stale {{.UseStale}};
+        proxy_cache_lock on;
+{{- if .IgnoreOriginHeaders}}
+        proxy_ignore_headers Cache-Control Expires Set-Cookie;
+{{- end}}
+{{- if .SliceSize}}
+
+        slice {{.SliceSize}};
+{{- end}}
+{{- if .RangeHeader}}
+        proxy_set_header Range {{.RangeHeader}};
+{{- end}}
+
+        proxy_pass http://$host$request_uri;
+        proxy_set_header Host $host;
+        proxy_set_header X-Real-IP $remote_addr;
+
+        add_header X-Cache-Status $upstream_cache_status always;
+
+        proxy_connect_timeout 60s;
+        proxy_read_timeout {{.ReadTimeout}};
+    }
+{{- if .ShortLived}}
+
+    location ~ "{{.ShortLived}}" {
+        proxy_cache {{$.Cache.Zone}};
+        proxy_cache_key "$host$uri$is_args$args";
+        proxy_cache_valid 200 {{.ShortValidity}};
+        proxy_cache_revalidate on;
+        proxy_cache_lock on;
+
+        proxy_pass http://$host$request_uri;
+        proxy_set_header Host $host;
+
+        add_header X-Cache-Status $upstream_cache_status always;
+    }
+{{- end}}
+}
+{{end}}`))
+
+// Render produces the nginx configuration for a model
+func Render(m *ConfigModel) ([]byte, error) {
+    if err := m.Validate(); err != nil {
+        return nil, fmt.Errorf("invalid config model: %w", err)
+    }
+    
+    var buf bytes.Buffer
+    if err := configTemplate.Execute(&buf, m); err != nil {
+        return nil, fmt.Errorf("failed to render config: %w", err)
+    }
+    return buf.Bytes(), nil
+}
+
+// Generator writes rendered configs into nginx's sites directories
+type Generator struct {
+    AvailableDir string
+    EnabledDir   string
+    Name         string
+    
+    mu sync.Mutex
+    // replaced is what the last Install overwrote, so Rollback can restore
+    // it even when there was no earlier file to keep on disk
+    replaced *priorConfig
+}
+
+// priorConfig is the managed file as it was before an install
+type priorConfig struct {
+    content []byte
+    existed bool
+}
+
+func NewGenerator() *Generator {
+    return &Generator{
+        AvailableDir: "/etc/nginx/sites-available",
+        EnabledDir:   "/etc/nginx/sites-enabled",
+        Name:         "isp-cache.conf",
+    }
+}
+
+// Path returns the managed config file
+func (g *Generator) Path() string {
+    return filepath.Join(g.AvailableDir, g.Name)
+}
+
+func (g *Generator) previousPath() string {
+    return g.Path() + ".prev"
+}
+
+// Apply renders the model, installs it if it changed, and reloads nginx.
+// If the config test or reload fails the previous version is restored.
+func (g *Generator) Apply(m *ConfigModel) (bool, error) {
+    rendered, err := Render(m)
+    if err != nil {
+        return false, err
+    }
+    return g.Install(rendered)
+}
+
+// Install writes an already rendered config; see Apply
+func (g *Generator) Install(rendered []byte) (bool, error) {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    
+    current, err := os.ReadFile(g.Path())
+    if err == nil && bytes.Equal(current, rendered) {
+        return false, nil
+    }
+    prior := &priorConfig{content: current, existed: err == nil}
+    
+    if prior.existed {
+        if err := writeAtomic(g.previousPath(), current); err != nil {
+            return false, fmt.Errorf("failed to keep previous config: %w", err)
+        }
+    }
+    g.replaced = prior
+    
+    if err := writeAtomic(g.Path(), rendered); err != nil {
+        return false, g.restore(err)
+    }
+    if err := g.enable(); err != nil {
+        return false, g.restore(err)
+    }
+    
+    if err := TestConfig(); err != nil {
+        return false, g.restore(fmt.Errorf("config test failed: %w", err))
+    }
+    if err := ReloadNginx(); err != nil {
+        return false, g.restore(fmt.Errorf("reload failed: %w", err))
+    }
+    
+    return true, nil
+}
+
+// restore puts the previous config back after a failed apply and returns cause
+func (g *Generator) restore(cause error) error {
+    if err := g.rollback(); err != nil {
+        return fmt.Errorf("%v; rollback also failed: %w", cause, err)
+    }
+    return fmt.Errorf("%v; previous config restored", cause)
+}
+
+// Rollback reinstates the config the last install replaced and reloads
+// nginx. If that install created the managed file, the file is removed.
+// Without an install in this process it falls back to the copy kept on disk.
+func (g *Generator) Rollback() error {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    return g.rollback()
+}
+
+func (g *Generator) rollback() error {
+    prior := g.replaced
+    if prior == nil {
+        previous, err := os.ReadFile(g.previousPath())
+        if err != nil {
+            return fmt.Errorf("no previous config: %w", err)
+        }
+        prior = &priorConfig{content: previous, existed: true}
+    }
+    
+    if prior.existed {
+        if err := writeAtomic(g.Path(), prior.content); err != nil {
+            return err
+        }
+    } else {
+        if err := os.Remove(filepath.Join(g.EnabledDir, g.Name)); err != nil && !os.IsNotExist(err) {
+            return err
+        }
+        if err := os.Remove(g.Path()); err != nil && !os.IsNotExist(err) {
+            return err
+        }
+    }
+    g.replaced = nil
+    
+    if err := TestConfig(); err != nil {
+        return fmt.Errorf("previous config does not pass test: %w", err)
+    }
+    return ReloadNginx()
+}
+
+// enable links the managed config into sites-enabled
+func (g *Generator) enable() error {
+    link := filepath.Join(g.EnabledDir, g.Name)
+    if target, err := os.Readlink(link); err == nil && target == g.Path() {
+        return nil
+    }
+    os.Remove(link)
+    return os.Symlink(g.Path(), link)
+}
+
+// writeAtomic replaces path via a temp file in the same directory
+func writeAtomic(path string, data []byte) error {
+    tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+    
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Sync(); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+    if err := os.Chmod(tmp.Name(), 0644); err != nil {
+        return err
+    }
+    return os.Rename(tmp.Name(), path)
+}
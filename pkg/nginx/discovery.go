@@ -0,0 +1,515 @@
+package nginx
+
+import (
+    "bytes"
+    "fmt"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "syscall"
+)
+
+// Instance is one running nginx master and what its effective config declares
+type Instance struct {
+    PID int `json:"pid"`
+    // ConfigFile is the -c argument, empty for the binary's default
+    ConfigFile string            `json:"config_file,omitempty"`
+    Zones      []CacheZoneConfig `json:"zones"`
+    Servers    []*ServerBlock    `json:"servers"`
+}
+
+// CacheZoneConfig is one proxy_cache_path directive
+type CacheZoneConfig struct {
+    Name          string `json:"name"`
+    Path          string `json:"path"`
+    Levels        string `json:"levels,omitempty"`
+    KeysZoneBytes int64  `json:"keys_zone_bytes"`
+    // MaxSizeBytes is 0 when max_size is not set and the zone may fill the disk
+    MaxSizeBytes int64  `json:"max_size_bytes"`
+    Inactive     string `json:"inactive"`
+}
+
+// ServerBlock is one server {} with the access logs and cache zones it uses,
+// including those inherited from http {} and set in its locations
+type ServerBlock struct {
+    // Label names the block in telemetry: its first server_name, made unique with the listen address
+    Label         string      `json:"label"`
+    Names         []string    `json:"names"`
+    Listen        []string    `json:"listen"`
+    DefaultServer bool        `json:"default_server"`
+    AccessLogs    []AccessLog `json:"access_logs"`
+    CacheZones    []string    `json:"cache_zones"`
+    
+    patterns []*regexp.Regexp
+    // zone is the server's own proxy_cache, used when no location matches
+    zone      string
+    locations []locationZone
+}
+
+// locationZone is one location {} of a server block and the zone it caches in
+type locationZone struct {
+    // modifier is "", "=", "^~", "~" or "~*"
+    modifier string
+    path     string
+    re       *regexp.Regexp
+    zone     string
+}
+
+// AccessLog is an access_log target, a file path or "syslog:..."
+type AccessLog struct {
+    Path   string `json:"path"`
+    Format string `json:"format"`
+}
+
+// DiscoverInstances finds running nginx masters and reads each effective
+// config with nginx -T. Without a running master, the default config is read.
+func DiscoverInstances() ([]*Instance, error) {
+    masters := findMasters()
+    if len(masters) == 0 {
+        masters = []master{{binary: "nginx"}}
+    }
+    
+    var instances []*Instance
+    var errs []string
+    for _, m := range masters {
+        dump, err := effectiveConfig(m.binary, m.config)
+        if err != nil {
+            errs = append(errs, err.Error())
+            continue
+        }
+        directives, err := ParseDump(dump)
+        if err != nil {
+            errs = append(errs, err.Error())
+            continue
+        }
+        instance := InstanceFromConfig(directives)
+        instance.PID = m.pid
+        instance.ConfigFile = m.config
+        instances = append(instances, instance)
+    }
+    if len(instances) == 0 {
+        return nil, fmt.Errorf("no nginx config readable: %s", strings.Join(errs, "; "))
+    }
+    return instances, nil
+}
+
+type master struct {
+    pid    int
+    binary string
+    config string
+}
+
+// findMasters lists root-owned "nginx: master process ... [-c <file>]"
+// processes. Any process can set its title, so the binary is taken from
+// /proc/<pid>/exe and must be root-owned and not writable by others; the
+// argv is only used for the -c config file.
+func findMasters() []master {
+    entries, _ := os.ReadDir("/proc")
+    var masters []master
+    for _, e := range entries {
+        pid, err := strconv.Atoi(e.Name())
+        if err != nil {
+            continue
+        }
+        dir := filepath.Join("/proc", e.Name())
+        cmdline, err := os.ReadFile(filepath.Join(dir, "cmdline"))
+        if err != nil {
+            continue
+        }
+        // nginx rewrites its argv into one space separated title
+        title := strings.TrimRight(string(bytes.ReplaceAll(cmdline, []byte{0}, []byte{' '})), " ")
+        rest, ok := strings.CutPrefix(title, "nginx: master process ")
+        if !ok {
+            continue
+        }
+        if !ownedByRoot(dir) {
+            continue
+        }
+        binary, err := os.Readlink(filepath.Join(dir, "exe"))
+        if err != nil || !trustedBinary(binary) {
+            continue
+        }
+        
+        m := master{pid: pid, binary: binary}
+        args := strings.Fields(rest)
+        for i := 1; i+1 < len(args); i++ {
+            if args[i] == "-c" {
+                m.config = args[i+1]
+            }
+        }
+        masters = append(masters, m)
+    }
+    sort.Slice(masters, func(i, j int) bool { return masters[i].pid < masters[j].pid })
+    return masters
+}
+
+// ownedByRoot reports whether the process behind a /proc/<pid> directory runs as uid 0
+func ownedByRoot(procDir string) bool {
+    info, err := os.Stat(procDir)
+    if err != nil {
+        return false
+    }
+    st, ok := info.Sys().(*syscall.Stat_t)
+    return ok && st.Uid == 0
+}
+
+// trustedBinary reports whether path is a root-owned executable only root can replace.
+// A binary replaced on disk since nginx started reads as "<path> (deleted)" and fails.
+func trustedBinary(path string) bool {
+    if !filepath.IsAbs(path) {
+        return false
+    }
+    info, err := os.Stat(path)
+    if err != nil || !info.Mode().IsRegular() || info.Mode().Perm()&0022 != 0 {
+        return false
+    }
+    st, ok := info.Sys().(*syscall.Stat_t)
+    return ok && st.Uid == 0
+}
+
+func effectiveConfig(binary, config string) (string, error) {
+    args := []string{"-T"}
+    if config != "" {
+        args = append(args, "-c", config)
+    }
+    output, err := exec.Command(binary, args...).CombinedOutput()
+    if err != nil {
+        return "", fmt.Errorf("%s -T failed: %w", binary, err)
+    }
+    return string(output), nil
+}
+
+// InstanceFromConfig collects the cache zones and server blocks of a parsed config
+func InstanceFromConfig(directives []*Directive) *Instance {
+    instance := &Instance{}
+    for _, d := range Find(directives, "proxy_cache_path") {
+        instance.Zones = append(instance.Zones, parseCachePath(d))
+    }
+    
+    for _, http := range Find(directives, "http") {
+        inherited := blockSettings(http.Block, serverSettings{})
+        for _, d := range http.Block {
+            if d.Name == "server" {
+                instance.Servers = append(instance.Servers, serverBlock(d, inherited))
+            }
+        }
+    }
+    labelServers(instance.Servers)
+    return instance
+}
+
+func parseCachePath(d *Directive) CacheZoneConfig {
+    zone := CacheZoneConfig{Inactive: "10m"}
+    if len(d.Args) > 0 {
+        zone.Path = d.Args[0]
+    }
+    for _, arg := range d.Args[1:] {
+        key, value, _ := strings.Cut(arg, "=")
+        switch key {
+        case "keys_zone":
+            name, size, _ := strings.Cut(value, ":")
+            zone.Name = name
+            zone.KeysZoneBytes, _ = ParseSize(size)
+        case "max_size":
+            zone.MaxSizeBytes, _ = ParseSize(value)
+        case "inactive":
+            zone.Inactive = value
+        case "levels":
+            zone.Levels = value
+        }
+    }
+    return zone
+}
+
+// serverSettings are the directives a server block inherits unless it sets its own
+type serverSettings struct {
+    accessLogs []AccessLog
+    cacheZones []string
+}
+
+// blockSettings returns the access_log and proxy_cache directives of one
+// block level, or the inherited ones when the block has none
+func blockSettings(block []*Directive, inherited serverSettings) serverSettings {
+    var own serverSettings
+    var logsSet, cacheSet bool
+    for _, d := range block {
+        switch d.Name {
+        case "access_log":
+            logsSet = true
+            if len(d.Args) == 0 || d.Args[0] == "off" {
+                continue
+            }
+            log := AccessLog{Path: d.Args[0], Format: "combined"}
+            if len(d.Args) > 1 && !strings.Contains(d.Args[1], "=") {
+                log.Format = d.Args[1]
+            }
+            own.accessLogs = append(own.accessLogs, log)
+        case "proxy_cache":
+            cacheSet = true
+            if len(d.Args) == 1 && d.Args[0] != "off" {
+                own.cacheZones = append(own.cacheZones, d.Args[0])
+            }
+        }
+    }
+    if !logsSet {
+        own.accessLogs = inherited.accessLogs
+    }
+    if !cacheSet {
+        own.cacheZones = inherited.cacheZones
+    }
+    return own
+}
+
+func serverBlock(d *Directive, inherited serverSettings) *ServerBlock {
+    s := &ServerBlock{}
+    settings := blockSettings(d.Block, inherited)
+    s.AccessLogs = append(s.AccessLogs, settings.accessLogs...)
+    s.CacheZones = append(s.CacheZones, settings.cacheZones...)
+    if len(settings.cacheZones) > 0 {
+        s.zone = settings.cacheZones[0]
+    }
+    
+    for _, child := range d.Block {
+        switch child.Name {
+        case "server_name":
+            s.Names = append(s.Names, child.Args...)
+        case "listen":
+            if len(child.Args) > 0 {
+                s.Listen = append(s.Listen, child.Args[0])
+            }
+            for _, arg := range child.Args[1:] {
+                if arg == "default_server" || arg == "default" {
+                    s.DefaultServer = true
+                }
+            }
+        case "location":
+            if loc, ok := parseLocation(child, settings); ok {
+                s.locations = append(s.locations, loc)
+            }
+        }
+    }
+    
+    // Locations may log and cache elsewhere than their server
+    for _, loc := range Find(d.Block, "location") {
+        own := blockSettings(loc.Block, serverSettings{})
+        s.AccessLogs = appendLogs(s.AccessLogs, own.accessLogs)
+        s.CacheZones = appendUnique(s.CacheZones, own.cacheZones)
+    }
+    
+    for _, name := range s.Names {
+        if re := serverNamePattern(name); re != nil {
+            s.patterns = append(s.patterns, re)
+        }
+    }
+    return s
+}
+
+// parseLocation reads a top-level location and the zone it caches in,
+// inheriting the server's proxy_cache unless it sets its own
+func parseLocation(d *Directive, server serverSettings) (locationZone, bool) {
+    var loc locationZone
+    switch len(d.Args) {
+    case 1:
+        loc.path = d.Args[0]
+    case 2:
+        loc.modifier, loc.path = d.Args[0], d.Args[1]
+    default:
+        return loc, false
+    }
+    // Named locations are only reached by internal redirects
+    if strings.HasPrefix(loc.path, "@") {
+        return loc, false
+    }
+    
+    var err error
+    switch loc.modifier {
+    case "", "=", "^~":
+    case "~":
+        loc.re, err = regexp.Compile(loc.path)
+    case "~*":
+        loc.re, err = regexp.Compile("(?i)" + loc.path)
+    default:
+        return loc, false
+    }
+    if err != nil {
+        return loc, false
+    }
+    if zones := blockSettings(d.Block, server).cacheZones; len(zones) > 0 {
+        loc.zone = zones[0]
+    }
+    return loc, true
+}
+
+func appendLogs(dst, src []AccessLog) []AccessLog {
+    for _, log := range src {
+        found := false
+        for _, existing := range dst {
+            if existing.Path == log.Path {
+                found = true
+                break
+            }
+        }
+        if !found {
+            dst = append(dst, log)
+        }
+    }
+    return dst
+}
+
+func appendUnique(dst, src []string) []string {
+    for _, s := range src {
+        found := false
+        for _, existing := range dst {
+            if existing == s {
+                found = true
+                break
+            }
+        }
+        if !found {
+            dst = append(dst, s)
+        }
+    }
+    return dst
+}
+
+// serverNamePattern converts a server_name to a regexp: exact names,
+// "*.example.com", ".example.com", "example.*" and "~regex"
+func serverNamePattern(name string) *regexp.Regexp {
+    switch {
+    case name == "" || name == "_":
+        return nil
+    case strings.HasPrefix(name, "~"):
+        re, err := regexp.Compile("(?i)" + name[1:])
+        if err != nil {
+            return nil
+        }
+        return re
+    case strings.HasPrefix(name, "*."):
+        return regexp.MustCompile(`(?i)^.+\.` + regexp.QuoteMeta(name[2:]) + `$`)
+    case strings.HasPrefix(name, "."):
+        return regexp.MustCompile(`(?i)^(.+\.)?` + regexp.QuoteMeta(name[1:]) + `$`)
+    case strings.HasSuffix(name, ".*"):
+        return regexp.MustCompile(`(?i)^` + regexp.QuoteMeta(name[:len(name)-2]) + `\..+$`)
+    }
+    return regexp.MustCompile(`(?i)^` + regexp.QuoteMeta(name) + `$`)
+}
+
+// Matches reports whether host is one of the block's server names
+func (s *ServerBlock) Matches(host string) bool {
+    for _, re := range s.patterns {
+        if re.MatchString(host) {
+            return true
+        }
+    }
+    return false
+}
+
+// CacheZoneFor returns the zone caching requests for uri, "" when the
+// location nginx picks does not cache. Locations are chosen as nginx does:
+// an exact match, then the longest prefix if it is ^~, then the first
+// matching regex, then the longest prefix.
+func (s *ServerBlock) CacheZoneFor(uri string) string {
+    path, _, _ := strings.Cut(uri, "?")
+    var prefix *locationZone
+    for i := range s.locations {
+        loc := &s.locations[i]
+        switch loc.modifier {
+        case "=":
+            if path == loc.path {
+                return loc.zone
+            }
+        case "", "^~":
+            if strings.HasPrefix(path, loc.path) && (prefix == nil || len(loc.path) > len(prefix.path)) {
+                prefix = loc
+            }
+        }
+    }
+    if prefix != nil && prefix.modifier == "^~" {
+        return prefix.zone
+    }
+    for _, loc := range s.locations {
+        if loc.re != nil && loc.re.MatchString(path) {
+            return loc.zone
+        }
+    }
+    if prefix != nil {
+        return prefix.zone
+    }
+    return s.zone
+}
+
+// labelServers names each block after its first server name, adding the
+// listen address when several blocks share a name
+func labelServers(servers []*ServerBlock) {
+    count := make(map[string]int)
+    for _, s := range servers {
+        s.Label = "_"
+        for _, name := range s.Names {
+            if name != "" && name != "_" {
+                s.Label = strings.TrimPrefix(name, "~")
+                break
+            }
+        }
+        count[s.Label]++
+    }
+    for _, s := range servers {
+        if count[s.Label] > 1 && len(s.Listen) > 0 {
+            s.Label += "@" + s.Listen[0]
+        }
+    }
+}
+
+// ServerFor returns the block serving host, following nginx: a name match,
+// else the default_server, else the first block
+func (inst *Instance) ServerFor(host string) *ServerBlock {
+    var fallback *ServerBlock
+    for _, s := range inst.Servers {
+        if host != "" && s.Matches(host) {
+            return s
+        }
+        if fallback == nil || (s.DefaultServer && !fallback.DefaultServer) {
+            fallback = s
+        }
+    }
+    return fallback
+}
+
+// LogFiles returns the distinct access log files of every server block
+func (inst *Instance) LogFiles() []string {
+    var files []string
+    for _, s := range inst.Servers {
+        for _, log := range s.AccessLogs {
+            if strings.HasPrefix(log.Path, "syslog:") || strings.Contains(log.Path, "$") {
+                continue
+            }
+            files = appendUnique(files, []string{log.Path})
+        }
+    }
+    return files
+}
+
+// ParseSize reads an nginx size: "512", "10k", "500m", "50g"
+func ParseSize(s string) (int64, error) {
+    s = strings.ToLower(strings.TrimSpace(s))
+    multiplier := int64(1)
+    switch {
+    case strings.HasSuffix(s, "k"):
+        multiplier = 1 << 10
+    case strings.HasSuffix(s, "m"):
+        multiplier = 1 << 20
+    case strings.HasSuffix(s, "g"):
+        multiplier = 1 << 30
+    }
+    if multiplier > 1 {
+        s = s[:len(s)-1]
+    }
+    n, err := strconv.ParseInt(s, 10, 64)
+    if err != nil {
+        return 0, fmt.Errorf("invalid size %q", s)
+    }
+    return n * multiplier, nil
+}
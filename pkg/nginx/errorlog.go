@@ -0,0 +1,162 @@
+package nginx
+
+import (
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// ErrorEntry is one parsed line of the nginx error log
+type ErrorEntry struct {
+    Time    time.Time
+    Level   string
+    PID     int
+    Conn    int64
+    Message string
+    
+    // Context nginx appends after the message, when present
+    Client   string
+    Server   string
+    Request  string
+    Upstream string
+    Host     string
+}
+
+// errorLevels maps nginx severities to their rank, most severe first
+var errorLevels = map[string]int{
+    "emerg":  0,
+    "alert":  1,
+    "crit":   2,
+    "error":  3,
+    "warn":   4,
+    "notice": 5,
+    "info":   6,
+    "debug":  7,
+}
+
+// ErrorLevelRank orders severities; unknown levels rank as info
+func ErrorLevelRank(level string) int {
+    if rank, ok := errorLevels[level]; ok {
+        return rank
+    }
+    return errorLevels["info"]
+}
+
+// errorLinePattern matches "2024/01/02 15:04:05 [error] 123#123: *45 message"
+var errorLinePattern = regexp.MustCompile(`^(\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}) \[(\w+)\] (\d+)#\d+: (?:\*(\d+) )?(.*)$`)
+
+// ParseErrorLine parses one error log line
+func ParseErrorLine(line string) (*ErrorEntry, bool) {
+    m := errorLinePattern.FindStringSubmatch(line)
+    if m == nil {
+        return nil, false
+    }
+    
+    e := &ErrorEntry{Level: m[2]}
+    e.Time, _ = time.ParseInLocation("2006/01/02 15:04:05", m[1], time.Local)
+    e.PID, _ = strconv.Atoi(m[3])
+    if m[4] != "" {
+        e.Conn, _ = strconv.ParseInt(m[4], 10, 64)
+    }
+    
+    e.Message = m[5]
+    if i := strings.Index(e.Message, ", client: "); i >= 0 {
+        parseErrorContext(e, e.Message[i+2:])
+        e.Message = e.Message[:i]
+    }
+    return e, true
+}
+
+// parseErrorContext reads `client: 1.2.3.4, server: _, request: "GET / HTTP/1.1", ...`
+func parseErrorContext(e *ErrorEntry, s string) {
+    for s != "" {
+        colon := strings.Index(s, ": ")
+        if colon < 0 {
+            return
+        }
+        key := s[:colon]
+        s = s[colon+2:]
+        
+        var value string
+        if strings.HasPrefix(s, `"`) {
+            end := strings.Index(s[1:], `"`)
+            if end < 0 {
+                value, s = s[1:], ""
+            } else {
+                value, s = s[1:end+1], s[end+2:]
+            }
+        } else if comma := strings.Index(s, ", "); comma >= 0 {
+            value, s = s[:comma], s[comma:]
+        } else {
+            value, s = s, ""
+        }
+        s = strings.TrimPrefix(s, ", ")
+        
+        switch key {
+        case "client":
+            e.Client = value
+        case "server":
+            e.Server = value
+        case "request":
+            e.Request = value
+        case "upstream":
+            e.Upstream = value
+        case "host":
+            e.Host = value
+        }
+    }
+}
+
+// errorPatterns classify the messages worth tracking as error rates
+var errorPatterns = []struct {
+    name     string
+    contains []string
+}{
+    {"upstream timed out", []string{"upstream timed out"}},
+    {"no live upstreams", []string{"no live upstreams"}},
+    {"disk full", []string{"No space left on device"}},
+    {"upstream connect failed", []string{"connect() failed", "connect() to"}},
+    {"upstream closed connection", []string{"upstream prematurely closed", "upstream sent no valid"}},
+    {"resolver failed", []string{"could not be resolved", "resolver error"}},
+    {"too many open files", []string{"Too many open files"}},
+    {"worker exited", []string{"exited on signal"}},
+    {"file not found", []string{"No such file or directory"}},
+    {"permission denied", []string{"Permission denied"}},
+    {"cache manager", []string{"cache manager", "cache loader"}},
+    {"ssl error", []string{"SSL_"}},
+    {"request body too large", []string{"client intended to send too large body"}},
+}
+
+// ErrorPattern names the class of an error message, or returns "other"
+func ErrorPattern(message string) string {
+    for _, p := range errorPatterns {
+        for _, c := range p.contains {
+            if strings.Contains(message, c) {
+                return p.name
+            }
+        }
+    }
+    return "other"
+}
+
+var digitsPattern = regexp.MustCompile(`\d+`)
+
+// NormalizeMessage replaces numbers and quoted values so repeated messages dedupe
+func NormalizeMessage(message string) string {
+    var b strings.Builder
+    quoted := false
+    for _, r := range message {
+        if r == '"' {
+            quoted = !quoted
+            if quoted {
+                b.WriteString(`"…"`)
+            }
+            continue
+        }
+        if !quoted {
+            b.WriteRune(r)
+        }
+    }
+    return digitsPattern.ReplaceAllString(b.String(), "N")
+}
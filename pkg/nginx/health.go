@@ -0,0 +1,301 @@
+package nginx
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "log/slog"
+    "net/http"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// HealthState summarizes whether the cache can serve subscribers
+type HealthState string
+
+const (
+    HealthUnknown   HealthState = "unknown"
+    HealthHealthy   HealthState = "healthy"
+    HealthDegraded  HealthState = "degraded"  // serving, but not caching or slow
+    HealthUnhealthy HealthState = "unhealthy" // not serving
+)
+
+// HealthCheck is the outcome of one probe
+type HealthCheck struct {
+    Name      string  `json:"name"`
+    OK        bool    `json:"ok"`
+    Skipped   bool    `json:"skipped,omitempty"`
+    LatencyMs float64 `json:"latency_ms,omitempty"`
+    Detail    string  `json:"detail,omitempty"`
+}
+
+// HealthReport is the result of one round of health checks
+type HealthReport struct {
+    State     HealthState   `json:"state"`
+    MasterPID int           `json:"master_pid,omitempty"`
+    Workers   int           `json:"workers"`
+    Checks    []HealthCheck `json:"checks"`
+    CheckedAt time.Time     `json:"checked_at"`
+    // Failures counts consecutive unhealthy rounds
+    Failures int `json:"failures,omitempty"`
+}
+
+// HealthMonitor probes nginx periodically and reports state transitions
+type HealthMonitor struct {
+    BaseURL   string
+    ProbePath string
+    Interval  time.Duration
+    // SlowThreshold marks the cache degraded when /health answers slower
+    SlowThreshold time.Duration
+    // RestartCommand runs after FailThreshold consecutive unhealthy rounds; empty disables restarts
+    RestartCommand []string
+    FailThreshold  int
+
+    OnTransition func(prev, next *HealthReport)
+    OnRestart    func(err error)
+    Logger       *slog.Logger
+
+    client *http.Client
+
+    mu        sync.Mutex
+    last      *HealthReport
+    failures  int
+    restarted bool
+}
+
+func NewHealthMonitor(baseURL string) *HealthMonitor {
+    return &HealthMonitor{
+        BaseURL:       strings.TrimSuffix(baseURL, "/"),
+        ProbePath:     "/cache-probe",
+        Interval:      15 * time.Second,
+        SlowThreshold: time.Second,
+        FailThreshold: 3,
+        Logger:        slog.Default(),
+        client: &http.Client{
+            Timeout: 5 * time.Second,
+            // The probes must hit nginx itself, never a proxy from the environment
+            Transport: &http.Transport{DisableKeepAlives: true},
+        },
+    }
+}
+
+// Last returns the most recent report, or nil before the first check
+func (m *HealthMonitor) Last() *HealthReport {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    return m.last
+}
+
+// Run checks nginx every Interval until ctx is cancelled
+func (m *HealthMonitor) Run(ctx context.Context) {
+    ticker := time.NewTicker(m.Interval)
+    defer ticker.Stop()
+
+    for {
+        m.observe(m.Check(ctx))
+
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+    }
+}
+
+// observe records a report, fires transitions and restarts nginx when it stays down
+func (m *HealthMonitor) observe(report *HealthReport) {
+    m.mu.Lock()
+    prev := m.last
+    if report.State == HealthUnhealthy {
+        m.failures++
+    } else {
+        m.failures = 0
+        m.restarted = false
+    }
+    report.Failures = m.failures
+    m.last = report
+
+    restart := len(m.RestartCommand) > 0 && m.FailThreshold > 0 &&
+        m.failures >= m.FailThreshold && !m.restarted
+    if restart {
+        m.restarted = true
+    }
+    m.mu.Unlock()
+
+    if prev == nil {
+        prev = &HealthReport{State: HealthUnknown}
+    }
+    for _, c := range report.Checks {
+        if !c.OK && !c.Skipped {
+            m.Logger.Debug("health check failed", "check", c.Name, "detail", c.Detail, "latency_ms", c.LatencyMs)
+        }
+    }
+    if prev.State != report.State && m.OnTransition != nil {
+        m.OnTransition(prev, report)
+    }
+
+    // One restart per outage; a restart loop would only hide the real problem
+    if restart {
+        m.Logger.Warn("nginx unhealthy, restarting", "failures", report.Failures, "command", strings.Join(m.RestartCommand, " "))
+        err := m.restart()
+        if err != nil {
+            m.Logger.Error("nginx restart failed", "error", err)
+        }
+        if m.OnRestart != nil {
+            m.OnRestart(err)
+        }
+    }
+}
+
+func (m *HealthMonitor) restart() error {
+    output, err := exec.Command(m.RestartCommand[0], m.RestartCommand[1:]...).CombinedOutput()
+    if err != nil {
+        return fmt.Errorf("%s: %w: %s", strings.Join(m.RestartCommand, " "), err, strings.TrimSpace(string(output)))
+    }
+    return nil
+}
+
+// Check runs one round of probes
+func (m *HealthMonitor) Check(ctx context.Context) *HealthReport {
+    report := &HealthReport{CheckedAt: time.Now()}
+
+    procs := HealthCheck{Name: "processes"}
+    master, workers, err := NginxProcesses()
+    report.MasterPID, report.Workers = master, workers
+    switch {
+    case err != nil:
+        procs.Detail = err.Error()
+    case master == 0:
+        procs.Detail = "no nginx master process"
+    case workers == 0:
+        procs.Detail = "no nginx worker processes"
+    default:
+        procs.OK = true
+        procs.Detail = fmt.Sprintf("master %d, %d workers", master, workers)
+    }
+
+    health := m.get(ctx, "health", "/health")
+    status := m.get(ctx, "cache-status", "/cache-status")
+    probe := m.probeHit(ctx)
+    report.Checks = []HealthCheck{procs, health, status, probe}
+
+    switch {
+    case !procs.OK || !health.OK:
+        report.State = HealthUnhealthy
+    case !status.OK || (!probe.OK && !probe.Skipped):
+        report.State = HealthDegraded
+    case m.SlowThreshold > 0 && health.LatencyMs > float64(m.SlowThreshold.Milliseconds()):
+        report.State = HealthDegraded
+    default:
+        report.State = HealthHealthy
+    }
+    return report
+}
+
+// get requests a location and expects 200
+func (m *HealthMonitor) get(ctx context.Context, name, path string) HealthCheck {
+    check := HealthCheck{Name: name}
+    resp, latency, err := m.request(ctx, path)
+    check.LatencyMs = float64(latency.Microseconds()) / 1000
+    if err != nil {
+        check.Detail = err.Error()
+        return check
+    }
+    if resp.StatusCode != http.StatusOK {
+        check.Detail = resp.Status
+        return check
+    }
+    check.OK = true
+    return check
+}
+
+// probeHit confirms a test object is stored and served from the cache.
+// A first MISS is expected after a restart, so the object is requested again.
+func (m *HealthMonitor) probeHit(ctx context.Context) HealthCheck {
+    check := HealthCheck{Name: "cache-hit"}
+    if m.ProbePath == "" {
+        check.Skipped = true
+        return check
+    }
+
+    var statuses []string
+    for attempt := 0; attempt < 2; attempt++ {
+        resp, latency, err := m.request(ctx, m.ProbePath)
+        check.LatencyMs = float64(latency.Microseconds()) / 1000
+        if err != nil {
+            check.Detail = err.Error()
+            return check
+        }
+        // Hand-written configs have no probe location
+        if resp.StatusCode == http.StatusNotFound {
+            check.Skipped = true
+            check.Detail = "no probe location in nginx config"
+            return check
+        }
+        if resp.StatusCode != http.StatusOK {
+            check.Detail = resp.Status
+            return check
+        }
+
+        cacheStatus := resp.Header.Get("X-Cache-Status")
+        statuses = append(statuses, cacheStatus)
+        if cacheStatus == "HIT" {
+            check.OK = true
+            check.Detail = strings.Join(statuses, " -> ")
+            return check
+        }
+    }
+    check.Detail = fmt.Sprintf("test object not served from cache (%s)", strings.Join(statuses, " -> "))
+    return check
+}
+
+func (m *HealthMonitor) request(ctx context.Context, path string) (*http.Response, time.Duration, error) {
+    req, err := http.NewRequestWithContext(ctx, "GET", m.BaseURL+path, nil)
+    if err != nil {
+        return nil, 0, err
+    }
+
+    start := time.Now()
+    resp, err := m.client.Do(req)
+    if err != nil {
+        return nil, time.Since(start), err
+    }
+    io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+    resp.Body.Close()
+    return resp, time.Since(start), nil
+}
+
+// NginxProcesses finds the nginx master and counts its workers via /proc
+func NginxProcesses() (master int, workers int, err error) {
+    entries, err := os.ReadDir("/proc")
+    if err != nil {
+        return 0, 0, err
+    }
+
+    for _, e := range entries {
+        pid, err := strconv.Atoi(e.Name())
+        if err != nil {
+            continue
+        }
+        cmdline, err := os.ReadFile(filepath.Join("/proc", e.Name(), "cmdline"))
+        if err != nil {
+            continue
+        }
+        // nginx rewrites its argv to "nginx: master process ..." / "nginx: worker process"
+        title := strings.TrimRight(strings.ReplaceAll(string(cmdline), "\x00", " "), " ")
+        switch {
+        case strings.HasPrefix(title, "nginx: master process"):
+            if master == 0 || pid < master {
+                master = pid
+            }
+        case strings.HasPrefix(title, "nginx: worker process"):
+            workers++
+        }
+    }
+    return master, workers, nil
+}
@@ -0,0 +1,253 @@
+package nginx
+
+import (
+    "encoding/json"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// LineParser turns one access log line into a Record
+type LineParser func(line string) (*Record, bool)
+
+// JSONFields maps Record fields to the keys of a JSON access log line, e.g.
+// {"cache_status": "cache", "bytes": "body_bytes_sent"}. Keys may name
+// nested values as "upstream.cache_status". Fields without a key are looked
+// up under the common names in defaultJSONKeys.
+//
+// Fields: remote_addr, time, request, method, uri, protocol, status, bytes,
+// referer, user_agent, host, cache_status, content_type, request_time,
+// upstream_connect_time, upstream_header_time, upstream_addr
+type JSONFields map[string]string
+
+// defaultJSONKeys are tried, in order, for fields JSONFields does not map
+var defaultJSONKeys = map[string][]string{
+    "remote_addr":           {"remote_addr", "client", "client_ip"},
+    "time":                  {"time_iso8601", "time_local", "time", "timestamp", "msec"},
+    "request":               {"request"},
+    "method":                {"request_method", "method"},
+    "uri":                   {"request_uri", "uri"},
+    "protocol":              {"server_protocol", "protocol"},
+    "status":                {"status"},
+    "bytes":                 {"body_bytes_sent", "bytes", "bytes_sent"},
+    "referer":               {"http_referer", "referer"},
+    "user_agent":            {"http_user_agent", "user_agent"},
+    "host":                  {"host", "http_host", "server_name"},
+    "cache_status":          {"upstream_cache_status", "cache_status", "cache"},
+    "content_type":          {"sent_http_content_type", "content_type"},
+    "request_time":          {"request_time", "rt"},
+    "upstream_connect_time": {"upstream_connect_time", "uct"},
+    "upstream_header_time":  {"upstream_header_time", "uht"},
+    "upstream_addr":         {"upstream_addr", "upa"},
+}
+
+// jsonVariables maps the nginx variables a log_format may log to Record fields
+var jsonVariables = map[string]string{
+    "remote_addr":            "remote_addr",
+    "time_iso8601":           "time",
+    "time_local":             "time",
+    "msec":                   "time",
+    "request":                "request",
+    "request_method":         "method",
+    "request_uri":            "uri",
+    "uri":                    "uri",
+    "server_protocol":        "protocol",
+    "status":                 "status",
+    "body_bytes_sent":        "bytes",
+    "bytes_sent":             "bytes",
+    "http_referer":           "referer",
+    "http_user_agent":        "user_agent",
+    "host":                   "host",
+    "http_host":              "host",
+    "server_name":            "host",
+    "upstream_cache_status":  "cache_status",
+    "sent_http_content_type": "content_type",
+    "request_time":           "request_time",
+    "upstream_connect_time":  "upstream_connect_time",
+    "upstream_header_time":   "upstream_header_time",
+    "upstream_addr":          "upstream_addr",
+}
+
+// ParseAny parses JSON lines with the default keys and anything else with ParseLine
+func ParseAny(line string) (*Record, bool) {
+    return JSONFields(nil).Parse(line)
+}
+
+// Parse parses a JSON line, or a text line with ParseLine
+func (f JSONFields) Parse(line string) (*Record, bool) {
+    trimmed := strings.TrimSpace(line)
+    if !strings.HasPrefix(trimmed, "{") {
+        return ParseLine(line)
+    }
+    
+    var obj map[string]interface{}
+    decoder := json.NewDecoder(strings.NewReader(trimmed))
+    decoder.UseNumber()
+    if err := decoder.Decode(&obj); err != nil {
+        return nil, false
+    }
+    get := func(field string) string {
+        if key, ok := f[field]; ok && key != "" {
+            return jsonValue(obj, key)
+        }
+        for _, key := range defaultJSONKeys[field] {
+            if v := jsonValue(obj, key); v != "" {
+                return v
+            }
+        }
+        return ""
+    }
+    
+    r := &Record{
+        RemoteAddr:          get("remote_addr"),
+        Referer:             dash(get("referer")),
+        UserAgent:           dash(get("user_agent")),
+        Method:              get("method"),
+        URI:                 get("uri"),
+        Protocol:            get("protocol"),
+        Host:                strings.ToLower(dash(get("host"))),
+        CacheStatus:         strings.ToUpper(dash(get("cache_status"))),
+        ContentType:         mediaType(get("content_type")),
+        RequestTime:         parseSeconds(get("request_time")),
+        UpstreamConnectTime: parseSeconds(get("upstream_connect_time")),
+        UpstreamHeaderTime:  parseSeconds(get("upstream_header_time")),
+        UpstreamAddr:        firstUpstream(get("upstream_addr")),
+        Time:                parseLogTime(get("time")),
+    }
+    
+    if request := strings.SplitN(get("request"), " ", 3); len(request) >= 2 {
+        if r.Method == "" {
+            r.Method = request[0]
+        }
+        if r.URI == "" {
+            r.URI = request[1]
+        }
+        if r.Protocol == "" && len(request) == 3 {
+            r.Protocol = request[2]
+        }
+    }
+    
+    var err error
+    if r.Status, err = strconv.Atoi(get("status")); err != nil {
+        return nil, false
+    }
+    r.BodyBytes, _ = strconv.ParseInt(get("bytes"), 10, 64)
+    
+    if r.Host == "" && strings.HasPrefix(r.URI, "http") {
+        r.Host = extractDomain(r.URI)
+    }
+    return r, true
+}
+
+// jsonValue returns the value at a dotted key as a string, "" when missing or null
+func jsonValue(obj map[string]interface{}, key string) string {
+    var v interface{} = obj
+    for _, part := range strings.Split(key, ".") {
+        m, ok := v.(map[string]interface{})
+        if !ok {
+            return ""
+        }
+        if v, ok = m[part]; !ok {
+            // Keys may contain dots themselves
+            if v, ok = m[key]; !ok {
+                return ""
+            }
+            break
+        }
+    }
+    switch v := v.(type) {
+    case string:
+        return v
+    case json.Number:
+        return v.String()
+    case bool:
+        return strconv.FormatBool(v)
+    }
+    return ""
+}
+
+func dash(s string) string {
+    if s == "-" {
+        return ""
+    }
+    return s
+}
+
+// parseLogTime reads $time_iso8601, $time_local or $msec
+func parseLogTime(s string) time.Time {
+    if t, err := time.Parse(time.RFC3339, s); err == nil {
+        return t
+    }
+    if t, err := time.Parse("02/Jan/2006:15:04:05 -0700", s); err == nil {
+        return t
+    }
+    if msec, err := strconv.ParseFloat(s, 64); err == nil {
+        return time.UnixMilli(int64(msec * 1000))
+    }
+    return time.Time{}
+}
+
+// jsonFormatField matches "key": "$variable" or "key": $variable in a log_format
+var jsonFormatField = regexp.MustCompile(`"([^"\\]+)"\s*:\s*(?:"\$\{?(\w+)\}?"|\$\{?(\w+)\}?)\s*[,}]`)
+
+// JSONFieldsFromFormat derives the field mapping from a JSON log_format
+// string. It is false when the format does not look like JSON or maps no field.
+func JSONFieldsFromFormat(format string) (JSONFields, bool) {
+    if !strings.HasPrefix(strings.TrimSpace(format), "{") {
+        return nil, false
+    }
+    fields := make(JSONFields)
+    for _, m := range jsonFormatField.FindAllStringSubmatch(format, -1) {
+        variable := m[2]
+        if variable == "" {
+            variable = m[3]
+        }
+        field, ok := jsonVariables[variable]
+        if !ok {
+            continue
+        }
+        // $body_bytes_sent wins over $bytes_sent, $time_iso8601 over $msec
+        if _, taken := fields[field]; !taken {
+            fields[field] = m[1]
+        }
+    }
+    return fields, len(fields) > 0
+}
+
+// DetectJSONFields finds the log_format used by the access_log writing to
+// accessLog, or by any access_log when none does, and derives the JSON field
+// mapping from it. It returns the format's name.
+func DetectJSONFields(directives []*Directive, accessLog string) (JSONFields, string, bool) {
+    formats := make(map[string]string)
+    for _, d := range Find(directives, "log_format") {
+        if len(d.Args) < 2 {
+            continue
+        }
+        var parts []string
+        for _, arg := range d.Args[1:] {
+            if !strings.HasPrefix(arg, "escape=") {
+                parts = append(parts, arg)
+            }
+        }
+        formats[d.Args[0]] = strings.Join(parts, "")
+    }
+    
+    var candidates []string
+    for _, d := range Find(directives, "access_log") {
+        if len(d.Args) < 2 || d.Args[0] == "off" {
+            continue
+        }
+        if d.Args[0] == accessLog {
+            candidates = append([]string{d.Args[1]}, candidates...)
+        } else {
+            candidates = append(candidates, d.Args[1])
+        }
+    }
+    for _, name := range candidates {
+        if fields, ok := JSONFieldsFromFormat(formats[name]); ok {
+            return fields, name, true
+        }
+    }
+    return nil, "", false
+}
@@ -0,0 +1,128 @@
+package nginx
+
+import (
+    "sort"
+    "sync"
+
+    "isp-agent/pkg/sketch"
+)
+
+// LatencySketches holds the latency distributions for one group, in milliseconds
+type LatencySketches struct {
+    // Response is $request_time, the full time to serve the client
+    Response *sketch.Sketch
+    // OriginTTFB is $upstream_header_time, only present when the origin was contacted
+    OriginTTFB *sketch.Sketch
+}
+
+func newLatencySketches() *LatencySketches {
+    return &LatencySketches{
+        Response:   sketch.New(sketch.Accuracy),
+        OriginTTFB: sketch.New(sketch.Accuracy),
+    }
+}
+
+func (l *LatencySketches) add(r *Record) {
+    if r.RequestTime >= 0 {
+        l.Response.Add(r.RequestTime * 1000)
+    }
+    if r.UpstreamHeaderTime >= 0 {
+        l.OriginTTFB.Add(r.UpstreamHeaderTime * 1000)
+    }
+}
+
+// Merge folds o into l
+func (l *LatencySketches) Merge(o *LatencySketches) {
+    l.Response.Merge(o.Response)
+    l.OriginTTFB.Merge(o.OriginTTFB)
+}
+
+// LatencyStats keeps latency sketches per cache status and per host
+type LatencyStats struct {
+    mu       sync.Mutex
+    maxHosts int
+    byStatus map[string]*LatencySketches
+    byHost   map[string]*LatencySketches
+}
+
+// otherHosts collects hosts beyond the tracking limit
+const otherHosts = "(other)"
+
+// NewLatencyStats tracks at most maxHosts hosts per interval; the rest share one group
+func NewLatencyStats(maxHosts int) *LatencyStats {
+    return &LatencyStats{
+        maxHosts: maxHosts,
+        byStatus: make(map[string]*LatencySketches),
+        byHost:   make(map[string]*LatencySketches),
+    }
+}
+
+func (s *LatencyStats) Observe(r *Record) {
+    if r.RequestTime < 0 && r.UpstreamHeaderTime < 0 {
+        return
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    status := CacheStatusOf(r)
+    byStatus, ok := s.byStatus[status]
+    if !ok {
+        byStatus = newLatencySketches()
+        s.byStatus[status] = byStatus
+    }
+    byStatus.add(r)
+
+    if r.Host == "" {
+        return
+    }
+    host := r.Host
+    if _, ok := s.byHost[host]; !ok && len(s.byHost) >= s.maxHosts {
+        host = otherHosts
+    }
+    byHost, ok := s.byHost[host]
+    if !ok {
+        byHost = newLatencySketches()
+        s.byHost[host] = byHost
+    }
+    byHost.add(r)
+}
+
+// Flush returns the sketches since the last flush and resets them
+func (s *LatencyStats) Flush() (byStatus, byHost map[string]*LatencySketches) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    byStatus, byHost = s.byStatus, s.byHost
+    s.byStatus = make(map[string]*LatencySketches)
+    s.byHost = make(map[string]*LatencySketches)
+    return byStatus, byHost
+}
+
+// TopByCount returns the keys with the most responses, largest first
+func TopByCount(groups map[string]*LatencySketches, limit int) []string {
+    keys := make([]string, 0, len(groups))
+    for k := range groups {
+        keys = append(keys, k)
+    }
+    sort.Slice(keys, func(i, j int) bool {
+        ci, cj := groups[keys[i]].Response.Count(), groups[keys[j]].Response.Count()
+        if ci != cj {
+            return ci > cj
+        }
+        return keys[i] < keys[j]
+    })
+    if limit > 0 && len(keys) > limit {
+        keys = keys[:limit]
+    }
+    return keys
+}
+
+// CacheStatusOf returns the record's $upstream_cache_status, "-" when the
+// response never went through the cache
+func CacheStatusOf(r *Record) string {
+    if r.CacheStatus == "" {
+        return "-"
+    }
+    return r.CacheStatus
+}
@@ -0,0 +1,218 @@
+package nginx
+
+import (
+    "fmt"
+    "path/filepath"
+    "strings"
+)
+
+// Directive is one statement of an nginx config, with its block if it has one
+type Directive struct {
+    Name  string
+    Args  []string
+    Block []*Directive
+    // File is the config file the directive was read from
+    File string
+}
+
+// EffectiveConfig returns the output of nginx -T: every loaded config file,
+// each introduced by a "# configuration file <path>:" line
+func EffectiveConfig() (string, error) {
+    return effectiveConfig("nginx", "")
+}
+
+// ParseDump parses nginx -T output into the directives of the main config
+// file, with include directives replaced by the files they name
+func ParseDump(dump string) ([]*Directive, error) {
+    files, order := splitDump(dump)
+    if len(order) == 0 {
+        return nil, fmt.Errorf("no configuration files in nginx -T output")
+    }
+    
+    parsed := make(map[string][]*Directive, len(files))
+    for _, name := range order {
+        directives, err := ParseConfig(files[name], name)
+        if err != nil {
+            return nil, err
+        }
+        parsed[name] = directives
+    }
+    return resolveIncludes(parsed[order[0]], parsed, order, 0), nil
+}
+
+// splitDump returns the contents of each file in the dump and the files in dump order
+func splitDump(dump string) (map[string]string, []string) {
+    const marker = "# configuration file "
+    files := make(map[string]string)
+    var order []string
+    var current string
+    var b strings.Builder
+    flush := func() {
+        if current != "" {
+            files[current] = b.String()
+        }
+        b.Reset()
+    }
+    for _, line := range strings.Split(dump, "\n") {
+        if strings.HasPrefix(line, marker) && strings.HasSuffix(line, ":") {
+            flush()
+            current = strings.TrimSuffix(strings.TrimPrefix(line, marker), ":")
+            order = append(order, current)
+            continue
+        }
+        if current != "" {
+            b.WriteString(line)
+            b.WriteByte('\n')
+        }
+    }
+    flush()
+    return files, order
+}
+
+// resolveIncludes inlines included files; includes are relative to the main config's directory
+func resolveIncludes(directives []*Directive, files map[string][]*Directive, order []string, depth int) []*Directive {
+    var out []*Directive
+    for _, d := range directives {
+        if d.Name == "include" && len(d.Args) == 1 && depth < 10 {
+            pattern := d.Args[0]
+            if !filepath.IsAbs(pattern) {
+                pattern = filepath.Join(filepath.Dir(order[0]), pattern)
+            }
+            for _, name := range order {
+                if ok, _ := filepath.Match(pattern, name); ok {
+                    out = append(out, resolveIncludes(files[name], files, order, depth+1)...)
+                }
+            }
+            continue
+        }
+        if d.Block != nil {
+            d.Block = resolveIncludes(d.Block, files, order, depth)
+        }
+        out = append(out, d)
+    }
+    return out
+}
+
+// ParseConfig parses the text of one nginx config file
+func ParseConfig(text, file string) ([]*Directive, error) {
+    tokens, err := tokenizeConfig(text)
+    if err != nil {
+        return nil, fmt.Errorf("%s: %w", file, err)
+    }
+    directives, rest, err := parseBlock(tokens, file)
+    if err != nil {
+        return nil, fmt.Errorf("%s: %w", file, err)
+    }
+    if len(rest) > 0 {
+        return nil, fmt.Errorf("%s: unexpected }", file)
+    }
+    return directives, nil
+}
+
+// configToken is a word or one of "{", "}", ";"; quoted words are never punctuation
+type configToken struct {
+    text   string
+    quoted bool
+}
+
+func (t configToken) is(punct string) bool {
+    return !t.quoted && t.text == punct
+}
+
+func tokenizeConfig(text string) ([]configToken, error) {
+    var tokens []configToken
+    for i := 0; i < len(text); {
+        c := text[i]
+        switch {
+        case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+            i++
+        case c == '#':
+            for i < len(text) && text[i] != '\n' {
+                i++
+            }
+        case c == '{' || c == '}' || c == ';':
+            tokens = append(tokens, configToken{text: string(c)})
+            i++
+        case c == '"' || c == '\'':
+            var b strings.Builder
+            j := i + 1
+            for ; j < len(text) && text[j] != c; j++ {
+                if text[j] == '\\' && j+1 < len(text) && (text[j+1] == c || text[j+1] == '\\') {
+                    j++
+                }
+                b.WriteByte(text[j])
+            }
+            if j >= len(text) {
+                return nil, fmt.Errorf("unterminated string")
+            }
+            tokens = append(tokens, configToken{text: b.String(), quoted: true})
+            i = j + 1
+        default:
+            j := i
+            for j < len(text) && !strings.ContainsRune(" \t\r\n{};", rune(text[j])) {
+                // ${var} may appear inside a word
+                if text[j] == '$' && j+1 < len(text) && text[j+1] == '{' {
+                    if end := strings.IndexByte(text[j:], '}'); end > 0 {
+                        j += end
+                    }
+                }
+                j++
+            }
+            tokens = append(tokens, configToken{text: text[i:j]})
+            i = j
+        }
+    }
+    return tokens, nil
+}
+
+// parseBlock reads directives until a closing brace, which is left in rest
+func parseBlock(tokens []configToken, file string) ([]*Directive, []configToken, error) {
+    var out []*Directive
+    for len(tokens) > 0 {
+        if tokens[0].is("}") {
+            return out, tokens, nil
+        }
+        d := &Directive{Name: tokens[0].text, File: file}
+        tokens = tokens[1:]
+        for {
+            if len(tokens) == 0 {
+                return nil, nil, fmt.Errorf("directive %q is not terminated", d.Name)
+            }
+            t := tokens[0]
+            tokens = tokens[1:]
+            if t.is(";") {
+                break
+            }
+            if t.is("{") {
+                block, rest, err := parseBlock(tokens, file)
+                if err != nil {
+                    return nil, nil, err
+                }
+                if len(rest) == 0 {
+                    return nil, nil, fmt.Errorf("block %q is not closed", d.Name)
+                }
+                d.Block = block
+                if d.Block == nil {
+                    d.Block = []*Directive{}
+                }
+                tokens = rest[1:]
+                break
+            }
+            d.Args = append(d.Args, t.text)
+        }
+        out = append(out, d)
+    }
+    return out, nil, nil
+}
+
+// Find returns every directive called name in directives and their blocks, depth first
+func Find(directives []*Directive, name string) []*Directive {
+    var out []*Directive
+    for _, d := range directives {
+        if d.Name == name {
+            out = append(out, d)
+        }
+        out = append(out, Find(d.Block, name)...)
+    }
+    return out
+}
@@ -0,0 +1,160 @@
+package nginx
+
+import (
+    "sync"
+)
+
+// Observer consumes parsed records, usually to aggregate them
+type Observer interface {
+    Observe(r *Record)
+}
+
+// Pipeline parses log lines, enriches the records and hands them to observers
+type Pipeline struct {
+    mu        sync.Mutex
+    parse     LineParser
+    enrichers []func(r *Record)
+    observers []Observer
+    
+    parsed  int64
+    skipped int64
+}
+
+func NewPipeline() *Pipeline {
+    return &Pipeline{parse: ParseAny}
+}
+
+// SetParser replaces the line parser, e.g. with a JSON field mapping
+func (p *Pipeline) SetParser(parse LineParser) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    p.parse = parse
+}
+
+// AddEnricher registers a function that labels records before observers see them
+func (p *Pipeline) AddEnricher(fn func(r *Record)) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    p.enrichers = append(p.enrichers, fn)
+}
+
+// AddObserver registers an aggregation stage
+func (p *Pipeline) AddObserver(o Observer) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    p.observers = append(p.observers, o)
+}
+
+// FeedLine parses and processes one log line
+func (p *Pipeline) FeedLine(line string) {
+    p.mu.Lock()
+    parse := p.parse
+    p.mu.Unlock()
+    
+    r, ok := parse(line)
+    if !ok {
+        p.mu.Lock()
+        p.skipped++
+        p.mu.Unlock()
+        return
+    }
+    p.Feed(r)
+}
+
+// Feed enriches a parsed record and passes it to every observer
+func (p *Pipeline) Feed(r *Record) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    
+    p.parsed++
+    for _, enrich := range p.enrichers {
+        enrich(r)
+    }
+    for _, o := range p.observers {
+        o.Observe(r)
+    }
+}
+
+// Consume feeds every new line from the tailer into the pipeline
+func (p *Pipeline) Consume(t *Tailer) error {
+    return t.ReadNew(p.FeedLine)
+}
+
+// Counts returns how many lines were parsed and skipped so far
+func (p *Pipeline) Counts() (parsed, skipped int64) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return p.parsed, p.skipped
+}
+
+// TrafficCounters aggregates requests for one group
+type TrafficCounters struct {
+    Requests int64 `json:"requests"`
+    Hits     int64 `json:"hits"`
+    Misses   int64 `json:"misses"`
+    Bytes    int64 `json:"bytes"`
+    HitBytes int64 `json:"hit_bytes"`
+}
+
+// HitRatio is the share of requests served from cache
+func (c *TrafficCounters) HitRatio() float64 {
+    if c.Requests == 0 {
+        return 0
+    }
+    return float64(c.Hits) / float64(c.Requests)
+}
+
+// add counts a record; STALE, UPDATING and REVALIDATED are served from cache
+func (c *TrafficCounters) add(r *Record) {
+    c.Requests++
+    c.Bytes += r.BodyBytes
+    switch r.CacheStatus {
+    case "HIT", "STALE", "UPDATING", "REVALIDATED":
+        c.Hits++
+        c.HitBytes += r.BodyBytes
+    case "MISS", "BYPASS", "EXPIRED":
+        c.Misses++
+    }
+}
+
+// GroupStats aggregates traffic per key, e.g. per CDN profile or host
+type GroupStats struct {
+    mu     sync.Mutex
+    key    func(r *Record) string
+    groups map[string]*TrafficCounters
+}
+
+// NewGroupStats groups records by key; records with an empty key are ignored
+func NewGroupStats(key func(r *Record) string) *GroupStats {
+    return &GroupStats{key: key, groups: make(map[string]*TrafficCounters)}
+}
+
+func (g *GroupStats) Observe(r *Record) {
+    k := g.key(r)
+    if k == "" {
+        return
+    }
+    
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    
+    c, ok := g.groups[k]
+    if !ok {
+        c = &TrafficCounters{}
+        g.groups[k] = c
+    }
+    c.add(r)
+}
+
+// Flush returns the counters collected since the last flush and resets them
+func (g *GroupStats) Flush() map[string]TrafficCounters {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    
+    out := make(map[string]TrafficCounters, len(g.groups))
+    for k, c := range g.groups {
+        out[k] = *c
+    }
+    g.groups = make(map[string]*TrafficCounters)
+    return out
+}
@@ -0,0 +1,50 @@
+package nginx
+
+import (
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "time"
+)
+
+type PrefetchResult struct {
+    URL         string `json:"url"`
+    Status      int    `json:"status"`
+    Bytes       int64  `json:"bytes"`
+    CacheStatus string `json:"cache_status"`
+}
+
+var prefetchClient = &http.Client{Timeout: 30 * time.Minute}
+
+// Prefetch requests a URL through the local cache so it is stored before subscribers ask for it
+func Prefetch(cacheAddr, rawURL string) (*PrefetchResult, error) {
+    u, err := url.Parse(rawURL)
+    if err != nil || u.Host == "" {
+        return nil, fmt.Errorf("invalid URL %q", rawURL)
+    }
+    
+    req, err := http.NewRequest("GET", fmt.Sprintf("http://%s%s", cacheAddr, u.RequestURI()), nil)
+    if err != nil {
+        return nil, err
+    }
+    req.Host = u.Host
+    
+    resp, err := prefetchClient.Do(req)
+    if err != nil {
+        return nil, fmt.Errorf("prefetch failed: %w", err)
+    }
+    defer resp.Body.Close()
+    
+    n, err := io.Copy(io.Discard, resp.Body)
+    if err != nil {
+        return nil, fmt.Errorf("prefetch interrupted: %w", err)
+    }
+    
+    return &PrefetchResult{
+        URL:         rawURL,
+        Status:      resp.StatusCode,
+        Bytes:       n,
+        CacheStatus: resp.Header.Get("X-Cache-Status"),
+    }, nil
+}
@@ -0,0 +1,83 @@
+package nginx
+
+import (
+    "bufio"
+    "crypto/md5"
+    "encoding/hex"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+)
+
+// CacheFilePath returns where nginx stores a cache key for the given levels (e.g. "1:2")
+func CacheFilePath(cachePath, levels, key string) string {
+    sum := md5.Sum([]byte(key))
+    name := hex.EncodeToString(sum[:])
+    
+    path := cachePath
+    end := len(name)
+    for _, level := range strings.Split(levels, ":") {
+        n, err := strconv.Atoi(level)
+        if err != nil || n <= 0 || n > end {
+            continue
+        }
+        path = filepath.Join(path, name[end-n:end])
+        end -= n
+    }
+    
+    return filepath.Join(path, name)
+}
+
+// PurgeKey removes the cached object for an exact cache key
+func PurgeKey(cachePath, levels, key string) (bool, error) {
+    err := os.Remove(CacheFilePath(cachePath, levels, key))
+    if os.IsNotExist(err) {
+        return false, nil
+    }
+    return err == nil, err
+}
+
+// PurgeMatching removes every cached object whose key satisfies match
+// and returns the number of files removed
+func PurgeMatching(cachePath string, match func(key string) bool) (int, error) {
+    removed := 0
+    
+    err := filepath.Walk(cachePath, func(path string, info os.FileInfo, err error) error {
+        if err != nil || info.IsDir() {
+            return nil
+        }
+        key, ok := readCacheKey(path)
+        if !ok || !match(key) {
+            return nil
+        }
+        if os.Remove(path) == nil {
+            removed++
+        }
+        return nil
+    })
+    
+    return removed, err
+}
+
+// readCacheKey extracts the "KEY: " line from an nginx cache file header
+func readCacheKey(path string) (string, bool) {
+    file, err := os.Open(path)
+    if err != nil {
+        return "", false
+    }
+    defer file.Close()
+    
+    reader := bufio.NewReaderSize(file, 4096)
+    for i := 0; i < 8; i++ {
+        line, err := reader.ReadString('\n')
+        if idx := strings.Index(line, "KEY: "); idx >= 0 {
+            return strings.TrimSpace(line[idx+5:]), true
+        }
+        if err != nil {
+            break
+        }
+    }
+    
+    return "", false
+}
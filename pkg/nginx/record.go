@@ -0,0 +1,189 @@
+package nginx
+
+import (
+    "net/netip"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Record is one parsed access log line
+type Record struct {
+    RemoteAddr  string
+    Time        time.Time
+    Method      string
+    URI         string
+    Protocol    string
+    Status      int
+    BodyBytes   int64
+    Referer     string
+    UserAgent   string
+    Host        string
+    CacheStatus string
+    // ContentType is the response media type without parameters, e.g. "video/mp4"
+    ContentType string
+    
+    // Timings in seconds, -1 when not logged or "-"
+    RequestTime         float64
+    UpstreamConnectTime float64
+    // UpstreamHeaderTime is the origin's time to first byte
+    UpstreamHeaderTime float64
+    // UpstreamAddr is the first origin address contacted ($upstream_addr), "" when none
+    UpstreamAddr string
+    
+    // Profile is the CDN profile the host belongs to, set by enrichers
+    Profile string
+    // Server and CacheZone are the server block and proxy_cache zone that
+    // handled the request, set when the nginx config was discovered
+    Server    string
+    CacheZone string
+    // ClientRegion and OriginASN are set by the GeoIP enricher when databases are loaded
+    ClientRegion string
+    OriginASN    uint64
+    OriginOrg    string
+}
+
+// combinedPrefix matches the combined log format every cache log format starts with
+var combinedPrefix = regexp.MustCompile(`^(\S+) \S+ (\S+) \[([^\]]+)\] "([^"]*)" (\d{3}) (\d+|-) "([^"]*)" "([^"]*)"(.*)$`)
+
+// ParseLine parses a combined-format line with optional key=value suffix fields
+// (cache=, cache_status=, rt=, uct=, uht=, upa=, host=, ct=, bytes=, X-Cache-Status:)
+func ParseLine(line string) (*Record, bool) {
+    m := combinedPrefix.FindStringSubmatch(line)
+    if m == nil {
+        return nil, false
+    }
+    
+    r := &Record{
+        RemoteAddr:          m[1],
+        Referer:             m[7],
+        UserAgent:           m[8],
+        RequestTime:         -1,
+        UpstreamConnectTime: -1,
+        UpstreamHeaderTime:  -1,
+    }
+    r.Time, _ = time.Parse("02/Jan/2006:15:04:05 -0700", m[3])
+    
+    request := strings.SplitN(m[4], " ", 3)
+    if len(request) >= 2 {
+        r.Method, r.URI = request[0], request[1]
+        if len(request) == 3 {
+            r.Protocol = request[2]
+        }
+    }
+    
+    r.Status, _ = strconv.Atoi(m[5])
+    r.BodyBytes, _ = strconv.ParseInt(m[6], 10, 64)
+    
+    parseSuffix(r, m[9])
+    
+    // Absolute-form requests carry the host in the URI
+    if r.Host == "" && strings.HasPrefix(r.URI, "http") {
+        r.Host = extractDomain(r.URI)
+    }
+    
+    return r, true
+}
+
+func parseSuffix(r *Record, suffix string) {
+    fields := strings.Fields(suffix)
+    for i := 0; i < len(fields); i++ {
+        field := fields[i]
+        
+        // Quoted values may contain spaces: ct="text/html; charset=utf-8"
+        if _, value, ok := strings.Cut(field, `="`); ok && !strings.HasSuffix(value, `"`) {
+            for i+1 < len(fields) && !strings.HasSuffix(field, `"`) {
+                i++
+                field += " " + fields[i]
+            }
+        }
+        
+        // "X-Cache-Status: HIT" style takes the next field as value
+        if strings.HasSuffix(field, ":") && i+1 < len(fields) {
+            setField(r, strings.TrimSuffix(field, ":"), fields[i+1])
+            i++
+            continue
+        }
+        if key, value, ok := strings.Cut(field, "="); ok {
+            setField(r, key, value)
+        }
+    }
+}
+
+func setField(r *Record, key, value string) {
+    value = strings.Trim(value, `"`)
+    switch strings.ToLower(key) {
+    case "cache", "cache_status", "x-cache-status", "x-cache", "upstream_cache_status":
+        r.CacheStatus = strings.ToUpper(value)
+    case "rt", "request_time":
+        r.RequestTime = parseSeconds(value)
+    case "uct", "upstream_connect_time":
+        r.UpstreamConnectTime = parseSeconds(value)
+    case "uht", "upstream_header_time":
+        r.UpstreamHeaderTime = parseSeconds(value)
+    case "host":
+        r.Host = strings.ToLower(value)
+    case "upa", "upstream_addr":
+        r.UpstreamAddr = firstUpstream(value)
+    case "ct", "content_type":
+        r.ContentType = mediaType(value)
+    case "bytes":
+        if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+            r.BodyBytes = n
+        }
+    }
+}
+
+// parseSeconds reads an nginx timing, which may list several upstreams ("0.001, 0.002")
+func parseSeconds(value string) float64 {
+    value = strings.TrimSuffix(value, ",")
+    if value == "" || value == "-" {
+        return -1
+    }
+    if idx := strings.IndexAny(value, ", :"); idx >= 0 {
+        value = value[:idx]
+    }
+    f, err := strconv.ParseFloat(value, 64)
+    if err != nil {
+        return -1
+    }
+    return f
+}
+
+// mediaType strips parameters from a Content-Type value
+func mediaType(value string) string {
+    if value == "-" {
+        return ""
+    }
+    if idx := strings.IndexByte(value, ';'); idx >= 0 {
+        value = value[:idx]
+    }
+    return strings.ToLower(strings.TrimSpace(value))
+}
+
+// firstUpstream returns the first address of an $upstream_addr value,
+// which lists every upstream tried ("10.0.0.1:80, 10.0.0.2:80")
+func firstUpstream(value string) string {
+    if idx := strings.IndexAny(value, ", "); idx >= 0 {
+        value = value[:idx]
+    }
+    if value == "-" {
+        return ""
+    }
+    return value
+}
+
+// UpstreamIP returns the IP of UpstreamAddr, or false for unix sockets and empty values
+func (r *Record) UpstreamIP() (netip.Addr, bool) {
+    if r.UpstreamAddr == "" {
+        return netip.Addr{}, false
+    }
+    if ap, err := netip.ParseAddrPort(r.UpstreamAddr); err == nil {
+        return ap.Addr().Unmap(), true
+    }
+    if addr, err := netip.ParseAddr(r.UpstreamAddr); err == nil {
+        return addr.Unmap(), true
+    }
+    return netip.Addr{}, false
+}
@@ -7,16 +7,22 @@ import (
     "os/exec"
     "path/filepath"
     "regexp"
+    "sort"
     "strconv"
     "strings"
 )
 
 type CacheStats struct {
+    // Hits are responses served from cache, Misses those fetched from the origin
+    // (see CacheStatusCounters); TotalRequests is their sum. CacheSizeUsed is in bytes.
     Hits           int64
     Misses         int64
     BytesServed    int64
     CacheSizeUsed  int64
     TotalRequests  int64
+    
+    // Statuses keeps every $upstream_cache_status value separately
+    Statuses CacheStatusCounters
 }
 
 type SystemStats struct {
@@ -24,177 +30,161 @@ type SystemStats struct {
     MemoryUsage float64
 }
 
-// GetCacheStats collects Nginx cache statistics from multiple sources
-func GetCacheStats(accessLogPath string) (*CacheStats, error) {
-    stats := &CacheStats{}
-    
-    // Try multiple methods to collect cache stats
-    // Method 1: Parse custom log format with upstream_cache_status
+// GetCacheStats collects Nginx cache statistics from multiple sources.
+// extraLogs are additional per-service logs, e.g. lancache-style logs of the enabled CDN profiles.
+func GetCacheStats(accessLogPath string, extraLogs []string) (*CacheStats, error) {
+    return CollectCacheStats(ParseAny, DefaultLogs(accessLogPath, extraLogs), DefaultCacheDirs)
+}
+
+// DefaultLogs returns the main log, the legacy cache logs and extraLogs
+func DefaultLogs(accessLogPath string, extraLogs []string) []string {
     if accessLogPath == "" {
         accessLogPath = "/var/log/nginx/access.log"
     }
-    
-    collectFromLogWithCacheStatus(stats, accessLogPath)
-    
-    // Method 2: Also check lancache-specific logs
-    lancacheLogs := []string{
-        "/var/log/nginx/lancache-steam.log",
-        "/var/log/nginx/lancache-epic.log",
-        "/var/log/nginx/lancache-blizzard.log",
-        "/var/log/nginx/lancache-riot.log",
-        "/var/log/nginx/lancache-origin.log",
+    return append([]string{
+        accessLogPath,
         "/var/log/nginx/cache.log",
         "/var/log/nginx/isp-cache.log",
-    }
+    }, extraLogs...)
+}
+
+// DefaultCacheDirs are measured when the cache zones are not known from the nginx config
+var DefaultCacheDirs = []string{
+    "/var/cache/nginx",
+    "/var/cache/nginx/isp-cache",
+    "/var/cache/nginx/lancache",
+    "/data/cache",
+    "/cache",
+}
+
+// CollectCacheStats counts the cache status of the last lines of each log,
+// read with parse, and sums the size of cacheDirs. Each log and directory is
+// counted once, including directories nested in another.
+func CollectCacheStats(parse LineParser, logs, cacheDirs []string) (*CacheStats, error) {
+    stats := &CacheStats{}
     
-    for _, logFile := range lancacheLogs {
-        if _, err := os.Stat(logFile); err == nil {
-            collectFromLogWithCacheStatus(stats, logFile)
+    seen := make(map[string]bool)
+    for _, logFile := range logs {
+        if seen[logFile] {
+            continue
         }
+        seen[logFile] = true
+        collectCacheStatus(&stats.Statuses, parse, logFile)
     }
+    stats.SetStatuses(stats.Statuses)
     
-    // Method 3: Parse any log that might have cache status indicators
-    // Look for patterns: HIT, MISS, BYPASS, EXPIRED, STALE, UPDATING, REVALIDATED
-    collectFromAnyLogFormat(stats, accessLogPath)
-    
-    stats.TotalRequests = stats.Hits + stats.Misses
-    
-    // Get cache directory size from multiple possible locations
-    cachePaths := []string{
-        "/var/cache/nginx",
-        "/var/cache/nginx/isp-cache",
-        "/var/cache/nginx/lancache",
-        "/data/cache",
-        "/cache",
-    }
-    
-    for _, cachePath := range cachePaths {
-        if _, err := os.Stat(cachePath); err == nil {
-            size := getCacheDirSize(cachePath)
-            if size > stats.CacheSizeUsed {
-                stats.CacheSizeUsed = size
-            }
-        }
+    for _, dir := range OutermostDirs(cacheDirs) {
+        stats.CacheSizeUsed += DirSize(dir)
     }
     
     return stats, nil
 }
 
-// collectFromLogWithCacheStatus parses logs with $upstream_cache_status format
-func collectFromLogWithCacheStatus(stats *CacheStats, logPath string) {
-    // Parse nginx logs looking for cache status
-    // Nginx upstream_cache_status values: HIT, MISS, BYPASS, EXPIRED, STALE, UPDATING, REVALIDATED
-    
-    // First try: Look for cache status at end of log line (common format)
-    cmd := exec.Command("sh", "-c", fmt.Sprintf(
-        `tail -n 50000 "%s" 2>/dev/null | grep -oE '(HIT|MISS|BYPASS|EXPIRED|STALE|UPDATING|REVALIDATED)' | sort | uniq -c`,
-        logPath,
-    ))
-    
-    output, err := cmd.Output()
-    if err != nil || len(output) == 0 {
-        return
-    }
-    
-    lines := strings.Split(string(output), "\n")
-    for _, line := range lines {
-        parts := strings.Fields(strings.TrimSpace(line))
-        if len(parts) < 2 {
-            continue
-        }
-        
-        count, _ := strconv.ParseInt(parts[0], 10, 64)
-        status := strings.ToUpper(parts[1])
-        
-        switch status {
-        case "HIT", "STALE", "UPDATING", "REVALIDATED":
-            stats.Hits += count
-        case "MISS", "BYPASS", "EXPIRED":
-            stats.Misses += count
+// OutermostDirs returns the existing directories of dirs that are not inside another one
+func OutermostDirs(dirs []string) []string {
+    var cleaned []string
+    for _, dir := range dirs {
+        if info, err := os.Stat(dir); err == nil && info.IsDir() {
+            cleaned = append(cleaned, filepath.Clean(dir))
         }
     }
+    sort.Strings(cleaned)
     
-    // Calculate bandwidth saved from cache hits (bytes served)
-    cmd = exec.Command("sh", "-c", fmt.Sprintf(
-        `tail -n 50000 "%s" 2>/dev/null | grep -E 'HIT|STALE' | awk '{for(i=1;i<=NF;i++){if($i ~ /^[0-9]+$/ && $i > 100){sum+=$i}}} END {print sum+0}'`,
-        logPath,
-    ))
-    
-    output, err = cmd.Output()
-    if err == nil {
-        bytesStr := strings.TrimSpace(string(output))
-        if bytesStr != "" && bytesStr != "0" {
-            bytes, _ := strconv.ParseInt(bytesStr, 10, 64)
-            stats.BytesServed += bytes
+    var out []string
+    for _, dir := range cleaned {
+        if n := len(out); n > 0 && (dir == out[n-1] || strings.HasPrefix(dir, out[n-1]+"/")) {
+            continue
         }
+        out = append(out, dir)
     }
+    return out
 }
 
-// collectFromAnyLogFormat tries to extract cache info from non-standard log formats
-func collectFromAnyLogFormat(stats *CacheStats, logPath string) {
-    // Look for X-Cache-Status header or similar patterns in logs
-    patterns := []string{
-        `X-Cache-Status:\s*(HIT|MISS)`,
-        `X-Cache:\s*(HIT|MISS)`,
-        `cache_status=(HIT|MISS)`,
-        `"cache":\s*"(HIT|MISS)"`,
-        `upstream_cache_status:\s*(HIT|MISS)`,
-    }
-    
+// SetStatuses replaces the status counters and the totals derived from them
+func (s *CacheStats) SetStatuses(c CacheStatusCounters) {
+    s.Statuses = c
+    served, fetched := c.Served(), c.Fetched()
+    s.Hits = served.Requests
+    s.Misses = fetched.Requests
+    s.BytesServed = served.Bytes
+    s.TotalRequests = s.Hits + s.Misses
+}
+
+// statusPattern finds the cache status in lines the parser does not understand
+var statusPattern = regexp.MustCompile(`(?i)(?:X-Cache-Status:|X-Cache:|cache_status=|cache=|"cache":|upstream_cache_status:)\s*"?(HIT|MISS|BYPASS|EXPIRED|STALE|UPDATING|REVALIDATED|-)(?:[\s",]|$)`)
+
+// collectCacheStatus counts the cache status of the last statsWindow lines of a log
+func collectCacheStatus(counts *CacheStatusCounters, parse LineParser, logPath string) {
     file, err := os.Open(logPath)
     if err != nil {
         return
     }
     defer file.Close()
     
-    // Compile all patterns
-    regexps := make([]*regexp.Regexp, len(patterns))
-    for i, p := range patterns {
-        regexps[i] = regexp.MustCompile(p)
+    if err := seekLastLines(file, statsWindow); err != nil {
+        return
     }
     
     scanner := bufio.NewScanner(file)
-    lineCount := 0
-    maxLines := 50000
-    
-    // Skip to last maxLines
+    scanner.Buffer(make([]byte, 64*1024), 1024*1024)
     for scanner.Scan() {
-        lineCount++
+        line := scanner.Text()
+        if r, ok := parse(line); ok {
+            if r.CacheStatus != "" {
+                counts.Add(r.CacheStatus, r.BodyBytes)
+            }
+            continue
+        }
+        if m := statusPattern.FindStringSubmatch(line); m != nil {
+            counts.Add(strings.ToUpper(m[1]), 0)
+        }
     }
-    
-    file.Seek(0, 0)
-    scanner = bufio.NewScanner(file)
-    
-    skipLines := lineCount - maxLines
-    if skipLines < 0 {
-        skipLines = 0
+}
+
+// statsWindow is how many recent log lines GetCacheStats looks at
+const statsWindow = 50000
+
+// seekLastLines positions f at the start of its last n lines
+func seekLastLines(f *os.File, n int) error {
+    info, err := f.Stat()
+    if err != nil {
+        return err
     }
     
-    currentLine := 0
-    for scanner.Scan() {
-        currentLine++
-        if currentLine <= skipLines {
-            continue
+    const block = 64 * 1024
+    buf := make([]byte, block)
+    offset := info.Size()
+    newlines := 0
+    for offset > 0 {
+        size := int64(block)
+        if offset < size {
+            size = offset
         }
-        
-        line := scanner.Text()
-        for _, re := range regexps {
-            matches := re.FindStringSubmatch(line)
-            if len(matches) >= 2 {
-                status := strings.ToUpper(matches[1])
-                if status == "HIT" {
-                    stats.Hits++
-                } else if status == "MISS" {
-                    stats.Misses++
-                }
-                break // Only count once per line
+        offset -= size
+        if _, err := f.ReadAt(buf[:size], offset); err != nil {
+            return err
+        }
+        for i := size - 1; i >= 0; i-- {
+            if buf[i] != '\n' {
+                continue
+            }
+            // The file's final newline ends the last line rather than starting one
+            if offset+i == info.Size()-1 {
+                continue
+            }
+            newlines++
+            if newlines == n {
+                _, err := f.Seek(offset+i+1, 0)
+                return err
             }
         }
     }
+    _, err = f.Seek(0, 0)
+    return err
 }
 
-// getCacheDirSize returns the size of cache directory in MB
-func getCacheDirSize(cachePath string) int64 {
+// DirSize returns the bytes used by the files under cachePath
+func DirSize(cachePath string) int64 {
     var totalSize int64
     
     // Method 1: Use du command (faster for large directories)
@@ -204,7 +194,7 @@ func getCacheDirSize(cachePath string) int64 {
         parts := strings.Fields(string(output))
         if len(parts) >= 1 {
             bytes, _ := strconv.ParseInt(parts[0], 10, 64)
-            return bytes / (1024 * 1024) // Convert to MB
+            return bytes
         }
     }
     
@@ -219,7 +209,7 @@ func getCacheDirSize(cachePath string) int64 {
         return nil
     })
     
-    return totalSize / (1024 * 1024) // Convert to MB
+    return totalSize
 }
 
 // GetSystemStats gets CPU and memory usage
@@ -252,7 +242,11 @@ func ReloadNginx() error {
 
 // TestConfig tests Nginx configuration validity
 func TestConfig() error {
-    return exec.Command("nginx", "-t").Run()
+    output, err := exec.Command("nginx", "-t").CombinedOutput()
+    if err != nil {
+        return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+    }
+    return nil
 }
 
 // GetTopDomains extracts top cached domains from logs
@@ -0,0 +1,402 @@
+package nginx
+
+import (
+    "bufio"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Status sources, from richest to most basic
+const (
+    SourcePlus = "plus"
+    SourceVTS  = "vts"
+    SourceStub = "stub_status"
+)
+
+// errNotAvailable means a status endpoint is not configured on this nginx
+var errNotAvailable = errors.New("status endpoint not available")
+
+// ConnectionStats are the stub_status counters
+type ConnectionStats struct {
+    Active   int64 `json:"active"`
+    Reading  int64 `json:"reading"`
+    Writing  int64 `json:"writing"`
+    Waiting  int64 `json:"waiting"`
+    Accepted int64 `json:"accepted"`
+    Handled  int64 `json:"handled"`
+    Requests int64 `json:"requests"`
+}
+
+// UpstreamStats describes one upstream peer
+type UpstreamStats struct {
+    Zone           string  `json:"zone"`
+    Server         string  `json:"server"`
+    Requests       int64   `json:"requests"`
+    Responses5xx   int64   `json:"responses_5xx"`
+    ResponseTimeMs float64 `json:"response_time_ms"`
+    Down           bool    `json:"down"`
+}
+
+// CacheZoneStats describes one proxy_cache zone
+type CacheZoneStats struct {
+    Zone      string `json:"zone"`
+    MaxSize   int64  `json:"max_size"`
+    UsedSize  int64  `json:"used_size"`
+    Hits      int64  `json:"hits"`
+    Misses    int64  `json:"misses"`
+    HitBytes  int64  `json:"hit_bytes"`
+    MissBytes int64  `json:"miss_bytes"`
+}
+
+// StatusSnapshot is one scrape of the nginx status endpoints
+type StatusSnapshot struct {
+    Source      string           `json:"source"`
+    Connections ConnectionStats  `json:"connections"`
+    Upstreams   []UpstreamStats  `json:"upstreams,omitempty"`
+    CacheZones  []CacheZoneStats `json:"cache_zones,omitempty"`
+    // RequestsPerSecond is computed from the previous snapshot
+    RequestsPerSecond float64   `json:"requests_per_second"`
+    CollectedAt       time.Time `json:"collected_at"`
+}
+
+// StatusCollector scrapes nginx Plus, VTS or stub_status, whichever is available
+type StatusCollector struct {
+    // Base is the address nginx serves the status locations on, e.g. http://127.0.0.1
+    Base string
+    // Host is sent as the Host header so the request matches a configured
+    // server_name rather than falling through to a proxying default server
+    Host string
+    // StubPath, VTSPath and PlusPath locate each endpoint; empty skips the source.
+    // VTS and Plus need modules most builds lack, so they are off by default.
+    StubPath string
+    VTSPath  string
+    PlusPath string
+
+    client *http.Client
+
+    mu   sync.Mutex
+    prev *StatusSnapshot
+}
+
+func NewStatusCollector(base string) *StatusCollector {
+    return &StatusCollector{
+        Base:     strings.TrimSuffix(base, "/"),
+        Host:     "localhost",
+        StubPath: "/nginx-status",
+        client: &http.Client{
+            Timeout:   5 * time.Second,
+            Transport: &http.Transport{DisableKeepAlives: true},
+        },
+    }
+}
+
+// Collect scrapes the richest available source
+func (c *StatusCollector) Collect(ctx context.Context) (*StatusSnapshot, error) {
+    sources := []struct {
+        path    string
+        collect func(context.Context) (*StatusSnapshot, error)
+    }{
+        {c.PlusPath, c.collectPlus},
+        {c.VTSPath, c.collectVTS},
+        {c.StubPath, c.collectStub},
+    }
+
+    var errs []string
+    for _, source := range sources {
+        if source.path == "" {
+            continue
+        }
+        snap, err := source.collect(ctx)
+        if errors.Is(err, errNotAvailable) {
+            continue
+        }
+        if err != nil {
+            errs = append(errs, err.Error())
+            continue
+        }
+        snap.CollectedAt = time.Now()
+        c.rate(snap)
+        return snap, nil
+    }
+
+    if len(errs) == 0 {
+        return nil, errNotAvailable
+    }
+    return nil, fmt.Errorf("nginx status: %s", strings.Join(errs, "; "))
+}
+
+// rate fills RequestsPerSecond from the previous snapshot, skipping nginx restarts and source changes
+func (c *StatusCollector) rate(snap *StatusSnapshot) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if prev := c.prev; prev != nil && prev.Source == snap.Source && snap.Connections.Requests >= prev.Connections.Requests {
+        if elapsed := snap.CollectedAt.Sub(prev.CollectedAt).Seconds(); elapsed > 0 {
+            snap.RequestsPerSecond = float64(snap.Connections.Requests-prev.Connections.Requests) / elapsed
+        }
+    }
+    c.prev = snap
+}
+
+// get fetches a status path; 404 means the source is not configured
+func (c *StatusCollector) get(ctx context.Context, path string) ([]byte, error) {
+    req, err := http.NewRequestWithContext(ctx, "GET", c.Base+path, nil)
+    if err != nil {
+        return nil, err
+    }
+    req.Host = c.Host
+    resp, err := c.client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode == http.StatusNotFound {
+        return nil, errNotAvailable
+    }
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("%s returned %s", path, resp.Status)
+    }
+    return io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+}
+
+func (c *StatusCollector) collectStub(ctx context.Context) (*StatusSnapshot, error) {
+    body, err := c.get(ctx, c.StubPath)
+    if err != nil {
+        return nil, err
+    }
+    conns, err := ParseStubStatus(string(body))
+    if err != nil {
+        return nil, err
+    }
+    return &StatusSnapshot{Source: SourceStub, Connections: *conns}, nil
+}
+
+// ParseStubStatus parses the text served by the stub_status directive:
+//
+//    Active connections: 291
+//    server accepts handled requests
+//     16630948 16630948 31070465
+//    Reading: 6 Writing: 179 Waiting: 106
+func ParseStubStatus(text string) (*ConnectionStats, error) {
+    stats := &ConnectionStats{}
+    var lines []string
+    scanner := bufio.NewScanner(strings.NewReader(text))
+    for scanner.Scan() {
+        if line := strings.TrimSpace(scanner.Text()); line != "" {
+            lines = append(lines, line)
+        }
+    }
+    if len(lines) < 4 || !strings.HasPrefix(lines[0], "Active connections:") {
+        return nil, fmt.Errorf("unexpected stub_status output")
+    }
+
+    var err error
+    if stats.Active, err = strconv.ParseInt(strings.TrimSpace(strings.TrimPrefix(lines[0], "Active connections:")), 10, 64); err != nil {
+        return nil, fmt.Errorf("invalid active connections: %w", err)
+    }
+    if _, err := fmt.Sscanf(lines[2], "%d %d %d", &stats.Accepted, &stats.Handled, &stats.Requests); err != nil {
+        return nil, fmt.Errorf("invalid request counters: %w", err)
+    }
+    if _, err := fmt.Sscanf(lines[3], "Reading: %d Writing: %d Waiting: %d", &stats.Reading, &stats.Writing, &stats.Waiting); err != nil {
+        return nil, fmt.Errorf("invalid connection states: %w", err)
+    }
+    return stats, nil
+}
+
+// vtsStatus is the subset of the nginx-module-vts JSON the agent reads
+type vtsStatus struct {
+    Connections struct {
+        Active   int64 `json:"active"`
+        Reading  int64 `json:"reading"`
+        Writing  int64 `json:"writing"`
+        Waiting  int64 `json:"waiting"`
+        Accepted int64 `json:"accepted"`
+        Handled  int64 `json:"handled"`
+        Requests int64 `json:"requests"`
+    } `json:"connections"`
+    UpstreamZones map[string][]struct {
+        Server         string `json:"server"`
+        RequestCounter int64  `json:"requestCounter"`
+        ResponseMsec   int64  `json:"responseMsec"`
+        Down           bool   `json:"down"`
+        Responses      struct {
+            Status5xx int64 `json:"5xx"`
+        } `json:"responses"`
+    } `json:"upstreamZones"`
+    CacheZones map[string]struct {
+        MaxSize   int64 `json:"maxSize"`
+        UsedSize  int64 `json:"usedSize"`
+        Responses struct {
+            Miss        int64 `json:"miss"`
+            Bypass      int64 `json:"bypass"`
+            Expired     int64 `json:"expired"`
+            Stale       int64 `json:"stale"`
+            Updating    int64 `json:"updating"`
+            Revalidated int64 `json:"revalidated"`
+            Hit         int64 `json:"hit"`
+        } `json:"responses"`
+    } `json:"cacheZones"`
+}
+
+func (c *StatusCollector) collectVTS(ctx context.Context) (*StatusSnapshot, error) {
+    body, err := c.get(ctx, c.VTSPath)
+    if err != nil {
+        return nil, err
+    }
+    var vts vtsStatus
+    if err := json.Unmarshal(body, &vts); err != nil {
+        return nil, fmt.Errorf("invalid VTS status: %w", err)
+    }
+
+    snap := &StatusSnapshot{Source: SourceVTS, Connections: ConnectionStats(vts.Connections)}
+    for zone, peers := range vts.UpstreamZones {
+        for _, p := range peers {
+            snap.Upstreams = append(snap.Upstreams, UpstreamStats{
+                Zone:           zone,
+                Server:         p.Server,
+                Requests:       p.RequestCounter,
+                Responses5xx:   p.Responses.Status5xx,
+                ResponseTimeMs: float64(p.ResponseMsec),
+                Down:           p.Down,
+            })
+        }
+    }
+    // VTS does not split bytes by cache status, only responses
+    for zone, z := range vts.CacheZones {
+        r := z.Responses
+        snap.CacheZones = append(snap.CacheZones, CacheZoneStats{
+            Zone:     zone,
+            MaxSize:  z.MaxSize,
+            UsedSize: z.UsedSize,
+            Hits:     r.Hit + r.Stale + r.Updating + r.Revalidated,
+            Misses:   r.Miss + r.Bypass + r.Expired,
+        })
+    }
+    sortSnapshot(snap)
+    return snap, nil
+}
+
+type plusCacheCounter struct {
+    Responses int64 `json:"responses"`
+    Bytes     int64 `json:"bytes"`
+}
+
+func (c *StatusCollector) collectPlus(ctx context.Context) (*StatusSnapshot, error) {
+    body, err := c.get(ctx, c.PlusPath+"/")
+    if err != nil {
+        return nil, err
+    }
+    // The API root lists the supported versions, e.g. [1,2,...,9]
+    var versions []int
+    if err := json.Unmarshal(body, &versions); err != nil || len(versions) == 0 {
+        return nil, errNotAvailable
+    }
+    sort.Ints(versions)
+    base := fmt.Sprintf("%s/%d", c.PlusPath, versions[len(versions)-1])
+
+    var conns struct {
+        Accepted int64 `json:"accepted"`
+        Dropped  int64 `json:"dropped"`
+        Active   int64 `json:"active"`
+        Idle     int64 `json:"idle"`
+    }
+    var requests struct {
+        Total int64 `json:"total"`
+    }
+    var upstreams map[string]struct {
+        Peers []struct {
+            Server       string `json:"server"`
+            State        string `json:"state"`
+            Requests     int64  `json:"requests"`
+            ResponseTime int64  `json:"response_time"`
+            Responses    struct {
+                Status5xx int64 `json:"5xx"`
+            } `json:"responses"`
+        } `json:"peers"`
+    }
+    var caches map[string]struct {
+        Size        int64            `json:"size"`
+        MaxSize     int64            `json:"max_size"`
+        Hit         plusCacheCounter `json:"hit"`
+        Stale       plusCacheCounter `json:"stale"`
+        Updating    plusCacheCounter `json:"updating"`
+        Revalidated plusCacheCounter `json:"revalidated"`
+        Miss        plusCacheCounter `json:"miss"`
+        Expired     plusCacheCounter `json:"expired"`
+        Bypass      plusCacheCounter `json:"bypass"`
+    }
+
+    for path, v := range map[string]interface{}{
+        "/connections":    &conns,
+        "/http/requests":  &requests,
+        "/http/upstreams": &upstreams,
+        "/http/caches":    &caches,
+    } {
+        body, err := c.get(ctx, base+path)
+        if err != nil {
+            return nil, err
+        }
+        if err := json.Unmarshal(body, v); err != nil {
+            return nil, fmt.Errorf("invalid Plus API response for %s: %w", path, err)
+        }
+    }
+
+    snap := &StatusSnapshot{
+        Source: SourcePlus,
+        Connections: ConnectionStats{
+            Active:   conns.Active,
+            Waiting:  conns.Idle,
+            Accepted: conns.Accepted,
+            Handled:  conns.Accepted - conns.Dropped,
+            Requests: requests.Total,
+        },
+    }
+    for zone, u := range upstreams {
+        for _, p := range u.Peers {
+            snap.Upstreams = append(snap.Upstreams, UpstreamStats{
+                Zone:           zone,
+                Server:         p.Server,
+                Requests:       p.Requests,
+                Responses5xx:   p.Responses.Status5xx,
+                ResponseTimeMs: float64(p.ResponseTime),
+                Down:           p.State == "down" || p.State == "unhealthy" || p.State == "unavail",
+            })
+        }
+    }
+    for zone, z := range caches {
+        snap.CacheZones = append(snap.CacheZones, CacheZoneStats{
+            Zone:      zone,
+            MaxSize:   z.MaxSize,
+            UsedSize:  z.Size,
+            Hits:      z.Hit.Responses + z.Stale.Responses + z.Updating.Responses + z.Revalidated.Responses,
+            Misses:    z.Miss.Responses + z.Expired.Responses + z.Bypass.Responses,
+            HitBytes:  z.Hit.Bytes + z.Stale.Bytes + z.Updating.Bytes + z.Revalidated.Bytes,
+            MissBytes: z.Miss.Bytes + z.Expired.Bytes + z.Bypass.Bytes,
+        })
+    }
+    sortSnapshot(snap)
+    return snap, nil
+}
+
+// sortSnapshot orders zones so reports are stable between scrapes
+func sortSnapshot(snap *StatusSnapshot) {
+    sort.Slice(snap.Upstreams, func(i, j int) bool {
+        if snap.Upstreams[i].Zone != snap.Upstreams[j].Zone {
+            return snap.Upstreams[i].Zone < snap.Upstreams[j].Zone
+        }
+        return snap.Upstreams[i].Server < snap.Upstreams[j].Server
+    })
+    sort.Slice(snap.CacheZones, func(i, j int) bool {
+        return snap.CacheZones[i].Zone < snap.CacheZones[j].Zone
+    })
+}
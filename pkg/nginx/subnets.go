@@ -0,0 +1,169 @@
+package nginx
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "net/netip"
+    "sort"
+    "sync"
+)
+
+// SubnetGroup names a set of client ranges, e.g. a POP, BNG pool or customer segment
+type SubnetGroup struct {
+    Name     string
+    Prefixes []netip.Prefix
+}
+
+// ParseSubnetGroup builds a group from CIDR strings
+func ParseSubnetGroup(name string, cidrs []string) (SubnetGroup, error) {
+    group := SubnetGroup{Name: name}
+    for _, cidr := range cidrs {
+        prefix, err := netip.ParsePrefix(cidr)
+        if err != nil {
+            return group, fmt.Errorf("subnet group %s: %w", name, err)
+        }
+        group.Prefixes = append(group.Prefixes, prefix.Masked())
+    }
+    return group, nil
+}
+
+// Anonymizer turns a client address into the label that is reported
+type Anonymizer func(addr netip.Addr) string
+
+// TruncateAddr reports the client's network instead of its address, e.g. 203.0.113.0/24
+func TruncateAddr(ipv4Bits, ipv6Bits int) Anonymizer {
+    return func(addr netip.Addr) string {
+        bits := ipv6Bits
+        if addr.Is4() {
+            bits = ipv4Bits
+        }
+        prefix, err := addr.Prefix(bits)
+        if err != nil {
+            return "invalid"
+        }
+        return prefix.String()
+    }
+}
+
+// HashAddr reports a keyed hash of the address. Without the key the hash
+// cannot be reversed by trying every address, yet the same client keeps the
+// same label across intervals.
+func HashAddr(key []byte) Anonymizer {
+    return func(addr netip.Addr) string {
+        mac := hmac.New(sha256.New, key)
+        mac.Write(addr.AsSlice())
+        return hex.EncodeToString(mac.Sum(nil)[:8])
+    }
+}
+
+// PlainAddr reports addresses unchanged
+func PlainAddr(addr netip.Addr) string {
+    return addr.String()
+}
+
+// UnassignedGroup collects clients outside every configured subnet
+const UnassignedGroup = "unassigned"
+
+// maxClients bounds per-interval client tracking; later new clients are only counted in their group
+const maxClients = 100000
+
+// ClientCounters is one client's traffic, labelled by the anonymizer
+type ClientCounters struct {
+    Client string
+    TrafficCounters
+}
+
+// SubnetStats aggregates traffic per subnet group and, optionally, per client
+type SubnetStats struct {
+    mu        sync.Mutex
+    groups    []SubnetGroup
+    topN      int
+    anonymize Anonymizer
+    perGroup  map[string]*TrafficCounters
+    perClient map[string]*TrafficCounters
+}
+
+// NewSubnetStats matches clients to the most specific configured prefix.
+// topN > 0 also tracks the busiest clients, labelled by anonymize.
+func NewSubnetStats(groups []SubnetGroup, topN int, anonymize Anonymizer) *SubnetStats {
+    return &SubnetStats{
+        groups:    groups,
+        topN:      topN,
+        anonymize: anonymize,
+        perGroup:  make(map[string]*TrafficCounters),
+        perClient: make(map[string]*TrafficCounters),
+    }
+}
+
+// Group returns the name of the group addr belongs to
+func (s *SubnetStats) Group(addr netip.Addr) string {
+    best, bestBits := UnassignedGroup, -1
+    for _, g := range s.groups {
+        for _, p := range g.Prefixes {
+            if p.Bits() > bestBits && p.Contains(addr) {
+                best, bestBits = g.Name, p.Bits()
+            }
+        }
+    }
+    return best
+}
+
+func (s *SubnetStats) Observe(r *Record) {
+    addr, err := netip.ParseAddr(r.RemoteAddr)
+    if err != nil {
+        return
+    }
+    addr = addr.Unmap()
+    group := s.Group(addr)
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    counter(s.perGroup, group).add(r)
+
+    if s.topN > 0 {
+        client := s.anonymize(addr)
+        if _, ok := s.perClient[client]; ok || len(s.perClient) < maxClients {
+            counter(s.perClient, client).add(r)
+        }
+    }
+}
+
+// Flush returns the per-group counters and the top clients by bytes since the last flush
+func (s *SubnetStats) Flush() (groups map[string]TrafficCounters, top []ClientCounters) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    groups = make(map[string]TrafficCounters, len(s.perGroup))
+    for name, c := range s.perGroup {
+        groups[name] = *c
+    }
+
+    for client, c := range s.perClient {
+        top = append(top, ClientCounters{Client: client, TrafficCounters: *c})
+    }
+    sort.Slice(top, func(i, j int) bool {
+        if top[i].Bytes != top[j].Bytes {
+            return top[i].Bytes > top[j].Bytes
+        }
+        return top[i].Client < top[j].Client
+    })
+    if len(top) > s.topN {
+        top = top[:s.topN]
+    }
+
+    s.perGroup = make(map[string]*TrafficCounters)
+    s.perClient = make(map[string]*TrafficCounters)
+    return groups, top
+}
+
+func counter(m map[string]*TrafficCounters, key string) *TrafficCounters {
+    c, ok := m[key]
+    if !ok {
+        c = &TrafficCounters{}
+        m[key] = c
+    }
+    return c
+}
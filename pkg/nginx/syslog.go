@@ -0,0 +1,319 @@
+package nginx
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "net"
+    "os"
+    "os/user"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// SyslogMessage is one datagram from nginx's access_log syslog: target
+type SyslogMessage struct {
+    Priority int
+    Hostname string
+    Tag      string
+    Message  string
+}
+
+// ParseSyslogMessage accepts RFC 5424 and RFC 3164 messages. nginx itself
+// sends the RFC 3164 form, with the hostname left out under nohostname.
+func ParseSyslogMessage(data []byte) (SyslogMessage, bool) {
+    var m SyslogMessage
+    if len(data) < 3 || data[0] != '<' {
+        return m, false
+    }
+    end := bytes.IndexByte(data[:min(len(data), 5)], '>')
+    if end < 2 {
+        return m, false
+    }
+    pri, err := strconv.Atoi(string(data[1:end]))
+    if err != nil || pri > 191 {
+        return m, false
+    }
+    m.Priority = pri
+    rest := strings.TrimRight(string(data[end+1:]), "\r\n\x00")
+    
+    if strings.HasPrefix(rest, "1 ") {
+        return parseRFC5424(m, rest[2:])
+    }
+    return parseRFC3164(m, rest)
+}
+
+// parseRFC5424 handles "TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD [MSG]"
+func parseRFC5424(m SyslogMessage, rest string) (SyslogMessage, bool) {
+    var fields [5]string
+    for i := range fields {
+        sp := strings.IndexByte(rest, ' ')
+        if sp < 0 {
+            return m, false
+        }
+        fields[i], rest = rest[:sp], rest[sp+1:]
+    }
+    m.Hostname = nilValue(fields[1])
+    m.Tag = nilValue(fields[2])
+    
+    // Structured data is "-" or a sequence of [id param="value" ...] elements
+    if strings.HasPrefix(rest, "-") {
+        rest = rest[1:]
+    } else {
+        for strings.HasPrefix(rest, "[") {
+            i := sdElementEnd(rest)
+            if i < 0 {
+                return m, false
+            }
+            rest = rest[i+1:]
+        }
+    }
+    rest = strings.TrimPrefix(rest, " ")
+    m.Message = strings.TrimPrefix(rest, "\ufeff")
+    return m, true
+}
+
+// sdElementEnd returns the index of the "]" closing the element at the start of s
+func sdElementEnd(s string) int {
+    quoted := false
+    for i := 1; i < len(s); i++ {
+        switch s[i] {
+        case '\\':
+            i++
+        case '"':
+            quoted = !quoted
+        case ']':
+            if !quoted {
+                return i
+            }
+        }
+    }
+    return -1
+}
+
+func nilValue(s string) string {
+    if s == "-" {
+        return ""
+    }
+    return s
+}
+
+// parseRFC3164 handles "Mmm dd hh:mm:ss [HOSTNAME] TAG: MSG"
+func parseRFC3164(m SyslogMessage, rest string) (SyslogMessage, bool) {
+    if len(rest) < 16 || rest[3] != ' ' || rest[15] != ' ' {
+        return m, false
+    }
+    rest = rest[16:]
+    
+    for i := 0; i < 2; i++ {
+        sp := strings.IndexByte(rest, ' ')
+        if sp < 0 {
+            break
+        }
+        token := rest[:sp]
+        if strings.HasSuffix(token, ":") {
+            m.Tag = token[:len(token)-1]
+            if j := strings.IndexByte(m.Tag, '['); j > 0 {
+                m.Tag = m.Tag[:j]
+            }
+            rest = rest[sp+1:]
+            break
+        }
+        if i == 0 {
+            m.Hostname = token
+            rest = rest[sp+1:]
+        }
+    }
+    m.Message = rest
+    return m, true
+}
+
+// SyslogStats counts datagrams since the receiver started. Dropped messages
+// arrived while the queue to the pipeline was full.
+type SyslogStats struct {
+    Received       int64 `json:"received"`
+    Malformed      int64 `json:"malformed"`
+    Dropped        int64 `json:"dropped"`
+    QueueDepth     int   `json:"queue_depth"`
+    QueueHighWater int   `json:"queue_high_water"`
+    QueueCapacity  int   `json:"queue_capacity"`
+}
+
+// SyslogReceiver accepts access log lines that nginx sends with
+// access_log syslog:server=... and feeds them into a Pipeline, as a Tailer
+// would for a log file. Reading never blocks on the pipeline: when the queue
+// is full, messages are dropped and counted.
+type SyslogReceiver struct {
+    // UDP is a host:port and Socket a unix datagram socket path; either may be empty
+    UDP    string
+    Socket string
+    // SocketGroup may write to the socket, which is created 0660. Empty picks
+    // the first existing of socketGroups, the usual nginx worker groups.
+    SocketGroup string
+    
+    pipeline *Pipeline
+    queue    chan string
+    
+    mu    sync.Mutex
+    stats SyslogStats
+}
+
+var socketGroups = []string{"nginx", "www-data"}
+
+// NewSyslogReceiver queues up to queueSize lines for the pipeline
+func NewSyslogReceiver(pipeline *Pipeline, queueSize int) *SyslogReceiver {
+    if queueSize <= 0 {
+        queueSize = 10000
+    }
+    return &SyslogReceiver{
+        pipeline: pipeline,
+        queue:    make(chan string, queueSize),
+        stats:    SyslogStats{QueueCapacity: queueSize},
+    }
+}
+
+// Run listens until ctx is cancelled
+func (s *SyslogReceiver) Run(ctx context.Context) error {
+    var conns []net.PacketConn
+    closeAll := func() {
+        for _, c := range conns {
+            c.Close()
+        }
+    }
+    
+    if s.UDP != "" {
+        conn, err := net.ListenPacket("udp", s.UDP)
+        if err != nil {
+            return fmt.Errorf("syslog UDP listen failed: %w", err)
+        }
+        conns = append(conns, conn)
+    }
+    if s.Socket != "" {
+        // A socket left behind by a previous run would fail the bind
+        os.Remove(s.Socket)
+        conn, err := net.ListenPacket("unixgram", s.Socket)
+        if err != nil {
+            closeAll()
+            return fmt.Errorf("syslog socket listen failed: %w", err)
+        }
+        conns = append(conns, conn)
+        // nginx workers run unprivileged, so their group gets write access
+        if err := s.shareSocket(); err != nil {
+            closeAll()
+            return err
+        }
+    }
+    if len(conns) == 0 {
+        return fmt.Errorf("no syslog address configured")
+    }
+    
+    go func() {
+        <-ctx.Done()
+        closeAll()
+        if s.Socket != "" {
+            os.Remove(s.Socket)
+        }
+    }()
+    go s.drain(ctx)
+    
+    errs := make(chan error, len(conns))
+    for _, conn := range conns {
+        go func(conn net.PacketConn) { errs <- s.serve(ctx, conn) }(conn)
+    }
+    err := <-errs
+    if ctx.Err() != nil {
+        return nil
+    }
+    closeAll()
+    return err
+}
+
+func (s *SyslogReceiver) serve(ctx context.Context, conn net.PacketConn) error {
+    buf := make([]byte, 65535)
+    for {
+        n, _, err := conn.ReadFrom(buf)
+        if err != nil {
+            if ctx.Err() != nil {
+                return nil
+            }
+            return err
+        }
+        s.receive(buf[:n])
+    }
+}
+
+// receive queues one datagram without waiting for the pipeline
+func (s *SyslogReceiver) receive(data []byte) {
+    msg, ok := ParseSyslogMessage(data)
+    
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    s.stats.Received++
+    if !ok {
+        s.stats.Malformed++
+        return
+    }
+    select {
+    case s.queue <- msg.Message:
+        if depth := len(s.queue); depth > s.stats.QueueHighWater {
+            s.stats.QueueHighWater = depth
+        }
+    default:
+        s.stats.Dropped++
+    }
+}
+
+// shareSocket hands the socket to the nginx worker group with mode 0660
+func (s *SyslogReceiver) shareSocket() error {
+    groups := socketGroups
+    if s.SocketGroup != "" {
+        groups = []string{s.SocketGroup}
+    }
+    for _, name := range groups {
+        group, err := user.LookupGroup(name)
+        if err != nil {
+            continue
+        }
+        gid, err := strconv.Atoi(group.Gid)
+        if err != nil {
+            return fmt.Errorf("syslog socket group %s: %w", name, err)
+        }
+        if err := os.Chown(s.Socket, -1, gid); err != nil {
+            return fmt.Errorf("syslog socket group %s: %w", name, err)
+        }
+        return os.Chmod(s.Socket, 0660)
+    }
+    return fmt.Errorf("syslog socket group %s not found", strings.Join(groups, " or "))
+}
+
+// drain feeds queued lines into the pipeline
+func (s *SyslogReceiver) drain(ctx context.Context) {
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case line := <-s.queue:
+            s.pipeline.FeedLine(line)
+        }
+    }
+}
+
+// Stats returns the counters since the receiver started
+func (s *SyslogReceiver) Stats() SyslogStats {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    stats := s.stats
+    stats.QueueDepth = len(s.queue)
+    return stats
+}
+
+// SyslogAccessLog returns the access_log target sending to a receiver on
+// server, which is a host:port or "unix:/path"
+func SyslogAccessLog(server, tag string) string {
+    if tag == "" {
+        tag = "nginx"
+    }
+    return fmt.Sprintf("syslog:server=%s,tag=%s,nohostname", server, tag)
+}
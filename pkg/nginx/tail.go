@@ -0,0 +1,74 @@
+package nginx
+
+import (
+    "bufio"
+    "io"
+    "os"
+    "syscall"
+)
+
+// Tailer reads lines appended to a log file since the previous call,
+// following rotation and truncation
+type Tailer struct {
+    Path string
+    
+    offset int64
+    inode  uint64
+    opened bool
+}
+
+// NewTailer starts tailing at the current end of the file so only new lines are read
+func NewTailer(path string) *Tailer {
+    t := &Tailer{Path: path}
+    if info, err := os.Stat(path); err == nil {
+        t.offset = info.Size()
+        t.inode = inodeOf(info)
+        t.opened = true
+    }
+    return t
+}
+
+// ReadNew calls fn for every complete line written since the last call
+func (t *Tailer) ReadNew(fn func(line string)) error {
+    file, err := os.Open(t.Path)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+    
+    info, err := file.Stat()
+    if err != nil {
+        return err
+    }
+    
+    // A new inode means the log was rotated; a smaller size means it was truncated
+    if inode := inodeOf(info); !t.opened || inode != t.inode || info.Size() < t.offset {
+        t.offset = 0
+        t.inode = inode
+        t.opened = true
+    }
+    
+    if _, err := file.Seek(t.offset, io.SeekStart); err != nil {
+        return err
+    }
+    
+    reader := bufio.NewReaderSize(file, 64*1024)
+    for {
+        line, err := reader.ReadString('\n')
+        if err != nil {
+            // Leave a partial last line for the next call
+            break
+        }
+        t.offset += int64(len(line))
+        fn(line[:len(line)-1])
+    }
+    
+    return nil
+}
+
+func inodeOf(info os.FileInfo) uint64 {
+    if st, ok := info.Sys().(*syscall.Stat_t); ok {
+        return st.Ino
+    }
+    return 0
+}
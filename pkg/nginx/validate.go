@@ -0,0 +1,116 @@
+package nginx
+
+import (
+    "fmt"
+    "regexp"
+)
+
+// Grammars for values that can reach the managed config from outside the
+// agent. Each one is strict enough that no value can end a directive or a
+// block (";", "{", "}"), open a quoted string or start a comment.
+var (
+    namePattern     = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+    hostnamePattern = regexp.MustCompile(`^(\*\.|\.)?([A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?\.)*[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+    durationPattern = regexp.MustCompile(`^[0-9]{1,9}(ms|s|m|h|d|w|M|y)?$`)
+    sizePattern     = regexp.MustCompile(`^[0-9]{1,9}[kKmMgG]?$`)
+    variablePattern = regexp.MustCompile(`^\$[a-z_][a-z0-9_]*$`)
+    cacheKeyPattern = regexp.MustCompile(`^(\$[a-z_][a-z0-9_]*|[A-Za-z0-9_./:-])+$`)
+    codesPattern    = regexp.MustCompile(`^(any|[1-5][0-9]{2}( [1-5][0-9]{2})*)$`)
+)
+
+// ValidName reports whether s can be used as a profile name
+func ValidName(s string) bool {
+    return namePattern.MatchString(s)
+}
+
+// ValidHostname reports whether s is a server_name or map hostname entry:
+// a DNS name, optionally with a leading "*." or "." wildcard
+func ValidHostname(s string) bool {
+    return len(s) <= 253 && hostnamePattern.MatchString(s)
+}
+
+// ValidDuration reports whether s is an nginx time value such as 30d or 600s
+func ValidDuration(s string) bool {
+    return durationPattern.MatchString(s)
+}
+
+// ValidSize reports whether s is an nginx size value such as 8m
+func ValidSize(s string) bool {
+    return sizePattern.MatchString(s)
+}
+
+// ValidVariable reports whether s is a single nginx variable such as $cookie_nocache
+func ValidVariable(s string) bool {
+    return variablePattern.MatchString(s)
+}
+
+// ValidCacheKey reports whether s is a proxy_cache_key made of variables and
+// plain URL characters
+func ValidCacheKey(s string) bool {
+    return cacheKeyPattern.MatchString(s)
+}
+
+// ValidStatusCodes reports whether s is the code list of a proxy_cache_valid
+// directive: "any" or space separated HTTP status codes
+func ValidStatusCodes(s string) bool {
+    return codesPattern.MatchString(s)
+}
+
+// Validate checks the parts of the model that can be set remotely. Render
+// refuses a model that fails, so a bad value never reaches nginx.
+func (m *ConfigModel) Validate() error {
+    for i, v := range m.CacheValidity {
+        if !ValidStatusCodes(v.Codes) {
+            return fmt.Errorf("cache validity %d: invalid status codes %q", i, v.Codes)
+        }
+        if !ValidDuration(v.Duration) {
+            return fmt.Errorf("cache validity %d: invalid duration %q", i, v.Duration)
+        }
+    }
+    for _, v := range m.Bypass {
+        if !ValidVariable(v) {
+            return fmt.Errorf("invalid bypass variable %q", v)
+        }
+    }
+    for _, h := range m.BlockedHosts {
+        if !ValidHostname(h) {
+            return fmt.Errorf("invalid blocked host %q", h)
+        }
+    }
+    for _, p := range m.Profiles {
+        if err := p.validate(); err != nil {
+            return fmt.Errorf("profile %q: %w", p.Name, err)
+        }
+    }
+    return nil
+}
+
+func (p *ServerProfile) validate() error {
+    if !ValidName(p.Name) {
+        return fmt.Errorf("invalid name")
+    }
+    if len(p.Hostnames) == 0 {
+        return fmt.Errorf("no hostnames")
+    }
+    for _, h := range p.Hostnames {
+        if !ValidHostname(h) {
+            return fmt.Errorf("invalid hostname %q", h)
+        }
+    }
+    if !ValidCacheKey(p.CacheKey) {
+        return fmt.Errorf("invalid cache key %q", p.CacheKey)
+    }
+    if !ValidDuration(p.Validity) {
+        return fmt.Errorf("invalid validity %q", p.Validity)
+    }
+    if p.SliceSize != "" && !ValidSize(p.SliceSize) {
+        return fmt.Errorf("invalid slice size %q", p.SliceSize)
+    }
+    if p.ReadTimeout != "" && !ValidDuration(p.ReadTimeout) {
+        return fmt.Errorf("invalid read timeout %q", p.ReadTimeout)
+    }
+    if p.ShortValidity != "" && !ValidDuration(p.ShortValidity) {
+        return fmt.Errorf("invalid short validity %q", p.ShortValidity)
+    }
+    return nil
+}
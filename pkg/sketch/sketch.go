@@ -0,0 +1,212 @@
+// Package sketch implements the DDSketch quantile summary used for latency.
+package sketch
+
+import (
+    "encoding/json"
+    "errors"
+    "math"
+    "sort"
+)
+
+// Sketch is a DDSketch: a quantile summary whose answers are within a fixed
+// relative error of the true value. Sketches with the same accuracy merge
+// exactly, so per-interval sketches can be combined into longer windows.
+type Sketch struct {
+    gamma    float64
+    logGamma float64
+    bins     map[int]int64
+    zeros    int64
+    count    int64
+    sum      float64
+    min      float64
+    max      float64
+}
+
+// Summary is a quantile summary in milliseconds
+type Summary struct {
+    Count int64   `json:"count"`
+    Mean  float64 `json:"mean_ms"`
+    P50   float64 `json:"p50_ms"`
+    P90   float64 `json:"p90_ms"`
+    P99   float64 `json:"p99_ms"`
+    Max   float64 `json:"max_ms"`
+}
+
+// Accuracy is the relative error of latency sketches (1%)
+const Accuracy = 0.01
+
+var errMismatch = errors.New("sketches have different accuracy")
+
+// New creates a sketch whose quantiles are within relativeAccuracy of the true value
+func New(relativeAccuracy float64) *Sketch {
+    gamma := (1 + relativeAccuracy) / (1 - relativeAccuracy)
+    return &Sketch{
+        gamma:    gamma,
+        logGamma: math.Log(gamma),
+        bins:     make(map[int]int64),
+        min:      math.Inf(1),
+        max:      math.Inf(-1),
+    }
+}
+
+// Add records a non-negative value; values below 1µs are counted as zero
+func (s *Sketch) Add(v float64) {
+    if v < 0 || math.IsNaN(v) {
+        return
+    }
+    s.count++
+    s.sum += v
+    s.min = math.Min(s.min, v)
+    s.max = math.Max(s.max, v)
+
+    if v < 1e-3 {
+        s.zeros++
+        return
+    }
+    s.bins[int(math.Ceil(math.Log(v)/s.logGamma))]++
+}
+
+// Merge adds every value recorded in o
+func (s *Sketch) Merge(o *Sketch) error {
+    if o == nil || o.count == 0 {
+        return nil
+    }
+    if s.gamma != o.gamma {
+        return errMismatch
+    }
+    for i, n := range o.bins {
+        s.bins[i] += n
+    }
+    s.zeros += o.zeros
+    s.count += o.count
+    s.sum += o.sum
+    s.min = math.Min(s.min, o.min)
+    s.max = math.Max(s.max, o.max)
+    return nil
+}
+
+func (s *Sketch) Count() int64 {
+    return s.count
+}
+
+// Quantile returns the value at rank q (0..1), or 0 for an empty sketch
+func (s *Sketch) Quantile(q float64) float64 {
+    if s.count == 0 {
+        return 0
+    }
+    if q <= 0 {
+        return s.min
+    }
+    if q >= 1 {
+        return s.max
+    }
+
+    rank := int64(q * float64(s.count-1))
+    if rank < s.zeros {
+        return 0
+    }
+    seen := s.zeros
+
+    keys := make([]int, 0, len(s.bins))
+    for k := range s.bins {
+        keys = append(keys, k)
+    }
+    sort.Ints(keys)
+    for _, k := range keys {
+        seen += s.bins[k]
+        if seen > rank {
+            // The bin midpoint keeps the error within the configured accuracy
+            v := 2 * math.Pow(s.gamma, float64(k)) / (s.gamma + 1)
+            return math.Max(s.min, math.Min(v, s.max))
+        }
+    }
+    return s.max
+}
+
+// Summary returns the usual percentiles
+func (s *Sketch) Summary() Summary {
+    if s.count == 0 {
+        return Summary{}
+    }
+    return Summary{
+        Count: s.count,
+        Mean:  s.sum / float64(s.count),
+        P50:   s.Quantile(0.50),
+        P90:   s.Quantile(0.90),
+        P99:   s.Quantile(0.99),
+        Max:   s.max,
+    }
+}
+
+// Clone returns an independent copy
+func (s *Sketch) Clone() *Sketch {
+    c := *s
+    c.bins = make(map[int]int64, len(s.bins))
+    for i, n := range s.bins {
+        c.bins[i] = n
+    }
+    return &c
+}
+
+// encoded is the JSON form of a sketch. Latency bins are mostly contiguous,
+// so they are stored as counts starting at bin Offset.
+type encoded struct {
+    Gamma  float64 `json:"gamma"`
+    Count  int64   `json:"count"`
+    Zeros  int64   `json:"zeros,omitempty"`
+    Sum    float64 `json:"sum"`
+    Min    float64 `json:"min"`
+    Max    float64 `json:"max"`
+    Offset int     `json:"offset"`
+    Bins   []int64 `json:"bins"`
+}
+
+func (s *Sketch) MarshalJSON() ([]byte, error) {
+    e := encoded{Gamma: s.gamma, Count: s.count, Zeros: s.zeros, Sum: s.sum}
+    if s.count > 0 {
+        // An empty sketch keeps infinite bounds, which JSON cannot carry
+        e.Min, e.Max = s.min, s.max
+    }
+    if len(s.bins) > 0 {
+        lo, hi := math.MaxInt, math.MinInt
+        for i := range s.bins {
+            lo = min(lo, i)
+            hi = max(hi, i)
+        }
+        e.Offset = lo
+        e.Bins = make([]int64, hi-lo+1)
+        for i, n := range s.bins {
+            e.Bins[i-lo] = n
+        }
+    }
+    return json.Marshal(e)
+}
+
+func (s *Sketch) UnmarshalJSON(data []byte) error {
+    var e encoded
+    if err := json.Unmarshal(data, &e); err != nil {
+        return err
+    }
+    if e.Gamma <= 1 {
+        return errors.New("invalid sketch gamma")
+    }
+    *s = Sketch{
+        gamma:    e.Gamma,
+        logGamma: math.Log(e.Gamma),
+        bins:     make(map[int]int64, len(e.Bins)),
+        zeros:    e.Zeros,
+        count:    e.Count,
+        sum:      e.Sum,
+        min:      math.Inf(1),
+        max:      math.Inf(-1),
+    }
+    if e.Count > 0 {
+        s.min, s.max = e.Min, e.Max
+    }
+    for i, n := range e.Bins {
+        if n > 0 {
+            s.bins[e.Offset+i] = n
+        }
+    }
+    return nil
+}
@@ -0,0 +1,426 @@
+package telemetry
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log/slog"
+    "net/http"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Interval identifies one telemetry report by its per-agent sequence number
+// and the time it covers, (From, To]
+type Interval struct {
+    Seq  uint64    `json:"seq"`
+    From time.Time `json:"from"`
+    To   time.Time `json:"to"`
+}
+
+// maxUnsent bounds the ledger, a week of 5-minute reports
+const maxUnsent = 2016
+
+// Ledger numbers telemetry reports and remembers the ones the SaaS has not
+// acknowledged. When spoolDir is set, the data of unsent reports is kept
+// there too, for agents running without local history.
+type Ledger struct {
+    path     string
+    spoolDir string
+    
+    mu    sync.Mutex
+    state ledgerState
+}
+
+type ledgerState struct {
+    NextSeq uint64     `json:"next_seq"`
+    Unsent  []Interval `json:"unsent"`
+}
+
+// OpenLedger loads the ledger at path, starting a new one if none exists
+func OpenLedger(path, spoolDir string) (*Ledger, error) {
+    l := &Ledger{path: path, spoolDir: spoolDir}
+    l.state.NextSeq = 1
+    
+    data, err := os.ReadFile(path)
+    if err != nil && !os.IsNotExist(err) {
+        return nil, err
+    }
+    if err == nil {
+        if err := json.Unmarshal(data, &l.state); err != nil {
+            return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+        }
+    }
+    if spoolDir != "" {
+        if err := os.MkdirAll(spoolDir, 0755); err != nil {
+            return nil, err
+        }
+    }
+    return l, nil
+}
+
+// Next assigns the next sequence number to the report ending at to
+func (l *Ledger) Next(to time.Time, seconds int) (Interval, error) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    
+    iv := Interval{
+        Seq:  l.state.NextSeq,
+        From: to.Add(-time.Duration(seconds) * time.Second),
+        To:   to,
+    }
+    l.state.NextSeq++
+    return iv, l.save()
+}
+
+// LastSeq returns the sequence number of the latest report
+func (l *Ledger) LastSeq() uint64 {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return l.state.NextSeq - 1
+}
+
+// Failed records a report the SaaS did not receive
+func (l *Ledger) Failed(iv Interval, data *TelemetryData) error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    
+    if l.spoolDir != "" {
+        encoded, err := json.Marshal(data)
+        if err != nil {
+            return err
+        }
+        if err := os.WriteFile(l.spoolPath(iv.Seq), encoded, 0644); err != nil {
+            return err
+        }
+    }
+    
+    l.state.Unsent = append(l.state.Unsent, iv)
+    for len(l.state.Unsent) > maxUnsent {
+        os.Remove(l.spoolPath(l.state.Unsent[0].Seq))
+        l.state.Unsent = l.state.Unsent[1:]
+    }
+    return l.save()
+}
+
+// Done forgets reports that were delivered or can no longer be rebuilt
+func (l *Ledger) Done(seqs []uint64) error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    
+    done := make(map[uint64]bool, len(seqs))
+    for _, seq := range seqs {
+        done[seq] = true
+        if l.spoolDir != "" {
+            os.Remove(l.spoolPath(seq))
+        }
+    }
+    kept := l.state.Unsent[:0]
+    for _, iv := range l.state.Unsent {
+        if !done[iv.Seq] {
+            kept = append(kept, iv)
+        }
+    }
+    l.state.Unsent = kept
+    return l.save()
+}
+
+// Unsent returns the reports the SaaS has not acknowledged, oldest first
+func (l *Ledger) Unsent() []Interval {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return append([]Interval(nil), l.state.Unsent...)
+}
+
+// Spooled returns the spooled data of a report, or nil if it was not spooled
+func (l *Ledger) Spooled(seq uint64) (*TelemetryData, error) {
+    if l.spoolDir == "" {
+        return nil, nil
+    }
+    encoded, err := os.ReadFile(l.spoolPath(seq))
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    var data TelemetryData
+    if err := json.Unmarshal(encoded, &data); err != nil {
+        return nil, err
+    }
+    return &data, nil
+}
+
+func (l *Ledger) spoolPath(seq uint64) string {
+    return filepath.Join(l.spoolDir, strconv.FormatUint(seq, 10)+".json")
+}
+
+// save writes the state atomically; callers hold mu
+func (l *Ledger) save() error {
+    encoded, err := json.Marshal(l.state)
+    if err != nil {
+        return err
+    }
+    if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+        return err
+    }
+    tmp := l.path + ".tmp"
+    if err := os.WriteFile(tmp, encoded, 0644); err != nil {
+        return err
+    }
+    return os.Rename(tmp, l.path)
+}
+
+// Backfiller asks the SaaS which reports it is missing and uploads them,
+// oldest first, in rate-limited batches. Every report keeps its original
+// sequence number, so the SaaS can ignore reports it already has.
+type Backfiller struct {
+    SaaSURL string
+    AgentID string
+    Ledger  *Ledger
+    // Load rebuilds a report, returning nil when its data is no longer kept
+    Load func(Interval) (*TelemetryData, error)
+    
+    BatchSize int
+    // Pause between batches, so backfill does not compete with live telemetry
+    Pause time.Duration
+    // MaxAge skips intervals older than this; 0 means no limit
+    MaxAge time.Duration
+    
+    Logger *slog.Logger
+    
+    client  *http.Client
+    running atomic.Bool
+}
+
+func NewBackfiller(saasURL, agentID string, ledger *Ledger, load func(Interval) (*TelemetryData, error)) *Backfiller {
+    return &Backfiller{
+        SaaSURL:   saasURL,
+        AgentID:   agentID,
+        Ledger:    ledger,
+        Load:      load,
+        BatchSize: 12,
+        Pause:     10 * time.Second,
+        MaxAge:    7 * 24 * time.Hour,
+        Logger:    slog.Default(),
+        client:    &http.Client{Timeout: 60 * time.Second},
+    }
+}
+
+// Trigger starts a backfill in the background unless one is already running
+func (b *Backfiller) Trigger(ctx context.Context) {
+    if !b.running.CompareAndSwap(false, true) {
+        return
+    }
+    go func() {
+        defer b.running.Store(false)
+        if err := b.Run(ctx); err != nil {
+            b.Logger.Warn("telemetry backfill failed", "error", err)
+        }
+    }()
+}
+
+// gapsRequest tells the SaaS the latest sequence number and the reports the
+// agent knows were not delivered; the SaaS answers with every interval it lacks
+type gapsRequest struct {
+    AgentID string     `json:"agent_id"`
+    LastSeq uint64     `json:"last_seq"`
+    Unsent  []Interval `json:"unsent"`
+}
+
+type gapsResponse struct {
+    Missing []Interval `json:"missing"`
+}
+
+type backfillRequest struct {
+    AgentID string          `json:"agent_id"`
+    Reports []TelemetryData `json:"reports"`
+    // Unavailable lists missing intervals whose data is gone, so the SaaS stops asking for them
+    Unavailable []uint64 `json:"unavailable,omitempty"`
+}
+
+// Run negotiates the missing intervals and uploads them
+func (b *Backfiller) Run(ctx context.Context) error {
+    missing, err := b.negotiate(ctx)
+    if err != nil {
+        return err
+    }
+    if len(missing) == 0 {
+        return nil
+    }
+    b.Logger.Info("backfilling missed telemetry intervals", "intervals", len(missing))
+    
+    sort.Slice(missing, func(i, j int) bool {
+        if !missing[i].To.Equal(missing[j].To) {
+            return missing[i].To.Before(missing[j].To)
+        }
+        return missing[i].Seq < missing[j].Seq
+    })
+    
+    batchSize := b.BatchSize
+    if batchSize <= 0 {
+        batchSize = 12
+    }
+    uploaded, unavailable := 0, 0
+    for start := 0; start < len(missing); start += batchSize {
+        end := start + batchSize
+        if end > len(missing) {
+            end = len(missing)
+        }
+        if start > 0 {
+            select {
+            case <-ctx.Done():
+                return ctx.Err()
+            case <-time.After(b.Pause):
+            }
+        }
+        
+        req := backfillRequest{AgentID: b.AgentID}
+        var seqs []uint64
+        for _, iv := range missing[start:end] {
+            seqs = append(seqs, iv.Seq)
+            data, err := b.load(iv)
+            if err != nil {
+                return fmt.Errorf("failed to load interval %d: %w", iv.Seq, err)
+            }
+            if data == nil {
+                req.Unavailable = append(req.Unavailable, iv.Seq)
+                continue
+            }
+            req.Reports = append(req.Reports, *data)
+        }
+        
+        key := fmt.Sprintf("%s-%d-%d", b.AgentID, seqs[0], seqs[len(seqs)-1])
+        if err := b.post(ctx, "/api/telemetry/backfill", key, req, nil); err != nil {
+            return err
+        }
+        if err := b.Ledger.Done(seqs); err != nil {
+            return err
+        }
+        uploaded += len(req.Reports)
+        unavailable += len(req.Unavailable)
+    }
+    
+    b.Logger.Info("telemetry backfill complete", "uploaded", uploaded, "unavailable", unavailable)
+    return nil
+}
+
+// negotiate asks the SaaS for missing intervals, falling back to the ledger
+// when the SaaS does not support gap negotiation
+func (b *Backfiller) negotiate(ctx context.Context) ([]Interval, error) {
+    unsent := b.Ledger.Unsent()
+    req := gapsRequest{AgentID: b.AgentID, LastSeq: b.Ledger.LastSeq(), Unsent: unsent}
+    
+    var resp gapsResponse
+    err := b.post(ctx, "/api/telemetry/gaps", "", req, &resp)
+    if errStatus, ok := err.(*statusError); ok && (errStatus.code == http.StatusNotFound || errStatus.code == http.StatusMethodNotAllowed) {
+        return unsent, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    
+    // Reports the SaaS has despite a failed send need no upload
+    seen := make(map[uint64]bool, len(resp.Missing))
+    var missing []Interval
+    for _, iv := range resp.Missing {
+        if !seen[iv.Seq] {
+            seen[iv.Seq] = true
+            missing = append(missing, iv)
+        }
+    }
+    var delivered []uint64
+    for _, iv := range unsent {
+        if !seen[iv.Seq] {
+            delivered = append(delivered, iv.Seq)
+        }
+    }
+    if len(delivered) > 0 {
+        if err := b.Ledger.Done(delivered); err != nil {
+            return nil, err
+        }
+    }
+    return missing, nil
+}
+
+// load rebuilds one report from the spool or the local history
+func (b *Backfiller) load(iv Interval) (*TelemetryData, error) {
+    if b.MaxAge > 0 && time.Since(iv.To) > b.MaxAge {
+        return nil, nil
+    }
+    data, err := b.Ledger.Spooled(iv.Seq)
+    if err != nil {
+        return nil, err
+    }
+    if data == nil && b.Load != nil {
+        data, err = b.Load(iv)
+        if err != nil || data == nil {
+            return nil, err
+        }
+    }
+    if data == nil {
+        return nil, nil
+    }
+    
+    data.AgentID = b.AgentID
+    data.Seq = iv.Seq
+    data.Timestamp = iv.To
+    data.IntervalSeconds = int(iv.To.Sub(iv.From).Seconds())
+    data.Backfill = true
+    data.Latency = data.Latency.withoutSketches()
+    return data, nil
+}
+
+type statusError struct {
+    code int
+    body string
+}
+
+func (e *statusError) Error() string {
+    return fmt.Sprintf("server returned %d: %s", e.code, e.body)
+}
+
+func (b *Backfiller) post(ctx context.Context, path, idempotencyKey string, body, out interface{}) error {
+    encoded, err := json.Marshal(body)
+    if err != nil {
+        return err
+    }
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.SaaSURL+path, bytes.NewReader(encoded))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    if idempotencyKey != "" {
+        req.Header.Set("Idempotency-Key", idempotencyKey)
+    }
+    
+    client := b.client
+    if client == nil {
+        client = http.DefaultClient
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    
+    // 409 means the SaaS already stored this batch
+    if resp.StatusCode == http.StatusConflict {
+        return nil
+    }
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+        return &statusError{code: resp.StatusCode, body: string(bytes.TrimSpace(msg))}
+    }
+    if out != nil {
+        return json.NewDecoder(resp.Body).Decode(out)
+    }
+    return nil
+}
@@ -0,0 +1,367 @@
+package telemetry
+
+import (
+    "sort"
+    "time"
+
+    "isp-agent/pkg/sketch"
+)
+
+// Merge combines consecutive samples (oldest first) into one covering their whole span.
+//
+// Interval aggregates (profiles, servers, breakdowns, subscribers, geo) are
+// summed. Cache zones keep the latest size with their traffic summed.
+// Log-window snapshots (cache hits/misses, cache status, size) and nginx, DNS
+// and syslog counters, which are cumulative, take the latest value. CPU and memory
+// are averaged. Latency percentiles are read from the merged sketches; only
+// samples recorded without sketches fall back to count-weighted averages.
+func Merge(samples []*TelemetryData) *TelemetryData {
+    if len(samples) == 0 {
+        return nil
+    }
+    last := samples[len(samples)-1]
+    out := *last
+    out.Profiles = nil
+    out.Latency = nil
+    out.Breakdown = nil
+    out.Subscribers = nil
+    out.Geo = nil
+    out.Errors = nil
+    out.Servers = nil
+    out.Zones = nil
+    out.IntervalSeconds = 0
+    
+    var cpu, mem float64
+    latency := make(latencyMerger)
+    for _, s := range samples {
+        cpu += s.CPUUsage
+        mem += s.MemoryUsage
+        out.IntervalSeconds += s.IntervalSeconds
+        
+        out.Profiles = mergeTraffic(out.Profiles, s.Profiles)
+        out.Breakdown = mergeBreakdown(out.Breakdown, s.Breakdown)
+        out.Subscribers = mergeSubscribers(out.Subscribers, s.Subscribers)
+        out.Geo = mergeGeo(out.Geo, s.Geo)
+        out.Errors = mergeErrors(out.Errors, s.Errors)
+        out.Servers = mergeTraffic(out.Servers, s.Servers)
+        out.Zones = mergeZones(out.Zones, s.Zones)
+        latency.add(s.Latency)
+    }
+    out.CPUUsage = cpu / float64(len(samples))
+    out.MemoryUsage = mem / float64(len(samples))
+    out.Latency = latency.report()
+    
+    if out.Subscribers != nil {
+        out.Subscribers.TopClients = topClients(out.Subscribers.TopClients, maxTopClients(samples))
+    }
+    if out.Geo != nil {
+        out.Geo.OriginASNs = topASNs(out.Geo.OriginASNs, maxOriginASNs(samples))
+    }
+    return &out
+}
+
+// Window returns the merged samples whose timestamps fall in (from, to]
+func Window(samples []*TelemetryData, from, to time.Time) *TelemetryData {
+    var in []*TelemetryData
+    for _, s := range samples {
+        if s.Timestamp.After(from) && !s.Timestamp.After(to) {
+            in = append(in, s)
+        }
+    }
+    return Merge(in)
+}
+
+func addTraffic(a, b TrafficStats) TrafficStats {
+    a.Requests += b.Requests
+    a.Hits += b.Hits
+    a.Misses += b.Misses
+    a.Bytes += b.Bytes
+    a.HitBytes += b.HitBytes
+    a.HitRatio = 0
+    if a.Requests > 0 {
+        a.HitRatio = float64(a.Hits) / float64(a.Requests)
+    }
+    return a
+}
+
+func mergeTraffic(dst, src map[string]TrafficStats) map[string]TrafficStats {
+    if len(src) == 0 {
+        return dst
+    }
+    if dst == nil {
+        dst = make(map[string]TrafficStats, len(src))
+    }
+    for k, v := range src {
+        dst[k] = addTraffic(dst[k], v)
+    }
+    return dst
+}
+
+func mergeZones(dst, src []ZoneStats) []ZoneStats {
+    out := make([]ZoneStats, 0, len(src))
+    for _, z := range src {
+        for _, prev := range dst {
+            if prev.Instance == z.Instance && prev.Name == z.Name {
+                z.Traffic = addTraffic(prev.Traffic, z.Traffic)
+                break
+            }
+        }
+        out = append(out, z)
+    }
+    return out
+}
+
+func mergeRequestBytes(dst, src map[string]RequestBytes) map[string]RequestBytes {
+    if dst == nil {
+        dst = make(map[string]RequestBytes, len(src))
+    }
+    for k, v := range src {
+        c := dst[k]
+        c.Requests += v.Requests
+        c.Bytes += v.Bytes
+        dst[k] = c
+    }
+    return dst
+}
+
+func mergeBreakdown(dst, src *ResponseBreakdown) *ResponseBreakdown {
+    if src == nil {
+        return dst
+    }
+    if dst == nil {
+        dst = &ResponseBreakdown{}
+    }
+    dst.StatusClass = mergeRequestBytes(dst.StatusClass, src.StatusClass)
+    dst.StatusCode = mergeRequestBytes(dst.StatusCode, src.StatusCode)
+    dst.Method = mergeRequestBytes(dst.Method, src.Method)
+    dst.ContentType = mergeRequestBytes(dst.ContentType, src.ContentType)
+    return dst
+}
+
+func mergeSubscribers(dst, src *SubscriberReport) *SubscriberReport {
+    if src == nil {
+        return dst
+    }
+    if dst == nil {
+        dst = &SubscriberReport{}
+    }
+    dst.Anonymization = src.Anonymization
+    dst.Groups = mergeTraffic(dst.Groups, src.Groups)
+    
+    index := make(map[string]int, len(dst.TopClients))
+    for i, c := range dst.TopClients {
+        index[c.Client] = i
+    }
+    for _, c := range src.TopClients {
+        if i, ok := index[c.Client]; ok {
+            dst.TopClients[i].TrafficStats = addTraffic(dst.TopClients[i].TrafficStats, c.TrafficStats)
+            continue
+        }
+        index[c.Client] = len(dst.TopClients)
+        dst.TopClients = append(dst.TopClients, c)
+    }
+    return dst
+}
+
+func mergeErrors(dst, src *ErrorLogStats) *ErrorLogStats {
+    if src == nil {
+        return dst
+    }
+    if dst == nil {
+        dst = &ErrorLogStats{Patterns: make(map[string]int64), Levels: make(map[string]int64)}
+    }
+    for k, v := range src.Patterns {
+        dst.Patterns[k] += v
+    }
+    for k, v := range src.Levels {
+        dst.Levels[k] += v
+    }
+    return dst
+}
+
+func mergeGeo(dst, src *GeoReport) *GeoReport {
+    if src == nil {
+        return dst
+    }
+    if dst == nil {
+        dst = &GeoReport{}
+    }
+    dst.ClientRegions = mergeTraffic(dst.ClientRegions, src.ClientRegions)
+    
+    index := make(map[uint64]int, len(dst.OriginASNs))
+    for i, a := range dst.OriginASNs {
+        index[a.ASN] = i
+    }
+    for _, a := range src.OriginASNs {
+        if i, ok := index[a.ASN]; ok {
+            d := &dst.OriginASNs[i]
+            d.Requests += a.Requests
+            d.Bytes += a.Bytes
+            d.MissBytes += a.MissBytes
+            continue
+        }
+        index[a.ASN] = len(dst.OriginASNs)
+        dst.OriginASNs = append(dst.OriginASNs, a)
+    }
+    return dst
+}
+
+// The merged top lists keep as many entries as the largest input did
+func maxTopClients(samples []*TelemetryData) int {
+    n := 0
+    for _, s := range samples {
+        if s.Subscribers != nil && len(s.Subscribers.TopClients) > n {
+            n = len(s.Subscribers.TopClients)
+        }
+    }
+    return n
+}
+
+func maxOriginASNs(samples []*TelemetryData) int {
+    n := 0
+    for _, s := range samples {
+        if s.Geo != nil && len(s.Geo.OriginASNs) > n {
+            n = len(s.Geo.OriginASNs)
+        }
+    }
+    return n
+}
+
+func topClients(clients []ClientStats, limit int) []ClientStats {
+    sort.Slice(clients, func(i, j int) bool {
+        if clients[i].Bytes != clients[j].Bytes {
+            return clients[i].Bytes > clients[j].Bytes
+        }
+        return clients[i].Client < clients[j].Client
+    })
+    if len(clients) > limit {
+        clients = clients[:limit]
+    }
+    return clients
+}
+
+func topASNs(asns []OriginASNStats, limit int) []OriginASNStats {
+    sort.Slice(asns, func(i, j int) bool {
+        if asns[i].MissBytes != asns[j].MissBytes {
+            return asns[i].MissBytes > asns[j].MissBytes
+        }
+        return asns[i].ASN < asns[j].ASN
+    })
+    if len(asns) > limit {
+        asns = asns[:limit]
+    }
+    return asns
+}
+
+// latencyMerger accumulates latency per group
+type latencyMerger map[string]*latencySum
+
+type latencySum struct {
+    response percentileSum
+    ttfb     percentileSum
+}
+
+// percentileSum merges the sketches of one latency group. Count-weighted
+// sums of the percentiles are kept alongside for samples without a sketch.
+type percentileSum struct {
+    weighted LatencyPercentiles
+    sketch   *sketch.Sketch
+    // inexact is set once a summary without a usable sketch was added
+    inexact bool
+}
+
+func (m latencyMerger) add(r *LatencyReport) {
+    if r == nil {
+        return
+    }
+    for status, g := range r.ByCacheStatus {
+        m.addGroup("status:"+status, g)
+    }
+    for host, g := range r.ByHost {
+        m.addGroup("host:"+host, g)
+    }
+}
+
+func (m latencyMerger) addGroup(key string, g LatencyGroup) {
+    sum, ok := m[key]
+    if !ok {
+        sum = &latencySum{}
+        m[key] = sum
+    }
+    sum.response.add(g.Response, g.ResponseSketch)
+    if g.OriginTTFB != nil {
+        sum.ttfb.add(*g.OriginTTFB, g.OriginTTFBSketch)
+    }
+}
+
+func (p *percentileSum) add(summary LatencyPercentiles, s *sketch.Sketch) {
+    addWeighted(&p.weighted, summary)
+    switch {
+    case summary.Count == 0:
+    case s == nil:
+        p.inexact = true
+    case p.sketch == nil:
+        p.sketch = s.Clone()
+    default:
+        if p.sketch.Merge(s) != nil {
+            p.inexact = true
+        }
+    }
+}
+
+// finish returns the merged percentiles and, when every input had one, the merged sketch
+func (p *percentileSum) finish() (LatencyPercentiles, *sketch.Sketch) {
+    if p.inexact || p.sketch == nil {
+        return finish(p.weighted), nil
+    }
+    return LatencyPercentiles(p.sketch.Summary()), p.sketch
+}
+
+// addWeighted keeps count-weighted sums in the percentile fields until finish divides them
+func addWeighted(dst *LatencyPercentiles, p LatencyPercentiles) {
+    w := float64(p.Count)
+    dst.Count += p.Count
+    dst.Mean += p.Mean * w
+    dst.P50 += p.P50 * w
+    dst.P90 += p.P90 * w
+    dst.P99 += p.P99 * w
+    if p.Max > dst.Max {
+        dst.Max = p.Max
+    }
+}
+
+func finish(p LatencyPercentiles) LatencyPercentiles {
+    if p.Count == 0 {
+        return LatencyPercentiles{}
+    }
+    w := float64(p.Count)
+    p.Mean /= w
+    p.P50 /= w
+    p.P90 /= w
+    p.P99 /= w
+    return p
+}
+
+func (m latencyMerger) report() *LatencyReport {
+    if len(m) == 0 {
+        return nil
+    }
+    r := &LatencyReport{
+        ByCacheStatus: make(map[string]LatencyGroup),
+        ByHost:        make(map[string]LatencyGroup),
+    }
+    for key, sum := range m {
+        var g LatencyGroup
+        g.Response, g.ResponseSketch = sum.response.finish()
+        if sum.ttfb.weighted.Count > 0 {
+            ttfb, s := sum.ttfb.finish()
+            g.OriginTTFB, g.OriginTTFBSketch = &ttfb, s
+        }
+        if len(key) > 7 && key[:7] == "status:" {
+            r.ByCacheStatus[key[7:]] = g
+        } else {
+            r.ByHost[key[5:]] = g
+        }
+    }
+    return r
+}
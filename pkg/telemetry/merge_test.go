@@ -0,0 +1,95 @@
+package telemetry
+
+import (
+    "encoding/json"
+    "math"
+    "testing"
+    "time"
+
+    "isp-agent/pkg/sketch"
+)
+
+// latencySample builds a sample whose HIT latency holds values
+func latencySample(values ...float64) *TelemetryData {
+    s := sketch.New(sketch.Accuracy)
+    for _, v := range values {
+        s.Add(v)
+    }
+    return &TelemetryData{
+        Timestamp: time.Now(),
+        Latency: &LatencyReport{ByCacheStatus: map[string]LatencyGroup{
+            "HIT": {Response: LatencyPercentiles(s.Summary()), ResponseSketch: s},
+        }},
+    }
+}
+
+func within(got, want float64) bool {
+    return math.Abs(got-want) <= want*sketch.Accuracy*1.01
+}
+
+func TestMergeLatencySketches(t *testing.T) {
+    // A quiet minute of fast hits and a busy one of slow hits: averaging
+    // the per-minute p50s would give ~50ms, the true p50 is 100ms
+    var fast, slow []float64
+    for i := 0; i < 10; i++ {
+        fast = append(fast, 1)
+    }
+    for i := 0; i < 990; i++ {
+        slow = append(slow, 100)
+    }
+    
+    tests := []struct {
+        name    string
+        samples []*TelemetryData
+        p50     float64
+        sketch  bool
+    }{
+        {"sketches", []*TelemetryData{latencySample(fast...), latencySample(slow...)}, 100, true},
+        {"single", []*TelemetryData{latencySample(slow...)}, 100, true},
+        {"without sketch", []*TelemetryData{latencySample(fast...), {
+            Latency: &LatencyReport{ByCacheStatus: map[string]LatencyGroup{
+                "HIT": {Response: LatencyPercentiles{Count: 10, P50: 21}},
+            }},
+        }}, 11, false},
+    }
+    for _, tt := range tests {
+        merged := Merge(tt.samples)
+        hit := merged.Latency.ByCacheStatus["HIT"]
+        if !within(hit.Response.P50, tt.p50) {
+            t.Errorf("%s: p50 %.2f, want %.2f", tt.name, hit.Response.P50, tt.p50)
+        }
+        if (hit.ResponseSketch != nil) != tt.sketch {
+            t.Errorf("%s: merged sketch kept = %v, want %v", tt.name, hit.ResponseSketch != nil, tt.sketch)
+        }
+    }
+    
+    // Merging must not change the inputs
+    a, b := latencySample(fast...), latencySample(slow...)
+    Merge([]*TelemetryData{a, b})
+    if n := a.Latency.ByCacheStatus["HIT"].ResponseSketch.Count(); n != 10 {
+        t.Errorf("input sketch changed to %d values", n)
+    }
+}
+
+func TestSketchRoundTrip(t *testing.T) {
+    data := Merge([]*TelemetryData{latencySample(1, 5, 50, 500), latencySample(0, 2000)})
+    encoded, err := json.Marshal(data)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var decoded TelemetryData
+    if err := json.Unmarshal(encoded, &decoded); err != nil {
+        t.Fatal(err)
+    }
+    
+    // A rollup of rollups still merges exactly
+    again := Merge([]*TelemetryData{&decoded, latencySample(100)})
+    want := latencySample(1, 5, 50, 500, 0, 2000, 100).Latency.ByCacheStatus["HIT"].Response
+    if got := again.Latency.ByCacheStatus["HIT"].Response; got != want {
+        t.Errorf("after round trip: %+v, want %+v", got, want)
+    }
+    
+    if stripped := data.Latency.withoutSketches(); stripped.ByCacheStatus["HIT"].ResponseSketch != nil {
+        t.Error("sketch left in report")
+    }
+}
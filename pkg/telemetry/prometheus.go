@@ -0,0 +1,96 @@
+package telemetry
+
+import (
+    "context"
+    "fmt"
+    "net/http"
+    "time"
+)
+
+// ServeMetrics exposes the latest telemetry in Prometheus text format until ctx is cancelled
+func ServeMetrics(ctx context.Context, addr string, latest func() *TelemetryData) error {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+        data := latest()
+        if data == nil {
+            http.Error(w, "no telemetry collected yet", http.StatusServiceUnavailable)
+            return
+        }
+        w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+        writeMetrics(w, data)
+    })
+    
+    server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+    go func() {
+        <-ctx.Done()
+        server.Close()
+    }()
+    
+    if err := server.ListenAndServe(); err != http.ErrServerClosed {
+        return err
+    }
+    return nil
+}
+
+func writeMetrics(w http.ResponseWriter, data *TelemetryData) {
+    metric := func(name, kind, help string, value interface{}) {
+        fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+    }
+    
+    metric("isp_cache_hits", "gauge", "Cache hits in the last interval", data.CacheHits)
+    metric("isp_cache_misses", "gauge", "Cache misses in the last interval", data.CacheMisses)
+    metric("isp_cache_requests", "gauge", "Requests in the last interval", data.TotalRequests)
+    metric("isp_cache_bandwidth_saved_megabytes", "gauge", "Bandwidth served from cache", data.BandwidthSaved)
+    metric("isp_cache_size_used_megabytes", "gauge", "Disk used by the cache", data.CacheSizeUsed)
+    if cs := data.CacheStatus; cs != nil {
+        metric("isp_cache_request_hit_ratio", "gauge", "Share of cacheable requests served from cache", cs.RequestHitRatio)
+        metric("isp_cache_byte_hit_ratio", "gauge", "Share of cacheable bytes served from cache", cs.ByteHitRatio)
+        
+        fmt.Fprintf(w, "# HELP isp_cache_responses Responses by cache status\n# TYPE isp_cache_responses gauge\n")
+        for _, s := range cacheStatuses(cs) {
+            fmt.Fprintf(w, "isp_cache_responses{status=%q} %d\n", s.name, s.RequestBytes.Requests)
+        }
+        fmt.Fprintf(w, "# HELP isp_cache_response_bytes Body bytes by cache status\n# TYPE isp_cache_response_bytes gauge\n")
+        for _, s := range cacheStatuses(cs) {
+            fmt.Fprintf(w, "isp_cache_response_bytes{status=%q} %d\n", s.name, s.RequestBytes.Bytes)
+        }
+    }
+    if len(data.Zones) > 0 {
+        fmt.Fprintf(w, "# HELP isp_cache_zone_size_bytes Disk used per proxy_cache zone\n# TYPE isp_cache_zone_size_bytes gauge\n")
+        for _, z := range data.Zones {
+            fmt.Fprintf(w, "isp_cache_zone_size_bytes{instance=\"%d\",zone=%q} %d\n", z.Instance, z.Name, z.SizeBytes)
+        }
+        fmt.Fprintf(w, "# HELP isp_cache_zone_max_size_bytes Configured max_size per proxy_cache zone\n# TYPE isp_cache_zone_max_size_bytes gauge\n")
+        for _, z := range data.Zones {
+            fmt.Fprintf(w, "isp_cache_zone_max_size_bytes{instance=\"%d\",zone=%q} %d\n", z.Instance, z.Name, z.MaxSizeBytes)
+        }
+        fmt.Fprintf(w, "# HELP isp_cache_zone_requests Requests per proxy_cache zone in the last interval\n# TYPE isp_cache_zone_requests gauge\n")
+        for _, z := range data.Zones {
+            fmt.Fprintf(w, "isp_cache_zone_requests{instance=\"%d\",zone=%q} %d\n", z.Instance, z.Name, z.Traffic.Requests)
+        }
+    }
+    metric("isp_agent_cpu_usage_percent", "gauge", "Host CPU usage", data.CPUUsage)
+    metric("isp_agent_memory_usage_percent", "gauge", "Host memory usage", data.MemoryUsage)
+    
+    if n := data.Nginx; n != nil {
+        metric("isp_nginx_connections_active", "gauge", "Open client connections", n.ActiveConnections)
+        metric("isp_nginx_connections_reading", "gauge", "Connections reading the request", n.Reading)
+        metric("isp_nginx_connections_writing", "gauge", "Connections writing the response", n.Writing)
+        metric("isp_nginx_connections_waiting", "gauge", "Idle keepalive connections", n.Waiting)
+        metric("isp_nginx_connections_accepted_total", "counter", "Accepted client connections", n.Accepted)
+        metric("isp_nginx_connections_handled_total", "counter", "Handled client connections", n.Handled)
+        metric("isp_nginx_requests_total", "counter", "Client requests", n.Requests)
+    }
+}
+
+type namedStatus struct {
+    name string
+    RequestBytes
+}
+
+func cacheStatuses(cs *CacheStatusStats) []namedStatus {
+    return []namedStatus{
+        {"hit", cs.Hit}, {"miss", cs.Miss}, {"bypass", cs.Bypass}, {"expired", cs.Expired},
+        {"stale", cs.Stale}, {"updating", cs.Updating}, {"revalidated", cs.Revalidated}, {"uncached", cs.Uncached},
+    }
+}
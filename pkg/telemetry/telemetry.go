@@ -2,10 +2,14 @@ package telemetry
 
 import (
     "bytes"
+    "context"
     "encoding/json"
     "fmt"
+    "log/slog"
     "net/http"
     "time"
+
+    "isp-agent/pkg/sketch"
 )
 
 type TelemetryData struct {
@@ -17,6 +21,280 @@ type TelemetryData struct {
     CacheSizeUsed  int     `json:"cache_size_used_mb"`
     CPUUsage       float64 `json:"cpu_usage"`
     MemoryUsage    float64 `json:"memory_usage"`
+    
+    // Timestamp is the end of the interval the data covers
+    Timestamp       time.Time `json:"timestamp"`
+    IntervalSeconds int       `json:"interval_seconds,omitempty"`
+    
+    // Seq numbers reports per agent so the SaaS can detect and dedupe missing intervals
+    AgentID  string `json:"agent_id,omitempty"`
+    Seq      uint64 `json:"seq,omitempty"`
+    Backfill bool   `json:"backfill,omitempty"`
+    
+    // CacheStatus keeps every $upstream_cache_status value instead of hits/misses only
+    CacheStatus *CacheStatusStats `json:"cache_status,omitempty"`
+    
+    // Profiles breaks the interval's traffic down by CDN profile
+    Profiles       map[string]TrafficStats `json:"profiles,omitempty"`
+    ProfileLibrary string                  `json:"profile_library_version,omitempty"`
+
+    // Latency holds the interval's response time percentiles
+    Latency *LatencyReport `json:"latency,omitempty"`
+
+    // Breakdown splits the interval's requests by status, method and content type
+    Breakdown *ResponseBreakdown `json:"breakdown,omitempty"`
+
+    // Subscribers groups traffic by configured client subnets (subscriber_analytics module)
+    Subscribers *SubscriberReport `json:"subscribers,omitempty"`
+
+    // Geo aggregates traffic by client region and origin network (GeoIP databases configured)
+    Geo *GeoReport `json:"geo,omitempty"`
+
+    // NginxHealth is the latest health monitor state
+    NginxHealth string `json:"nginx_health,omitempty"`
+
+    // Nginx is scraped from stub_status, VTS or the nginx Plus API
+    Nginx *NginxStatus `json:"nginx,omitempty"`
+
+    // DNS is set when the built-in DNS responder is enabled
+    DNS *DNSStats `json:"dns,omitempty"`
+    // Syslog is set when access logs are received over syslog
+    Syslog *SyslogStats `json:"syslog,omitempty"`
+    // Instances, Zones and Servers are set when the nginx config was discovered
+    // with nginx -T; Servers is keyed by server block label
+    Instances []NginxInstance         `json:"instances,omitempty"`
+    Zones     []ZoneStats             `json:"zones,omitempty"`
+    Servers   map[string]TrafficStats `json:"servers,omitempty"`
+    
+    // Errors counts nginx error log lines and agent warnings in the interval
+    Errors *ErrorLogStats `json:"errors,omitempty"`
+}
+
+// Minimal keeps the core counters and drops the detailed reports, for agents
+// whose license is not active
+func (d *TelemetryData) Minimal() *TelemetryData {
+    return &TelemetryData{
+        ISPID:           d.ISPID,
+        CacheHits:       d.CacheHits,
+        CacheMisses:     d.CacheMisses,
+        BandwidthSaved:  d.BandwidthSaved,
+        TotalRequests:   d.TotalRequests,
+        CacheSizeUsed:   d.CacheSizeUsed,
+        CPUUsage:        d.CPUUsage,
+        MemoryUsage:     d.MemoryUsage,
+        Timestamp:       d.Timestamp,
+        IntervalSeconds: d.IntervalSeconds,
+        AgentID:         d.AgentID,
+        Seq:             d.Seq,
+        Backfill:        d.Backfill,
+        NginxHealth:     d.NginxHealth,
+    }
+}
+
+// ErrorLogStats counts log lines per pattern (e.g. "upstream timed out",
+// "agent/dns") and per level
+type ErrorLogStats struct {
+    Patterns map[string]int64 `json:"patterns"`
+    Levels   map[string]int64 `json:"levels"`
+}
+
+// CacheStatusStats counts requests and bytes per cache status.
+// RequestHitRatio and ByteHitRatio are (hit + stale + updating + revalidated)
+// divided by every response with a cache status except uncached ("-").
+type CacheStatusStats struct {
+    Hit             RequestBytes `json:"hit"`
+    Miss            RequestBytes `json:"miss"`
+    Bypass          RequestBytes `json:"bypass"`
+    Expired         RequestBytes `json:"expired"`
+    Stale           RequestBytes `json:"stale"`
+    Updating        RequestBytes `json:"updating"`
+    Revalidated     RequestBytes `json:"revalidated"`
+    Uncached        RequestBytes `json:"uncached"`
+    RequestHitRatio float64      `json:"request_hit_ratio"`
+    ByteHitRatio    float64      `json:"byte_hit_ratio"`
+}
+
+// SubscriberReport holds traffic per subnet group and the busiest clients.
+// Clients are labelled according to Anonymization ("truncate", "hash" or "none").
+type SubscriberReport struct {
+    Groups        map[string]TrafficStats `json:"groups"`
+    TopClients    []ClientStats           `json:"top_clients,omitempty"`
+    Anonymization string                  `json:"anonymization"`
+}
+
+type ClientStats struct {
+    Client string `json:"client"`
+    TrafficStats
+}
+
+// GeoReport breaks traffic down by client region ("US-CA") and by the
+// origin networks cache misses were fetched from
+type GeoReport struct {
+    ClientRegions map[string]TrafficStats `json:"client_regions,omitempty"`
+    OriginASNs    []OriginASNStats        `json:"origin_asns,omitempty"`
+}
+
+// OriginASNStats covers responses fetched from one origin network
+type OriginASNStats struct {
+    ASN          uint64 `json:"asn"`
+    Organization string `json:"organization,omitempty"`
+    Requests     int64  `json:"requests"`
+    Bytes        int64  `json:"bytes"`
+    MissBytes    int64  `json:"miss_bytes"`
+}
+
+// ResponseBreakdown maps each bucket (e.g. "2xx", "206", "GET", "video/mp4")
+// to its requests and body bytes
+type ResponseBreakdown struct {
+    StatusClass map[string]RequestBytes `json:"status_class"`
+    StatusCode  map[string]RequestBytes `json:"status_code"`
+    Method      map[string]RequestBytes `json:"method"`
+    ContentType map[string]RequestBytes `json:"content_type"`
+}
+
+type RequestBytes struct {
+    Requests int64 `json:"requests"`
+    Bytes    int64 `json:"bytes"`
+}
+
+// LatencyReport breaks latency down by cache status (HIT, MISS, ...) and by the busiest hosts
+type LatencyReport struct {
+    ByCacheStatus map[string]LatencyGroup `json:"by_cache_status,omitempty"`
+    ByHost        map[string]LatencyGroup `json:"by_host,omitempty"`
+}
+
+// LatencyGroup holds the client response time and, when the origin was
+// contacted, its time to first byte
+type LatencyGroup struct {
+    Response   LatencyPercentiles  `json:"response"`
+    OriginTTFB *LatencyPercentiles `json:"origin_ttfb,omitempty"`
+    
+    // The sketches behind the percentiles. They are kept in local history so
+    // merged windows report true quantiles, and left out of reports.
+    ResponseSketch   *sketch.Sketch `json:"response_sketch,omitempty"`
+    OriginTTFBSketch *sketch.Sketch `json:"origin_ttfb_sketch,omitempty"`
+}
+
+// withoutSketches returns a copy of r with only the percentiles
+func (r *LatencyReport) withoutSketches() *LatencyReport {
+    if r == nil {
+        return nil
+    }
+    strip := func(groups map[string]LatencyGroup) map[string]LatencyGroup {
+        if groups == nil {
+            return nil
+        }
+        out := make(map[string]LatencyGroup, len(groups))
+        for k, g := range groups {
+            g.ResponseSketch, g.OriginTTFBSketch = nil, nil
+            out[k] = g
+        }
+        return out
+    }
+    return &LatencyReport{ByCacheStatus: strip(r.ByCacheStatus), ByHost: strip(r.ByHost)}
+}
+
+// LatencyPercentiles are in milliseconds, accurate to within 1%
+type LatencyPercentiles struct {
+    Count int64   `json:"count"`
+    Mean  float64 `json:"mean_ms"`
+    P50   float64 `json:"p50_ms"`
+    P90   float64 `json:"p90_ms"`
+    P99   float64 `json:"p99_ms"`
+    Max   float64 `json:"max_ms"`
+}
+
+// NginxStatus holds nginx's own counters, which are cumulative since nginx started
+type NginxStatus struct {
+    Source            string           `json:"source"`
+    ActiveConnections int64            `json:"active_connections"`
+    Reading           int64            `json:"reading"`
+    Writing           int64            `json:"writing"`
+    Waiting           int64            `json:"waiting"`
+    Accepted          int64            `json:"accepted"`
+    Handled           int64            `json:"handled"`
+    Requests          int64            `json:"requests"`
+    RequestsPerSecond float64          `json:"requests_per_second"`
+    Upstreams         []UpstreamStats  `json:"upstreams,omitempty"`
+    CacheZones        []CacheZoneStats `json:"cache_zones,omitempty"`
+}
+
+type UpstreamStats struct {
+    Zone           string  `json:"zone"`
+    Server         string  `json:"server"`
+    Requests       int64   `json:"requests"`
+    Responses5xx   int64   `json:"responses_5xx"`
+    ResponseTimeMs float64 `json:"response_time_ms"`
+    Down           bool    `json:"down"`
+}
+
+type CacheZoneStats struct {
+    Zone      string `json:"zone"`
+    MaxSize   int64  `json:"max_size"`
+    UsedSize  int64  `json:"used_size"`
+    Hits      int64  `json:"hits"`
+    Misses    int64  `json:"misses"`
+    HitBytes  int64  `json:"hit_bytes"`
+    MissBytes int64  `json:"miss_bytes"`
+}
+
+// DNSStats holds the DNS responder counters since the agent started
+type DNSStats struct {
+    Queries         int64            `json:"queries"`
+    Steered         int64            `json:"steered"`
+    Forwarded       int64            `json:"forwarded"`
+    CacheHits       int64            `json:"cache_hits"`
+    UpstreamErrors  int64            `json:"upstream_errors"`
+    Refused         int64            `json:"refused"`
+    Dropped         int64            `json:"dropped"`
+    ByType          map[string]int64 `json:"by_type,omitempty"`
+    ByProfile       map[string]int64 `json:"by_profile,omitempty"`
+    AvgLatencyMs    float64          `json:"avg_latency_ms"`
+    SteeringEnabled bool             `json:"steering_enabled"`
+}
+
+// NginxInstance is one nginx master found on the host
+type NginxInstance struct {
+    PID        int    `json:"pid"`
+    ConfigFile string `json:"config_file,omitempty"`
+    Zones      int    `json:"zones"`
+    Servers    int    `json:"servers"`
+}
+
+// ZoneStats describes one proxy_cache_path zone: its configuration, the disk
+// it uses and the requests of the server blocks caching in it
+type ZoneStats struct {
+    Instance      int    `json:"instance_pid,omitempty"`
+    Name          string `json:"name"`
+    Path          string `json:"path"`
+    KeysZoneBytes int64  `json:"keys_zone_bytes"`
+    MaxSizeBytes  int64  `json:"max_size_bytes"`
+    Inactive      string `json:"inactive"`
+    SizeBytes     int64  `json:"size_bytes"`
+    // UsedRatio is SizeBytes / MaxSizeBytes, 0 without max_size
+    UsedRatio float64      `json:"used_ratio"`
+    Traffic   TrafficStats `json:"traffic"`
+}
+
+// SyslogStats holds the access log syslog receiver counters since the agent
+// started. Dropped lines arrived while QueueCapacity lines were waiting for the parser.
+type SyslogStats struct {
+    Received       int64 `json:"received"`
+    Malformed      int64 `json:"malformed"`
+    Dropped        int64 `json:"dropped"`
+    QueueDepth     int   `json:"queue_depth"`
+    QueueHighWater int   `json:"queue_high_water"`
+    QueueCapacity  int   `json:"queue_capacity"`
+}
+
+// TrafficStats summarizes requests for one group of log records
+type TrafficStats struct {
+    Requests int64   `json:"requests"`
+    Hits     int64   `json:"hits"`
+    Misses   int64   `json:"misses"`
+    Bytes    int64   `json:"bytes"`
+    HitBytes int64   `json:"hit_bytes"`
+    HitRatio float64 `json:"hit_ratio"`
 }
 
 type SiteData struct {
@@ -36,6 +314,7 @@ type Response struct {
 // Send sends telemetry data to SaaS platform
 func Send(saasURL string, data TelemetryData) error {
     url := fmt.Sprintf("%s/api/telemetry", saasURL)
+    data.Latency = data.Latency.withoutSketches()
     
     jsonData, err := json.Marshal(data)
     if err != nil {
@@ -75,10 +354,46 @@ func SendCachedSite(saasURL string, data SiteData) error {
     return nil
 }
 
+// LogEntry is one log line shipped in a batch, with repeats folded into Count
+type LogEntry struct {
+    Source    string            `json:"source"`
+    Level     string            `json:"level"`
+    Pattern   string            `json:"pattern"`
+    Message   string            `json:"message"`
+    Count     int               `json:"count"`
+    FirstSeen time.Time         `json:"first_seen"`
+    LastSeen  time.Time         `json:"last_seen"`
+    Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+// LogBatch is posted to /api/logs like a single system log, with the entries in one request
+type LogBatch struct {
+    AgentID  string     `json:"agent_id"`
+    ISPID    int        `json:"isp_id"`
+    Hostname string     `json:"hostname"`
+    Entries  []LogEntry `json:"entries"`
+    // Suppressed counts lines dropped by rate limiting, per source/pattern
+    Suppressed map[string]int `json:"suppressed,omitempty"`
+}
+
+// saasClient posts logs and alerts; the timeout keeps an unresponsive SaaS
+// from stalling the health, alert and log shipping loops
+var saasClient = &http.Client{Timeout: 30 * time.Second}
+
+// SendLogBatch sends shipped log entries to the SaaS
+func SendLogBatch(saasURL string, batch LogBatch) error {
+    jsonData, err := json.Marshal(batch)
+    if err != nil {
+        return fmt.Errorf("failed to marshal logs: %w", err)
+    }
+    if err := post(fmt.Sprintf("%s/api/logs", saasURL), jsonData); err != nil {
+        return fmt.Errorf("failed to send logs: %w", err)
+    }
+    return nil
+}
+
 // SendSystemLog sends a log entry to the SaaS
 func SendSystemLog(saasURL, level, source, message string, metadata map[string]interface{}) error {
-    url := fmt.Sprintf("%s/api/logs", saasURL)
-    
     logData := map[string]interface{}{
         "level":    level,
         "source":   source,
@@ -87,43 +402,130 @@ func SendSystemLog(saasURL, level, source, message string, metadata map[string]i
     }
     
     jsonData, _ := json.Marshal(logData)
-    
-    resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
+    return post(fmt.Sprintf("%s/api/logs", saasURL), jsonData)
+}
+
+// AlertEvent is a local alert rule firing or resolving
+type AlertEvent struct {
+    AgentID   string    `json:"agent_id"`
+    Hostname  string    `json:"hostname,omitempty"`
+    Rule      string    `json:"rule"`
+    State     string    `json:"state"`
+    Severity  string    `json:"severity"`
+    Summary   string    `json:"summary,omitempty"`
+    Condition string    `json:"condition"`
+    Value     float64   `json:"value"`
+    Since     time.Time `json:"since"`
+    At        time.Time `json:"at"`
+}
+
+// SendAlert reports an alert state change to /api/alerts
+func SendAlert(saasURL string, event AlertEvent) error {
+    jsonData, err := json.Marshal(event)
+    if err != nil {
+        return fmt.Errorf("failed to marshal alert: %w", err)
+    }
+    if err := post(fmt.Sprintf("%s/api/alerts", saasURL), jsonData); err != nil {
+        return fmt.Errorf("failed to send alert: %w", err)
+    }
+    return nil
+}
+
+func post(url string, jsonData []byte) error {
+    resp, err := saasClient.Post(url, "application/json", bytes.NewBuffer(jsonData))
     if err != nil {
         return err
     }
     defer resp.Body.Close()
     
+    if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("server returned %s", resp.Status)
+    }
     return nil
 }
 
 // StartTelemetryLoop runs telemetry collection in a loop
 func StartTelemetryLoop(saasURL string, ispID int, interval time.Duration, collectFunc func() (*TelemetryData, error)) {
-    ticker := time.NewTicker(interval)
+    reporter := &Reporter{SaaSURL: saasURL, ISPID: ispID, Interval: interval, Collect: collectFunc, Logger: slog.Default()}
+    reporter.Run(context.Background())
+}
+
+// Reporter sends telemetry on an interval. With a Ledger, every report gets a
+// sequence number and failed reports are recorded; with a Backfiller, the
+// SaaS is asked for missing intervals after startup and after each outage.
+type Reporter struct {
+    SaaSURL  string
+    ISPID    int
+    AgentID  string
+    Interval time.Duration
+    Collect  func() (*TelemetryData, error)
+    
+    Ledger   *Ledger
+    Backfill *Backfiller
+    Logger   *slog.Logger
+}
+
+// Run reports immediately and then every Interval until ctx is cancelled
+func (r *Reporter) Run(ctx context.Context) {
+    ticker := time.NewTicker(r.Interval)
     defer ticker.Stop()
     
-    // Send initial telemetry immediately
-    sendTelemetry(saasURL, ispID, collectFunc)
+    negotiated := false
     
-    for range ticker.C {
-        sendTelemetry(saasURL, ispID, collectFunc)
+    // Send initial telemetry immediately
+    for {
+        if r.send() && r.Backfill != nil && (!negotiated || len(r.Ledger.Unsent()) > 0) {
+            negotiated = true
+            r.Backfill.Trigger(ctx)
+        }
+        
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
     }
 }
 
-// sendTelemetry collects and sends telemetry data with logging
-func sendTelemetry(saasURL string, ispID int, collectFunc func() (*TelemetryData, error)) {
-    data, err := collectFunc()
+// send collects and sends one report, returning whether the SaaS accepted it
+func (r *Reporter) send() bool {
+    data, err := r.Collect()
     if err != nil {
         // Log but don't fail - collect what we can
+        r.Logger.Warn("telemetry collection failed", "error", err)
         data = &TelemetryData{}
     }
+    if data.Timestamp.IsZero() {
+        data.Timestamp = time.Now().UTC()
+    }
     
-    data.ISPID = ispID
+    data.ISPID = r.ISPID
+    data.AgentID = r.AgentID
+    
+    var iv Interval
+    if r.Ledger != nil {
+        if iv, err = r.Ledger.Next(data.Timestamp, data.IntervalSeconds); err != nil {
+            r.Logger.Error("failed to update telemetry ledger", "error", err)
+        }
+        data.Seq = iv.Seq
+    }
     
     // Ensure we always send something
-    if err := Send(saasURL, *data); err != nil {
+    err = Send(r.SaaSURL, *data)
+    if err != nil {
         // Retry once after a short delay
         time.Sleep(5 * time.Second)
-        Send(saasURL, *data)
+        err = Send(r.SaaSURL, *data)
+    }
+    if err == nil {
+        return true
+    }
+    
+    r.Logger.Warn("telemetry report failed", "seq", data.Seq, "error", err)
+    if r.Ledger != nil {
+        if err := r.Ledger.Failed(iv, data); err != nil {
+            r.Logger.Error("failed to record unsent telemetry", "seq", data.Seq, "error", err)
+        }
     }
+    return false
 }
@@ -1,12 +1,21 @@
 package updater
 
 import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -17,6 +26,9 @@ type VersionInfo struct {
 	Version      string    `json:"version"`
 	DownloadURL  string    `json:"download_url"`
 	Checksum     string    `json:"checksum"`
+	// Signature is the base64 Ed25519 signature of the version, a NUL byte
+	// and the binary's SHA-256 digest
+	Signature    string    `json:"signature"`
 	ReleaseNotes string    `json:"release_notes"`
 	IsStable     bool      `json:"is_stable"`
 	CreatedAt    time.Time `json:"created_at"`
@@ -47,14 +59,89 @@ func CheckForUpdates(saasURL string) (*VersionInfo, bool, error) {
 		return nil, false, fmt.Errorf("API error: %s", apiResp.Error)
 	}
 	
-	// Check if update is needed
-	needsUpdate := apiResp.Data.Version != CurrentVersion
+	// Only newer versions are installed
+	needsUpdate := newer(apiResp.Data.Version, CurrentVersion)
 	
 	return &apiResp.Data, needsUpdate, nil
 }
 
-// DownloadAndInstall downloads and installs a new version
-func DownloadAndInstall(version *VersionInfo) error {
+var (
+	ErrUnsigned = errors.New("update is not signed with the vendor key")
+	ErrNotNewer = errors.New("update is not newer than the running version")
+)
+
+// newer reports whether version is a higher dotted version number than
+// current; anything that does not parse is never newer
+func newer(version, current string) bool {
+	v, ok := parseVersion(version)
+	if !ok {
+		return false
+	}
+	c, ok := parseVersion(current)
+	if !ok {
+		return false
+	}
+	for i := 0; i < len(v) || i < len(c); i++ {
+		var a, b int
+		if i < len(v) {
+			a = v[i]
+		}
+		if i < len(c) {
+			b = c[i]
+		}
+		if a != b {
+			return a > b
+		}
+	}
+	return false
+}
+
+func parseVersion(version string) ([]int, bool) {
+	parts := strings.Split(strings.TrimPrefix(version, "v"), ".")
+	nums := make([]int, len(parts))
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, false
+		}
+		nums[i] = n
+	}
+	return nums, true
+}
+
+// signedPayload is what the vendor signs: the version, a NUL byte and the
+// digest, so a signed binary cannot be offered under another version
+func signedPayload(version string, digest []byte) []byte {
+	payload := append([]byte(version), 0)
+	return append(payload, digest...)
+}
+
+// verify checks a downloaded binary's digest against the published checksum
+// and the vendor signature over the version and digest
+func verify(version *VersionInfo, digest []byte, publicKey ed25519.PublicKey) error {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("%w: no public key to verify with", ErrUnsigned)
+	}
+	if version.Checksum != "" && !strings.EqualFold(version.Checksum, hex.EncodeToString(digest)) {
+		return fmt.Errorf("checksum mismatch")
+	}
+	signature, err := base64.StdEncoding.DecodeString(version.Signature)
+	if err != nil || !ed25519.Verify(publicKey, signedPayload(version.Version, digest), signature) {
+		return ErrUnsigned
+	}
+	return nil
+}
+
+// DownloadAndInstall downloads a new version and installs it once its
+// signature checks out against publicKey
+func DownloadAndInstall(logger *slog.Logger, version *VersionInfo, publicKey ed25519.PublicKey) error {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("%w: no public key to verify with", ErrUnsigned)
+	}
+	if !newer(version.Version, CurrentVersion) {
+		return fmt.Errorf("refusing to install %s over %s: %w", version.Version, CurrentVersion, ErrNotNewer)
+	}
+	
 	// Get current executable path
 	exePath, err := os.Executable()
 	if err != nil {
@@ -64,7 +151,7 @@ func DownloadAndInstall(version *VersionInfo) error {
 	// Download new version to temporary file
 	tempFile := exePath + ".new"
 	
-	fmt.Printf("Downloading version %s from %s...\n", version.Version, version.DownloadURL)
+	logger.Info("downloading update", "version", version.Version, "url", version.DownloadURL)
 	
 	resp, err := http.Get(version.DownloadURL)
 	if err != nil {
@@ -78,13 +165,20 @@ func DownloadAndInstall(version *VersionInfo) error {
 	}
 	defer out.Close()
 	
-	_, err = io.Copy(out, resp.Body)
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, hash), resp.Body)
 	if err != nil {
+		os.Remove(tempFile)
 		return fmt.Errorf("failed to write file: %w", err)
 	}
 	
 	out.Close()
 	
+	if err := verify(version, hash.Sum(nil), publicKey); err != nil {
+		os.Remove(tempFile)
+		return fmt.Errorf("refusing to install %s: %w", version.Version, err)
+	}
+	
 	// Make executable
 	if err := os.Chmod(tempFile, 0755); err != nil {
 		return fmt.Errorf("failed to set permissions: %w", err)
@@ -103,37 +197,40 @@ func DownloadAndInstall(version *VersionInfo) error {
 		return fmt.Errorf("failed to install new version: %w", err)
 	}
 	
-	fmt.Printf("✓ Successfully updated to version %s\n", version.Version)
-	fmt.Println("  Release notes:", version.ReleaseNotes)
-	fmt.Println("  Restarting agent...")
+	logger.Info("update installed, restarting agent", "version", version.Version, "release_notes", version.ReleaseNotes)
 	
 	// Restart the agent
 	cmd := exec.Command("systemctl", "restart", "isp-agent")
 	if err := cmd.Run(); err != nil {
-		fmt.Printf("Warning: Failed to restart service: %v\n", err)
-		fmt.Println("Please manually restart with: systemctl restart isp-agent")
+		logger.Warn("failed to restart service, restart manually with: systemctl restart isp-agent", "error", err)
 	}
 	
 	return nil
 }
 
-// StartUpdateLoop checks for updates periodically
-func StartUpdateLoop(saasURL string, interval time.Duration) {
+// StartUpdateLoop checks for updates periodically until ctx is cancelled
+func StartUpdateLoop(ctx context.Context, logger *slog.Logger, saasURL string, interval time.Duration, publicKey ed25519.PublicKey) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 	
-	for range ticker.C {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		
 		version, needsUpdate, err := CheckForUpdates(saasURL)
 		if err != nil {
-			fmt.Printf("Update check failed: %v\n", err)
+			logger.Warn("update check failed", "error", err)
 			continue
 		}
 		
 		if needsUpdate {
-			fmt.Printf("New version available: %s (current: %s)\n", version.Version, CurrentVersion)
+			logger.Info("new version available", "version", version.Version, "current", CurrentVersion)
 			
-			if err := DownloadAndInstall(version); err != nil {
-				fmt.Printf("Update failed: %v\n", err)
+			if err := DownloadAndInstall(logger, version, publicKey); err != nil {
+				logger.Error("update failed", "error", err)
 			}
 		}
 	}
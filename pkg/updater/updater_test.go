@@ -0,0 +1,63 @@
+package updater
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+func TestVerifyBindsVersion(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte("agent binary"))
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, signedPayload("1.2.0", digest[:])))
+
+	if err := verify(&VersionInfo{Version: "1.2.0", Signature: signature}, digest[:], pub); err != nil {
+		t.Errorf("signed version: %v", err)
+	}
+	// The same signed binary offered as another version
+	if err := verify(&VersionInfo{Version: "1.3.0", Signature: signature}, digest[:], pub); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("replayed under another version: got %v, want ErrUnsigned", err)
+	}
+	// A bare digest signature is no longer accepted
+	bare := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, digest[:]))
+	if err := verify(&VersionInfo{Version: "1.2.0", Signature: bare}, digest[:], pub); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("digest-only signature: got %v, want ErrUnsigned", err)
+	}
+}
+
+func TestNewer(t *testing.T) {
+	tests := []struct {
+		version, current string
+		want             bool
+	}{
+		{"1.0.1", "1.0.0", true},
+		{"1.10.0", "1.9.0", true},
+		{"v2.0", "1.9.9", true},
+		{"1.0.0", "1.0.0", false},
+		{"1.0", "1.0.0", false},
+		{"0.9.9", "1.0.0", false},
+		{"1.0.0-beta", "0.1.0", false},
+		{"", "1.0.0", false},
+	}
+	for _, tt := range tests {
+		if got := newer(tt.version, tt.current); got != tt.want {
+			t.Errorf("newer(%q, %q) = %v, want %v", tt.version, tt.current, got, tt.want)
+		}
+	}
+}
+
+func TestDownloadAndInstallRefusesOlder(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = DownloadAndInstall(nil, &VersionInfo{Version: CurrentVersion, DownloadURL: "http://127.0.0.1:0/agent"}, pub)
+	if !errors.Is(err, ErrNotNewer) {
+		t.Errorf("same version: got %v, want ErrNotNewer", err)
+	}
+}